@@ -8,7 +8,7 @@ import (
 	"github.com/spf13/viper"
 )
 
-//go:embed score_1.yaml
+//go:embed score_1.yaml quality.yaml
 var configFS embed.FS
 
 type Config struct {
@@ -19,16 +19,35 @@ type Config struct {
 type Metric struct {
 	Name      string    `mapstructure:"name"`
 	Operation Operation `mapstructure:"operation"`
+	// Precision is the number of decimals the metric is written with (nil => 2)
+	Precision *int `mapstructure:"precision,omitempty"`
+	// Rounding is how values are rounded to Precision: half-up (default), half-even or truncate
+	Rounding string `mapstructure:"rounding,omitempty"`
+	// Unit labels the values in the output, e.g. "tCO2e" (after Scale)
+	Unit string `mapstructure:"unit,omitempty"`
+	// Scale multiplies the values before they are rounded, e.g. 0.001 for kg => t (0 => 1)
+	Scale float64 `mapstructure:"scale,omitempty"`
 }
 
 type Operation struct {
 	Type       string      `mapstructure:"type"`
 	Parameters []Parameter `mapstructure:"parameters"`
+	// Values is the category list for the "in" operation
+	Values []string `mapstructure:"values,omitempty"`
+	// Table maps categories to numbers for the "lookup" / "map" operations.
+	// Keys are matched case-insensitively (viper lower-cases map keys).
+	Table map[string]float64 `mapstructure:"table,omitempty"`
+	// Default is returned by "lookup" when the category is not in Table; nil => null
+	Default *float64 `mapstructure:"default,omitempty"`
+	// Periods is how many years back "lag" reads; 0 (omitted) means 1
+	Periods int `mapstructure:"periods,omitempty"`
 }
 
 type Parameter struct {
 	Source string `mapstructure:"source"`
 	Param  string `mapstructure:"param,omitempty"`
+	// Value is a literal operand (e.g. `value: "yes"` for eq) used instead of Source
+	Value string `mapstructure:"value,omitempty"`
 }
 
 func InitScoreConfig(fileName string) (*Config, error) {
@@ -45,12 +64,23 @@ func InitScoreConfig(fileName string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error reading embedded config file: %v", err)
 	}
-	viper.SetConfigType("yaml")
-	if err := viper.ReadConfig(bytes.NewReader(fileData)); err != nil {
+	return ParseScoreConfig(fileData, "yaml")
+}
+
+// ParseScoreConfig parses a score config that is not embedded, e.g. a file being worked on. format
+// is "yaml" (default) or "json".
+func ParseScoreConfig(data []byte, format string) (*Config, error) {
+	if format == "" {
+		format = "yaml"
+	}
+	// own viper instance, so configs can be parsed concurrently
+	v := viper.New()
+	v.SetConfigType(format)
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
 		return nil, fmt.Errorf("error loading config: %v", err)
 	}
 	config := &Config{}
-	if err := viper.Unmarshal(&config); err != nil {
+	if err := v.Unmarshal(&config); err != nil {
 		return nil, fmt.Errorf("error unmarshalling config: %v", err)
 	}
 
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// QualityConfig holds the declarative data-quality rules for every dataset.
+type QualityConfig struct {
+	Datasets []DatasetRules `mapstructure:"datasets"`
+}
+
+// DatasetRules are the row-level checks applied to one dataset while it is loaded.
+// Lists are used instead of maps because viper lower-cases map keys.
+type DatasetRules struct {
+	Name string `mapstructure:"name"`
+	// Required fields must be present (non-null) on every row
+	Required []string `mapstructure:"required"`
+	// NonNegative numeric fields must be >= 0
+	NonNegative []string `mapstructure:"non_negative"`
+	// Ranges bound numeric fields to [min, max]; either bound can be left out
+	Ranges []RangeRule `mapstructure:"ranges"`
+	// Allowed restricts categorical fields to a fixed set of values
+	Allowed []AllowedRule `mapstructure:"allowed"`
+	// UniqueCompanyDate rejects a second row for the same company and date
+	UniqueCompanyDate bool `mapstructure:"unique_company_date"`
+	// MaxPerYear is the maximum number of rows per company and year, 0 => unlimited
+	MaxPerYear int `mapstructure:"max_per_year"`
+}
+
+type RangeRule struct {
+	Field string   `mapstructure:"field"`
+	Min   *float64 `mapstructure:"min"`
+	Max   *float64 `mapstructure:"max"`
+}
+
+type AllowedRule struct {
+	Field  string   `mapstructure:"field"`
+	Values []string `mapstructure:"values"`
+}
+
+// Rules returns the rules for a dataset, nil if it has none.
+func (q *QualityConfig) Rules(dataset string) *DatasetRules {
+	if q == nil {
+		return nil
+	}
+	for i := range q.Datasets {
+		if q.Datasets[i].Name == dataset {
+			return &q.Datasets[i]
+		}
+	}
+	return nil
+}
+
+// InitQualityConfig loads the embedded data-quality rules file.
+func InitQualityConfig(fileName string) (*QualityConfig, error) {
+	fileData, err := configFS.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading embedded quality file: %v", err)
+	}
+
+	// own viper instance so the score config loaded through the global one is left alone
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(fileData)); err != nil {
+		return nil, fmt.Errorf("error loading quality config: %v", err)
+	}
+	quality := &QualityConfig{}
+	if err := v.Unmarshal(quality); err != nil {
+		return nil, fmt.Errorf("error unmarshalling quality config: %v", err)
+	}
+	return quality, nil
+}
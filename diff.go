@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"esgbook-software-engineer-technical-test-2024/config"
+	"esgbook-software-engineer-technical-test-2024/internal"
+)
+
+// runDiff is the diff command: it reports the impact of a config change on the data in DATA_DIR,
+// or compares two runs stored in RUNS_DIR.
+//
+//	score-app diff -candidate new.yaml [-base old.yaml] [-company 1000,1001] [-metrics metric_4]
+//	score-app diff -runs -base <run ID> -candidate <run ID>
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	base := fs.String("base", "", "base score config file (default: the embedded "+file+"), or a run ID with -runs")
+	candidate := fs.String("candidate", "", "candidate score config file, or a run ID with -runs")
+	runs := fs.Bool("runs", false, "compare two runs stored in RUNS_DIR")
+	company := fs.String("company", "", "companies to compare (comma-separated)")
+	year := fs.String("year", "", "years to compare (comma-separated)")
+	fromYear := fs.String("from-year", "", "first year to compare")
+	toYear := fs.String("to-year", "", "last year to compare")
+	metrics := fs.String("metrics", "", "metrics to compare (comma-separated)")
+	tolerance := fs.Float64("tolerance", 0, "largest delta counted as unchanged (default 1e-9)")
+	top := fs.Int("top", 0, "top movers per metric (default 10)")
+	asJSON := fs.Bool("json", false, "write the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *candidate == "" {
+		return errors.New("diff: -candidate is required")
+	}
+	opts := internal.DiffOptions{Tolerance: *tolerance, Top: *top}
+	ctx := context.Background()
+
+	var diff *internal.ScoreDiff
+	if *runs {
+		if *base == "" {
+			return errors.New("diff: -base is required with -runs")
+		}
+		runsDir := os.Getenv("RUNS_DIR")
+		if runsDir == "" {
+			runsDir = "runs"
+		}
+		rs, err := internal.NewFileRunStore(runsDir)
+		if err != nil {
+			return err
+		}
+		if diff, err = internal.DiffRuns(rs, *base, *candidate, opts); err != nil {
+			return err
+		}
+	} else {
+		baseConfig, err := config.InitScoreConfig(file)
+		if err != nil {
+			return err
+		}
+		if *base != "" {
+			if baseConfig, err = readScoreConfig(*base); err != nil {
+				return err
+			}
+		}
+		candidateConfig, err := readScoreConfig(*candidate)
+		if err != nil {
+			return err
+		}
+		snapshot, err := loadSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+
+		query := url.Values{}
+		for name, val := range map[string]string{"company": *company, "year": *year, "from_year": *fromYear, "to_year": *toYear, "metrics": *metrics} {
+			if val != "" {
+				query.Set(name, val)
+			}
+		}
+		// metrics of either config can be asked for
+		union := &config.Config{Name: baseConfig.Name, Metrics: append(append([]config.Metric(nil), baseConfig.Metrics...), candidateConfig.Metrics...)}
+		filter, err := internal.ParseScoreFilter(query, union)
+		if err != nil {
+			return err
+		}
+		if diff, err = internal.DiffConfigs(ctx, baseConfig, candidateConfig, snapshot, filter, opts); err != nil {
+			return err
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	}
+	return diff.WriteText(os.Stdout)
+}
+
+func readScoreConfig(path string) (*config.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := "yaml"
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		format = "json"
+	}
+	cfg, err := config.ParseScoreConfig(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// loadSnapshot loads the datasets of DATA_DIR once, with the quality rules of the server.
+func loadSnapshot(ctx context.Context) (*internal.Snapshot, error) {
+	qualityRules, err := config.InitQualityConfig(qualityFile)
+	if err != nil {
+		return nil, err
+	}
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data"
+	}
+	storage, prefix, err := internal.OpenStorage(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	store := internal.NewDatasetStore(internal.NewDataLoaderService(internal.NewLoaderRegistry(), qualityRules), storage, prefix, internal.StoreOptions{})
+	if _, err := store.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	if store.Snapshot() == nil {
+		return nil, errors.New("no datasets loaded")
+	}
+	return store.Snapshot(), nil
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+func TestSnapshotAsOf(t *testing.T) {
+	dir := t.TempDir()
+	day := func(d int) time.Time { return time.Date(2025, 1, d, 12, 0, 0, 0, time.UTC) }
+	writeFile := func(name, content string, mtime time.Time) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+
+	// waste has no known_at column: its history comes from the reloads; emissions keeps its own,
+	// two observations of the same row (a restatement)
+	writeFile("waste_data.csv", "company_id,date,wst_1\n1,2023-06-30,10\n2,2023-06-30,20\n", day(1))
+	writeFile("emissions_data.csv", "company_id,date,known_at,emi_1\n"+
+		"1,2023-06-30,2025-01-02,5\n"+
+		"1,2023-06-30,2025-01-05T08:00:00Z,6\n", day(1))
+
+	quality := &c.QualityConfig{Datasets: []c.DatasetRules{{Name: "emissions_data", UniqueCompanyDate: true, MaxPerYear: 1}}}
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), quality), FileStorage{Root: dir}, "", StoreOptions{})
+	refresh := func() {
+		_, err := store.Refresh(context.Background())
+		require.NoError(t, err)
+	}
+	refresh()
+	emissions := store.Snapshot().Datasets["emissions_data"]
+	assert.Equal(t, NumberValue(6), emissions[CompanyYearKey{"1", 2023}]["emi_1"], "the latest known observation is current")
+	assert.Empty(t, store.Snapshot().Quality.Quarantine)
+
+	// day 3: company 1 restated; day 4: company 2 removed
+	writeFile("waste_data.csv", "company_id,date,wst_1\n1,2023-06-30,11\n2,2023-06-30,20\n", day(3))
+	refresh()
+	writeFile("waste_data.csv", "company_id,date,wst_1\n1,2023-06-30,11\n", day(4))
+	refresh()
+
+	// day 6: a change event, and one known since day 5 (after the last version, so it counts from then)
+	store.ApplyChanges([]ChangeEvent{
+		{Op: ChangeUpdate, Dataset: "waste_data", CompanyID: "1", Date: mustDate(t, "2023-06-30"), Field: "wst_1", Value: NumberValue(12), KnownAt: day(6)},
+		{Op: ChangeInsert, Dataset: "waste_data", CompanyID: "3", Date: mustDate(t, "2023-06-30"), Field: "wst_1", Value: NumberValue(30), KnownAt: day(5)},
+	})
+
+	wasteAsOf := func(at time.Time) Dataset {
+		snapshot, err := store.SnapshotAsOf(at)
+		require.NoError(t, err)
+		assert.Equal(t, at, snapshot.AsOf)
+		return snapshot.Datasets["waste_data"]
+	}
+	wst := func(v float64) map[string]Value { return map[string]Value{"wst_1": NumberValue(v)} }
+
+	// before the first version seen, earlier versions of waste are unknown
+	_, err := store.SnapshotAsOf(day(1).Add(-time.Hour))
+	assert.ErrorIs(t, err, errHistoryNotKept)
+	assert.Equal(t, Dataset{{"1", 2023}: wst(10), {"2", 2023}: wst(20)}, wasteAsOf(day(2)))
+	assert.Equal(t, Dataset{{"1", 2023}: wst(11), {"2", 2023}: wst(20)}, wasteAsOf(day(3)))
+	assert.Equal(t, Dataset{{"1", 2023}: wst(11)}, wasteAsOf(day(4)))
+	assert.Equal(t, Dataset{{"1", 2023}: wst(11), {"3", 2023}: wst(30)}, wasteAsOf(day(5)))
+	assert.Equal(t, store.Snapshot().Datasets["waste_data"], wasteAsOf(day(7)))
+
+	for at, want := range map[time.Time]float64{day(2): 5, day(4): 5, day(5): 6} {
+		snapshot, err := store.SnapshotAsOf(at)
+		require.NoError(t, err)
+		assert.Equal(t, NumberValue(want), snapshot.Datasets["emissions_data"][CompanyYearKey{"1", 2023}]["emi_1"], at)
+	}
+	snapshot, err := store.SnapshotAsOf(day(1))
+	require.NoError(t, err)
+	assert.Empty(t, snapshot.Datasets["emissions_data"])
+
+	// a dataset that appears later narrows the history to the first refresh, not to its mtime: it
+	// was not there in between
+	startedAt := store.startedAt
+	writeFile("energy_data.csv", "company_id,date,nrg_1\n1,2023-06-30,1\n", time.Now().Add(time.Hour))
+	refresh()
+	_, err = store.SnapshotAsOf(day(2))
+	assert.ErrorIs(t, err, errHistoryNotKept)
+	snapshot, err = store.SnapshotAsOf(startedAt)
+	require.NoError(t, err)
+	assert.Empty(t, snapshot.Datasets["energy_data"])
+	assert.Equal(t, Dataset{{"1", 2023}: wst(12), {"3", 2023}: wst(30)}, snapshot.Datasets["waste_data"])
+}
+
+func TestSnapshotAsOfRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC()
+	writeFile := func(content string, mtime time.Time) {
+		path := filepath.Join(dir, "waste_data.csv")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "",
+		StoreOptions{HistoryRetention: 24 * time.Hour})
+	refresh := func() {
+		_, err := store.Refresh(context.Background())
+		require.NoError(t, err)
+	}
+	writeFile("company_id,date,wst_1\n1,2023-06-30,10\n2,2023-06-30,20\n", now.Add(-72*time.Hour))
+	refresh()
+	writeFile("company_id,date,wst_1\n1,2023-06-30,11\n", now.Add(-48*time.Hour))
+	refresh()
+
+	// both versions are past the horizon: only the one current at it is kept
+	entry := store.entries["waste_data.csv"]
+	require.NotNil(t, entry)
+	assert.Len(t, entry.observed, 1)
+	assert.Len(t, entry.observed[CompanyYearKey{"1", 2023}], 1)
+
+	_, err := store.SnapshotAsOf(now.Add(-60 * time.Hour))
+	assert.ErrorIs(t, err, errHistoryNotKept)
+
+	snapshot, err := store.SnapshotAsOf(now.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, Dataset{{"1", 2023}: {"wst_1": NumberValue(11)}}, snapshot.Datasets["waste_data"])
+	assert.Equal(t, snapshot.Datasets["waste_data"], store.Snapshot().Datasets["waste_data"])
+}
+
+func TestPruneObserved(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2025, 1, d, 0, 0, 0, 0, time.UTC) }
+	date := mustDate(t, "2023-06-30")
+	rec := func(d int, v float64) Record {
+		return Record{Date: date, KnownAt: day(d), Values: map[string]Value{"wst_1": NumberValue(v)}}
+	}
+	removed := Record{Date: date, KnownAt: day(2), Removed: true}
+	observed := map[CompanyYearKey][]Record{
+		{"1", 2023}: {rec(1, 10), rec(2, 11), rec(4, 12)},
+		{"2", 2023}: {rec(1, 20), removed},
+		{"3", 2023}: {rec(4, 30)},
+	}
+
+	pruned, changed := pruneObserved(observed, day(3))
+	assert.True(t, changed)
+	assert.Equal(t, map[CompanyYearKey][]Record{
+		{"1", 2023}: {rec(2, 11), rec(4, 12)},
+		{"3", 2023}: {rec(4, 30)},
+	}, pruned)
+	assert.Len(t, observed[CompanyYearKey{"1", 2023}], 3, "the input is left alone")
+
+	_, changed = pruneObserved(pruned, day(3))
+	assert.False(t, changed)
+}
+
+func TestParseAsOf(t *testing.T) {
+	at, err := ParseAsOf("2024-03-01")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 1, 23, 59, 59, 999999999, time.UTC), at)
+
+	at, err = ParseAsOf("2024-03-01T10:00:00+02:00")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC), at)
+
+	_, err = ParseAsOf("yesterday")
+	assert.Error(t, err)
+}
+
+func mustDate(t *testing.T, raw string) time.Time {
+	d, err := ParseDateOrYear(raw)
+	require.NoError(t, err)
+	return d
+}
@@ -0,0 +1,985 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// ChangeOp is the kind of a change event. insert and update are both upserts, so replaying
+// events that were already applied is harmless.
+type ChangeOp string
+
+const (
+	ChangeInsert ChangeOp = "insert"
+	ChangeUpdate ChangeOp = "update"
+	ChangeDelete ChangeOp = "delete"
+)
+
+// dateLayout is how row dates are keyed in change patches.
+const dateLayout = "2006-01-02"
+
+// ChangeEvent is one change to a dataset row, e.g.
+//
+//	{"op":"update","dataset":"waste_data","company_id":"1001","date":"2024-03-01","field":"was_1","value":12.5}
+//	{"op":"delete","dataset":"waste_data","company_id":"1001","date":"2024-03-01","field":"was_1"}
+//	{"op":"delete","dataset":"waste_data","company_id":"1001","date":"2024-03-01"}
+//
+// A delete without a field removes the whole row; an upsert with a null value removes the field.
+// An optional "known_at" says when the change became known; by default it is when it is applied.
+type ChangeEvent struct {
+	Op        ChangeOp
+	Dataset   string
+	CompanyID string
+	Date      time.Time
+	Field     string
+	Value     Value
+	KnownAt   time.Time
+}
+
+// key is the company-year the event touches.
+func (e ChangeEvent) key() CompanyYearKey {
+	return CompanyYearKey{CompanyID: e.CompanyID, Year: e.Date.Year()}
+}
+
+// MarshalJSON writes the event in the change log format, with known_at when it is set.
+func (e ChangeEvent) MarshalJSON() ([]byte, error) {
+	raw := map[string]interface{}{
+		"op":         e.Op,
+		"dataset":    e.Dataset,
+		"company_id": e.CompanyID,
+		"date":       e.Date.Format(dateLayout),
+	}
+	if e.Field != "" {
+		raw["field"] = e.Field
+		raw["value"] = e.Value
+	}
+	if !e.KnownAt.IsZero() {
+		raw[knownAtField] = e.KnownAt.UTC().Format(time.RFC3339Nano)
+	}
+	return json.Marshal(raw)
+}
+
+// parseChangeEvent decodes one JSON line of a change log.
+func parseChangeEvent(line []byte) (ChangeEvent, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return ChangeEvent{}, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	ev := ChangeEvent{
+		Op:        ChangeOp(strings.ToLower(jsonKeyString(raw["op"]))),
+		Dataset:   jsonKeyString(raw["dataset"]),
+		CompanyID: jsonKeyString(raw["company_id"]),
+		Field:     jsonKeyString(raw["field"]),
+	}
+	switch {
+	case ev.Op != ChangeInsert && ev.Op != ChangeUpdate && ev.Op != ChangeDelete:
+		return ChangeEvent{}, fmt.Errorf("unknown op %q", ev.Op)
+	case ev.Dataset == "" || ev.CompanyID == "":
+		return ChangeEvent{}, fmt.Errorf("missing dataset or company_id")
+	case ev.Op != ChangeDelete && ev.Field == "":
+		return ChangeEvent{}, fmt.Errorf("%s needs a field", ev.Op)
+	}
+
+	var err error
+	if ev.Date, err = ParseDateOrYear(jsonKeyString(raw["date"])); err != nil {
+		return ChangeEvent{}, err
+	}
+	if ev.Value, err = valueFromJSON(raw["value"]); err != nil {
+		return ChangeEvent{}, err
+	}
+	if knownAt := jsonKeyString(raw[knownAtField]); knownAt != "" {
+		if ev.KnownAt, err = ParseKnownAt(knownAt); err != nil {
+			return ChangeEvent{}, err
+		}
+	}
+	return ev, nil
+}
+
+// rowPatch is the net effect of the change events applied to one (company, date) row.
+type rowPatch struct {
+	// Replace ignores the loaded row: it was deleted, later events start from an empty row
+	Replace bool             `json:"replace,omitempty"`
+	Deleted bool             `json:"deleted,omitempty"`
+	Set     map[string]Value `json:"set,omitempty"`
+	Unset   map[string]bool  `json:"unset,omitempty"`
+}
+
+func (p *rowPatch) apply(ev ChangeEvent) {
+	switch {
+	case ev.Op == ChangeDelete && ev.Field == "":
+		*p = rowPatch{Replace: true, Deleted: true}
+	case ev.Op == ChangeDelete || ev.Value.IsNull():
+		delete(p.Set, ev.Field)
+		if !p.Replace {
+			if p.Unset == nil {
+				p.Unset = make(map[string]bool)
+			}
+			p.Unset[ev.Field] = true
+		}
+	default:
+		p.Deleted = false
+		if p.Set == nil {
+			p.Set = make(map[string]Value)
+		}
+		p.Set[ev.Field] = ev.Value
+		delete(p.Unset, ev.Field)
+	}
+}
+
+// empty reports whether the patch leaves the loaded row as it is.
+func (p rowPatch) empty() bool {
+	return !p.Replace && !p.Deleted && len(p.Set) == 0 && len(p.Unset) == 0
+}
+
+func (p rowPatch) clone() rowPatch {
+	out := rowPatch{Replace: p.Replace, Deleted: p.Deleted}
+	if p.Set != nil {
+		out.Set = make(map[string]Value, len(p.Set))
+		for field, v := range p.Set {
+			out.Set[field] = v
+		}
+	}
+	if p.Unset != nil {
+		out.Unset = make(map[string]bool, len(p.Unset))
+		for field := range p.Unset {
+			out.Unset[field] = true
+		}
+	}
+	return out
+}
+
+// patchVersion is the patch of a row as it stood from KnownAt on.
+type patchVersion struct {
+	KnownAt time.Time `json:"known_at"`
+	Patch   rowPatch  `json:"patch"`
+}
+
+// patchAsOf returns the patch known at asOf (zero = the latest), nil if there was none yet.
+func patchAsOf(versions []patchVersion, asOf time.Time) *rowPatch {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if asOf.IsZero() || !versions[i].KnownAt.After(asOf) {
+			return &versions[i].Patch
+		}
+	}
+	return nil
+}
+
+// changeOverlay holds the row patches of every dataset: dataset => company-year => date => the
+// versions of the patch, oldest first. It survives file reloads, so the files are a baseline and
+// the change events are applied on top.
+type changeOverlay map[string]map[CompanyYearKey]map[string][]patchVersion
+
+// apply adds the version of the row's patch after ev. The history is append-only: an event known
+// before the row's last version is recorded at that version's time.
+func (o changeOverlay) apply(ev ChangeEvent, now time.Time) {
+	byKey, ok := o[ev.Dataset]
+	if !ok {
+		byKey = make(map[CompanyYearKey]map[string][]patchVersion)
+		o[ev.Dataset] = byKey
+	}
+	byDate, ok := byKey[ev.key()]
+	if !ok {
+		byDate = make(map[string][]patchVersion)
+		byKey[ev.key()] = byDate
+	}
+	date := ev.Date.Format(dateLayout)
+	versions := byDate[date]
+
+	knownAt := ev.KnownAt
+	if knownAt.IsZero() {
+		knownAt = now
+	}
+	var next rowPatch
+	if n := len(versions); n > 0 {
+		last := versions[n-1]
+		if knownAt.Before(last.KnownAt) {
+			knownAt = last.KnownAt
+		}
+		next = last.Patch.clone()
+		if knownAt.Equal(last.KnownAt) {
+			versions = versions[: n-1 : n-1] // same instant: one version (a new array, compact may be reading the old one)
+		}
+	}
+	next.apply(ev)
+	byDate[date] = append(versions, patchVersion{KnownAt: knownAt, Patch: next})
+}
+
+// clone copies the maps of o down to the dates; the version slices are shared, apply and supersede
+// replace them rather than write to them.
+func (o changeOverlay) clone() changeOverlay {
+	out := make(changeOverlay, len(o))
+	for dataset, byKey := range o {
+		keys := make(map[CompanyYearKey]map[string][]patchVersion, len(byKey))
+		for key, byDate := range byKey {
+			keys[key] = maps.Clone(byDate)
+		}
+		out[dataset] = keys
+	}
+	return out
+}
+
+// supersede ends the patches of the company-years whose rows changed in a reload of the dataset
+// after the patch's last version: from then on the file wins, so each patched date gets an empty
+// version at the time of the change. The earlier versions stay for as-of snapshots until prune
+// drops them.
+func (o changeOverlay) supersede(dataset string, e *storeEntry) {
+	for key, byDate := range o[dataset] {
+		var changedAt time.Time
+		for _, rows := range [][]Record{e.observed[key], e.loaded.rows[key]} {
+			for _, rec := range rows {
+				if rec.KnownAt.After(changedAt) {
+					changedAt = rec.KnownAt
+				}
+			}
+		}
+		for date, versions := range byDate {
+			last := versions[len(versions)-1]
+			if last.Patch.empty() || !changedAt.After(last.KnownAt) {
+				continue
+			}
+			byDate[date] = append(versions[:len(versions):len(versions)], patchVersion{KnownAt: changedAt})
+		}
+	}
+}
+
+// prune folds the patch versions known at horizon into the one current then, like pruneObserved
+// does for the row history, and drops the versions that no longer patch anything: a row whose
+// patch was superseded before the horizon is left out entirely. It reports whether anything was
+// dropped.
+func (o changeOverlay) prune(horizon time.Time) bool {
+	pruned := false
+	for dataset, byKey := range o {
+		for key, byDate := range byKey {
+			for date, versions := range byDate {
+				from := 0
+				for i, v := range versions {
+					if !v.KnownAt.After(horizon) {
+						from = i
+					}
+				}
+				if versions[from].Patch.empty() && !versions[from].KnownAt.After(horizon) {
+					from++ // as-of the next version nothing is patched either
+				}
+				switch {
+				case from == len(versions):
+					delete(byDate, date)
+				case from > 0:
+					byDate[date] = versions[from:]
+				default:
+					continue
+				}
+				pruned = true
+			}
+			if len(byDate) == 0 {
+				delete(byKey, key)
+			}
+		}
+		if len(byKey) == 0 {
+			delete(o, dataset)
+		}
+	}
+	return pruned
+}
+
+// rowsByCompanyYear groups accepted rows by company-year, in source order.
+func rowsByCompanyYear(records []Record) map[CompanyYearKey][]Record {
+	rows := make(map[CompanyYearKey][]Record)
+	for _, rec := range records {
+		if rec.Invalid != nil {
+			continue
+		}
+		key := CompanyYearKey{CompanyID: rec.CompanyID, Year: rec.Date.Year()}
+		rows[key] = append(rows[key], rec)
+	}
+	return rows
+}
+
+// materialise applies the patches of one company-year to its loaded rows and keeps the latest row,
+// like latestPerYear does for a plain load. With a non-zero asOf only the row observations and
+// patch versions known at that time count. ok=false means no row is left.
+func materialise(base []Record, patches map[string][]patchVersion, asOf time.Time) (map[string]Value, bool) {
+	type row struct {
+		date    time.Time
+		knownAt time.Time
+		removed bool
+		values  map[string]Value
+	}
+	rows := make(map[string]row, len(base)+len(patches))
+	for _, rec := range base {
+		if !asOf.IsZero() && rec.KnownAt.After(asOf) {
+			continue
+		}
+		d := rec.Date.Format(dateLayout)
+		// the latest known observation of a date wins, the first one on a tie, as in latestPerYear
+		if r, ok := rows[d]; !ok || rec.KnownAt.After(r.knownAt) {
+			rows[d] = row{date: rec.Date, knownAt: rec.KnownAt, removed: rec.Removed, values: rec.Values}
+		}
+	}
+	for d, r := range rows {
+		if r.removed {
+			delete(rows, d)
+		}
+	}
+
+	for d, versions := range patches {
+		p := patchAsOf(versions, asOf)
+		if p == nil {
+			continue
+		}
+		loaded, ok := rows[d]
+		if p.Deleted {
+			delete(rows, d)
+			continue
+		}
+		if !ok && !p.Replace && len(p.Set) == 0 {
+			continue // only removed fields of a row that does not exist
+		}
+		date, _ := time.Parse(dateLayout, d)
+		values := make(map[string]Value, len(loaded.values)+len(p.Set))
+		if ok && !p.Replace {
+			date = loaded.date
+			for field, v := range loaded.values {
+				if !p.Unset[field] {
+					values[field] = v
+				}
+			}
+		}
+		for field, v := range p.Set {
+			values[field] = v
+		}
+		rows[d] = row{date: date, values: values}
+	}
+
+	var latest *row
+	for _, r := range rows {
+		if latest == nil || r.date.After(latest.date) {
+			r := r
+			latest = &r
+		}
+	}
+	if latest == nil {
+		return nil, false
+	}
+	return latest.values, true
+}
+
+// changeEventsSource is the source of the quarantined rows made by change events.
+const changeEventsSource = "change events"
+
+// materialiseChecked is materialise followed by the row-level quality rules of the dataset: a row
+// the patches made fail them is quarantined, and the company-year keeps its loaded rows as if it
+// had no patches. Rows with nothing patched were checked when they were loaded.
+func materialiseChecked(dataset string, key CompanyYearKey, base []Record, patches map[string][]patchVersion, asOf time.Time, rules *c.DatasetRules) (map[string]Value, bool, *QuarantinedRow) {
+	values, ok := materialise(base, patches, asOf)
+	if !ok || rules == nil || len(patches) == 0 {
+		return values, ok, nil
+	}
+	rule, field, reason := checkRow(Record{CompanyID: key.CompanyID, Values: values}, rules)
+	if rule == "" {
+		return values, true, nil
+	}
+	values, ok = materialise(base, nil, asOf)
+	return values, ok, &QuarantinedRow{
+		Dataset:   dataset,
+		Source:    changeEventsSource,
+		CompanyID: key.CompanyID,
+		Date:      strconv.Itoa(key.Year),
+		Rule:      rule,
+		Field:     field,
+		Reason:    reason,
+	}
+}
+
+// withChangeQuarantine returns a copy of the report in which the rows quarantined by change events
+// for the changed company-years are replaced by quarantined. changed reports whether any were
+// removed or added.
+func (r *QualityReport) withChangeQuarantine(keys ChangeSet, quarantined []QuarantinedRow) (out *QualityReport, changed bool) {
+	out = &QualityReport{GeneratedAt: r.GeneratedAt, Datasets: r.Datasets}
+	out.Quarantine = make([]QuarantinedRow, 0, len(r.Quarantine)+len(quarantined))
+	for _, q := range r.Quarantine {
+		if q.Source == changeEventsSource {
+			if year, err := strconv.Atoi(q.Date); err == nil && keys[q.Dataset][CompanyYearKey{CompanyID: q.CompanyID, Year: year}] {
+				changed = true
+				continue
+			}
+		}
+		out.Quarantine = append(out.Quarantine, q)
+	}
+	out.Quarantine = append(out.Quarantine, quarantined...)
+	return out, changed || len(quarantined) > 0
+}
+
+// ApplyChanges applies change events on top of the loaded datasets and, once the store has a
+// snapshot, publishes a new one in which only the touched company-years were rebuilt. Datasets
+// that failed to load stay unavailable. It returns the number of events applied.
+func (s *DatasetStore) ApplyChanges(events []ChangeEvent) int {
+	if len(events) == 0 {
+		return 0
+	}
+
+	s.mu.Lock()
+
+	now := time.Now().UTC()
+	touched := make(ChangeSet)
+	for _, ev := range events {
+		s.overlay.apply(ev, now)
+		touched.add(ev.Dataset, ev.key())
+	}
+
+	current := s.current.Load()
+	if current == nil {
+		s.mu.Unlock()
+		return len(events) // applied with the first load
+	}
+
+	next := *current
+	next.Version = current.Version + 1
+	next.LoadedAt = time.Now().UTC()
+	next.columns = &lazyColumns{}
+	next.Datasets = make(map[string]Dataset, len(current.Datasets)+len(touched))
+	for name, ds := range current.Datasets {
+		next.Datasets[name] = ds
+	}
+	// a new set of patched keys for each touched dataset, the others are shared with current
+	next.patched = make(ChangeSet, len(current.patched)+len(touched))
+	for name, keys := range current.patched {
+		next.patched[name] = keys
+	}
+	bases := loadedByName(s.entries)
+	var quarantined []QuarantinedRow
+	for name, keys := range touched {
+		patched := make(map[CompanyYearKey]bool, len(s.overlay[name]))
+		for key := range s.overlay[name] {
+			patched[key] = true
+		}
+		next.patched[name] = patched
+		if _, down := next.Unavailable[name]; down {
+			continue
+		}
+		var rejected []QuarantinedRow
+		next.Datasets[name], rejected = s.rebuild(name, next.Datasets[name], bases[name], keys)
+		quarantined = append(quarantined, rejected...)
+	}
+	var quarantineChanged bool
+	next.Quality, quarantineChanged = current.Quality.withChangeQuarantine(touched, quarantined)
+	s.recordChanges(next.Version, touched)
+	s.current.Store(&next)
+	s.mu.Unlock()
+
+	if s.opts.QuarantineDir != "" && quarantineChanged {
+		if err := next.Quality.WriteQuarantine(s.opts.QuarantineDir); err != nil {
+			log.Printf("[WARN] %v", err)
+		}
+	}
+	return len(events)
+}
+
+// applyOverlay rebuilds every company-year with patches in a freshly built snapshot.
+func (s *DatasetStore) applyOverlay(snapshot *Snapshot, entries map[string]*storeEntry) {
+	bases := loadedByName(entries)
+	for name, byKey := range s.overlay {
+		keys := make(map[CompanyYearKey]bool, len(byKey))
+		for key := range byKey {
+			keys[key] = true
+		}
+		snapshot.patched[name] = keys
+		if _, down := snapshot.Unavailable[name]; down {
+			continue
+		}
+		var rejected []QuarantinedRow
+		snapshot.Datasets[name], rejected = s.rebuild(name, snapshot.Datasets[name], bases[name], keys)
+		snapshot.Quality.Quarantine = append(snapshot.Quality.Quarantine, rejected...)
+	}
+}
+
+// rebuild returns a copy of ds with the given company-years materialised again, and the patched
+// rows quarantined by the dataset's quality rules.
+func (s *DatasetStore) rebuild(name string, ds Dataset, base *LoadedDataset, keys map[CompanyYearKey]bool) (Dataset, []QuarantinedRow) {
+	out := make(Dataset, len(ds)+len(keys))
+	for key, values := range ds {
+		out[key] = values
+	}
+	rules := s.service.quality.Rules(name)
+	var quarantined []QuarantinedRow
+	for key := range keys {
+		var rows []Record
+		if base != nil {
+			rows = base.rows[key]
+		}
+		values, ok, q := materialiseChecked(name, key, rows, s.overlay[name][key], time.Time{}, rules)
+		if q != nil {
+			quarantined = append(quarantined, *q)
+		}
+		if ok {
+			out[key] = values
+		} else {
+			delete(out, key)
+		}
+	}
+	return out, quarantined
+}
+
+// loadedByName indexes the loaded datasets by name; on a name clash the later key wins, as in newSnapshot.
+func loadedByName(entries map[string]*storeEntry) map[string]*LoadedDataset {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	byName := make(map[string]*LoadedDataset, len(entries))
+	for _, key := range keys {
+		if e := entries[key]; e.loaded != nil {
+			byName[e.loaded.Name] = e.loaded
+		}
+	}
+	return byName
+}
+
+// ChangeSource is somewhere change events come from.
+type ChangeSource interface {
+	// Name identifies the source in the persisted offsets.
+	Name() string
+	// Read returns the events after offset ("" = from the start) and the offset to resume from
+	// once they have been applied.
+	Read(ctx context.Context, offset string) ([]ChangeEvent, string, error)
+}
+
+// LogTailSource tails a JSONL change log that is only ever appended to. The offset is a byte
+// position; a trailing line without its newline is left for the next read.
+type LogTailSource struct {
+	Path string
+}
+
+func (s LogTailSource) Name() string { return "log:" + s.Path }
+
+func (s LogTailSource) Read(ctx context.Context, offset string) ([]ChangeEvent, string, error) {
+	pos, err := parseOffset(offset)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	f, err := os.Open(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, offset, nil // nothing written yet
+		}
+		return nil, offset, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, offset, err
+	}
+	if info.Size() < pos {
+		log.Printf("[WARN] change log %s is shorter than its offset %d, reading it from the start", s.Path, pos)
+		pos = 0
+	}
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+
+	var events []ChangeEvent
+	reader := bufio.NewReader(f)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, offset, err
+		}
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break // incomplete last line: not consumed
+		}
+		if err != nil {
+			return nil, offset, err
+		}
+		pos += int64(len(line))
+		events = appendEvent(events, line, fmt.Sprintf("%s@%d", s.Path, pos))
+	}
+	return events, strconv.FormatInt(pos, 10), nil
+}
+
+// BatchDirSource reads change batches from a directory: every ".jsonl" file is one batch, applied
+// in file name order. Producers should write a batch under another name and rename it when done.
+// The offset is the name of the last batch applied.
+type BatchDirSource struct {
+	Dir string
+}
+
+func (s BatchDirSource) Name() string { return "batches:" + s.Dir }
+
+func (s BatchDirSource) Read(ctx context.Context, offset string) ([]ChangeEvent, string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, offset, fmt.Errorf("failed to read change batch directory %s: %w", s.Dir, err)
+	}
+
+	var events []ChangeEvent
+	last := offset
+	for _, e := range entries { // os.ReadDir sorts by name
+		if e.IsDir() || filepath.Ext(e.Name()) != ".jsonl" || e.Name() <= offset {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, offset, err
+		}
+		content, err := os.ReadFile(filepath.Join(s.Dir, e.Name()))
+		if err != nil {
+			return nil, offset, err
+		}
+		for i, line := range bytes.Split(content, []byte("\n")) {
+			events = appendEvent(events, line, fmt.Sprintf("%s:%d", e.Name(), i+1))
+		}
+		last = e.Name()
+	}
+	return events, last, nil
+}
+
+// appendEvent parses one line; blank lines are skipped and invalid ones logged.
+func appendEvent(events []ChangeEvent, line []byte, where string) []ChangeEvent {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return events
+	}
+	ev, err := parseChangeEvent(line)
+	if err != nil {
+		log.Printf("[WARN] Skipping change event %s: %v", where, err)
+		return events
+	}
+	return append(events, ev)
+}
+
+func parseOffset(offset string) (int64, error) {
+	if offset == "" {
+		return 0, nil
+	}
+	pos, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil || pos < 0 {
+		return 0, fmt.Errorf("invalid change log offset %q", offset)
+	}
+	return pos, nil
+}
+
+// ChangeFeed polls change sources into a DatasetStore. Every poll that applied events or moved an
+// offset appends them to a journal next to the state file; every CompactEvery polls the journal is
+// folded into the state file (offsets and patches) and emptied. A restart restores the state file,
+// replays the journal on top of it, re-applies the patches on top of the files and resumes every
+// source where it left off.
+type ChangeFeed struct {
+	store     *DatasetStore
+	sources   []ChangeSource
+	statePath string
+	offsets   map[string]string
+	// CompactEvery is the number of journal records after which the state file is rewritten
+	CompactEvery int
+
+	// seq numbers the journal records; the state file holds the last one folded into it
+	seq       int64
+	journal   *os.File
+	journaled int // records appended since the last compaction
+}
+
+const defaultCompactEvery = 100
+
+// changeState is the JSON content of the state file.
+type changeState struct {
+	// Seq is the last journal record included
+	Seq     int64             `json:"seq"`
+	Offsets map[string]string `json:"offsets"`
+	Patches []patchState      `json:"patches"`
+}
+
+type patchState struct {
+	Dataset   string         `json:"dataset"`
+	CompanyID string         `json:"company_id"`
+	Date      string         `json:"date"`
+	History   []patchVersion `json:"history"`
+}
+
+// journalRecord is one line of the journal: the offsets moved by a poll and the events it applied,
+// each with the known_at it was applied at, so replaying them rebuilds the same patch history.
+type journalRecord struct {
+	Seq     int64             `json:"seq"`
+	Offsets map[string]string `json:"offsets,omitempty"`
+	Events  []json.RawMessage `json:"events,omitempty"`
+}
+
+func NewChangeFeed(store *DatasetStore, statePath string, sources ...ChangeSource) *ChangeFeed {
+	return &ChangeFeed{
+		store:     store,
+		sources:   sources,
+		statePath: statePath,
+		offsets:   make(map[string]string),
+
+		CompactEvery: defaultCompactEvery,
+	}
+}
+
+func (f *ChangeFeed) journalPath() string { return f.statePath + ".journal" }
+
+// Restore loads the offsets and patches saved by a previous run and replays its journal, then
+// folds the journal into the state file; missing files are a fresh start. Call it before the
+// store's first Refresh.
+func (f *ChangeFeed) Restore() error {
+	content, err := os.ReadFile(f.statePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var state changeState
+	if err == nil {
+		if err := json.Unmarshal(content, &state); err != nil {
+			return fmt.Errorf("invalid change state %s: %w", f.statePath, err)
+		}
+	}
+	for name, offset := range state.Offsets {
+		f.offsets[name] = offset
+	}
+	f.seq = state.Seq
+
+	f.store.mu.Lock()
+	for _, p := range state.Patches {
+		date, err := time.Parse(dateLayout, p.Date)
+		if err != nil || len(p.History) == 0 {
+			f.store.mu.Unlock()
+			return fmt.Errorf("invalid patch in %s for %s/%s", f.statePath, p.Dataset, p.CompanyID)
+		}
+		key := CompanyYearKey{CompanyID: p.CompanyID, Year: date.Year()}
+		if f.store.overlay[p.Dataset] == nil {
+			f.store.overlay[p.Dataset] = make(map[CompanyYearKey]map[string][]patchVersion)
+		}
+		if f.store.overlay[p.Dataset][key] == nil {
+			f.store.overlay[p.Dataset][key] = make(map[string][]patchVersion)
+		}
+		f.store.overlay[p.Dataset][key][p.Date] = p.History
+	}
+	f.store.mu.Unlock()
+
+	if err := f.replay(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(f.journalPath()); err == nil && info.Size() > 0 {
+		return f.compact() // also drops a torn record, so new ones are not appended to it
+	}
+	return nil
+}
+
+// replay applies the journal records written after the state file. A torn last record (the process
+// died while writing it) ends the replay: its events are read again from their source.
+func (f *ChangeFeed) replay() error {
+	file, err := os.Open(f.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	f.store.mu.Lock()
+	defer f.store.mu.Unlock()
+
+	reader := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var rec journalRecord
+		if jsonErr := json.Unmarshal(line, &rec); jsonErr != nil {
+			log.Printf("[WARN] change journal %s: record %d is incomplete, replay stops there: %v", f.journalPath(), n, jsonErr)
+			break
+		}
+		if rec.Seq <= f.seq {
+			continue // already in the state file
+		}
+		for _, raw := range rec.Events {
+			ev, err := parseChangeEvent(raw)
+			if err != nil {
+				return fmt.Errorf("invalid event in %s record %d: %w", f.journalPath(), n, err)
+			}
+			f.store.overlay.apply(ev, ev.KnownAt)
+		}
+		for name, offset := range rec.Offsets {
+			f.offsets[name] = offset
+		}
+		f.seq = rec.Seq
+		if err == io.EOF {
+			break
+		}
+	}
+	return nil
+}
+
+// Poll reads every source once, applies the new events and saves the state. It returns the number
+// of events applied; a failing source does not stop the others.
+func (f *ChangeFeed) Poll(ctx context.Context) (int, error) {
+	var errs []error
+	applied := 0
+	rec := journalRecord{Offsets: make(map[string]string)}
+	for _, src := range f.sources {
+		events, next, err := src.Read(ctx, f.offsets[src.Name()])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", src.Name(), err))
+			continue
+		}
+		// stamp the events so the journal replays them at the same instant
+		now := time.Now().UTC()
+		for i := range events {
+			if events[i].KnownAt.IsZero() {
+				events[i].KnownAt = now
+			}
+		}
+		applied += f.store.ApplyChanges(events)
+		for _, ev := range events {
+			raw, err := json.Marshal(ev)
+			if err != nil {
+				return applied, err
+			}
+			rec.Events = append(rec.Events, raw)
+		}
+		if next != f.offsets[src.Name()] {
+			f.offsets[src.Name()] = next
+			rec.Offsets[src.Name()] = next
+		}
+	}
+	if len(rec.Offsets) > 0 || len(rec.Events) > 0 {
+		if err := f.record(rec); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return applied, errors.Join(errs...)
+}
+
+// record appends a poll to the journal and compacts it every CompactEvery records.
+func (f *ChangeFeed) record(rec journalRecord) error {
+	if f.journal == nil {
+		file, err := os.OpenFile(f.journalPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open change journal: %w", err)
+		}
+		f.journal = file
+	}
+
+	f.seq++
+	rec.Seq = f.seq
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := f.journal.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write change journal: %w", err)
+	}
+	if err := f.journal.Sync(); err != nil {
+		return fmt.Errorf("failed to write change journal: %w", err)
+	}
+
+	f.journaled++
+	if f.CompactEvery > 0 && f.journaled < f.CompactEvery {
+		return nil
+	}
+	return f.compact()
+}
+
+// Close compacts the journal into the state file and closes it.
+func (f *ChangeFeed) Close() error {
+	var err error
+	if f.journaled > 0 {
+		err = f.compact()
+	}
+	if f.journal != nil {
+		if cerr := f.journal.Close(); err == nil {
+			err = cerr
+		}
+		f.journal = nil
+	}
+	return err
+}
+
+// Run polls every interval until ctx is done, then compacts the journal.
+func (f *ChangeFeed) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := f.Close(); err != nil {
+				log.Printf("[WARN] change feed: %v", err)
+			}
+			return
+		case <-ticker.C:
+			n, err := f.Poll(ctx)
+			if err != nil {
+				log.Printf("[WARN] change feed: %v", err)
+			}
+			if n > 0 {
+				log.Printf("Applied %d change events", n)
+			}
+		}
+	}
+}
+
+// compact writes the state file atomically (temp file + rename), then empties the journal. A crash
+// in between leaves records the state file already has, which replay skips by their seq.
+func (f *ChangeFeed) compact() error {
+	state := changeState{Seq: f.seq, Offsets: f.offsets}
+
+	f.store.mu.Lock()
+	for dataset, byKey := range f.store.overlay {
+		for key, byDate := range byKey {
+			for date, versions := range byDate {
+				state.Patches = append(state.Patches, patchState{Dataset: dataset, CompanyID: key.CompanyID, Date: date, History: versions})
+			}
+		}
+	}
+	f.store.mu.Unlock()
+	sort.Slice(state.Patches, func(i, j int) bool {
+		a, b := state.Patches[i], state.Patches[j]
+		if a.Dataset != b.Dataset {
+			return a.Dataset < b.Dataset
+		}
+		if a.CompanyID != b.CompanyID {
+			return a.CompanyID < b.CompanyID
+		}
+		return a.Date < b.Date
+	})
+
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := f.statePath + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return fmt.Errorf("failed to save change state: %w", err)
+	}
+	if err := os.Rename(tmp, f.statePath); err != nil {
+		return fmt.Errorf("failed to save change state: %w", err)
+	}
+
+	if err := os.Truncate(f.journalPath(), 0); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to empty change journal: %w", err)
+	}
+	f.journaled = 0
+	return nil
+}
@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeFeed(t *testing.T) {
+	dataDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "waste_data.csv"), []byte(
+		"company_id,date,wst_1,wst_2\n"+
+			"1,2023-01-01,10,1\n"+
+			"1,2023-06-01,11,2\n"+
+			"2,2023-01-01,20,3\n"), 0o644))
+
+	cdcDir := t.TempDir()
+	logPath := filepath.Join(cdcDir, "changes.jsonl")
+	batchDir := filepath.Join(cdcDir, "batches")
+	statePath := filepath.Join(cdcDir, "state.json")
+	require.NoError(t, os.Mkdir(batchDir, 0o755))
+
+	newFeed := func() (*DatasetStore, *ChangeFeed) {
+		store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dataDir}, "", StoreOptions{})
+		feed := NewChangeFeed(store, statePath, LogTailSource{Path: logPath}, BatchDirSource{Dir: batchDir})
+		require.NoError(t, feed.Restore())
+		_, err := store.Refresh(context.Background())
+		require.NoError(t, err)
+		return store, feed
+	}
+	store, feed := newFeed()
+	_, known := store.Changes(0, 1) // first load: everything
+	assert.False(t, known)
+
+	// update the latest row of company 1, delete company 2's only row; the last line is still being written
+	require.NoError(t, os.WriteFile(logPath, []byte(
+		`{"op":"update","dataset":"waste_data","company_id":"1","date":"2023-06-01","field":"wst_1","value":99}`+"\n"+
+			`{"op":"delete","dataset":"waste_data","company_id":2,"date":"2023-01-01"}`+"\n"+
+			`not json`+"\n"+
+			`{"op":"insert","dataset":"waste_data","company_id":"3"`), 0o644))
+
+	n, err := feed.Poll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	snapshot := store.Snapshot()
+	assert.Equal(t, int64(2), snapshot.Version)
+	waste := snapshot.Datasets["waste_data"]
+	assert.Equal(t, NumberValue(99), waste[CompanyYearKey{"1", 2023}]["wst_1"])
+	assert.Equal(t, NumberValue(2), waste[CompanyYearKey{"1", 2023}]["wst_2"])
+	assert.NotContains(t, waste, CompanyYearKey{"2", 2023})
+	changes, known := store.Changes(1, 2)
+	assert.True(t, known)
+	assert.Equal(t, ChangeSet{"waste_data": {{"1", 2023}: true, {"2", 2023}: true}}, changes)
+
+	// finish the partial line, and a batch that deletes the latest row of company 1 (=> the earlier
+	// row becomes the latest) and adds a new company-year
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`,"date":"2024","field":"wst_1","value":"7"}` + "\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(batchDir, "0001.jsonl"), []byte(
+		`{"op":"delete","dataset":"waste_data","company_id":"1","date":"2023-06-01"}`+"\n"+
+			`{"op":"delete","dataset":"waste_data","company_id":"1","date":"2023-01-01","field":"wst_2"}`+"\n"), 0o644))
+
+	n, err = feed.Poll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	waste = store.Snapshot().Datasets["waste_data"]
+	assert.Equal(t, map[string]Value{"wst_1": NumberValue(10)}, waste[CompanyYearKey{"1", 2023}])
+	assert.Equal(t, map[string]Value{"wst_1": NumberValue(7)}, waste[CompanyYearKey{"3", 2024}])
+
+	// nothing new => nothing applied
+	n, err = feed.Poll(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// a restart re-applies the saved patches on top of the file and resumes after the last offsets
+	store, feed = newFeed()
+	assert.Equal(t, waste, store.Snapshot().Datasets["waste_data"])
+	n, err = feed.Poll(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// the patches survive a reload of the file, except where the file has newer rows than them
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "waste_data.csv"), []byte(
+		"company_id,date,wst_1,wst_2\n"+
+			"1,2023-01-01,10,1\n"+
+			"1,2023-06-01,11,2\n"+
+			"2,2023-01-01,21,3\n"+
+			"4,2023-01-01,40,4\n"), 0o644))
+	_, err = store.Refresh(context.Background())
+	require.NoError(t, err)
+	snapshot = store.Snapshot()
+	waste = snapshot.Datasets["waste_data"]
+	assert.Equal(t, map[string]Value{"wst_1": NumberValue(10)}, waste[CompanyYearKey{"1", 2023}])
+	assert.Equal(t, map[string]Value{"wst_1": NumberValue(21), "wst_2": NumberValue(3)}, waste[CompanyYearKey{"2", 2023}])
+	assert.Equal(t, map[string]Value{"wst_1": NumberValue(7)}, waste[CompanyYearKey{"3", 2024}])
+	assert.Contains(t, waste, CompanyYearKey{"4", 2023})
+	assert.Equal(t, map[CompanyYearKey]bool{{"1", 2023}: true, {"2", 2023}: true, {"3", 2024}: true}, snapshot.patched["waste_data"])
+
+	// the superseded patch is kept for as-of snapshots until the history retention drops it
+	store.opts.HistoryRetention = time.Nanosecond
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "waste_data.csv"), []byte(
+		"company_id,date,wst_1,wst_2\n"+
+			"1,2023-01-01,10,1\n"+
+			"1,2023-06-01,11,2\n"+
+			"2,2023-01-01,21,3\n"), 0o644))
+	_, err = store.Refresh(context.Background())
+	require.NoError(t, err)
+	assert.NotContains(t, store.overlay["waste_data"], CompanyYearKey{"2", 2023})
+	assert.Contains(t, store.overlay["waste_data"], CompanyYearKey{"1", 2023})
+	assert.Equal(t, map[string]Value{"wst_1": NumberValue(21), "wst_2": NumberValue(3)},
+		store.Snapshot().Datasets["waste_data"][CompanyYearKey{"2", 2023}])
+	require.NoError(t, feed.compact())
+	content, err := os.ReadFile(statePath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), `"company_id":"2"`)
+}
+
+func TestChangeQualityRules(t *testing.T) {
+	dataDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "waste_data.csv"), []byte(
+		"company_id,date,wst_1\n"+
+			"1,2023-01-01,10\n"), 0o644))
+	quarantineDir := t.TempDir()
+	quality := &c.QualityConfig{Datasets: []c.DatasetRules{{Name: "waste_data", NonNegative: []string{"wst_1"}}}}
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), quality), FileStorage{Root: dataDir}, "", StoreOptions{QuarantineDir: quarantineDir})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+
+	// a change that breaks a rule is quarantined, the company-year keeps its loaded row
+	update := func(company string, value float64) ChangeEvent {
+		return ChangeEvent{Op: ChangeUpdate, Dataset: "waste_data", CompanyID: company,
+			Date: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), Field: "wst_1", Value: NumberValue(value)}
+	}
+	store.ApplyChanges([]ChangeEvent{update("1", -5), update("2", -1)})
+	snapshot := store.Snapshot()
+	waste := snapshot.Datasets["waste_data"]
+	assert.Equal(t, map[string]Value{"wst_1": NumberValue(10)}, waste[CompanyYearKey{"1", 2023}])
+	assert.NotContains(t, waste, CompanyYearKey{"2", 2023})
+	assert.ElementsMatch(t, []QuarantinedRow{
+		{Dataset: "waste_data", Source: changeEventsSource, CompanyID: "1", Date: "2023", Rule: ruleNonNegative, Field: "wst_1", Reason: "-5 is negative"},
+		{Dataset: "waste_data", Source: changeEventsSource, CompanyID: "2", Date: "2023", Rule: ruleNonNegative, Field: "wst_1", Reason: "-1 is negative"},
+	}, snapshot.Quality.Quarantine)
+	content, err := os.ReadFile(filepath.Join(quarantineDir, "waste_data.quarantine.csv"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "change events")
+
+	// a later change that fixes the row takes the row out of quarantine
+	store.ApplyChanges([]ChangeEvent{update("1", 3)})
+	snapshot = store.Snapshot()
+	assert.Equal(t, map[string]Value{"wst_1": NumberValue(3)}, snapshot.Datasets["waste_data"][CompanyYearKey{"1", 2023}])
+	require.Len(t, snapshot.Quality.Quarantine, 1)
+	assert.Equal(t, "2", snapshot.Quality.Quarantine[0].CompanyID)
+}
+
+func TestChangeFeedJournal(t *testing.T) {
+	dataDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "waste_data.csv"), []byte(
+		"company_id,date,was_1\n1,2023-01-01,10\n"), 0o644))
+
+	cdcDir := t.TempDir()
+	logPath := filepath.Join(cdcDir, "changes.jsonl")
+	statePath := filepath.Join(cdcDir, "state.json")
+	journalPath := statePath + ".journal"
+
+	newFeed := func() (*DatasetStore, *ChangeFeed) {
+		store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dataDir}, "", StoreOptions{})
+		feed := NewChangeFeed(store, statePath, LogTailSource{Path: logPath})
+		feed.CompactEvery = 2
+		require.NoError(t, feed.Restore())
+		_, err := store.Refresh(context.Background())
+		require.NoError(t, err)
+		return store, feed
+	}
+	appendLog := func(line string) {
+		f, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		require.NoError(t, err)
+		_, err = f.WriteString(line + "\n")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	poll := func(feed *ChangeFeed) {
+		_, err := feed.Poll(context.Background())
+		require.NoError(t, err)
+	}
+	was1 := func(store *DatasetStore) Value {
+		return store.Snapshot().Datasets["waste_data"][CompanyYearKey{"1", 2023}]["was_1"]
+	}
+
+	store, feed := newFeed()
+
+	// a poll only appends to the journal
+	appendLog(`{"op":"update","dataset":"waste_data","company_id":"1","date":"2023-01-01","field":"was_1","value":11}`)
+	poll(feed)
+	assert.NoFileExists(t, statePath)
+	journal, err := os.ReadFile(journalPath)
+	require.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(journal, []byte("\n")))
+
+	// the second one compacts it into the state file
+	appendLog(`{"op":"update","dataset":"waste_data","company_id":"1","date":"2023-01-01","field":"was_1","value":12}`)
+	poll(feed)
+	assert.FileExists(t, statePath)
+	info, err := os.Stat(journalPath)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	appendLog(`{"op":"delete","dataset":"waste_data","company_id":"1","date":"2023-01-01"}`)
+	appendLog(`{"op":"update","dataset":"waste_data","company_id":"1","date":"2023-01-01","field":"was_2","value":1}`)
+	poll(feed)
+	assert.Equal(t, Value{}, was1(store))
+	journal, err = os.ReadFile(journalPath)
+	require.NoError(t, err)
+
+	// restart after a crash in the middle of writing the next record: the state file and the
+	// complete journal record are restored, the torn one is dropped
+	require.NoError(t, os.WriteFile(journalPath, append(append([]byte(nil), journal...), `{"seq":4,"offs`...), 0o644))
+	store, feed = newFeed()
+	assert.Equal(t, map[string]Value{"was_2": NumberValue(1)}, store.Snapshot().Datasets["waste_data"][CompanyYearKey{"1", 2023}])
+	info, err = os.Stat(journalPath)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	// a later change, folded into the state file on shutdown
+	appendLog(`{"op":"update","dataset":"waste_data","company_id":"1","date":"2023-01-01","field":"was_1","value":13}`)
+	poll(feed)
+	require.NoError(t, feed.Close())
+	want := map[string]Value{"was_1": NumberValue(13), "was_2": NumberValue(1)}
+	assert.Equal(t, want, store.Snapshot().Datasets["waste_data"][CompanyYearKey{"1", 2023}])
+
+	// a record already folded into the state file (crash between compaction and emptying the
+	// journal) is not applied again: its row delete would wipe the later change
+	require.NoError(t, os.WriteFile(journalPath, journal, 0o644))
+	store, feed = newFeed()
+	assert.Equal(t, want, store.Snapshot().Datasets["waste_data"][CompanyYearKey{"1", 2023}])
+
+	// nothing is read twice from the source either
+	n, err := feed.Poll(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestParseChangeEvent(t *testing.T) {
+	ev, err := parseChangeEvent([]byte(`{"op":"UPDATE","dataset":"d","company_id":1001,"date":2024,"field":"f","value":true}`))
+	require.NoError(t, err)
+	assert.Equal(t, ChangeUpdate, ev.Op)
+	assert.Equal(t, CompanyYearKey{"1001", 2024}, ev.key())
+	assert.Equal(t, BoolValue(true), ev.Value)
+
+	for _, line := range []string{
+		`{"op":"upsert","dataset":"d","company_id":"1","date":"2024"}`,
+		`{"op":"insert","dataset":"d","company_id":"1","date":"2024"}`,
+		`{"op":"delete","company_id":"1","date":"2024"}`,
+		`{"op":"delete","dataset":"d","company_id":"1","date":"soon"}`,
+	} {
+		_, err := parseChangeEvent([]byte(line))
+		assert.Error(t, err, line)
+	}
+}
@@ -0,0 +1,442 @@
+package internal
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// bitmap is a fixed-size set of slots.
+type bitmap []uint64
+
+func newBitmap(n int) bitmap { return make(bitmap, (n+63)/64) }
+
+func (b bitmap) get(i int) bool { return b[i>>6]&(1<<(uint(i)&63)) != 0 }
+func (b bitmap) set(i int)      { b[i>>6] |= 1 << (uint(i) & 63) }
+func (b bitmap) clear(i int)    { b[i>>6] &^= 1 << (uint(i) & 63) }
+
+// Column holds one field of a dataset for every slot of its ColumnStore. Numbers are kept in a
+// dense []float64 with a bitmap of the slots that have one; bools and strings (dictionary-encoded)
+// are only allocated for fields that hold them.
+type Column struct {
+	nums  []float64
+	isNum bitmap
+
+	isBool  bitmap
+	boolVal bitmap
+
+	strs []int32 // 1-based index into dict, 0 = no string
+	dict []string
+}
+
+// Float returns the number at slot; anything else (null, bool, string) reads as null.
+func (col *Column) Float(slot int) (float64, bool) {
+	if col == nil || slot < 0 || col.isNum == nil || !col.isNum.get(slot) {
+		return 0, false
+	}
+	return col.nums[slot], true
+}
+
+// code returns the dictionary code of the string at slot, 0 if there is none.
+func (col *Column) code(slot int) int32 {
+	if col == nil || slot < 0 || col.strs == nil {
+		return 0
+	}
+	return col.strs[slot]
+}
+
+// Value returns the typed value at slot.
+func (col *Column) Value(slot int) Value {
+	if col == nil || slot < 0 {
+		return Value{}
+	}
+	if col.isNum != nil && col.isNum.get(slot) {
+		return NumberValue(col.nums[slot])
+	}
+	if col.isBool != nil && col.isBool.get(slot) {
+		return BoolValue(col.boolVal.get(slot))
+	}
+	if col.strs != nil && col.strs[slot] != 0 {
+		return StringValue(col.dict[col.strs[slot]-1])
+	}
+	return Value{}
+}
+
+// clone copies the column, so a patched store doesn't write into the one it was derived from.
+func (col *Column) clone() *Column {
+	if col == nil {
+		return &Column{}
+	}
+	return &Column{
+		nums:    slices.Clone(col.nums),
+		isNum:   slices.Clone(col.isNum),
+		isBool:  slices.Clone(col.isBool),
+		boolVal: slices.Clone(col.boolVal),
+		strs:    slices.Clone(col.strs),
+		dict:    slices.Clone(col.dict),
+	}
+}
+
+// set writes v at slot of a column of slots slots, replacing what was there.
+func (col *Column) set(slot, slots int, v Value) {
+	if col.isNum != nil {
+		col.isNum.clear(slot)
+	}
+	if col.isBool != nil {
+		col.isBool.clear(slot)
+	}
+	if col.strs != nil {
+		col.strs[slot] = 0
+	}
+	switch v.Kind {
+	case KindNumber:
+		if col.nums == nil {
+			col.nums, col.isNum = make([]float64, slots), newBitmap(slots)
+		}
+		col.nums[slot] = v.Num
+		col.isNum.set(slot)
+	case KindBool:
+		if col.isBool == nil {
+			col.isBool, col.boolVal = newBitmap(slots), newBitmap(slots)
+		}
+		col.isBool.set(slot)
+		if v.Bool {
+			col.boolVal.set(slot)
+		} else {
+			col.boolVal.clear(slot)
+		}
+	case KindString:
+		if col.strs == nil {
+			col.strs = make([]int32, slots)
+		}
+		code := int32(slices.Index(col.dict, v.Str) + 1)
+		if code == 0 {
+			col.dict = append(col.dict, v.Str)
+			code = int32(len(col.dict))
+		}
+		col.strs[slot] = code
+	}
+}
+
+// ColumnDataset is a dataset in columnar form.
+type ColumnDataset struct {
+	columns map[string]*Column
+}
+
+// fieldKinds are the value kinds of every field, as Dataset.FieldKinds finds them, read from
+// which kinds of storage the columns have. Columns patched by withChanges keep the storage of
+// values that were replaced, so their kinds only grow, like patchKinds.
+func (cs *ColumnStore) fieldKinds() map[string]map[string]map[ValueKind]bool {
+	kinds := make(map[string]map[string]map[ValueKind]bool, len(cs.datasets))
+	for name, cd := range cs.datasets {
+		fields := make(map[string]map[ValueKind]bool, len(cd.columns))
+		for field, col := range cd.columns {
+			seen := make(map[ValueKind]bool, 1)
+			if col.isNum != nil {
+				seen[KindNumber] = true
+			}
+			if col.isBool != nil {
+				seen[KindBool] = true
+			}
+			if col.strs != nil {
+				seen[KindString] = true
+			}
+			if len(seen) > 0 {
+				fields[field] = seen
+			}
+		}
+		kinds[name] = fields
+	}
+	return kinds
+}
+
+// Column returns the field's column, nil if no row has the field.
+func (d *ColumnDataset) Column(field string) *Column {
+	if d == nil {
+		return nil
+	}
+	return d.columns[field]
+}
+
+// ColumnStore holds datasets in columnar form. Company IDs and years are interned and every
+// (company, year) is a slot: company index * years + year index, so a row is found with two small
+// lookups instead of hashing its key and field name in nested maps. Only the years some row has
+// count, so a stray date (year 1, 9999) adds one slot per company, not the range up to it.
+type ColumnStore struct {
+	companies  []string // sorted, so slot order is key order
+	companyIdx map[string]int32
+	years      []int // sorted, the years some row has
+	yearIdx    map[int]int32
+	datasets   map[string]*ColumnDataset
+	// keys are the company-years with a row in any dataset, in slot order
+	keys []CompanyYearKey
+}
+
+// buildColumnStore converts datasets (by the names used in score configs) to columns.
+func buildColumnStore(datasets map[string]Dataset) *ColumnStore {
+	cs := &ColumnStore{
+		companyIdx: make(map[string]int32),
+		yearIdx:    make(map[int]int32),
+		datasets:   make(map[string]*ColumnDataset, len(datasets)),
+	}
+
+	// 1) intern the companies and the years
+	for _, ds := range datasets {
+		for key := range ds {
+			if _, ok := cs.companyIdx[key.CompanyID]; !ok {
+				cs.companyIdx[key.CompanyID] = 0
+				cs.companies = append(cs.companies, key.CompanyID)
+			}
+			if _, ok := cs.yearIdx[key.Year]; !ok {
+				cs.yearIdx[key.Year] = 0
+				cs.years = append(cs.years, key.Year)
+			}
+		}
+	}
+	sort.Strings(cs.companies)
+	for i, id := range cs.companies {
+		cs.companyIdx[id] = int32(i)
+	}
+	sort.Ints(cs.years)
+	for i, year := range cs.years {
+		cs.yearIdx[year] = int32(i)
+	}
+	slots := len(cs.companies) * len(cs.years)
+
+	// 2) fill the columns
+	present := newBitmap(slots)
+	for name, ds := range datasets {
+		cd := &ColumnDataset{columns: make(map[string]*Column)}
+		dicts := make(map[string]map[string]int32)
+		for key, row := range ds {
+			slot := cs.Slot(key)
+			present.set(slot) // a row counts even without values
+			for field, v := range row {
+				col := cd.columns[field]
+				if col == nil {
+					col = &Column{}
+					cd.columns[field] = col
+				}
+				switch v.Kind {
+				case KindNumber:
+					if col.nums == nil {
+						col.nums, col.isNum = make([]float64, slots), newBitmap(slots)
+					}
+					col.nums[slot] = v.Num
+					col.isNum.set(slot)
+				case KindBool:
+					if col.isBool == nil {
+						col.isBool, col.boolVal = newBitmap(slots), newBitmap(slots)
+					}
+					col.isBool.set(slot)
+					if v.Bool {
+						col.boolVal.set(slot)
+					}
+				case KindString:
+					if col.strs == nil {
+						col.strs = make([]int32, slots)
+						dicts[field] = make(map[string]int32)
+					}
+					code, ok := dicts[field][v.Str]
+					if !ok {
+						col.dict = append(col.dict, v.Str)
+						code = int32(len(col.dict))
+						dicts[field][v.Str] = code
+					}
+					col.strs[slot] = code
+				}
+			}
+		}
+		cs.datasets[name] = cd
+	}
+
+	for slot := 0; slot < slots; slot++ {
+		if present.get(slot) {
+			cs.keys = append(cs.keys, CompanyYearKey{CompanyID: cs.companies[slot/len(cs.years)], Year: cs.years[slot%len(cs.years)]})
+		}
+	}
+	return cs
+}
+
+// Slot returns the slot of key, -1 if the store has no such company or year.
+func (cs *ColumnStore) Slot(key CompanyYearKey) int {
+	idx, ok := cs.companyIdx[key.CompanyID]
+	if !ok {
+		return -1
+	}
+	year, ok := cs.yearIdx[key.Year]
+	if !ok {
+		return -1
+	}
+	return int(idx)*len(cs.years) + int(year)
+}
+
+// withChanges returns the store of datasets, given the store cs of an earlier version of them and
+// the company-years that changed since (by dataset name as used in configs). Only the columns in
+// which a changed key's value differs are copied and written; the others are shared with cs, which
+// is not modified. ok is false when a changed key's company or year has no slot in cs: the store
+// has to be built again.
+func (cs *ColumnStore) withChanges(datasets map[string]Dataset, changed map[string]keySet) (*ColumnStore, bool) {
+	touched := make(keySet)
+	for _, keys := range changed {
+		for key := range keys {
+			if cs.Slot(key) < 0 {
+				return nil, false
+			}
+			touched[key] = true
+		}
+	}
+
+	next := *cs
+	next.datasets = maps.Clone(cs.datasets)
+	slots := len(cs.companies) * len(cs.years)
+	for name, keys := range changed {
+		if len(keys) == 0 {
+			continue
+		}
+		cd := &ColumnDataset{columns: make(map[string]*Column)}
+		if old := cs.datasets[name]; old != nil {
+			maps.Copy(cd.columns, old.columns)
+		}
+		copied := make(map[string]bool)
+		write := func(field string, slot int, v Value) {
+			if !copied[field] {
+				copied[field] = true
+				cd.columns[field] = cd.columns[field].clone()
+			}
+			cd.columns[field].set(slot, slots, v)
+		}
+		ds := datasets[name]
+		for key := range keys {
+			slot := cs.Slot(key)
+			row := ds[key]
+			for field, col := range cd.columns {
+				if v := row[field]; col.Value(slot) != nullAsZero(v) {
+					write(field, slot, v)
+				}
+			}
+			for field, v := range row {
+				if _, ok := cd.columns[field]; !ok && !v.IsNull() {
+					write(field, slot, v)
+				}
+			}
+		}
+		next.datasets[name] = cd
+	}
+
+	// keys that gained their first row or lost their last one
+	for key := range touched {
+		present := false
+		for _, ds := range datasets {
+			if _, present = ds[key]; present {
+				break
+			}
+		}
+		i, found := slices.BinarySearchFunc(next.keys, key, compareKeys)
+		switch {
+		case present && !found:
+			next.keys = slices.Insert(slices.Clip(next.keys), i, key)
+		case !present && found:
+			next.keys = slices.Delete(slices.Clone(next.keys), i, i+1)
+		}
+	}
+	return &next, true
+}
+
+// nullAsZero returns v, or the zero Value if v is null, which is how columns read nulls back.
+func nullAsZero(v Value) Value {
+	if v.IsNull() {
+		return Value{}
+	}
+	return v
+}
+
+// Keys returns every company-year with a row in any dataset, sorted by company then year.
+// The slice is shared and must not be modified.
+func (cs *ColumnStore) Keys() []CompanyYearKey {
+	return cs.keys
+}
+
+// has reports whether some dataset has a row at key.
+func (cs *ColumnStore) has(key CompanyYearKey) bool {
+	_, found := slices.BinarySearchFunc(cs.keys, key, compareKeys)
+	return found
+}
+
+// Dataset returns a dataset by score config name, nil if there is none.
+func (cs *ColumnStore) Dataset(name string) *ColumnDataset {
+	return cs.datasets[name]
+}
+
+// sourceRef is a parameter source resolved once per run: a self.<metric> reference or a column.
+// A nil column (unknown dataset or field, malformed source, literal value) reads as null.
+type sourceRef struct {
+	self   bool
+	metric string
+	col    *Column
+}
+
+// resolveSource turns "dataset.field" or "self.metric" into a sourceRef.
+func (cs *ColumnStore) resolveSource(source string) sourceRef {
+	if strings.HasPrefix(source, "self.") {
+		return sourceRef{self: true, metric: strings.TrimPrefix(source, "self.")}
+	}
+	parts := strings.Split(source, ".")
+	if len(parts) != 2 {
+		return sourceRef{} // invalid format => null
+	}
+	return sourceRef{col: cs.Dataset(parts[0]).Column(parts[1])}
+}
+
+// boundMetric is a metric with its parameter sources resolved against a ColumnStore.
+type boundMetric struct {
+	c.Metric
+	params []sourceRef // one per Operation.Parameters
+}
+
+func (cs *ColumnStore) bindMetrics(metrics []c.Metric) []boundMetric {
+	bound := make([]boundMetric, len(metrics))
+	for i, metric := range metrics {
+		bound[i] = boundMetric{Metric: metric, params: make([]sourceRef, len(metric.Operation.Parameters))}
+		for j, p := range metric.Operation.Parameters {
+			if p.Source != "" {
+				bound[i].params[j] = cs.resolveSource(p.Source)
+			}
+		}
+	}
+	return bound
+}
+
+// lazyColumns builds a snapshot's ColumnStore on first use.
+type lazyColumns struct {
+	once  sync.Once
+	store *ColumnStore
+}
+
+// Columns returns the snapshot's datasets in columnar form, under their score config names.
+// It is built on first use and shared by every run on the snapshot.
+func (s *Snapshot) Columns() *ColumnStore {
+	if s.columns == nil {
+		return buildColumnStore(scoreDatasets(s))
+	}
+	s.columns.once.Do(func() {
+		s.columns.store = buildColumnStore(scoreDatasets(s))
+	})
+	return s.columns.store
+}
+
+// useColumns makes cs the snapshot's columns unless they were built already, and returns the
+// ones the snapshot has.
+func (s *Snapshot) useColumns(cs *ColumnStore) *ColumnStore {
+	if s.columns == nil {
+		return cs
+	}
+	s.columns.once.Do(func() {
+		s.columns.store = cs
+	})
+	return s.columns.store
+}
@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+func TestColumnStore(t *testing.T) {
+	datasets := typedDatasets()
+	datasets["waste"] = Dataset{
+		{CompanyID: "1002", Year: 2021}: {"was_1": NumberValue(1.5)},
+		{CompanyID: "1000", Year: 2024}: {},
+	}
+	cs := buildColumnStore(datasets)
+
+	assert.Equal(t, []CompanyYearKey{{"1000", 2023}, {"1000", 2024}, {"1001", 2023}, {"1002", 2021}}, cs.Keys())
+	assert.Equal(t, -1, cs.Slot(CompanyYearKey{"1000", 2020}))
+	assert.Equal(t, -1, cs.Slot(CompanyYearKey{"9999", 2023}))
+
+	// every cell reads back as it was, everything else is null
+	for name, ds := range datasets {
+		for key, row := range ds {
+			slot := cs.Slot(key)
+			require.NotEqual(t, -1, slot, key)
+			for field, v := range row {
+				assert.Equal(t, v, cs.Dataset(name).Column(field).Value(slot), "%s.%s %v", name, field, key)
+			}
+		}
+	}
+	slot := cs.Slot(CompanyYearKey{"1002", 2021})
+	assert.Equal(t, Value{}, cs.Dataset("disclosure").Column("dis_1").Value(slot))
+	_, ok := cs.Dataset("disclosure").Column("reporting_standard").Float(cs.Slot(CompanyYearKey{"1000", 2023}))
+	assert.False(t, ok, "strings read as null in numeric context")
+	assert.Nil(t, cs.Dataset("nope").Column("x"))
+
+	assert.Equal(t, sourceRef{self: true, metric: "m"}, cs.resolveSource("self.m"))
+	assert.Equal(t, sourceRef{}, cs.resolveSource("disclosure.dis_1.extra"))
+	assert.Same(t, cs.Dataset("waste").Column("was_1"), cs.resolveSource("waste.was_1").col)
+
+	// only the years rows have are slots: a stray date adds one per company, not the range up to it
+	stray := buildColumnStore(map[string]Dataset{"waste": {{"1", 1}: {}, {"1", 2023}: {}, {"2", 9999}: {}}})
+	assert.Equal(t, []int{1, 2023, 9999}, stray.years)
+	assert.Equal(t, 5, stray.Slot(CompanyYearKey{"2", 9999}))
+	assert.Equal(t, -1, stray.Slot(CompanyYearKey{"1", 2000}))
+	assert.Equal(t, []CompanyYearKey{{"1", 1}, {"1", 2023}, {"2", 9999}}, stray.Keys())
+	assert.True(t, stray.has(CompanyYearKey{"2", 9999}))
+	assert.False(t, stray.has(CompanyYearKey{"2", 2023}), "a slot without a row")
+
+	// the field kinds are the ones of the rows
+	for name, ds := range datasets {
+		assert.Equal(t, ds.FieldKinds(), cs.fieldKinds()[name], name)
+	}
+}
+
+func TestColumnStoreWithChanges(t *testing.T) {
+	withWaste := func() map[string]Dataset {
+		datasets := typedDatasets()
+		datasets["waste"] = Dataset{{"1000", 2024}: {"was_1": NumberValue(1)}}
+		return datasets
+	}
+	before := withWaste()
+	cs := buildColumnStore(before)
+
+	after := withWaste()
+	changed := map[string]keySet{"disclosure": {}}
+	for key, row := range after["disclosure"] {
+		changed["disclosure"][key] = true
+		if key.CompanyID == "1001" {
+			delete(after["disclosure"], key) // its last row
+			continue
+		}
+		row = maps.Clone(row)
+		row["dis_1"] = StringValue("restated")
+		delete(row, "reporting_standard")
+		row["new_field"] = BoolValue(true)
+		after["disclosure"][key] = row
+	}
+	after["disclosure"][CompanyYearKey{"1001", 2024}] = map[string]Value{"dis_1": NumberValue(3)}
+	changed["disclosure"][CompanyYearKey{"1001", 2024}] = true
+
+	patched, ok := cs.withChanges(after, changed)
+	require.True(t, ok)
+	rebuilt := buildColumnStore(after)
+	assert.Equal(t, rebuilt.Keys(), patched.Keys())
+	for name, ds := range after {
+		for _, key := range rebuilt.Keys() {
+			for field := range ds[key] {
+				assert.Equal(t, rebuilt.Dataset(name).Column(field).Value(rebuilt.Slot(key)),
+					patched.Dataset(name).Column(field).Value(patched.Slot(key)), "%s.%s %v", name, field, key)
+			}
+		}
+	}
+	assert.Equal(t, Value{}, patched.Dataset("disclosure").Column("reporting_standard").Value(patched.Slot(CompanyYearKey{"1000", 2023})))
+
+	// cs is untouched, and what didn't change is shared
+	assert.Equal(t, buildColumnStore(before).Keys(), cs.Keys())
+	for key, row := range before["disclosure"] {
+		for field, v := range row {
+			assert.Equal(t, v, cs.Dataset("disclosure").Column(field).Value(cs.Slot(key)))
+		}
+	}
+	for name := range before {
+		if name != "disclosure" {
+			assert.Same(t, cs.Dataset(name), patched.Dataset(name), name)
+		}
+	}
+
+	// a year without a slot needs a new layout
+	_, ok = cs.withChanges(after, map[string]keySet{"disclosure": {{"1000", 1999}: true}})
+	assert.False(t, ok)
+}
+
+// syntheticDatasets builds three datasets of companies x years rows with fields numeric fields each.
+func syntheticDatasets(companies, years, fields int) map[string]Dataset {
+	datasets := make(map[string]Dataset)
+	for _, name := range []string{"disclosure", "waste", "emissions"} {
+		ds := make(Dataset, companies*years)
+		for company := 0; company < companies; company++ {
+			for year := 0; year < years; year++ {
+				row := make(map[string]Value, fields)
+				for f := 0; f < fields; f++ {
+					if (company+year+f+len(name))%10 != 0 { // some nulls, not in the same rows for every dataset
+						row[fmt.Sprintf("%s_%d", name[:3], f)] = NumberValue(float64(company*year + f + 1))
+					}
+				}
+				ds[CompanyYearKey{CompanyID: fmt.Sprint(100000 + company), Year: 2000 + year}] = row
+			}
+		}
+		datasets[name] = ds
+	}
+	return datasets
+}
+
+func syntheticConfig(fields int) *c.Config {
+	cfg := &c.Config{Name: "synthetic"}
+	for f := 0; f < fields; f++ {
+		src := func(ds string) c.Parameter { return c.Parameter{Source: fmt.Sprintf("%s.%s_%d", ds, ds[:3], f)} }
+		cfg.Metrics = append(cfg.Metrics,
+			c.Metric{Name: fmt.Sprintf("total_%d", f), Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{src("waste"), src("emissions")}}},
+			c.Metric{Name: fmt.Sprintf("ratio_%d", f), Operation: c.Operation{Type: "divide", Parameters: []c.Parameter{
+				src("disclosure"), {Source: fmt.Sprintf("self.total_%d", f)},
+			}}},
+		)
+	}
+	return cfg
+}
+
+const benchCompanies, benchYears, benchFields = 20000, 10, 5
+
+// heapAfter returns the live heap after building something that is kept alive by the caller.
+func heapAfter() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// BenchmarkDatasetMemory measures the live heap of the nested maps alone and of what a snapshot
+// that has been scored holds: the maps and their columnar copy.
+func BenchmarkDatasetMemory(b *testing.B) {
+	b.Run("maps", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			before := heapAfter()
+			datasets := syntheticDatasets(benchCompanies, benchYears, benchFields)
+			b.ReportMetric(float64(heapAfter()-before)/(1<<20), "MiB")
+			runtime.KeepAlive(datasets)
+		}
+	})
+	b.Run("maps+columns", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			before := heapAfter()
+			datasets := syntheticDatasets(benchCompanies, benchYears, benchFields)
+			cs := buildColumnStore(datasets)
+			b.ReportMetric(float64(heapAfter()-before)/(1<<20), "MiB")
+			runtime.KeepAlive(datasets)
+			runtime.KeepAlive(cs)
+		}
+	})
+}
+
+// BenchmarkReadValues reads every source of every key, the way the engine used to (split the
+// source, hash the dataset, key and field) and through column handles resolved once.
+func BenchmarkReadValues(b *testing.B) {
+	datasets := syntheticDatasets(benchCompanies, benchYears, benchFields)
+	cs := buildColumnStore(datasets)
+	var sources []string
+	for name := range datasets {
+		for f := 0; f < benchFields; f++ {
+			sources = append(sources, fmt.Sprintf("%s.%s_%d", name, name[:3], f))
+		}
+	}
+	keys := cs.Keys()
+
+	b.Run("maps", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var sum float64
+			for _, key := range keys {
+				for _, source := range sources {
+					parts := strings.Split(source, ".")
+					if v, ok := datasets[parts[0]][key][parts[1]].Float(); ok {
+						sum += v
+					}
+				}
+			}
+			runtime.KeepAlive(sum)
+		}
+		b.ReportMetric(float64(len(keys)*len(sources)*b.N)/b.Elapsed().Seconds(), "values/s")
+	})
+	b.Run("columns", func(b *testing.B) {
+		refs := make([]sourceRef, len(sources))
+		for i, source := range sources {
+			refs[i] = cs.resolveSource(source)
+		}
+		for i := 0; i < b.N; i++ {
+			var sum float64
+			for _, key := range keys {
+				slot := cs.Slot(key)
+				for _, ref := range refs {
+					if v, ok := ref.col.Float(slot); ok {
+						sum += v
+					}
+				}
+			}
+			runtime.KeepAlive(sum)
+		}
+		b.ReportMetric(float64(len(keys)*len(sources)*b.N)/b.Elapsed().Seconds(), "values/s")
+	})
+}
+
+// BenchmarkComputeScores is a full run of the engine on a large synthetic snapshot.
+func BenchmarkComputeScores(b *testing.B) {
+	cs := buildColumnStore(syntheticDatasets(benchCompanies, benchYears, benchFields))
+	cfg := syntheticConfig(benchFields)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		computeScores(context.Background(), cfg, cs, nil, nil, workerCount(0))
+	}
+	b.ReportMetric(float64(len(cs.Keys())*b.N)/b.Elapsed().Seconds(), "keys/s")
+}
@@ -0,0 +1,468 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+const (
+	defaultDiffTop       = 10
+	defaultDiffTolerance = 1e-9
+)
+
+// DiffOptions tunes a score diff.
+type DiffOptions struct {
+	// Tolerance is the largest delta still counted as unchanged (0 => 1e-9, float noise)
+	Tolerance float64
+	// Top is the number of top movers per metric (0 => 10)
+	Top int
+}
+
+// DiffSide is one side of a diff: scores of a config, or a stored run.
+type DiffSide struct {
+	Label      string   `json:"label"`
+	RunID      string   `json:"run_id,omitempty"`
+	ConfigHash string   `json:"config_hash,omitempty"`
+	Rows       int      `json:"rows"`
+	Metrics    []string `json:"metrics"`
+}
+
+// ScoreDiff is the impact of going from the base scores to the candidate ones.
+type ScoreDiff struct {
+	Base      DiffSide `json:"base"`
+	Candidate DiffSide `json:"candidate"`
+	Tolerance float64  `json:"tolerance"`
+	// Rows are the company-years on both sides (Common) or on one only
+	Rows struct {
+		Common  int `json:"common"`
+		Added   int `json:"added"`
+		Removed int `json:"removed"`
+	} `json:"rows"`
+	// Companies is the number of companies on either side, CompaniesChanged the ones with at least
+	// one cell changed, added or removed
+	Companies        int `json:"companies"`
+	CompaniesChanged int `json:"companies_changed"`
+	// Metrics are the metrics of the base, then the ones only the candidate has
+	Metrics []MetricDiff `json:"metrics"`
+	// CoverageChanged are the metrics whose share of non-null values changed
+	CoverageChanged []string `json:"coverage_changed"`
+}
+
+// MetricDiff is what changed for one metric. A cell is a company-year's value of the metric: it
+// changed (set on both sides, moved by more than the tolerance), was added (null or missing in
+// the base) or removed (null or missing in the candidate).
+type MetricDiff struct {
+	Name string `json:"name"`
+	// Status is changed, unchanged, added (candidate only) or removed (base only)
+	Status           string       `json:"status"`
+	Changed          int          `json:"changed"`
+	Unchanged        int          `json:"unchanged"`
+	Added            int          `json:"added"`
+	Removed          int          `json:"removed"`
+	CompaniesChanged int          `json:"companies_changed"`
+	Deltas           DeltaSummary `json:"deltas"`
+	TopMovers        []Mover      `json:"top_movers"`
+	Coverage         Coverage     `json:"coverage"`
+}
+
+// DeltaSummary is the distribution of candidate - base over the cells set on both sides.
+type DeltaSummary struct {
+	Count   int     `json:"count"`
+	Mean    float64 `json:"mean"`
+	MeanAbs float64 `json:"mean_abs"`
+	Min     float64 `json:"min"`
+	P5      float64 `json:"p5"`
+	P25     float64 `json:"p25"`
+	Median  float64 `json:"median"`
+	P75     float64 `json:"p75"`
+	P95     float64 `json:"p95"`
+	Max     float64 `json:"max"`
+}
+
+// Mover is a changed cell.
+type Mover struct {
+	CompanyID string  `json:"company_id"`
+	Year      int     `json:"year"`
+	Base      float64 `json:"base"`
+	Candidate float64 `json:"candidate"`
+	Delta     float64 `json:"delta"`
+}
+
+// Coverage is how many rows of each side have a value for the metric.
+type Coverage struct {
+	Base          int     `json:"base"`
+	Candidate     int     `json:"candidate"`
+	BaseRate      float64 `json:"base_rate"`
+	CandidateRate float64 `json:"candidate_rate"`
+	Changed       bool    `json:"changed"`
+}
+
+// cellValue is the value of a metric in a row; nulls (and NaN/Inf) are not set.
+func cellValue(row ScoredRow, metric string) (float64, bool) {
+	val, ok := row.Values[metric]
+	if !ok || math.IsNaN(val) || math.IsInf(val, 0) {
+		return 0, false
+	}
+	return val, true
+}
+
+// DiffScores compares the candidate scores to the base ones, cell by cell. The rows of each side
+// are matched by company and year; their order doesn't matter.
+func DiffScores(base, candidate DiffSide, baseRows, candidateRows ScoreRows, opts DiffOptions) *ScoreDiff {
+	if opts.Tolerance <= 0 {
+		opts.Tolerance = defaultDiffTolerance
+	}
+	if opts.Top <= 0 {
+		opts.Top = defaultDiffTop
+	}
+	base.Rows, candidate.Rows = len(baseRows), len(candidateRows)
+	d := &ScoreDiff{Base: base, Candidate: candidate, Tolerance: opts.Tolerance, CoverageChanged: []string{}}
+
+	byKey := func(rows ScoreRows) map[CompanyYearKey]ScoredRow {
+		m := make(map[CompanyYearKey]ScoredRow, len(rows))
+		for _, row := range rows {
+			m[row.Key()] = row
+		}
+		return m
+	}
+	baseByKey, candidateByKey := byKey(baseRows), byKey(candidateRows)
+	keySet := make(keySet, len(baseByKey)+len(candidateByKey))
+	companies := make(map[string]bool)
+	for key := range baseByKey {
+		keySet[key] = true
+		if _, ok := candidateByKey[key]; ok {
+			d.Rows.Common++
+		} else {
+			d.Rows.Removed++
+		}
+	}
+	for key := range candidateByKey {
+		if _, ok := baseByKey[key]; !ok {
+			d.Rows.Added++
+		}
+		keySet[key] = true
+	}
+	keys := make([]CompanyYearKey, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+		companies[key.CompanyID] = true
+	}
+	sortKeys(keys)
+	d.Companies = len(companies)
+
+	metrics := slices.Clone(base.Metrics)
+	for _, name := range candidate.Metrics {
+		if !slices.Contains(metrics, name) {
+			metrics = append(metrics, name)
+		}
+	}
+	changedCompanies := make(map[string]bool)
+	for _, name := range metrics {
+		md := diffMetric(name, keys, baseByKey, candidateByKey, opts, changedCompanies)
+		inBase, inCandidate := slices.Contains(base.Metrics, name), slices.Contains(candidate.Metrics, name)
+		switch {
+		case !inBase:
+			md.Status = "added"
+		case !inCandidate:
+			md.Status = "removed"
+		case md.Changed+md.Added+md.Removed > 0:
+			md.Status = "changed"
+		default:
+			md.Status = "unchanged"
+		}
+		md.Coverage.Changed = md.Coverage.BaseRate != md.Coverage.CandidateRate
+		if md.Coverage.Changed {
+			d.CoverageChanged = append(d.CoverageChanged, name)
+		}
+		d.Metrics = append(d.Metrics, md)
+	}
+	d.CompaniesChanged = len(changedCompanies)
+	return d
+}
+
+func diffMetric(
+	name string,
+	keys []CompanyYearKey,
+	baseByKey, candidateByKey map[CompanyYearKey]ScoredRow,
+	opts DiffOptions,
+	changedCompanies map[string]bool,
+) MetricDiff {
+	md := MetricDiff{Name: name, TopMovers: []Mover{}}
+	companies := make(map[string]bool)
+	var deltas []float64
+	var movers []Mover
+	for _, key := range keys {
+		baseRow, candidateRow := baseByKey[key], candidateByKey[key]
+		b, hasB := cellValue(baseRow, name)
+		cv, hasC := cellValue(candidateRow, name)
+		if hasB {
+			md.Coverage.Base++
+		}
+		if hasC {
+			md.Coverage.Candidate++
+		}
+		switch {
+		case hasB && hasC:
+			delta := cv - b
+			deltas = append(deltas, delta)
+			if math.Abs(delta) <= opts.Tolerance {
+				md.Unchanged++
+				continue
+			}
+			md.Changed++
+			movers = append(movers, Mover{CompanyID: key.CompanyID, Year: key.Year, Base: b, Candidate: cv, Delta: delta})
+		case hasC:
+			md.Added++
+		case hasB:
+			md.Removed++
+		default:
+			continue
+		}
+		companies[key.CompanyID] = true
+		changedCompanies[key.CompanyID] = true
+	}
+	md.CompaniesChanged = len(companies)
+	md.Deltas = summarizeDeltas(deltas)
+	md.Coverage.BaseRate = rate(md.Coverage.Base, len(baseByKey))
+	md.Coverage.CandidateRate = rate(md.Coverage.Candidate, len(candidateByKey))
+
+	// biggest moves first; the keys are sorted, so ties stay by company and year
+	sort.SliceStable(movers, func(i, j int) bool { return math.Abs(movers[i].Delta) > math.Abs(movers[j].Delta) })
+	if len(movers) > opts.Top {
+		movers = movers[:opts.Top]
+	}
+	md.TopMovers = append(md.TopMovers, movers...)
+	return md
+}
+
+func rate(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+func summarizeDeltas(deltas []float64) DeltaSummary {
+	s := DeltaSummary{Count: len(deltas)}
+	if len(deltas) == 0 {
+		return s
+	}
+	sorted := slices.Clone(deltas)
+	slices.Sort(sorted)
+	var sum, sumAbs float64
+	for _, delta := range sorted {
+		sum += delta
+		sumAbs += math.Abs(delta)
+	}
+	// nearest rank
+	quantile := func(q float64) float64 {
+		return sorted[int(math.Ceil(q*float64(len(sorted))))-1]
+	}
+	s.Mean, s.MeanAbs = sum/float64(len(sorted)), sumAbs/float64(len(sorted))
+	s.Min, s.Max = sorted[0], sorted[len(sorted)-1]
+	s.P5, s.P25, s.Median, s.P75, s.P95 = quantile(0.05), quantile(0.25), quantile(0.5), quantile(0.75), quantile(0.95)
+	return s
+}
+
+// DiffConfigs scores the snapshot with both configs (the filter's rows and metrics) and compares
+// them.
+func DiffConfigs(
+	ctx context.Context,
+	base, candidate *c.Config,
+	snapshot *Snapshot,
+	filter ScoreFilter,
+	opts DiffOptions,
+) (*ScoreDiff, error) {
+	var sides [2]DiffSide
+	var rows [2]ScoreRows
+	for i, cfg := range []*c.Config{base, candidate} {
+		label := [2]string{"base", "candidate"}[i]
+		// the filter can name metrics of either config, each side keeps its own
+		f := filter
+		if f.Metrics != nil {
+			f.Metrics = slices.DeleteFunc(slices.Clone(f.Metrics), func(name string) bool {
+				return !slices.Contains(metricNames(cfg), name)
+			})
+		}
+		var err error
+		if rows[i], err = CalculateScoreFiltered(ctx, cfg, snapshot, f); err != nil {
+			return nil, fmt.Errorf("%s: %w", label, err)
+		}
+		sides[i] = DiffSide{Label: label, ConfigHash: configHash(cfg), Metrics: metricNames(f.Output(cfg))}
+	}
+	return DiffScores(sides[0], sides[1], rows[0], rows[1], opts), nil
+}
+
+// DiffRuns compares two stored runs.
+func DiffRuns(rs RunStore, baseID, candidateID string, opts DiffOptions) (*ScoreDiff, error) {
+	var sides [2]DiffSide
+	var rows [2]ScoreRows
+	for i, id := range []string{baseID, candidateID} {
+		record, err := rs.Get(id)
+		if err != nil {
+			return nil, fmt.Errorf("run %s: %w", id, err)
+		}
+		if err := rs.Rows(id, func(row ScoredRow) error {
+			rows[i] = append(rows[i], row)
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("run %s: %w", id, err)
+		}
+		sides[i] = DiffSide{Label: [2]string{"base", "candidate"}[i], RunID: id, ConfigHash: record.ConfigHash, Metrics: metricNames(record.outputConfig())}
+	}
+	return DiffScores(sides[0], sides[1], rows[0], rows[1], opts), nil
+}
+
+// DiffRequest is the body of POST /diff: the product's config with each side's overrides (as in
+// JobRequest; no overrides => the product as is), scored on the current snapshot.
+type DiffRequest struct {
+	Product   string     `json:"product"`
+	Filters   JobFilters `json:"filters"`
+	Base      []c.Metric `json:"base"`
+	Candidate []c.Metric `json:"candidate"`
+	Tolerance float64    `json:"tolerance"`
+	Top       int        `json:"top"`
+}
+
+// DiffHandler reports the impact of a config change:
+//   - GET /diff?base=<run ID>&candidate=<run ID> compares two stored runs (?tolerance=, ?top=)
+//   - POST /diff (DiffRequest) scores the current snapshot with two versions of the config
+//
+// Runs are read from runs (nil => only POST works).
+func DiffHandler(scoreConfig *c.Config, store *DatasetStore, runs RunStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var diff *ScoreDiff
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			query := r.URL.Query()
+			if runs == nil {
+				http.Error(w, "runs are not stored", http.StatusNotFound)
+				return
+			}
+			if query.Get("base") == "" || query.Get("candidate") == "" {
+				http.Error(w, "expected ?base=<run ID>&candidate=<run ID>", http.StatusBadRequest)
+				return
+			}
+			var opts DiffOptions
+			if opts, err = parseDiffOptions(query.Get("tolerance"), query.Get("top")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if diff, err = DiffRuns(runs, query.Get("base"), query.Get("candidate"), opts); err != nil {
+				http.Error(w, err.Error(), runErrorStatus(err))
+				return
+			}
+		case http.MethodPost:
+			var req DiffRequest
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid diff request: %v", err), http.StatusBadRequest)
+				return
+			}
+			if req.Product != "" && req.Product != scoreConfig.Name {
+				http.Error(w, fmt.Sprintf("unknown product %q", req.Product), http.StatusBadRequest)
+				return
+			}
+			snapshot := store.Snapshot()
+			if snapshot == nil {
+				http.Error(w, "datasets are not loaded yet", http.StatusServiceUnavailable)
+				return
+			}
+			base, candidate := overrideMetrics(scoreConfig, req.Base), overrideMetrics(scoreConfig, req.Candidate)
+			for _, cfg := range []*c.Config{base, candidate} {
+				if err := ValidateScoreConfig(cfg, scoreDatasets(snapshot)); err != nil {
+					http.Error(w, fmt.Sprintf("invalid score config %s: %v", cfg.Name, err), http.StatusBadRequest)
+					return
+				}
+			}
+			filter, err := ParseScoreFilter(req.Filters.query(), overrideMetrics(base, candidate.Metrics))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			opts := DiffOptions{Tolerance: req.Tolerance, Top: req.Top}
+			if diff, err = DiffConfigs(r.Context(), base, candidate, snapshot, filter, opts); err != nil {
+				http.Error(w, fmt.Sprintf("Error: %v", err), scoreErrorStatus(err))
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, diff)
+	}
+}
+
+func parseDiffOptions(tolerance, top string) (DiffOptions, error) {
+	var opts DiffOptions
+	var err error
+	if tolerance != "" {
+		if opts.Tolerance, err = strconv.ParseFloat(tolerance, 64); err != nil || opts.Tolerance < 0 {
+			return opts, fmt.Errorf("invalid tolerance %q", tolerance)
+		}
+	}
+	if top != "" {
+		if opts.Top, err = strconv.Atoi(top); err != nil || opts.Top < 0 {
+			return opts, fmt.Errorf("invalid top %q", top)
+		}
+	}
+	return opts, nil
+}
+
+// WriteText writes the diff as a plain-text report.
+func (d *ScoreDiff) WriteText(w io.Writer) error {
+	ew := &errWriter{w: w}
+	side := func(s DiffSide) string {
+		if s.RunID != "" {
+			return "run " + s.RunID
+		}
+		return "config " + s.ConfigHash[:min(12, len(s.ConfigHash))]
+	}
+	ew.printf("base:      %s (%d rows)\n", side(d.Base), d.Base.Rows)
+	ew.printf("candidate: %s (%d rows)\n", side(d.Candidate), d.Candidate.Rows)
+	ew.printf("rows: %d common, %d added, %d removed\n", d.Rows.Common, d.Rows.Added, d.Rows.Removed)
+	ew.printf("companies changed: %d of %d (tolerance %g)\n", d.CompaniesChanged, d.Companies, d.Tolerance)
+	for _, md := range d.Metrics {
+		ew.printf("\n%s: %s\n", md.Name, md.Status)
+		ew.printf("  cells: %d changed, %d unchanged, %d added, %d removed; %d companies\n",
+			md.Changed, md.Unchanged, md.Added, md.Removed, md.CompaniesChanged)
+		if md.Deltas.Count > 0 {
+			s := md.Deltas
+			ew.printf("  deltas: mean %.6g, mean abs %.6g, min %.6g, p5 %.6g, p25 %.6g, median %.6g, p75 %.6g, p95 %.6g, max %.6g\n",
+				s.Mean, s.MeanAbs, s.Min, s.P5, s.P25, s.Median, s.P75, s.P95, s.Max)
+		}
+		ew.printf("  coverage: %d => %d values (%.1f%% => %.1f%%)", md.Coverage.Base, md.Coverage.Candidate,
+			100*md.Coverage.BaseRate, 100*md.Coverage.CandidateRate)
+		if md.Coverage.Changed {
+			ew.printf(" changed")
+		}
+		ew.printf("\n")
+		for _, m := range md.TopMovers {
+			ew.printf("  %s %d: %.6g => %.6g (%+.6g)\n", m.CompanyID, m.Year, m.Base, m.Candidate, m.Delta)
+		}
+	}
+	return ew.err
+}
+
+// errWriter keeps the first write error, so a report is written without checking every line.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...any) {
+	if ew.err == nil {
+		_, ew.err = fmt.Fprintf(ew.w, format, args...)
+	}
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+func TestDiffScores(t *testing.T) {
+	row := func(company string, year int, values map[string]float64) ScoredRow {
+		return ScoredRow{CompanyID: company, Year: year, Values: values}
+	}
+	base := ScoreRows{
+		row("1", 2022, map[string]float64{"a": 1, "b": 5, "old": 1}),
+		row("1", 2023, map[string]float64{"a": 2, "b": 5, "old": 1}),
+		row("2", 2023, map[string]float64{"a": 3, "old": 1}),
+		row("3", 2023, map[string]float64{"a": 4, "b": 1, "old": 1}), // dropped
+	}
+	candidate := ScoreRows{
+		row("2", 2023, map[string]float64{"a": 3.5, "b": 2, "new": 1}), // b added
+		row("1", 2023, map[string]float64{"a": 2 + 1e-12, "new": 1}),   // b removed, a within tolerance
+		row("1", 2022, map[string]float64{"a": -9, "b": 5, "new": 1}),
+		row("4", 2023, map[string]float64{"a": 0, "new": 1}), // new row
+	}
+	d := DiffScores(DiffSide{Label: "base", Metrics: []string{"a", "b", "old"}}, DiffSide{Label: "candidate", Metrics: []string{"a", "b", "new"}},
+		base, candidate, DiffOptions{Top: 1})
+
+	assert.Equal(t, 4, d.Base.Rows)
+	assert.Equal(t, 3, d.Rows.Common)
+	assert.Equal(t, 1, d.Rows.Added)
+	assert.Equal(t, 1, d.Rows.Removed)
+	assert.Equal(t, 4, d.Companies)
+	assert.Equal(t, 4, d.CompaniesChanged)
+
+	require.Len(t, d.Metrics, 4)
+	a := d.Metrics[0]
+	assert.Equal(t, "changed", a.Status)
+	assert.Equal(t, []int{2, 1, 1, 1}, []int{a.Changed, a.Unchanged, a.Added, a.Removed})
+	assert.Equal(t, 4, a.CompaniesChanged, "1 and 2 moved, 3 and 4 only have a row on one side")
+	assert.Equal(t, 3, a.Deltas.Count)
+	assert.Equal(t, -10.0, a.Deltas.Min)
+	assert.Equal(t, 0.5, a.Deltas.Max)
+	assert.InDelta(t, 1e-12, a.Deltas.Median, 1e-15)
+	assert.Equal(t, []Mover{{CompanyID: "1", Year: 2022, Base: 1, Candidate: -9, Delta: -10}}, a.TopMovers)
+	assert.False(t, a.Coverage.Changed)
+
+	b := d.Metrics[1]
+	assert.Equal(t, []int{0, 1, 1, 2}, []int{b.Changed, b.Unchanged, b.Added, b.Removed})
+	assert.Equal(t, Coverage{Base: 3, Candidate: 2, BaseRate: 0.75, CandidateRate: 0.5, Changed: true}, b.Coverage)
+
+	assert.Equal(t, "removed", d.Metrics[2].Status)
+	assert.Equal(t, 4, d.Metrics[2].Removed)
+	assert.Equal(t, "added", d.Metrics[3].Status)
+	assert.Equal(t, 4, d.Metrics[3].Added)
+	assert.Equal(t, []string{"b", "old", "new"}, d.CoverageChanged)
+
+	var text bytes.Buffer
+	require.NoError(t, d.WriteText(&text))
+	assert.Contains(t, text.String(), "companies changed: 4 of 4")
+	assert.Contains(t, text.String(), "  1 2022: 1 => -9 (-10)\n")
+
+	same := DiffScores(DiffSide{Metrics: []string{"a", "b", "old"}}, DiffSide{Metrics: []string{"a", "b", "old"}}, base, base, DiffOptions{})
+	assert.Zero(t, same.CompaniesChanged)
+	for _, md := range same.Metrics {
+		assert.Equal(t, "unchanged", md.Status, md.Name)
+		assert.Empty(t, md.TopMovers)
+	}
+}
+
+func TestDiffHandler(t *testing.T) {
+	rs, err := NewFileRunStore(t.TempDir())
+	require.NoError(t, err)
+
+	jobs, store, _ := newJobsFixture(t, JobOptions{Runs: rs})
+	handler := DiffHandler(crossSectionalConfig(), store, rs)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(method, target, bytes.NewBufferString(body)))
+		return rec
+	}
+
+	// disclosure.dis_1 no longer counts towards weighted, for companies 5001-5004
+	rec := do(http.MethodPost, "/diff", `{
+		"filters": {"company": ["5001", "5002", "5003", "5004"], "metrics": ["weighted", "total", "doubled"]},
+		"candidate": [
+			{"name": "weighted", "operation": {"type": "sum", "parameters": [{"source": "self.total_rank"}]}},
+			{"name": "doubled", "operation": {"type": "sum", "parameters": [{"source": "self.total"}, {"source": "self.total"}]}}
+		],
+		"top": 2}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var d ScoreDiff
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &d))
+	assert.Equal(t, []string{"total", "weighted"}, d.Base.Metrics)
+	assert.Equal(t, []string{"total", "weighted", "doubled"}, d.Candidate.Metrics)
+	assert.Equal(t, 16, d.Rows.Common)
+	require.Len(t, d.Metrics, 3)
+	assert.Equal(t, "unchanged", d.Metrics[0].Status)
+	assert.Equal(t, "changed", d.Metrics[1].Status)
+	assert.Len(t, d.Metrics[1].TopMovers, 2)
+	assert.Equal(t, "added", d.Metrics[2].Status)
+	assert.Contains(t, d.CoverageChanged, "doubled")
+
+	for body, want := range map[string]int{
+		`{"product": "nope"}`: http.StatusBadRequest,
+		`{"candidate": [{"name": "x", "operation": {"type": "nope"}}]}`: http.StatusBadRequest,
+		`{"filters": {"metrics": ["nope"]}}`:                            http.StatusBadRequest,
+		`{"colour": "blue"}`:                                            http.StatusBadRequest,
+	} {
+		assert.Equal(t, want, do(http.MethodPost, "/diff", body).Code, body)
+	}
+
+	// two stored runs: the same job with and without an override
+	submit := func(overrides ...c.Metric) string {
+		status, err := jobs.Submit(JobRequest{Filters: JobFilters{Year: []int{2023}}, Overrides: overrides})
+		require.NoError(t, err)
+		waitJob(t, jobs, status.ID, JobSucceeded)
+		return status.ID
+	}
+	before := submit()
+	after := submit(c.Metric{Name: "gri", Operation: c.Operation{Type: "eq", Parameters: []c.Parameter{{Source: "disclosure.standard"}, {Value: "sasb"}}}})
+	rec = do(http.MethodGet, "/diff?base="+before+"&candidate="+after, "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &d))
+	assert.Equal(t, before, d.Base.RunID)
+	assert.Equal(t, 150, d.Rows.Common)
+	for _, md := range d.Metrics {
+		if md.Name == "gri" {
+			assert.Equal(t, 150, md.Changed, "gri and sasb swap everywhere")
+		} else {
+			assert.Equal(t, "unchanged", md.Status, md.Name)
+		}
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/diff?base="+before, "").Code)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/diff?base="+before+"&candidate="+after+"&top=x", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/diff?base="+before+"&candidate=nope", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodDelete, "/diff", "").Code)
+}
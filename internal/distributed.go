@@ -0,0 +1,715 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// workerShardPath is where every instance accepts shard jobs.
+const workerShardPath = "/worker/shard"
+
+// defaultShardTimeout bounds one attempt at a shard job.
+const defaultShardTimeout = 5 * time.Minute
+
+// defaultHealthTimeout bounds one health check of a worker.
+const defaultHealthTimeout = 5 * time.Second
+
+// maxCachedShards is how many shards a worker keeps between the phases of a run.
+const maxCachedShards = 4
+
+// maxWorkerFailures is how many health checks in a row a worker may fail before it is removed.
+const maxWorkerFailures = 3
+
+// ShardJob asks a worker to score the companies of one shard (partitionOf(company, Shards) ==
+// Shard) of the datasets in its storage. A job runs phases 0..Phase (see splitPhases) again, so any
+// worker can take it and a failed one can be retried elsewhere; only the rows of the shard are kept
+// between jobs (see shardCache).
+type ShardJob struct {
+	Config *c.Config `json:"config"`
+	Shard  int       `json:"shard"`
+	Shards int       `json:"shards"`
+	Phase  int       `json:"phase"`
+	// Fingerprint is the data phase 0 was scored on, sent with the later phases: a worker that
+	// still has the shard of that data scores it again instead of reading the objects
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Dists are what the cross-sectional metrics of phases 1..Phase rank against, gathered over
+	// every shard by the coordinator
+	Dists []yearDistribution `json:"dists,omitempty"`
+}
+
+// ShardResult is a worker's answer to a ShardJob.
+type ShardResult struct {
+	// Fingerprint identifies the data the shard was scored on; every shard of a run must agree
+	Fingerprint string `json:"fingerprint"`
+	// Kinds are the field kinds of the shard's datasets, to validate the config on the union
+	Kinds map[string]map[string]map[ValueKind]bool `json:"kinds,omitempty"`
+	// Dist is the shard's part of the next phase's cross-sectional source (not the last phase)
+	Dist yearDistribution `json:"dist,omitempty"`
+	// Rows are the shard's scores (last phase only), sorted by company and year
+	Rows []ScoredRow `json:"rows,omitempty"`
+}
+
+// dataFingerprint identifies the content a snapshot was loaded from.
+func dataFingerprint(snapshot *Snapshot) string {
+	return fingerprintOf(snapshot.Fingerprints)
+}
+
+// fingerprintOf combines the hashes of source objects, by object key.
+func fingerprintOf(hashes map[string]string) string {
+	keys := make([]string, 0, len(hashes))
+	for key := range hashes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s=%s\n", key, hashes[key])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// errInvalidShardJob wraps the errors of jobs a worker can't run at all.
+var errInvalidShardJob = errors.New("invalid shard job")
+
+// ScoreShard runs a shard job on the datasets under prefix. Only the rows of the shard's companies
+// are kept as the objects are streamed, so a worker holds its shard in memory, not the datasets.
+// Change events are not applied.
+func (s *DataLoaderService) ScoreShard(ctx context.Context, storage Storage, prefix string, job ShardJob) (*ShardResult, error) {
+	phases, err := checkShardJob(job)
+	if err != nil {
+		return nil, err
+	}
+	datasets, fingerprint, err := s.loadShard(ctx, storage, prefix, job.Shard, job.Shards)
+	if err != nil {
+		return nil, err
+	}
+	return s.scoreShard(ctx, job, phases, datasets, fingerprint)
+}
+
+// checkShardJob returns the phases of a job's config, or errInvalidShardJob if it can't be run.
+func checkShardJob(job ShardJob) ([][]stage, error) {
+	if job.Config == nil {
+		return nil, fmt.Errorf("%w: no score config", errInvalidShardJob)
+	}
+	if err := validateScoreConfigKinds(job.Config, nil); err != nil {
+		return nil, fmt.Errorf("%w: score config %s: %w", errInvalidShardJob, job.Config.Name, err)
+	}
+	phases := splitPhases(planStages(job.Config))
+	switch {
+	case job.Shards <= 0 || job.Shard < 0 || job.Shard >= job.Shards:
+		return nil, fmt.Errorf("%w: shard %d of %d", errInvalidShardJob, job.Shard, job.Shards)
+	case job.Phase < 0 || job.Phase >= len(phases):
+		return nil, fmt.Errorf("%w: phase %d, the config has %d", errInvalidShardJob, job.Phase, len(phases))
+	case len(job.Dists) != job.Phase:
+		return nil, fmt.Errorf("%w: phase %d needs %d distributions, got %d", errInvalidShardJob, job.Phase, job.Phase, len(job.Dists))
+	}
+	return phases, nil
+}
+
+// scoreShard runs phases 0..job.Phase on the datasets of a shard.
+func (s *DataLoaderService) scoreShard(ctx context.Context, job ShardJob, phases [][]stage, datasets map[string]Dataset, fingerprint string) (*ShardResult, error) {
+	res := &ShardResult{Fingerprint: fingerprint}
+	if job.Phase == 0 {
+		res.Kinds = make(map[string]map[string]map[ValueKind]bool, len(datasets))
+		for name, ds := range datasets {
+			res.Kinds[name] = ds.FieldKinds()
+		}
+	}
+
+	cols := buildColumnStore(datasets)
+	results := make(map[CompanyYearKey]map[string]float64, len(cols.Keys()))
+	for _, key := range cols.Keys() {
+		results[key] = map[string]float64{}
+	}
+	for i := 0; i <= job.Phase; i++ {
+		var dist yearDistribution
+		if i > 0 {
+			dist = job.Dists[i-1]
+		}
+		var err error
+		if res.Dist, err = runPhase(ctx, phases, i, cols, results, dist, workerCount(s.ScoreWorkers)); err != nil {
+			return nil, err
+		}
+	}
+
+	if job.Phase == len(phases)-1 {
+		res.Rows = make([]ScoredRow, 0, len(results))
+		for _, key := range cols.Keys() {
+			res.Rows = append(res.Rows, ScoredRow{CompanyID: key.CompanyID, Year: key.Year, Values: results[key]})
+		}
+	}
+	return res, nil
+}
+
+// loadShard reads the scored datasets under prefix, keeping the rows of the shard's companies, and
+// reduces them like LoadDataset: quality rules (they only compare rows of the same company) and
+// latest row per year. It also returns the fingerprint of the objects read.
+func (s *DataLoaderService) loadShard(ctx context.Context, storage Storage, prefix string, shard, shards int) (map[string]Dataset, string, error) {
+	objects, err := s.scoredObjects(ctx, storage, prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	hashes := make(map[string]string, len(objects))
+	byName := make(map[string]Dataset, len(objects))
+	for _, o := range objects {
+		records, hash, err := s.readShard(ctx, storage, o, shard, shards)
+		if err != nil {
+			return nil, "", err
+		}
+		hashes[o.Key] = hash
+		name := datasetNameOf(o.Name())
+		accepted, _, _ := applyQualityRules(name, o.Name(), records, s.quality.Rules(name))
+		byName[name] = latestPerYear(accepted)
+	}
+
+	datasets := make(map[string]Dataset, len(datasetAliases))
+	for alias, name := range datasetAliases {
+		datasets[alias] = byName[name]
+	}
+	return datasets, fingerprintOf(hashes), nil
+}
+
+// readShard streams one object and returns the records of the shard's companies, with the hash the
+// store gives the object.
+func (s *DataLoaderService) readShard(ctx context.Context, storage Storage, o ObjectInfo, shard, shards int) ([]Record, string, error) {
+	name := o.Name()
+	loader, ok := s.registry.GetLoader(filepath.Ext(name))
+	if !ok {
+		return nil, "", fmt.Errorf("no loader for extension %q: %s", filepath.Ext(name), name)
+	}
+	r, err := storage.Open(ctx, o.Key)
+	if err != nil {
+		return nil, "", err
+	}
+	defer r.Close()
+
+	var records []Record
+	keep := func(rec Record) error {
+		if partitionOf(rec.CompanyID, shards) == shard {
+			records = append(records, rec)
+		}
+		return nil
+	}
+
+	// external sources are fingerprinted like the store does, with the data they point to
+	if fp, ok := loader.(Fingerprinter); ok {
+		spec, err := readSpec(o, r)
+		if err != nil {
+			return nil, "", err
+		}
+		hash, err := externalHash(ctx, fp, name, spec)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := streamRecords(ctx, loader, name, bytes.NewReader(spec), keep); err != nil {
+			return nil, "", fmt.Errorf("failed to load %s: %w", o.Key, err)
+		}
+		return records, hash, nil
+	}
+
+	h := sha256.New()
+	tee := io.TeeReader(r, h)
+	if err := streamRecords(ctx, loader, name, tee, keep); err != nil {
+		return nil, "", fmt.Errorf("failed to load %s: %w", o.Key, err)
+	}
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", o.Key, err)
+	}
+	return records, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ScoreShard runs a shard job on the store's objects (see DataLoaderService.ScoreShard). A job
+// carrying the fingerprint of a shard read by an earlier job scores that shard again.
+func (st *DatasetStore) ScoreShard(ctx context.Context, job ShardJob) (*ShardResult, error) {
+	phases, err := checkShardJob(job)
+	if err != nil {
+		return nil, err
+	}
+	datasets, ok := st.shards.get(job.Fingerprint, job.Shard, job.Shards)
+	fingerprint := job.Fingerprint
+	if !ok {
+		if datasets, fingerprint, err = st.service.loadShard(ctx, st.storage, st.prefix, job.Shard, job.Shards); err != nil {
+			return nil, err
+		}
+		st.shards.put(fingerprint, job.Shard, job.Shards, datasets)
+	}
+	return st.service.scoreShard(ctx, job, phases, datasets, fingerprint)
+}
+
+// shardCache keeps the last shards a worker read, by the fingerprint of their data, so the later
+// phases of a run don't stream the objects again.
+type shardCache struct {
+	mu sync.Mutex
+	// entries are the cached shards, least recently used first
+	entries []cachedShard
+}
+
+type cachedShard struct {
+	fingerprint   string
+	shard, shards int
+	datasets      map[string]Dataset
+}
+
+func (sc *shardCache) get(fingerprint string, shard, shards int) (map[string]Dataset, bool) {
+	if fingerprint == "" {
+		return nil, false
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for i, e := range sc.entries {
+		if e.fingerprint == fingerprint && e.shard == shard && e.shards == shards {
+			sc.entries = append(append(sc.entries[:i:i], sc.entries[i+1:]...), e)
+			return e.datasets, true
+		}
+	}
+	return nil, false
+}
+
+func (sc *shardCache) put(fingerprint string, shard, shards int, datasets map[string]Dataset) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for i, e := range sc.entries {
+		if e.shard == shard && e.shards == shards {
+			// the same shard of other data is stale
+			sc.entries = append(sc.entries[:i:i], sc.entries[i+1:]...)
+			break
+		}
+	}
+	sc.entries = append(sc.entries, cachedShard{fingerprint: fingerprint, shard: shard, shards: shards, datasets: datasets})
+	if len(sc.entries) > maxCachedShards {
+		sc.entries = sc.entries[len(sc.entries)-maxCachedShards:]
+	}
+}
+
+// authorized reports whether a request carries the workers' shared secret
+// ("Authorization: Bearer <token>").
+func authorized(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// WorkerShardHandler runs shard jobs on the store's objects (POST, JSON). Jobs must carry the
+// token (see authorized); without one every job is refused.
+func WorkerShardHandler(store *DatasetStore, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if token == "" {
+			http.Error(w, "shard jobs are disabled: the worker has no token", http.StatusForbidden)
+			return
+		}
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var job ShardJob
+		if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+			http.Error(w, fmt.Sprintf("invalid shard job: %v", err), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Scoring shard %d/%d, phase %d", job.Shard, job.Shards, job.Phase)
+
+		res, err := store.ScoreShard(r.Context(), job)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errInvalidShardJob) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, fmt.Sprintf("Error: %v", err), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Printf("Failed to write shard result: %v", err)
+		}
+	}
+}
+
+// Coordinator splits the companies into shards and scores them on registered workers (other
+// instances of the service, reached over HTTP). A failed shard is retried on the other workers,
+// and workers that stop answering health checks are removed (see Watch).
+type Coordinator struct {
+	// Token is the workers' shared secret: sent with shard jobs, and required to register a
+	// worker. Without one, workers can't register themselves.
+	Token string
+
+	client *http.Client
+	// shards is the number of shards per run, 0 => one per worker
+	shards int
+
+	mu      sync.Mutex
+	workers []string
+	// failures counts the health checks each worker failed in a row
+	failures map[string]int
+}
+
+// NewCoordinator creates a coordinator for the given worker base URLs (e.g. "http://10.0.0.2:8000").
+func NewCoordinator(shards int, workers ...string) *Coordinator {
+	co := &Coordinator{client: &http.Client{Timeout: defaultShardTimeout}, shards: shards, failures: make(map[string]int)}
+	for _, worker := range workers {
+		co.Register(worker)
+	}
+	return co
+}
+
+// Register adds a worker, if it isn't registered yet.
+func (co *Coordinator) Register(worker string) {
+	worker = strings.TrimRight(worker, "/")
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	for _, w := range co.workers {
+		if w == worker {
+			return
+		}
+	}
+	co.workers = append(co.workers, worker)
+	log.Printf("Registered worker %s", worker)
+}
+
+// Watch checks every worker's /health every interval until ctx is done. A worker failing
+// maxWorkerFailures checks in a row is removed; it comes back by registering again.
+func (co *Coordinator) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			co.checkWorkers(ctx)
+		}
+	}
+}
+
+// checkWorkers runs one round of health checks and removes the dead workers.
+func (co *Coordinator) checkWorkers(ctx context.Context) {
+	workers := co.Workers()
+	errs := make([]error, len(workers))
+	var wg sync.WaitGroup
+	for i, worker := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = co.ping(ctx, worker)
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	for i, worker := range workers {
+		if errs[i] == nil {
+			delete(co.failures, worker)
+			continue
+		}
+		co.failures[worker]++
+		if co.failures[worker] < maxWorkerFailures {
+			continue
+		}
+		delete(co.failures, worker)
+		for j, w := range co.workers {
+			if w == worker {
+				co.workers = append(co.workers[:j:j], co.workers[j+1:]...)
+				break
+			}
+		}
+		log.Printf("[WARN] removed worker %s after %d failed health checks: %v", worker, maxWorkerFailures, errs[i])
+	}
+}
+
+func (co *Coordinator) ping(ctx context.Context, worker string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultHealthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, worker+"/health", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := co.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Workers returns the registered workers.
+func (co *Coordinator) Workers() []string {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	return append([]string(nil), co.workers...)
+}
+
+// Score scores every shard on the workers and returns the rows by company and year.
+// Cross-sectional metrics are a reduce step between phases: the shards' parts of their source are
+// merged by the coordinator and sent back with the jobs of the next phase. The results are the same
+// as CalculateScore, provided every worker sees the same data.
+func (co *Coordinator) Score(ctx context.Context, scoreConfig *c.Config) (ScoreRows, error) {
+	rows, _, err := co.score(ctx, scoreConfig)
+	return rows, err
+}
+
+// score is Score, also returning the fingerprint of the data the workers scored.
+func (co *Coordinator) score(ctx context.Context, scoreConfig *c.Config) (ScoreRows, string, error) {
+	tracer := otel.Tracer("score-app")
+	ctx, span := tracer.Start(ctx, "CoordinatorScore")
+	defer span.End()
+
+	if err := validateScoreConfigKinds(scoreConfig, nil); err != nil {
+		return nil, "", fmt.Errorf("invalid score config %s: %w", scoreConfig.Name, err)
+	}
+	workers := co.Workers()
+	if len(workers) == 0 {
+		return nil, "", errors.New("no workers registered")
+	}
+	shards := co.shards
+	if shards <= 0 {
+		shards = len(workers)
+	}
+
+	phases := splitPhases(planStages(scoreConfig))
+	var dists []yearDistribution
+	var fingerprint string
+	for phase := range phases {
+		results, err := co.runShards(ctx, workers, scoreConfig, shards, phase, dists, fingerprint)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, res := range results {
+			if fingerprint == "" {
+				fingerprint = res.Fingerprint
+			} else if res.Fingerprint != fingerprint {
+				return nil, "", errors.New("workers scored different data, retry once they have all refreshed")
+			}
+		}
+		if phase == 0 {
+			kinds := make(map[string]map[string]map[ValueKind]bool)
+			for _, res := range results {
+				for name, fields := range res.Kinds {
+					mergeKinds(kinds, name, fields)
+				}
+			}
+			if err := validateScoreConfigKinds(scoreConfig, kinds); err != nil {
+				return nil, "", fmt.Errorf("invalid score config %s: %w", scoreConfig.Name, err)
+			}
+		}
+
+		if phase < len(phases)-1 {
+			dist := make(yearDistribution)
+			for _, res := range results {
+				dist.merge(res.Dist)
+			}
+			dist.sort()
+			dists = append(dists, dist)
+			continue
+		}
+		var rows ScoreRows
+		for _, res := range results {
+			for _, row := range res.Rows {
+				if row.Values == nil {
+					row.Values = map[string]float64{}
+				}
+				rows = append(rows, row)
+			}
+		}
+		sort.Slice(rows, func(i, j int) bool { return lessKey(rows[i].Key(), rows[j].Key()) })
+		return rows, fingerprint, nil
+	}
+	return nil, "", nil
+}
+
+// runShards runs one phase of every shard, at most one job per worker at a time.
+func (co *Coordinator) runShards(
+	ctx context.Context,
+	workers []string,
+	scoreConfig *c.Config,
+	shards, phase int,
+	dists []yearDistribution,
+	fingerprint string,
+) ([]*ShardResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*ShardResult, shards)
+	errs := make([]error, shards)
+	sem := make(chan struct{}, len(workers))
+	var wg sync.WaitGroup
+	for shard := 0; shard < shards; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			job := ShardJob{Config: scoreConfig, Shard: shard, Shards: shards, Phase: phase, Dists: dists, Fingerprint: fingerprint}
+			if results[shard], errs[shard] = co.dispatch(ctx, workers, job); errs[shard] != nil {
+				cancel() // the run fails, don't keep the other workers busy
+			}
+		}(shard)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// dispatch sends a job to the shard's worker, then to every other worker in turn until one succeeds.
+func (co *Coordinator) dispatch(ctx context.Context, workers []string, job ShardJob) (*ShardResult, error) {
+	var errs []error
+	for attempt := 0; attempt < len(workers); attempt++ {
+		worker := workers[(job.Shard+attempt)%len(workers)]
+		res, err := co.post(ctx, worker, job)
+		if err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Printf("[WARN] shard %d/%d phase %d failed on %s: %v", job.Shard, job.Shards, job.Phase, worker, err)
+		errs = append(errs, fmt.Errorf("%s: %w", worker, err))
+	}
+	return nil, fmt.Errorf("shard %d/%d failed on every worker: %w", job.Shard, job.Shards, errors.Join(errs...))
+}
+
+func (co *Coordinator) post(ctx context.Context, worker string, job ShardJob) (*ShardResult, error) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, worker+workerShardPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if co.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+co.Token)
+	}
+	resp, err := co.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var res ShardResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("invalid shard result: %w", err)
+	}
+	return &res, nil
+}
+
+// DistributedScoreHandler scores on the coordinator's workers and streams the scores, by company and
+// year or in the order of ?sort=, in the format asked for (as /run-scores). Filters are applied to
+// the output only. Runs are stored in runs (nil => not stored).
+func DistributedScoreHandler(scoreConfig *c.Config, co *Coordinator, runs RunStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Received request to calculate distributed scores")
+		out, ok := parseScoreRequest(w, r, scoreConfig)
+		if !ok {
+			return
+		}
+		rec := newRunRecorder(runs, out.meta.RunID, "distributed", r.URL.RawQuery, scoreConfig, out.filter)
+		streamScores(w, out.rw, out.meta, rec, func(emit func(CompanyYearKey, map[string]float64) error) error {
+			rows, fingerprint, err := co.score(r.Context(), scoreConfig)
+			if err != nil {
+				return err
+			}
+			if rec != nil {
+				rec.record.DataFingerprint = fingerprint
+			}
+			return out.filter.Apply(rows).Sorted(out.order).emitTo(emit)
+		})
+	}
+}
+
+// WorkersHandler lists the coordinator's workers (GET) or registers one (POST {"url": "..."}, with
+// the coordinator's token, see authorized).
+func WorkersHandler(co *Coordinator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if co.Token == "" {
+				http.Error(w, "worker registration is disabled: the coordinator has no token", http.StatusForbidden)
+				return
+			}
+			if !authorized(r, co.Token) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			var body struct {
+				URL string `json:"url"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.URL == "" {
+				http.Error(w, `expected {"url": "<worker base URL>"}`, http.StatusBadRequest)
+				return
+			}
+			co.Register(body.URL)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string][]string{"workers": co.Workers()}); err != nil {
+			log.Printf("Failed to write workers: %v", err)
+		}
+	}
+}
+
+// RegisterWorker registers workerURL with the coordinator at coordinatorURL, with the workers'
+// shared secret. Registering again is harmless, and brings back a worker that was removed.
+func RegisterWorker(ctx context.Context, coordinatorURL, workerURL, token string) error {
+	body, err := json.Marshal(map[string]string{"url": workerURL})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(coordinatorURL, "/")+"/workers", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("coordinator answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// workerToken is the shared secret of the test workers.
+const workerToken = "s3cret"
+
+// startWorkers starts n in-process workers, each with its own store on dir. The stores are never
+// refreshed: workers read their shard from storage.
+func startWorkers(t *testing.T, dir string, n int) []string {
+	quality := &c.QualityConfig{Datasets: []c.DatasetRules{{Name: "emissions_data", NonNegative: []string{"emi_1"}, MaxPerYear: 1}}}
+	var urls []string
+	for i := 0; i < n; i++ {
+		store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), quality), FileStorage{Root: dir}, "", StoreOptions{})
+		mux := http.NewServeMux()
+		mux.HandleFunc(workerShardPath, WorkerShardHandler(store, workerToken))
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+		urls = append(urls, srv.URL)
+	}
+	return urls
+}
+
+func TestCoordinatorMatchesInMemory(t *testing.T) {
+	dir := t.TempDir()
+	writePartitionFixture(t, dir)
+	workers := startWorkers(t, dir, 3)
+
+	// a worker that always fails: its shards are retried on the others
+	var failed atomic.Int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failed.Add(1)
+		http.Error(w, "out of memory", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	quality := &c.QualityConfig{Datasets: []c.DatasetRules{{Name: "emissions_data", NonNegative: []string{"emi_1"}, MaxPerYear: 1}}}
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), quality), FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	cfg := crossSectionalConfig()
+	want, err := CalculateScore(context.Background(), cfg, store.Snapshot())
+	require.NoError(t, err)
+
+	for _, shards := range []int{0, 1, 7} {
+		co := NewCoordinator(shards, append([]string{broken.URL}, workers...)...)
+		co.Token = workerToken
+		got, err := co.Score(context.Background(), cfg)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "%d shards", shards) // same rows, same order
+	}
+	assert.Positive(t, failed.Load())
+}
+
+func TestCoordinatorFails(t *testing.T) {
+	dir := t.TempDir()
+	writePartitionFixture(t, dir)
+	cfg := crossSectionalConfig()
+	_, err := NewCoordinator(0).Score(context.Background(), cfg)
+	assert.ErrorContains(t, err, "no workers")
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	_, err = NewCoordinator(2, broken.URL).Score(context.Background(), cfg)
+	assert.ErrorContains(t, err, "failed on every worker")
+
+	// type checks see every shard
+	bad := &c.Config{Name: "bad", Metrics: []c.Metric{
+		{Name: "total", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{{Source: "disclosure.standard"}}}},
+	}}
+	co := NewCoordinator(3, startWorkers(t, dir, 2)...)
+	co.Token = workerToken
+	_, err = co.Score(context.Background(), bad)
+	assert.ErrorContains(t, err, "operation needs numbers")
+
+	// jobs without the token are refused
+	_, err = NewCoordinator(3, startWorkers(t, dir, 2)...).Score(context.Background(), cfg)
+	assert.ErrorContains(t, err, "status 401")
+}
+
+func TestLoadShard(t *testing.T) {
+	dir := t.TempDir()
+	writePartitionFixture(t, dir)
+	service := NewDataLoaderService(NewLoaderRegistry(), nil)
+	store := NewDatasetStore(service, FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+
+	// every shard holds its own companies only, and together they are the snapshot
+	const shards = 3
+	var fingerprint string
+	merged := make(map[string]Dataset)
+	for shard := 0; shard < shards; shard++ {
+		datasets, fp, err := service.loadShard(context.Background(), FileStorage{Root: dir}, "", shard, shards)
+		require.NoError(t, err)
+		if fingerprint == "" {
+			fingerprint = fp
+		}
+		assert.Equal(t, fingerprint, fp)
+		for alias, ds := range datasets {
+			if merged[alias] == nil {
+				merged[alias] = make(Dataset)
+			}
+			for key, row := range ds {
+				assert.Equal(t, shard, partitionOf(key.CompanyID, shards))
+				merged[alias][key] = row
+			}
+		}
+	}
+	for alias, ds := range scoreDatasets(store.Snapshot()) {
+		assert.Equal(t, len(ds), len(merged[alias]), alias)
+		for key, row := range ds {
+			assert.Equal(t, row, merged[alias][key], "%s %v", alias, key)
+		}
+	}
+}
+
+func TestWorkersHandler(t *testing.T) {
+	co := NewCoordinator(0)
+	srv := httptest.NewServer(WorkersHandler(co))
+	defer srv.Close()
+
+	// no token on the coordinator: nobody can register
+	assert.ErrorContains(t, RegisterWorker(context.Background(), srv.URL, "http://worker-1:8000", workerToken), "403")
+
+	co.Token = workerToken
+	assert.ErrorContains(t, RegisterWorker(context.Background(), srv.URL, "http://worker-1:8000", "guess"), "401")
+	assert.Empty(t, co.Workers())
+
+	require.NoError(t, RegisterWorker(context.Background(), srv.URL, "http://worker-1:8000/", workerToken))
+	require.NoError(t, RegisterWorker(context.Background(), srv.URL, "http://worker-1:8000", workerToken))
+	require.NoError(t, RegisterWorker(context.Background(), srv.URL, "http://worker-2:8000", workerToken))
+	assert.Equal(t, []string{"http://worker-1:8000", "http://worker-2:8000"}, co.Workers())
+}
+
+func TestCoordinatorRemovesDeadWorkers(t *testing.T) {
+	var down atomic.Bool
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer worker.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	co := NewCoordinator(0, worker.URL, dead.URL)
+	for i := 0; i < maxWorkerFailures-1; i++ {
+		co.checkWorkers(context.Background())
+	}
+	assert.Len(t, co.Workers(), 2, "not yet")
+
+	down.Store(true)
+	co.checkWorkers(context.Background())
+	assert.Equal(t, []string{worker.URL}, co.Workers())
+
+	// a successful check starts the count again
+	down.Store(false)
+	co.checkWorkers(context.Background())
+	down.Store(true)
+	for i := 0; i < maxWorkerFailures-1; i++ {
+		co.checkWorkers(context.Background())
+	}
+	assert.Equal(t, []string{worker.URL}, co.Workers())
+	co.checkWorkers(context.Background())
+	assert.Empty(t, co.Workers())
+
+	// registering again brings it back
+	co.Register(worker.URL)
+	assert.Equal(t, []string{worker.URL}, co.Workers())
+}
+
+func TestWorkerShardCache(t *testing.T) {
+	dir := t.TempDir()
+	writePartitionFixture(t, dir)
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "", StoreOptions{})
+	cfg := crossSectionalConfig()
+	require.Greater(t, len(splitPhases(planStages(cfg))), 1)
+
+	first, err := store.ScoreShard(context.Background(), ShardJob{Config: cfg, Shard: 1, Shards: 2})
+	require.NoError(t, err)
+
+	// the later phases score the shard read for phase 0, even once the objects are gone
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		require.NoError(t, os.Remove(filepath.Join(dir, e.Name())))
+	}
+	job := ShardJob{Config: cfg, Shard: 1, Shards: 2, Phase: 1, Dists: []yearDistribution{first.Dist}, Fingerprint: first.Fingerprint}
+	res, err := store.ScoreShard(context.Background(), job)
+	require.NoError(t, err)
+	assert.Equal(t, first.Fingerprint, res.Fingerprint)
+
+	// another shard reads the objects: there are none left
+	job.Shard = 0
+	res, err = store.ScoreShard(context.Background(), job)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Fingerprint, res.Fingerprint)
+	assert.Empty(t, res.Rows)
+}
+
+func TestWorkerShardHandlerNeedsToken(t *testing.T) {
+	dir := t.TempDir()
+	writePartitionFixture(t, dir)
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "", StoreOptions{})
+	srv := httptest.NewServer(WorkerShardHandler(store, ""))
+	defer srv.Close()
+
+	// a worker without a token takes no jobs, whatever they carry
+	co := NewCoordinator(1, srv.URL)
+	co.Token = workerToken
+	_, err := co.Score(context.Background(), crossSectionalConfig())
+	assert.ErrorContains(t, err, "status 403")
+}
@@ -0,0 +1,446 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// errExplainNoData is returned when the company has no row in any dataset for the year.
+var errExplainNoData = errors.New("no data")
+
+// Explanation is what /explain returns: the evaluation tree of some metrics of a product for one
+// company-year, against the store's current snapshot.
+type Explanation struct {
+	Product    string         `json:"product"`
+	ConfigHash string         `json:"config_hash"`
+	Version    int64          `json:"snapshot_version"`
+	CompanyID  string         `json:"company_id"`
+	Year       int            `json:"year"`
+	Metrics    []*ExplainNode `json:"metrics"`
+}
+
+// ExplainNode is one step of an evaluation: a metric (with its operation and inputs), a dataset
+// source (with its raw value and the row it came from) or a literal value. Result is the number the
+// step contributes, null when it reads as null. Nodes under a lag are at an earlier year.
+type ExplainNode struct {
+	Metric      string           `json:"metric,omitempty"`
+	Operation   string           `json:"operation,omitempty"`
+	Source      string           `json:"source,omitempty"`
+	CompanyID   string           `json:"company_id"`
+	Year        int              `json:"year"`
+	Raw         *Value           `json:"raw,omitempty"`
+	Result      *float64         `json:"result"`
+	Flags       []string         `json:"flags,omitempty"`
+	Note        string           `json:"note,omitempty"`
+	From        *RowProvenance   `json:"from,omitempty"`
+	Quarantined []QuarantinedRow `json:"quarantined,omitempty"`
+	Inputs      []*ExplainNode   `json:"inputs,omitempty"`
+}
+
+// RowProvenance is the source row a dataset value was read from.
+type RowProvenance struct {
+	Dataset string     `json:"dataset"`
+	Object  string     `json:"object"`
+	Row     int        `json:"row"`
+	Date    string     `json:"date"`
+	KnownAt *time.Time `json:"known_at,omitempty"`
+}
+
+// Flags of an ExplainNode.
+const (
+	flagNull           = "null"             // the step reads as null
+	flagMissingRow     = "missing_row"      // the dataset has no row for the company-year
+	flagMissingValue   = "missing_value"    // the row has no value for the field
+	flagNotNumeric     = "not_numeric"      // a category or flag read by a numeric operation, so null
+	flagUnavailable    = "unavailable"      // the dataset failed to load
+	flagQuarantined    = "quarantined"      // rows of the company-year were quarantined
+	flagChanged        = "changed"          // change events were applied on top of the row
+	flagPartial        = "partial"          // sum skipped null inputs
+	flagFallback       = "fallback"         // or took its second input
+	flagDefault        = "default"          // lookup used its default for an unknown category
+	flagDivisionByZero = "division_by_zero" // divide by 0, which is null
+)
+
+func floatPtr(f float64) *float64 { return &f }
+
+// sourceRow finds the row behind a dataset's value at key: the latest accepted row of the
+// company-year in the object the snapshot's dataset was loaded from, as latestPerYear picks it.
+// patched reports change events on the company-year.
+func (s *Snapshot) sourceRow(dataset string, key CompanyYearKey) (object string, rec Record, patched, ok bool) {
+	patched = s.patched[dataset][key]
+	src, found := s.sources[dataset]
+	if !found {
+		return "", Record{}, patched, false
+	}
+	for _, r := range src.loaded.rows[key] {
+		if !ok || r.Date.After(rec.Date) || (r.Date.Equal(rec.Date) && r.KnownAt.After(rec.KnownAt)) {
+			rec, ok = r, true
+		}
+	}
+	return src.object, rec, patched, ok
+}
+
+// explainer builds the evaluation tree of one company from the results of a run over its keys.
+type explainer struct {
+	ctx      context.Context
+	cfg      *c.Config
+	snapshot *Snapshot
+	datasets map[string]Dataset
+	metrics  map[string]c.Metric
+	results  map[CompanyYearKey]map[string]float64
+	// ranked counts the non-null values of a metric's source by year, for pct_rank notes
+	ranked map[string]map[int]int
+}
+
+// Explain evaluates metrics (nil => every metric of the config) for the company-year against the
+// store's current snapshot and returns how each value came about.
+func Explain(ctx context.Context, scoreConfig *c.Config, store *DatasetStore, key CompanyYearKey, metrics []string) (*Explanation, error) {
+	snapshot := store.Snapshot()
+	if snapshot == nil {
+		return nil, errDatasetsNotLoaded
+	}
+	ex := &explainer{
+		ctx:      ctx,
+		cfg:      scoreConfig,
+		snapshot: snapshot,
+		datasets: scoreDatasets(snapshot),
+		metrics:  make(map[string]c.Metric, len(scoreConfig.Metrics)),
+		results:  make(map[CompanyYearKey]map[string]float64),
+		ranked:   make(map[string]map[int]int),
+	}
+	for _, metric := range scoreConfig.Metrics {
+		ex.metrics[metric.Name] = metric
+	}
+	if len(metrics) == 0 {
+		metrics = metricNames(scoreConfig)
+	}
+	for _, name := range metrics {
+		if _, ok := ex.metrics[name]; !ok {
+			return nil, fmt.Errorf("unknown metric %q", name)
+		}
+	}
+
+	found := false
+	for _, ds := range ex.datasets {
+		if _, found = ds[key]; found {
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("company %s in %d: %w", key.CompanyID, key.Year, errExplainNoData)
+	}
+
+	// every metric of every year of the company, so lags can be followed
+	rows, err := CalculateScoreFiltered(ctx, scoreConfig, snapshot, ScoreFilter{Companies: map[string]bool{key.CompanyID: true}})
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		ex.results[CompanyYearKey{CompanyID: row.CompanyID, Year: row.Year}] = row.Values
+	}
+
+	out := &Explanation{
+		Product:    scoreConfig.Name,
+		ConfigHash: configHash(scoreConfig),
+		Version:    snapshot.Version,
+		CompanyID:  key.CompanyID,
+		Year:       key.Year,
+	}
+	for _, name := range metrics {
+		node, err := ex.metric(name, key)
+		if err != nil {
+			return nil, err
+		}
+		out.Metrics = append(out.Metrics, node)
+	}
+	return out, nil
+}
+
+// metric explains a metric at key: its result from the run and the explanation of its inputs.
+func (ex *explainer) metric(name string, key CompanyYearKey) (*ExplainNode, error) {
+	metric := ex.metrics[name]
+	op := metric.Operation
+	node := &ExplainNode{Metric: name, Operation: op.Type, CompanyID: key.CompanyID, Year: key.Year}
+	if val, ok := ex.results[key][name]; ok {
+		node.Result = floatPtr(val)
+	}
+
+	at := key
+	if op.Type == "lag" {
+		at.Year -= lagPeriods(op)
+		node.Note = fmt.Sprintf("value of %d", at.Year)
+	}
+	for _, p := range op.Parameters {
+		var input *ExplainNode
+		switch {
+		case p.Source == "":
+			raw := ParseValue(p.Value)
+			input = &ExplainNode{CompanyID: at.CompanyID, Year: at.Year, Raw: &raw}
+			if num, ok := raw.Float(); ok {
+				input.Result = floatPtr(num)
+			}
+		case strings.HasPrefix(p.Source, "self."):
+			var err error
+			if input, err = ex.metric(strings.TrimPrefix(p.Source, "self."), at); err != nil {
+				return nil, err
+			}
+			input.Source = p.Source
+		default:
+			input = ex.source(p.Source, at, numericOperations[op.Type])
+		}
+		node.Inputs = append(node.Inputs, input)
+	}
+
+	switch op.Type {
+	case "sum":
+		for _, input := range node.Inputs {
+			if input.Result == nil && node.Result != nil {
+				node.Flags = append(node.Flags, flagPartial)
+				break
+			}
+		}
+	case "or":
+		if len(node.Inputs) >= 2 && node.Inputs[0].Result == nil && node.Inputs[1].Result != nil {
+			node.Flags = append(node.Flags, flagFallback)
+		}
+	case "divide":
+		if len(node.Inputs) >= 2 && node.Inputs[0].Result != nil && node.Inputs[1].Result != nil && *node.Inputs[1].Result == 0 {
+			node.Flags = append(node.Flags, flagDivisionByZero)
+		}
+	case "lookup", "map":
+		if len(node.Inputs) >= 1 && node.Inputs[0].Raw != nil && !node.Inputs[0].Raw.IsNull() && op.Default != nil {
+			if _, ok := op.Table[strings.ToLower(node.Inputs[0].Raw.String())]; !ok {
+				node.Flags = append(node.Flags, flagDefault)
+			}
+		}
+	case "pct_rank":
+		if len(op.Parameters) >= 1 {
+			n, err := ex.rankedValues(op.Parameters[0].Source, key.Year)
+			if err != nil {
+				return nil, err
+			}
+			node.Note = fmt.Sprintf("rank among %d values of %d", n, key.Year)
+		}
+	}
+	if node.Result == nil {
+		node.Flags = append(node.Flags, flagNull)
+	}
+	return node, nil
+}
+
+// source explains a dataset source at key: the raw cell, where it came from and how it reads.
+func (ex *explainer) source(source string, key CompanyYearKey, numeric bool) *ExplainNode {
+	node := &ExplainNode{Source: source, CompanyID: key.CompanyID, Year: key.Year, Raw: &Value{}}
+	alias, field, _ := strings.Cut(source, ".")
+	dataset := datasetAliases[alias]
+	if dataset == "" {
+		dataset = alias
+	}
+
+	if _, ok := ex.snapshot.Unavailable[dataset]; ok {
+		node.Flags = append(node.Flags, flagUnavailable)
+	}
+	row, ok := ex.datasets[alias][key]
+	if !ok {
+		node.Flags = append(node.Flags, flagMissingRow)
+	} else if v := row[field]; v.IsNull() {
+		node.Flags = append(node.Flags, flagMissingValue)
+	} else {
+		*node.Raw = v
+		if num, isNum := v.Float(); isNum {
+			node.Result = floatPtr(num)
+		} else if numeric {
+			node.Flags = append(node.Flags, flagNotNumeric)
+		}
+	}
+
+	if object, rec, patched, found := ex.snapshot.sourceRow(dataset, key); found {
+		node.From = &RowProvenance{Dataset: dataset, Object: object, Row: rec.Row, Date: rec.RawDate}
+		if !rec.KnownAt.IsZero() {
+			node.From.KnownAt = &rec.KnownAt
+		}
+		if patched {
+			node.Flags = append(node.Flags, flagChanged)
+		}
+	} else if patched {
+		node.Flags = append(node.Flags, flagChanged)
+	}
+	if ex.snapshot.Quality != nil {
+		for _, q := range ex.snapshot.Quality.Quarantine {
+			if q.Dataset != dataset || q.CompanyID != key.CompanyID {
+				continue
+			}
+			// rows quarantined for their date have none to match
+			if date, err := ParseDateOrYear(q.Date); err == nil && date.Year() == key.Year {
+				node.Quarantined = append(node.Quarantined, q)
+			}
+		}
+		if len(node.Quarantined) > 0 {
+			node.Flags = append(node.Flags, flagQuarantined)
+		}
+	}
+	if node.Result == nil && (numeric || node.Raw.IsNull()) {
+		node.Flags = append(node.Flags, flagNull)
+	}
+	return node
+}
+
+// rankedValues counts the non-null values of a pct_rank source in a year, i.e. what it ranks against.
+func (ex *explainer) rankedValues(source string, year int) (int, error) {
+	if n, ok := ex.ranked[source][year]; ok {
+		return n, nil
+	}
+	count := 0
+	if metric, ok := strings.CutPrefix(source, "self."); ok {
+		rows, err := CalculateScoreFiltered(ex.ctx, ex.cfg, ex.snapshot, ScoreFilter{Years: map[int]bool{year: true}, Metrics: []string{metric}})
+		if err != nil {
+			return 0, err
+		}
+		for _, row := range rows {
+			if _, ok := row.Values[metric]; ok {
+				count++
+			}
+		}
+	} else {
+		alias, field, _ := strings.Cut(source, ".")
+		for key, row := range ex.datasets[alias] {
+			if _, ok := row[field].Float(); ok && key.Year == year {
+				count++
+			}
+		}
+	}
+	if ex.ranked[source] == nil {
+		ex.ranked[source] = make(map[int]int)
+	}
+	ex.ranked[source][year] = count
+	return count, nil
+}
+
+// WriteText writes the explanation as an indented tree, one step per line.
+func (e *Explanation) WriteText(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("%s: company %s, %d (snapshot %d, config %s)\n", e.Product, e.CompanyID, e.Year, e.Version, e.ConfigHash[:min(12, len(e.ConfigHash))])
+	for _, node := range e.Metrics {
+		ew.printf("\n")
+		node.writeText(ew, 0, CompanyYearKey{CompanyID: e.CompanyID, Year: e.Year})
+	}
+	return ew.err
+}
+
+func (n *ExplainNode) writeText(ew *errWriter, depth int, at CompanyYearKey) {
+	label := n.Metric
+	switch {
+	case label == "" && n.Source != "":
+		label = n.Source
+	case label == "":
+		label = "value"
+	}
+	if n.Year != at.Year {
+		label += fmt.Sprintf(" @%d", n.Year)
+	}
+
+	value := "null"
+	switch {
+	case n.Result != nil:
+		value = strconv.FormatFloat(*n.Result, 'g', -1, 64)
+	case n.Raw != nil && n.Raw.Kind == KindString:
+		value = strconv.Quote(n.Raw.Str)
+	case n.Raw != nil && !n.Raw.IsNull():
+		value = n.Raw.String()
+	}
+	line := strings.Repeat("  ", depth) + label + " = " + value
+	if n.Operation != "" {
+		line += "  " + n.Operation
+	}
+	if n.From != nil {
+		line += fmt.Sprintf("  (%s row %d, %s)", path.Base(n.From.Object), n.From.Row, n.From.Date)
+	}
+	if len(n.Flags) > 0 {
+		line += "  [" + strings.Join(n.Flags, ", ") + "]"
+	}
+	if n.Note != "" {
+		line += "  " + n.Note
+	}
+	ew.printf("%s\n", line)
+	for _, q := range n.Quarantined {
+		ew.printf("%s! %s row %d quarantined by %s: %s\n", strings.Repeat("  ", depth+1), path.Base(q.Source), q.Row, q.Rule, q.Reason)
+	}
+	for _, input := range n.Inputs {
+		input.writeText(ew, depth+1, CompanyYearKey{CompanyID: n.CompanyID, Year: n.Year})
+	}
+}
+
+// ExplainHandler answers GET /explain?score=&company=&year=&metric= with the evaluation tree of
+// the metrics (comma-separated, default every metric) for the company-year, as JSON or with
+// ?format=text as an indented tree.
+func ExplainHandler(scoreConfig *c.Config, store *DatasetStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		if product := query.Get("score"); product != "" && product != scoreConfig.Name {
+			http.Error(w, fmt.Sprintf("unknown score %q", product), http.StatusBadRequest)
+			return
+		}
+		company := strings.TrimSpace(query.Get("company"))
+		if company == "" {
+			http.Error(w, "company is required", http.StatusBadRequest)
+			return
+		}
+		year, err := strconv.Atoi(query.Get("year"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid year %q", query.Get("year")), http.StatusBadRequest)
+			return
+		}
+		var metrics []string
+		for _, raw := range query["metric"] {
+			for _, part := range strings.Split(raw, ",") {
+				if part = strings.TrimSpace(part); part != "" {
+					metrics = append(metrics, part)
+				}
+			}
+		}
+		for _, name := range metrics {
+			if indexOf(metricNames(scoreConfig), name) < 0 {
+				http.Error(w, fmt.Sprintf("unknown metric %q", name), http.StatusBadRequest)
+				return
+			}
+		}
+		format := query.Get("format")
+		if format != "" && format != "json" && format != "text" {
+			http.Error(w, fmt.Sprintf("unknown format %q, expected json or text", format), http.StatusBadRequest)
+			return
+		}
+
+		explanation, err := Explain(r.Context(), scoreConfig, store, CompanyYearKey{CompanyID: company, Year: year}, metrics)
+		switch {
+		case errors.Is(err, errDatasetsNotLoaded):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		case errors.Is(err, errExplainNoData):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("Error: %v", err), scoreErrorStatus(err))
+			return
+		}
+
+		if format == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			explanation.WriteText(w)
+			return
+		}
+		writeJSON(w, explanation)
+	}
+}
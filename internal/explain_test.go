@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+func newExplainFixture(t *testing.T) *DatasetStore {
+	dir := t.TempDir()
+	writePartitionFixture(t, dir)
+	quality := &c.QualityConfig{Datasets: []c.DatasetRules{{Name: "emissions_data", NonNegative: []string{"emi_1"}}}}
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), quality), FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	return store
+}
+
+func TestExplain(t *testing.T) {
+	store := newExplainFixture(t)
+	cfg := crossSectionalConfig()
+
+	// 5000 has no waste in 2022, a restated emissions row and a dis_1 that is not a number
+	e, err := Explain(context.Background(), cfg, store, CompanyYearKey{CompanyID: "5000", Year: 2022}, []string{"growth", "gri", "weighted"})
+	require.NoError(t, err)
+	assert.Equal(t, "cross_sectional", e.Product)
+	assert.Equal(t, configHash(cfg), e.ConfigHash)
+	require.Len(t, e.Metrics, 3)
+
+	want, err := CalculateScoreFiltered(context.Background(), cfg, store.Snapshot(), ScoreFilter{Companies: map[string]bool{"5000": true}, Years: map[int]bool{2022: true}})
+	require.NoError(t, err)
+	for _, node := range e.Metrics {
+		if val, ok := want[0].Values[node.Metric]; ok {
+			require.NotNil(t, node.Result, node.Metric)
+			assert.Equal(t, val, *node.Result, "the engine's result")
+		}
+	}
+
+	growth := e.Metrics[0]
+	assert.Equal(t, "divide", growth.Operation)
+	require.Len(t, growth.Inputs, 2)
+	total, prev := growth.Inputs[0], growth.Inputs[1]
+	assert.Equal(t, "total", total.Metric)
+	assert.Equal(t, 126.0, *total.Result)
+	assert.Equal(t, []string{flagPartial}, total.Flags)
+	waste, emissions := total.Inputs[0], total.Inputs[1]
+	assert.Equal(t, "waste.wst_1", waste.Source)
+	assert.Nil(t, waste.Result)
+	assert.Equal(t, []string{flagMissingRow, flagNull}, waste.Flags)
+	assert.Nil(t, waste.From)
+	assert.Equal(t, NumberValue(126), *emissions.Raw)
+	require.NotNil(t, emissions.From)
+	assert.Equal(t, RowProvenance{Dataset: "emissions_data", Object: "emissions_data.csv", Row: 7, Date: "2022-12-31", KnownAt: emissions.From.KnownAt}, *emissions.From)
+	require.NotNil(t, emissions.From.KnownAt)
+	assert.Equal(t, "2024-06-01", emissions.From.KnownAt.Format(dateLayout), "the restated row")
+
+	assert.Equal(t, "lag", prev.Operation)
+	assert.Equal(t, "value of 2021", prev.Note)
+	assert.Equal(t, 125.0, *prev.Result)
+	require.Len(t, prev.Inputs, 1)
+	assert.Equal(t, 2021, prev.Inputs[0].Year)
+	assert.Equal(t, 125.0, *prev.Inputs[0].Result)
+
+	gri := e.Metrics[1]
+	assert.Equal(t, 1.0, *gri.Result)
+	assert.Equal(t, StringValue("gri"), *gri.Inputs[0].Raw)
+	assert.Empty(t, gri.Inputs[0].Flags, "a category is not null for eq")
+	assert.Equal(t, StringValue("gri"), *gri.Inputs[1].Raw)
+
+	weighted := e.Metrics[2]
+	assert.Equal(t, []string{flagPartial}, weighted.Flags)
+	assert.Contains(t, weighted.Inputs[0].Note, "rank among")
+	assert.Equal(t, StringValue("oops"), *weighted.Inputs[1].Raw)
+	assert.Equal(t, []string{flagNotNumeric, flagNull}, weighted.Inputs[1].Flags)
+
+	// 5013's only emissions row of 2023 is negative
+	e, err = Explain(context.Background(), cfg, store, CompanyYearKey{CompanyID: "5013", Year: 2023}, []string{"total"})
+	require.NoError(t, err)
+	emissions = e.Metrics[0].Inputs[1]
+	assert.Equal(t, []string{flagMissingRow, flagQuarantined, flagNull}, emissions.Flags)
+	require.Len(t, emissions.Quarantined, 1)
+	assert.Equal(t, "emi_1", emissions.Quarantined[0].Field)
+
+	_, err = Explain(context.Background(), cfg, store, CompanyYearKey{CompanyID: "5000", Year: 2019}, nil)
+	assert.ErrorIs(t, err, errExplainNoData)
+}
+
+func TestSnapshotSourceRow(t *testing.T) {
+	store := newExplainFixture(t)
+	before := store.Snapshot()
+	key := CompanyYearKey{CompanyID: "5000", Year: 2022}
+
+	// the provenance is the captured snapshot's, whatever the store publishes after it
+	store.ApplyChanges([]ChangeEvent{{Op: ChangeUpdate, Dataset: "emissions_data", CompanyID: "5000", Date: mustDate(t, "2022-12-31"), Field: "emi_1", Value: NumberValue(1)}})
+	for snapshot, patched := range map[*Snapshot]bool{before: false, store.Snapshot(): true} {
+		object, rec, gotPatched, ok := snapshot.sourceRow("emissions_data", key)
+		require.True(t, ok)
+		assert.Equal(t, "emissions_data.csv", object)
+		assert.Equal(t, 7, rec.Row)
+		assert.Equal(t, patched, gotPatched)
+	}
+	_, _, patched, ok := store.Snapshot().sourceRow("waste_data", key)
+	assert.False(t, ok, "no waste row")
+	assert.False(t, patched)
+
+	// a quarantined row matches the year of its date, not a prefix of it
+	before.Quality.Quarantine = append(before.Quality.Quarantine,
+		QuarantinedRow{Dataset: "emissions_data", CompanyID: "5000", Date: "2022", Rule: "r"},
+		QuarantinedRow{Dataset: "emissions_data", CompanyID: "5000", Date: "20221", Rule: "r"})
+	ex := &explainer{snapshot: before, datasets: scoreDatasets(before)}
+	node := ex.source("emissions.emi_1", key, true)
+	require.Len(t, node.Quarantined, 1)
+	assert.Equal(t, "2022", node.Quarantined[0].Date)
+}
+
+func TestExplainHandler(t *testing.T) {
+	handler := ExplainHandler(crossSectionalConfig(), newExplainFixture(t))
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := get("/explain?score=cross_sectional&company=5001&year=2023")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var e Explanation
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &e))
+	assert.Len(t, e.Metrics, len(crossSectionalConfig().Metrics))
+
+	rec = get("/explain?company=5000&year=2022&metric=total&format=text")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "\ntotal = 126  sum  [partial]\n"+
+		"  waste.wst_1 = null  [missing_row, null]\n"+
+		"  emissions.emi_1 = 126  (emissions_data.csv row 7, 2022-12-31)\n")
+
+	for target, want := range map[string]int{
+		"/explain?company=5000&year=2019":             http.StatusNotFound,
+		"/explain?company=5000":                       http.StatusBadRequest,
+		"/explain?year=2022":                          http.StatusBadRequest,
+		"/explain?company=5000&year=2022&metric=nope": http.StatusBadRequest,
+		"/explain?company=5000&year=2022&score=nope":  http.StatusBadRequest,
+		"/explain?company=5000&year=2022&format=yaml": http.StatusBadRequest,
+	} {
+		assert.Equal(t, want, get(target).Code, target)
+	}
+}
@@ -0,0 +1,348 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// ScoreFilter narrows a score request down to some company-years and metrics. The zero value
+// keeps everything.
+type ScoreFilter struct {
+	// Companies are the company IDs to keep; nil => every company
+	Companies map[string]bool
+	// Years are the years to keep; nil => every year
+	Years map[int]bool
+	// FromYear and ToYear bound the years (inclusive); 0 => unbounded
+	FromYear, ToYear int
+	// Metrics are the metrics to return, in config order; nil => every metric
+	Metrics []string
+}
+
+// ParseScoreFilter reads company=, year=, from_year=, to_year= and metrics= from a query. company,
+// year and metrics take comma-separated lists and can be repeated. Metrics must be metrics of the
+// config.
+func ParseScoreFilter(query url.Values, scoreConfig *c.Config) (ScoreFilter, error) {
+	var f ScoreFilter
+	list := func(name string) []string {
+		var out []string
+		for _, raw := range query[name] {
+			for _, part := range strings.Split(raw, ",") {
+				if part = strings.TrimSpace(part); part != "" {
+					out = append(out, part)
+				}
+			}
+		}
+		return out
+	}
+	year := func(name, raw string) (int, error) {
+		y, err := strconv.Atoi(raw)
+		if err != nil || y <= 0 {
+			return 0, fmt.Errorf("invalid %s %q, expected a year", name, raw)
+		}
+		return y, nil
+	}
+
+	for _, id := range list("company") {
+		if f.Companies == nil {
+			f.Companies = make(map[string]bool)
+		}
+		f.Companies[id] = true
+	}
+	for _, raw := range list("year") {
+		y, err := year("year", raw)
+		if err != nil {
+			return f, err
+		}
+		if f.Years == nil {
+			f.Years = make(map[int]bool)
+		}
+		f.Years[y] = true
+	}
+	var err error
+	if raw := query.Get("from_year"); raw != "" {
+		if f.FromYear, err = year("from_year", raw); err != nil {
+			return f, err
+		}
+	}
+	if raw := query.Get("to_year"); raw != "" {
+		if f.ToYear, err = year("to_year", raw); err != nil {
+			return f, err
+		}
+	}
+	if f.FromYear != 0 && f.ToYear != 0 && f.FromYear > f.ToYear {
+		return f, fmt.Errorf("from_year %d is after to_year %d", f.FromYear, f.ToYear)
+	}
+
+	if requested := list("metrics"); requested != nil {
+		names := metricNames(scoreConfig)
+		for _, name := range requested {
+			if !slices.Contains(names, name) {
+				return f, fmt.Errorf("unknown metric %q", name)
+			}
+		}
+		for _, name := range names {
+			if slices.Contains(requested, name) {
+				f.Metrics = append(f.Metrics, name)
+			}
+		}
+	}
+	return f, nil
+}
+
+// IsZero reports whether the filter keeps everything.
+func (f ScoreFilter) IsZero() bool {
+	return f.Companies == nil && f.Years == nil && f.FromYear == 0 && f.ToYear == 0 && f.Metrics == nil
+}
+
+// filtersKeys reports whether the filter drops any company-year.
+func (f ScoreFilter) filtersKeys() bool {
+	return f.Companies != nil || f.Years != nil || f.FromYear != 0 || f.ToYear != 0
+}
+
+// Match reports whether the filter keeps key.
+func (f ScoreFilter) Match(key CompanyYearKey) bool {
+	if f.Companies != nil && !f.Companies[key.CompanyID] {
+		return false
+	}
+	if f.Years != nil && !f.Years[key.Year] {
+		return false
+	}
+	if f.FromYear != 0 && key.Year < f.FromYear {
+		return false
+	}
+	return f.ToYear == 0 || key.Year <= f.ToYear
+}
+
+// Output is the config with only the metrics the filter returns; it describes the columns of the
+// output (sort fields, formats).
+func (f ScoreFilter) Output(scoreConfig *c.Config) *c.Config {
+	if f.Metrics == nil {
+		return scoreConfig
+	}
+	out := &c.Config{Name: scoreConfig.Name}
+	for _, metric := range scoreConfig.Metrics {
+		if slices.Contains(f.Metrics, metric.Name) {
+			out.Metrics = append(out.Metrics, metric)
+		}
+	}
+	return out
+}
+
+// Apply keeps the rows and metrics of the filter. Rows are copied only when metrics are dropped.
+func (f ScoreFilter) Apply(rows ScoreRows) ScoreRows {
+	if f.IsZero() {
+		return rows
+	}
+	out := make(ScoreRows, 0, len(rows))
+	for _, row := range rows {
+		if !f.Match(row.Key()) {
+			continue
+		}
+		row.Values = f.project(row.Values)
+		out = append(out, row)
+	}
+	return out
+}
+
+// project keeps the values of the filter's metrics.
+func (f ScoreFilter) project(values map[string]float64) map[string]float64 {
+	if f.Metrics == nil {
+		return values
+	}
+	out := make(map[string]float64, len(f.Metrics))
+	for _, name := range f.Metrics {
+		if val, ok := values[name]; ok {
+			out[name] = val
+		}
+	}
+	return out
+}
+
+// projectMetrics returns the config with only the metrics of names and the metrics they read
+// (self.<metric>, transitively), in config order.
+func projectMetrics(scoreConfig *c.Config, names []string) *c.Config {
+	needed := make(map[string]bool, len(names))
+	for _, name := range names {
+		needed[name] = true
+	}
+	// a metric can only read metrics defined before it (validation), so one backward pass is enough
+	for i := len(scoreConfig.Metrics) - 1; i >= 0; i-- {
+		metric := scoreConfig.Metrics[i]
+		if !needed[metric.Name] {
+			continue
+		}
+		for _, p := range metric.Operation.Parameters {
+			if dep, ok := strings.CutPrefix(p.Source, "self."); ok {
+				needed[dep] = true
+			}
+		}
+	}
+	out := &c.Config{Name: scoreConfig.Name}
+	for _, metric := range scoreConfig.Metrics {
+		if needed[metric.Name] {
+			out.Metrics = append(out.Metrics, metric)
+		}
+	}
+	return out
+}
+
+// neededKeys works out, for every metric, the keys at which it has to be computed so that the
+// metrics of targets can be: the reverse of affectedKeys.
+//   - self.<metric>: the keys needed for the metric reading it
+//   - lag: the keys needed, moved `periods` years earlier
+//   - pct_rank (and other cross-key operations): every key of a year that is needed, since a rank
+//     depends on every company of its year
+func neededKeys(cfg *c.Config, targets map[string]keySet, keysByYear map[int][]CompanyYearKey) map[string]keySet {
+	needed := make(map[string]keySet, len(cfg.Metrics))
+	for name, keys := range targets {
+		needed[name] = make(keySet, len(keys))
+		needed[name].addAll(keys)
+	}
+
+	for i := len(cfg.Metrics) - 1; i >= 0; i-- {
+		metric := cfg.Metrics[i]
+		keys := needed[metric.Name]
+		if len(keys) == 0 {
+			continue
+		}
+		for _, p := range metric.Operation.Parameters {
+			dep, ok := strings.CutPrefix(p.Source, "self.")
+			if !ok {
+				continue // dataset columns are always there
+			}
+			if needed[dep] == nil {
+				needed[dep] = make(keySet)
+			}
+			_, crossKey := crossKeyOperations[metric.Operation.Type]
+			switch {
+			case metric.Operation.Type == "lag":
+				periods := lagPeriods(metric.Operation)
+				for key := range keys {
+					needed[dep][CompanyYearKey{CompanyID: key.CompanyID, Year: key.Year - periods}] = true
+				}
+			case crossKey:
+				years := make(map[int]bool)
+				for key := range keys {
+					years[key.Year] = true
+				}
+				for year := range years {
+					for _, key := range keysByYear[year] {
+						needed[dep][key] = true
+					}
+				}
+			default:
+				needed[dep].addAll(keys)
+			}
+		}
+	}
+	return needed
+}
+
+// CalculateScoreFiltered computes the scores of the filter only: the metrics it returns and the
+// ones they read, at the company-years it keeps and the ones those read (earlier years for lag,
+// the other companies of the year for pct_rank). The rows are the ones CalculateScore would return,
+// filtered.
+func CalculateScoreFiltered(
+	ctx context.Context,
+	scoreConfig *c.Config,
+	snapshot *Snapshot,
+	filter ScoreFilter,
+) (ScoreRows, error) {
+	if filter.IsZero() {
+		return CalculateScore(ctx, scoreConfig, snapshot)
+	}
+	results, err := scoreFiltered(ctx, scoreConfig, snapshot, filter)
+	if err != nil {
+		return nil, err
+	}
+	return filter.Apply(newScoreRows(results)), nil
+}
+
+// EmitScoresFiltered runs CalculateScoreFiltered and hands its rows to emit by company and year,
+// straight from the run's results instead of collecting them first. An error from emit stops it.
+func EmitScoresFiltered(
+	ctx context.Context,
+	scoreConfig *c.Config,
+	snapshot *Snapshot,
+	filter ScoreFilter,
+	emit func(CompanyYearKey, map[string]float64) error,
+) error {
+	results, err := scoreFiltered(ctx, scoreConfig, snapshot, filter)
+	if err != nil {
+		return err
+	}
+	for _, key := range snapshot.Columns().Keys() { // by company and year
+		values, ok := results[key]
+		if !ok || !filter.Match(key) {
+			continue
+		}
+		if err := emit(key, filter.project(values)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scoreFiltered computes the results behind CalculateScoreFiltered: the company-years some metric
+// of the filter needs, the ones it drops partial. With the zero filter it is every company-year.
+func scoreFiltered(
+	ctx context.Context,
+	scoreConfig *c.Config,
+	snapshot *Snapshot,
+	filter ScoreFilter,
+) (map[CompanyYearKey]map[string]float64, error) {
+	tracer := otel.Tracer("score-app")
+	ctx, span := tracer.Start(ctx, "CalculateScoreFiltered")
+	defer span.End()
+
+	// the whole config is validated, so a projection fails the way the full run would; the field
+	// kinds come from the columns rather than from a walk of every row
+	cols := snapshot.Columns()
+	if err := validateScoreConfigKinds(scoreConfig, cols.fieldKinds()); err != nil {
+		return nil, fmt.Errorf("invalid score config %s: %w", scoreConfig.Name, err)
+	}
+	if filter.IsZero() {
+		return computeScores(ctx, scoreConfig, cols, nil, nil, workerCount(snapshot.workers))
+	}
+
+	output := filter.Output(scoreConfig)
+	cfg := projectMetrics(scoreConfig, metricNames(output))
+
+	keysByYear := make(map[int][]CompanyYearKey)
+	kept := make(keySet)
+	for _, key := range cols.Keys() {
+		keysByYear[key.Year] = append(keysByYear[key.Year], key)
+		if filter.Match(key) {
+			kept[key] = true
+		}
+	}
+	targets := make(map[string]keySet, len(output.Metrics))
+	for _, metric := range output.Metrics {
+		targets[metric.Name] = kept
+	}
+	needed := neededKeys(cfg, targets, keysByYear)
+
+	// rows only for the keys some metric is computed at (stages skip the keys without one); lag
+	// can ask for years the columns don't have
+	results := make(map[CompanyYearKey]map[string]float64, len(kept))
+	for _, keys := range needed {
+		for key := range keys {
+			if _, ok := results[key]; !ok && cols.has(key) {
+				results[key] = map[string]float64{}
+			}
+		}
+	}
+
+	if err := runStages(ctx, planStages(cfg), cols, results, needed, nil, workerCount(snapshot.workers)); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+func TestParseScoreFilter(t *testing.T) {
+	cfg := crossSectionalConfig()
+	parse := func(raw string) (ScoreFilter, error) {
+		query, err := url.ParseQuery(raw)
+		require.NoError(t, err)
+		return ParseScoreFilter(query, cfg)
+	}
+
+	f, err := parse("")
+	require.NoError(t, err)
+	assert.True(t, f.IsZero())
+
+	f, err = parse("company=5001,5002&company=5003&year=2021,2023&from_year=2022&metrics=weighted,total")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"5001": true, "5002": true, "5003": true}, f.Companies)
+	assert.Equal(t, []string{"total", "weighted"}, f.Metrics, "config order")
+	assert.True(t, f.Match(CompanyYearKey{"5002", 2023}))
+	assert.False(t, f.Match(CompanyYearKey{"5002", 2021}), "before from_year")
+	assert.False(t, f.Match(CompanyYearKey{"5002", 2022}), "not a year asked for")
+	assert.False(t, f.Match(CompanyYearKey{"5004", 2023}))
+	assert.Equal(t, []string{"total", "weighted"}, metricNames(f.Output(cfg)))
+
+	for raw, want := range map[string]string{
+		"year=last":                   `invalid year "last"`,
+		"from_year=2024&to_year=2020": "from_year 2024 is after to_year 2020",
+		"metrics=total,nope":          `unknown metric "nope"`,
+		"to_year=-1":                  `invalid to_year "-1"`,
+	} {
+		_, err := parse(raw)
+		assert.ErrorContains(t, err, want, raw)
+	}
+}
+
+func TestProjectMetrics(t *testing.T) {
+	cfg := crossSectionalConfig()
+	assert.Equal(t, []string{"total", "gri", "total_rank", "weighted"}, metricNames(projectMetrics(cfg, []string{"weighted", "gri"})))
+	assert.Equal(t, []string{"total", "prev_total", "growth"}, metricNames(projectMetrics(cfg, []string{"growth"})))
+	assert.Equal(t, []string{"waste_rank"}, metricNames(projectMetrics(cfg, []string{"waste_rank"})))
+}
+
+func TestCalculateScoreFilteredMatchesFull(t *testing.T) {
+	dir := t.TempDir()
+	writePartitionFixture(t, dir)
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	snapshot := store.Snapshot()
+
+	cfg := crossSectionalConfig()
+	cfg.Metrics = append(cfg.Metrics, c.Metric{Name: "prev_growth", Operation: c.Operation{Type: "lag", Periods: 2,
+		Parameters: []c.Parameter{{Source: "self.growth"}}}})
+	full, err := CalculateScore(context.Background(), cfg, snapshot)
+	require.NoError(t, err)
+
+	for _, raw := range []string{
+		"",
+		"company=5001",
+		"company=5001,5040&year=2023",
+		"year=2022",
+		"from_year=2022&to_year=2023",
+		"to_year=2021",
+		"metrics=growth",
+		"metrics=prev_growth&year=2023",
+		"metrics=weighted&company=5007", // pct_rank of a computed value, for one company
+		"metrics=waste_rank,gri&company=5003&from_year=2021",
+		"company=nope",
+	} {
+		query, err := url.ParseQuery(raw)
+		require.NoError(t, err)
+		filter, err := ParseScoreFilter(query, cfg)
+		require.NoError(t, err)
+
+		got, err := CalculateScoreFiltered(context.Background(), cfg, snapshot, filter)
+		require.NoError(t, err, raw)
+		assert.Equal(t, filter.Apply(full), got, raw)
+
+		// the same rows, handed over one by one
+		emitted := ScoreRows{}
+		require.NoError(t, EmitScoresFiltered(context.Background(), cfg, snapshot, filter, func(key CompanyYearKey, values map[string]float64) error {
+			emitted = append(emitted, ScoredRow{CompanyID: key.CompanyID, Year: key.Year, Values: values})
+			return nil
+		}), raw)
+		assert.Equal(t, filter.Apply(full), emitted, raw)
+	}
+}
+
+func TestCalculateScoreFilteredPushdown(t *testing.T) {
+	// 50 companies (100000...), 2000-2004
+	datasets := syntheticDatasets(50, 5, 1)
+	snapshot := &Snapshot{Datasets: map[string]Dataset{}}
+	for alias, name := range datasetAliases {
+		snapshot.Datasets[name] = datasets[alias]
+	}
+
+	// counts the keys each metric is evaluated at
+	var calls = map[string]*atomic.Int64{"a": {}, "b": {}, "other": {}}
+	operations["test_count"] = func(ctx context.Context, m *planMetric, slot int, f *frame) (float64, bool) {
+		calls[m.Operation.Parameters[0].Param].Add(1)
+		return 1, false
+	}
+	defer delete(operations, "test_count")
+	counted := func(name string) c.Metric {
+		return c.Metric{Name: name, Operation: c.Operation{Type: "test_count", Parameters: []c.Parameter{{Source: "waste.was_0", Param: name}}}}
+	}
+	cfg := &c.Config{Name: "pushdown", Metrics: []c.Metric{
+		counted("a"),
+		{Name: "prev_a", Operation: c.Operation{Type: "lag", Parameters: []c.Parameter{{Source: "self.a"}}}},
+		counted("b"),
+		{Name: "b_rank", Operation: c.Operation{Type: "pct_rank", Parameters: []c.Parameter{{Source: "self.b"}}}},
+		counted("other"),
+	}}
+	run := func(raw string) ScoreRows {
+		for _, n := range calls {
+			n.Store(0)
+		}
+		query, err := url.ParseQuery(raw)
+		require.NoError(t, err)
+		filter, err := ParseScoreFilter(query, cfg)
+		require.NoError(t, err)
+		rows, err := CalculateScoreFiltered(context.Background(), cfg, snapshot, filter)
+		require.NoError(t, err)
+		return rows
+	}
+
+	// lag reads the year before: "a" is only needed there
+	rows := run("company=100000&year=2001&metrics=prev_a")
+	require.Len(t, rows, 1)
+	assert.Equal(t, map[string]float64{"prev_a": 1}, rows[0].Values)
+	assert.Equal(t, int64(1), calls["a"].Load())
+	assert.Zero(t, calls["b"].Load())
+	assert.Zero(t, calls["other"].Load())
+
+	// pct_rank reads every company of the year
+	run("company=100000&year=2000&metrics=b_rank")
+	assert.Equal(t, int64(50), calls["b"].Load())
+	assert.Zero(t, calls["a"].Load())
+
+	// per-key metrics: only the keys asked for
+	run("company=100000")
+	assert.Equal(t, int64(5), calls["other"].Load())
+
+	// and only those have a row of results
+	filter, err := ParseScoreFilter(url.Values{"company": {"100000"}, "metrics": {"other"}}, cfg)
+	require.NoError(t, err)
+	results, err := scoreFiltered(context.Background(), cfg, snapshot, filter)
+	require.NoError(t, err)
+	assert.Len(t, results, 5)
+}
+
+func TestCalculateScoreHandlerFilter(t *testing.T) {
+	dir := t.TempDir()
+	writePartitionFixture(t, dir)
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	handler := CalculateScoreHandler(context.Background(), crossSectionalConfig(), store, nil)
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	// computed with pushdown, then served from the cache once it holds the snapshot's scores
+	const target = "/run-scores?company=5001,5002&from_year=2022&metrics=total,gri&sort=-total"
+	pushed := get(target)
+	require.Equal(t, http.StatusOK, pushed.Code)
+	assert.Equal(t, http.StatusOK, get("/run-scores").Code)
+	cached := get(target)
+	assert.Equal(t, pushed.Body.String(), cached.Body.String())
+	assert.Equal(t, "company,year,total,gri\n5001,2022,36.00,1.00\n5001,2023,35.00,1.00\n5002,2023,4.00,1.00\n5002,2022,-2.00,1.00\n", pushed.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, get("/run-scores?metrics=nope").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/run-scores?metrics=total&sort=gri").Code, "sort by a metric that is not returned")
+}
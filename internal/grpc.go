@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+	"esgbook-software-engineer-technical-test-2024/scorepb"
+)
+
+// GRPCServer is the gRPC score service (scorepb.ScoreService). It scores with the same engine and
+// the same dataset store as the HTTP handlers, and stores its score runs the same way.
+type GRPCServer struct {
+	scorepb.UnimplementedScoreServiceServer
+	store   *DatasetStore
+	runs    RunStore
+	configs []*c.Config
+}
+
+// NewGRPCServer serves the score configs, the first one being the default product, and stores the
+// runs in runs (nil => not stored).
+func NewGRPCServer(store *DatasetStore, runs RunStore, configs ...*c.Config) *GRPCServer {
+	return &GRPCServer{store: store, runs: runs, configs: configs}
+}
+
+// ServeGRPC serves the score service on lis, with the standard health and reflection services,
+// until ctx is done; it then reports NOT_SERVING and stops gracefully.
+func ServeGRPC(ctx context.Context, lis net.Listener, srv *GRPCServer, opts ...grpc.ServerOption) error {
+	s := grpc.NewServer(opts...)
+	scorepb.RegisterScoreServiceServer(s, srv)
+	hs := health.NewServer()
+	hs.SetServingStatus(scorepb.ScoreService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, hs)
+	reflection.Register(s)
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			hs.Shutdown()
+			s.GracefulStop()
+		case <-stopped:
+		}
+	}()
+	return s.Serve(lis)
+}
+
+// product finds a config by name; no name is the default product.
+func (g *GRPCServer) product(name string) (*c.Config, error) {
+	if name == "" && len(g.configs) > 0 {
+		return g.configs[0], nil
+	}
+	for _, cfg := range g.configs {
+		if cfg.Name == name {
+			return cfg, nil
+		}
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "unknown product %q", name)
+}
+
+// snapshot is the store's current snapshot, Unavailable before the datasets are loaded.
+func (g *GRPCServer) snapshot() (*Snapshot, error) {
+	snapshot := g.store.Snapshot()
+	if snapshot == nil {
+		return nil, status.Error(codes.Unavailable, errDatasetsNotLoaded.Error())
+	}
+	return snapshot, nil
+}
+
+// grpcError turns an error of a score run into a status, as scoreErrorStatus does for HTTP.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, errDatasetsNotLoaded):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, errExplainNoData):
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Errorf(codes.Internal, "Error: %v", err)
+}
+
+func (g *GRPCServer) ListProducts(ctx context.Context, req *scorepb.ListProductsRequest) (*scorepb.ListProductsResponse, error) {
+	resp := &scorepb.ListProductsResponse{}
+	for _, cfg := range g.configs {
+		product := &scorepb.Product{Name: cfg.Name, ConfigHash: configHash(cfg)}
+		for i, f := range metricFormats(cfg, false) {
+			product.Metrics = append(product.Metrics, &scorepb.Metric{
+				Name:      f.Name,
+				Operation: cfg.Metrics[i].Operation.Type,
+				Unit:      f.Unit,
+				Precision: int32(*f.Precision),
+				Rounding:  string(f.Rounding),
+				Scale:     f.Scale,
+			})
+		}
+		resp.Products = append(resp.Products, product)
+	}
+	return resp, nil
+}
+
+// ValidateConfig checks a config like POST /preview does, without scoring it. A config that does
+// not parse is an InvalidArgument; one that doesn't validate is a response with valid=false.
+func (g *GRPCServer) ValidateConfig(ctx context.Context, req *scorepb.ValidateConfigRequest) (*scorepb.ValidateConfigResponse, error) {
+	if req.Format != "" && req.Format != "yaml" && req.Format != "json" {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown format %q, expected yaml or json", req.Format)
+	}
+	if len(req.Config) > maxPreviewConfigSize {
+		return nil, status.Errorf(codes.InvalidArgument, "config is larger than %d bytes", maxPreviewConfigSize)
+	}
+	scoreConfig, err := c.ParseScoreConfig([]byte(req.Config), req.Format)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(scoreConfig.Metrics) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "config has no metrics")
+	}
+	snapshot, err := g.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	resp := &scorepb.ValidateConfigResponse{Name: scoreConfig.Name, ConfigHash: configHash(scoreConfig)}
+	resp.Warnings, resp.Errors = checkConfigReport(scoreConfig, snapshot)
+	resp.Valid = len(resp.Errors) == 0
+	return resp, nil
+}
+
+// Score streams the rows of a product as the run hands them over; the run ID is sent in the
+// x-run-id header with the first row. A run that fails before it gets an error status.
+func (g *GRPCServer) Score(req *scorepb.ScoreRequest, stream grpc.ServerStreamingServer[scorepb.ScoreRow]) error {
+	scoreConfig, err := g.product(req.Product)
+	if err != nil {
+		return err
+	}
+	filters := JobFilters{Company: req.Companies, FromYear: int(req.FromYear), ToYear: int(req.ToYear), Metrics: req.Metrics}
+	for _, year := range req.Years {
+		filters.Year = append(filters.Year, int(year))
+	}
+	query := filters.query()
+	filter, err := ParseScoreFilter(query, scoreConfig)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	snapshot, err := g.snapshot()
+	if err != nil {
+		return err
+	}
+
+	runID := uuid.NewString()
+	rec := newRunRecorder(g.runs, runID, "grpc", query.Encode(), scoreConfig, filter)
+	rec.setSnapshot(snapshot)
+
+	formats := metricFormats(filter.Output(scoreConfig), req.FullPrecision)
+	started := false
+	err = EmitScoresFiltered(stream.Context(), scoreConfig, snapshot, filter, func(key CompanyYearKey, values map[string]float64) error {
+		if !started {
+			started = true
+			if err := stream.SendHeader(metadata.Pairs("x-run-id", runID)); err != nil {
+				return err
+			}
+		}
+		row := ScoredRow{CompanyID: key.CompanyID, Year: key.Year, Values: values}
+		rec.add(row)
+		out := &scorepb.ScoreRow{CompanyId: row.CompanyID, Year: int32(row.Year), Values: make(map[string]float64, len(formats))}
+		for _, f := range formats {
+			if val, ok := cellValue(row, f.Name); ok {
+				out.Values[f.Name] = f.Value(val)
+			}
+		}
+		return stream.Send(out)
+	})
+	if err == nil && !started {
+		err = stream.SendHeader(metadata.Pairs("x-run-id", runID)) // no rows at all
+	}
+	rec.finish(err)
+	if err != nil && !started {
+		return grpcError(err)
+	}
+	return err
+}
+
+func (g *GRPCServer) Explain(ctx context.Context, req *scorepb.ExplainRequest) (*scorepb.ExplainResponse, error) {
+	scoreConfig, err := g.product(req.Product)
+	if err != nil {
+		return nil, err
+	}
+	if req.CompanyId == "" {
+		return nil, status.Error(codes.InvalidArgument, "company_id is required")
+	}
+	for _, name := range req.Metrics {
+		if indexOf(metricNames(scoreConfig), name) < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown metric %q", name)
+		}
+	}
+	e, err := Explain(ctx, scoreConfig, g.store, CompanyYearKey{CompanyID: req.CompanyId, Year: int(req.Year)}, req.Metrics)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &scorepb.ExplainResponse{
+		Product:         e.Product,
+		ConfigHash:      e.ConfigHash,
+		SnapshotVersion: e.Version,
+		CompanyId:       e.CompanyID,
+		Year:            int32(e.Year),
+	}
+	for _, node := range e.Metrics {
+		resp.Metrics = append(resp.Metrics, explainNodeProto(node))
+	}
+	return resp, nil
+}
+
+func explainNodeProto(n *ExplainNode) *scorepb.ExplainNode {
+	out := &scorepb.ExplainNode{
+		Metric:    n.Metric,
+		Operation: n.Operation,
+		Source:    n.Source,
+		CompanyId: n.CompanyID,
+		Year:      int32(n.Year),
+		Result:    n.Result,
+		Flags:     n.Flags,
+		Note:      n.Note,
+	}
+	if n.Raw != nil {
+		out.Raw = typedValueProto(*n.Raw)
+	}
+	if n.From != nil {
+		out.From = &scorepb.RowProvenance{Dataset: n.From.Dataset, Object: n.From.Object, Row: int32(n.From.Row), Date: n.From.Date}
+		if n.From.KnownAt != nil {
+			out.From.KnownAt = n.From.KnownAt.Format(time.RFC3339Nano)
+		}
+	}
+	for _, q := range n.Quarantined {
+		out.Quarantined = append(out.Quarantined, &scorepb.QuarantinedRow{Source: q.Source, Row: int32(q.Row), Date: q.Date, Rule: q.Rule, Field: q.Field, Reason: q.Reason})
+	}
+	for _, input := range n.Inputs {
+		out.Inputs = append(out.Inputs, explainNodeProto(input))
+	}
+	return out
+}
+
+func typedValueProto(v Value) *scorepb.TypedValue {
+	switch v.Kind {
+	case KindNumber:
+		return &scorepb.TypedValue{Kind: &scorepb.TypedValue_NumberValue{NumberValue: v.Num}}
+	case KindBool:
+		return &scorepb.TypedValue{Kind: &scorepb.TypedValue_BoolValue{BoolValue: v.Bool}}
+	case KindString:
+		return &scorepb.TypedValue{Kind: &scorepb.TypedValue_StringValue{StringValue: v.Str}}
+	}
+	return &scorepb.TypedValue{}
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"esgbook-software-engineer-technical-test-2024/scorepb"
+)
+
+// newGRPCClient serves srv on an in-process listener for the duration of the test.
+func newGRPCClient(t *testing.T, srv *GRPCServer) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- ServeGRPC(ctx, lis, srv) }()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+		cancel()
+		assert.NoError(t, <-served)
+	})
+	return conn
+}
+
+func TestGRPCServer(t *testing.T) {
+	rs, err := NewFileRunStore(t.TempDir())
+	require.NoError(t, err)
+
+	_, store, _ := newJobsFixture(t, JobOptions{})
+	cfg := crossSectionalConfig()
+	conn := newGRPCClient(t, NewGRPCServer(store, rs, cfg))
+	client := scorepb.NewScoreServiceClient(conn)
+	ctx := context.Background()
+
+	products, err := client.ListProducts(ctx, &scorepb.ListProductsRequest{})
+	require.NoError(t, err)
+	require.Len(t, products.Products, 1)
+	assert.Equal(t, "cross_sectional", products.Products[0].Name)
+	assert.Equal(t, configHash(cfg), products.Products[0].ConfigHash)
+	require.Len(t, products.Products[0].Metrics, len(cfg.Metrics))
+	assert.Equal(t, "pct_rank", products.Products[0].Metrics[0].Operation)
+
+	// the rows of /run-scores, streamed
+	var header metadata.MD
+	stream, err := client.Score(ctx, &scorepb.ScoreRequest{Companies: []string{"5001", "5002"}, Metrics: []string{"total", "growth"}}, grpc.Header(&header))
+	require.NoError(t, err)
+	var rows []*scorepb.ScoreRow
+	for {
+		row, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		rows = append(rows, row)
+	}
+	filter := ScoreFilter{Companies: map[string]bool{"5001": true, "5002": true}, Metrics: []string{"total", "growth"}}
+	want, err := CalculateScoreFiltered(ctx, cfg, store.Snapshot(), filter)
+	require.NoError(t, err)
+	require.Len(t, rows, len(want))
+	formats := metricFormats(filter.Output(cfg), false)
+	for i, row := range rows {
+		assert.Equal(t, want[i].CompanyID, row.CompanyId)
+		assert.Equal(t, int32(want[i].Year), row.Year)
+		for _, f := range formats {
+			if val, ok := want[i].Values[f.Name]; ok {
+				assert.Equal(t, f.Value(val), row.Values[f.Name], "%s %d %s", row.CompanyId, row.Year, f.Name)
+			} else {
+				assert.NotContains(t, row.Values, f.Name)
+			}
+		}
+	}
+	require.Len(t, header.Get("x-run-id"), 1)
+	record, err := rs.Get(header.Get("x-run-id")[0])
+	require.NoError(t, err)
+	assert.Equal(t, "grpc", record.Source)
+	assert.Equal(t, len(want), record.Rows)
+
+	// a run without rows still has its header
+	header = nil
+	stream, err = client.Score(ctx, &scorepb.ScoreRequest{Companies: []string{"nope"}}, grpc.Header(&header))
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+	assert.Len(t, header.Get("x-run-id"), 1)
+
+	stream, err = client.Score(ctx, &scorepb.ScoreRequest{Metrics: []string{"nope"}})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	stream, err = client.Score(ctx, &scorepb.ScoreRequest{Product: "nope"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	valid, err := client.ValidateConfig(ctx, &scorepb.ValidateConfigRequest{Config: previewConfig})
+	require.NoError(t, err)
+	assert.True(t, valid.Valid)
+	assert.Equal(t, "draft", valid.Name)
+	assert.Len(t, valid.Warnings, 1)
+	invalid, err := client.ValidateConfig(ctx, &scorepb.ValidateConfigRequest{Format: "json", Config: `{"metrics": [
+		{"name": "a", "operation": {"type": "nope"}}, {"name": "b", "operation": {"type": "sum", "parameters": [{"source": "self.c"}]}}]}`})
+	require.NoError(t, err)
+	assert.False(t, invalid.Valid)
+	assert.Len(t, invalid.Errors, 2)
+	_, err = client.ValidateConfig(ctx, &scorepb.ValidateConfigRequest{Format: "json", Config: "{"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	explained, err := client.Explain(ctx, &scorepb.ExplainRequest{CompanyId: "5000", Year: 2022, Metrics: []string{"total", "gri"}})
+	require.NoError(t, err)
+	require.Len(t, explained.Metrics, 2)
+	total := explained.Metrics[0]
+	assert.Equal(t, 126.0, total.GetResult())
+	assert.Equal(t, []string{flagPartial}, total.Flags)
+	require.Len(t, total.Inputs, 2)
+	assert.Nil(t, total.Inputs[0].Result)
+	assert.Equal(t, 126.0, total.Inputs[1].Raw.GetNumberValue())
+	assert.Equal(t, "emissions_data.csv", total.Inputs[1].From.Object)
+	assert.Equal(t, "2024-06-01T00:00:00Z", total.Inputs[1].From.KnownAt)
+	assert.Equal(t, "gri", explained.Metrics[1].Inputs[0].Raw.GetStringValue())
+	_, err = client.Explain(ctx, &scorepb.ExplainRequest{CompanyId: "5000", Year: 2019})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Explain(ctx, &scorepb.ExplainRequest{CompanyId: "5000", Year: 2022, Metrics: []string{"nope"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	health, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "score.v1.ScoreService"})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, health.Status)
+
+	info, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+	require.NoError(t, info.Send(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{}}))
+	resp, err := info.Recv()
+	require.NoError(t, err)
+	var services []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		services = append(services, s.Name)
+	}
+	assert.Contains(t, services, "score.v1.ScoreService")
+	assert.Contains(t, services, "grpc.health.v1.Health")
+	require.NoError(t, info.CloseSend())
+}
@@ -2,21 +2,30 @@ package internal
 
 import (
 	"context"
-	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"sort"
+	"strings"
 	"time"
 
 	"go.opentelemetry.io/otel"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
 )
 
 const wastePath = "data/waste_data.csv"
 const emissionPath = "data/emissions_data.csv"
 const disclosurePath = "data/disclosure_data.csv"
 
-func CalculateScoreHandler(ctx context.Context, configFileName string) http.HandlerFunc {
+// CalculateScoreHandler scores the store's snapshot and streams the rows; every run is stored in
+// runs (nil => not stored).
+func CalculateScoreHandler(ctx context.Context, scoreConfig *c.Config, store *DatasetStore, runs RunStore) http.HandlerFunc {
+	// results are kept between requests and only the changed company-years are recomputed
+	cache := NewScoreCache(scoreConfig, store)
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Received request to calculate scores")
 
@@ -25,52 +34,219 @@ func CalculateScoreHandler(ctx context.Context, configFileName string) http.Hand
 		childCtx, span := tracer.Start(r.Context(), "computeScores")
 		defer span.End()
 
-		lr := NewLoaderRegistry()
-		dataService := NewDataLoaderService(lr)
-
-		// 1) Calculate the score using your business logic function
-		scoreConfig, scoredResults, err := CalculateScore(childCtx, configFileName, dataService)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+		// 1) Calculate the score against the current dataset snapshot, or with ?as_of= against the
+		// data as it was known at that instant. A filter is pushed down into the run, unless the
+		// scores of the snapshot are cached already
+		if store.Snapshot() == nil {
+			http.Error(w, "datasets are not loaded yet", http.StatusServiceUnavailable)
 			return
 		}
-
-		// 2) Prepare to send results as CSV
-		w.Header().Set("Content-Type", "text/csv")
-		w.Header().Set("Content-Disposition", `attachment; filename="scores.csv"`)
-		csvWriter := csv.NewWriter(w)
-		defer csvWriter.Flush()
-
-		// 3) Write Header Row: "company", "year", plus each metric
-		header := []string{"company", "year"}
-		for _, metric := range scoreConfig.Metrics {
-			header = append(header, metric.Name)
+		out, ok := parseScoreRequest(w, r, scoreConfig)
+		if !ok {
+			return
+		}
+		rec := newRunRecorder(runs, out.meta.RunID, "run-scores", r.URL.RawQuery, scoreConfig, out.filter)
+		var err error
+		var snapshot *Snapshot
+		var scoredResults ScoreRows
+		if raw := r.URL.Query().Get("as_of"); raw != "" {
+			asOf, perr := ParseAsOf(raw)
+			if perr != nil {
+				http.Error(w, perr.Error(), http.StatusBadRequest)
+				return
+			}
+			if snapshot, err = store.SnapshotAsOf(asOf); err == nil {
+				scoredResults, err = CalculateScoreFiltered(childCtx, scoreConfig, snapshot, out.filter)
+			}
+			w.Header().Set("X-As-Of", asOf.Format(time.RFC3339Nano))
+		} else if out.filter.IsZero() {
+			snapshot, scoredResults, err = cache.Scores(childCtx)
+		} else if cached, rows, ok := cache.Cached(); ok {
+			snapshot, scoredResults = cached, out.filter.Apply(rows)
+		} else {
+			snapshot = store.Snapshot()
+			scoredResults, err = CalculateScoreFiltered(childCtx, scoreConfig, snapshot, out.filter)
 		}
-		err = csvWriter.Write(header)
 		if err != nil {
-			log.Printf("Failed to write CSV header: %v", err)
-			http.Error(w, "Failed to write CSV header", http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Error: %v", err), scoreErrorStatus(err))
 			return
 		}
 
-		// 4) Write Data Rows
-		for cy, metricsMap := range scoredResults {
-			row := []string{
-				cy.CompanyID,
-				strconv.Itoa(cy.Year),
+		// datasets that failed to load (continue policy) only produce nulls, tell the client
+		if len(snapshot.Unavailable) > 0 {
+			names := make([]string, 0, len(snapshot.Unavailable))
+			for name := range snapshot.Unavailable {
+				names = append(names, name)
 			}
-			for _, metric := range scoreConfig.Metrics {
-				if val, ok := metricsMap[metric.Name]; ok {
-					row = append(row, fmt.Sprintf("%.2f", val))
-				} else {
-					row = append(row, "") // or "NULL"
+			sort.Strings(names)
+			w.Header().Set("X-Unavailable-Datasets", strings.Join(names, ","))
+		}
+
+		// 2) Send the rows in the format asked for, by company and year or in the order asked for
+		rows := scoredResults.Sorted(out.order)
+		rec.setSnapshot(snapshot)
+		streamScores(w, out.rw, out.meta, rec, rows.emitTo)
+	}
+}
+
+func metricNames(scoreConfig *c.Config) []string {
+	names := make([]string, len(scoreConfig.Metrics))
+	for i, metric := range scoreConfig.Metrics {
+		names[i] = metric.Name
+	}
+	return names
+}
+
+// scoreErrorStatus is the status of a failed score run: 504 when it ran out of time, 500 otherwise
+// (a client that went away doesn't read it).
+func scoreErrorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	if errors.Is(err, errHistoryNotKept) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// PartitionedScoreHandler computes the scores out of core (see DataLoaderService.ScorePartitioned)
+// and streams them by company and year. It reads the store's objects from storage again, so
+// change events are not applied. Rows are never all in memory, so ?sort= can only be the default
+// order. Filters are applied to the output only: every company-year is still scored. Runs are
+// stored in runs (nil => not stored).
+func PartitionedScoreHandler(scoreConfig *c.Config, store *DatasetStore, opts PartitionOptions, runs RunStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Received request to calculate partitioned scores")
+		out, ok := parseScoreRequest(w, r, scoreConfig)
+		if !ok {
+			return
+		}
+		if !isDefaultOrder(out.order) {
+			http.Error(w, "out-of-core scores can only be sorted by company and year (ascending)", http.StatusBadRequest)
+			return
+		}
+		// the objects are read again from storage: the store's snapshot is the data as of the start
+		rec := newRunRecorder(runs, out.meta.RunID, "partitioned", r.URL.RawQuery, scoreConfig, out.filter)
+		rec.setSnapshot(store.Snapshot())
+		streamScores(w, out.rw, out.meta, rec, func(emit func(CompanyYearKey, map[string]float64) error) error {
+			return store.ScorePartitioned(r.Context(), scoreConfig, opts, func(key CompanyYearKey, row map[string]float64) error {
+				if !out.filter.Match(key) {
+					return nil
 				}
+				return emit(key, row)
+			})
+		})
+	}
+}
+
+// scoreOutput is how a score request wants its rows: which ones, order, format and the run's
+// metadata.
+type scoreOutput struct {
+	filter ScoreFilter
+	order  []SortKey
+	rw     ResultWriter
+	meta   ResultMeta
+}
+
+// parseScoreRequest reads the output options of a score request: the filter (company=, year=,
+// from_year=, to_year=, metrics=), the sort order (?sort=), the format (?format= or Accept) and the
+// precision (?precision=). It answers the request itself when they are invalid.
+func parseScoreRequest(w http.ResponseWriter, r *http.Request, scoreConfig *c.Config) (scoreOutput, bool) {
+	var out scoreOutput
+	var err error
+	if out.filter, err = ParseScoreFilter(r.URL.Query(), scoreConfig); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return out, false
+	}
+	// the columns of the output are the metrics of the filter
+	scoreConfig = out.filter.Output(scoreConfig)
+	if out.order, err = ParseSortKeys(r.URL.Query().Get("sort"), metricNames(scoreConfig)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return out, false
+	}
+	if out.rw, err = defaultFormats.Negotiate(r); err != nil {
+		http.Error(w, err.Error(), formatStatus(err))
+		return out, false
+	}
+	if out.meta, err = newResultMeta(scoreConfig, r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return out, false
+	}
+	return out, true
+}
+
+// streamScores writes the rows run emits with rw, and stores them with rec (nil => not stored).
+// The output only starts with the first row, so a run that fails before it still gets an error
+// status; a run without rows writes an empty result. The run is stored only once every row was
+// written: a client that goes away (a failed write, or its request cancelled) aborts it, like a
+// failed run.
+func streamScores(
+	w http.ResponseWriter,
+	rw ResultWriter,
+	meta ResultMeta,
+	rec *runRecorder,
+	run func(emit func(CompanyYearKey, map[string]float64) error) error,
+) {
+	started := false
+	begin := func() error {
+		started = true
+		w.Header().Set("Content-Type", rw.ContentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="scores.%s"`, rw.Extension()))
+		w.Header().Set("X-Run-ID", meta.RunID)
+		return rw.Begin(w, meta)
+	}
+	emit := func(cy CompanyYearKey, metricsMap map[string]float64) error {
+		if !started {
+			if err := begin(); err != nil {
+				return err
 			}
-			if err := csvWriter.Write(row); err != nil {
-				log.Printf("Failed to write CSV row: %v", err)
-				http.Error(w, "Failed to write CSV row", http.StatusInternalServerError)
-				return
+		}
+		row := ScoredRow{CompanyID: cy.CompanyID, Year: cy.Year, Values: metricsMap}
+		rec.add(row)
+		return rw.WriteRow(row)
+	}
+
+	err := run(emit)
+	if !started {
+		if err != nil {
+			rec.finish(err)
+			http.Error(w, fmt.Sprintf("Error: %v", err), scoreErrorStatus(err))
+			return
+		}
+		err = begin() // no rows at all
+	}
+	if endErr := rw.End(); err == nil {
+		err = endErr
+	}
+	rec.finish(err)
+	if err != nil {
+		log.Printf("Failed to stream scores: %v", err)
+	}
+}
+
+// QualityReportHandler serves the data-quality summary of the current dataset snapshot as JSON.
+// With ?quarantine=csv it returns the quarantined rows themselves, with the rule that failed.
+func QualityReportHandler(store *DatasetStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshot := store.Snapshot()
+		if snapshot == nil {
+			http.Error(w, "datasets are not loaded yet", http.StatusServiceUnavailable)
+			return
+		}
+		report := snapshot.Quality
+
+		if r.URL.Query().Get("quarantine") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="quarantine.csv"`)
+			if err := writeQuarantineCSV(w, report.Quarantine); err != nil {
+				log.Printf("Failed to write quarantine CSV: %v", err)
 			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("Failed to write quality report: %v", err)
 		}
 	}
 }
@@ -0,0 +1,555 @@
+package internal
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// stage is a run of metrics that can be computed together. Per-key stages evaluate their metrics
+// key by key, in parallel; a cross-key stage holds a single metric (lag, pct_rank, ...) that needs
+// the earlier metrics of every key first.
+type stage struct {
+	metrics  []c.Metric
+	crossKey bool
+}
+
+// planStages splits the config's metrics into stages, keeping their order.
+func planStages(cfg *c.Config) []stage {
+	var stages []stage
+	for _, metric := range cfg.Metrics {
+		if _, ok := crossKeyOperations[metric.Operation.Type]; ok {
+			stages = append(stages, stage{metrics: []c.Metric{metric}, crossKey: true})
+			continue
+		}
+		if n := len(stages); n > 0 && !stages[n-1].crossKey {
+			stages[n-1].metrics = append(stages[n-1].metrics, metric)
+			continue
+		}
+		stages = append(stages, stage{metrics: []c.Metric{metric}})
+	}
+	return stages
+}
+
+// keySet is a set of company-years.
+type keySet map[CompanyYearKey]bool
+
+func (ks keySet) addAll(other keySet) {
+	for key := range other {
+		ks[key] = true
+	}
+}
+
+// affectedKeys works out, for every metric, the keys whose value may differ from prev:
+//   - dataset sources: the changed keys of that dataset
+//   - self.<metric>: the keys affected for that metric
+//   - lag: the affected keys of its source, moved `periods` years later
+//   - pct_rank: every key of a year in which its source is affected
+//
+// Keys that appeared or disappeared affect every source. changed is nil for a full run.
+func affectedKeys(
+	cfg *c.Config,
+	changed map[string]keySet,
+	structural keySet,
+	keysByYear map[int][]CompanyYearKey,
+) map[string]keySet {
+	affected := make(map[string]keySet, len(cfg.Metrics))
+
+	sourceKeys := func(source string) keySet {
+		if strings.HasPrefix(source, "self.") {
+			return affected[strings.TrimPrefix(source, "self.")]
+		}
+		dataset, _, _ := strings.Cut(source, ".")
+		return changed[dataset]
+	}
+
+	for _, metric := range cfg.Metrics {
+		keys := make(keySet)
+		keys.addAll(structural)
+
+		for _, p := range metric.Operation.Parameters {
+			if p.Source == "" {
+				continue // literal values never change
+			}
+			from := make(keySet)
+			from.addAll(structural)
+			from.addAll(sourceKeys(p.Source))
+
+			switch metric.Operation.Type {
+			case "lag":
+				periods := lagPeriods(metric.Operation)
+				for key := range from {
+					keys[CompanyYearKey{CompanyID: key.CompanyID, Year: key.Year + periods}] = true
+				}
+			case "pct_rank":
+				years := make(map[int]bool)
+				for key := range from {
+					years[key.Year] = true
+				}
+				for year := range years {
+					for _, key := range keysByYear[year] {
+						keys[key] = true
+					}
+				}
+			default:
+				keys.addAll(from)
+			}
+		}
+		affected[metric.Name] = keys
+	}
+	return affected
+}
+
+// computeScores runs the config's stages. With prev == nil every key is computed; otherwise only
+// the keys affected by changed (dataset => company-years, dataset names as used in the config)
+// are recomputed and the other rows are shared with prev, which is never modified.
+func computeScores(
+	ctx context.Context,
+	cfg *c.Config,
+	cols *ColumnStore,
+	prev map[CompanyYearKey]map[string]float64,
+	changed map[string]keySet,
+	numWorkers int,
+) (map[CompanyYearKey]map[string]float64, error) {
+	results, _, err := recomputeScores(ctx, cfg, cols, prev, changed, numWorkers)
+	return results, err
+}
+
+// recomputeScores is computeScores, also returning the keys some metric was recomputed at, the
+// ones that disappeared since prev included (nil for a full run).
+func recomputeScores(
+	ctx context.Context,
+	cfg *c.Config,
+	cols *ColumnStore,
+	prev map[CompanyYearKey]map[string]float64,
+	changed map[string]keySet,
+	numWorkers int,
+) (map[CompanyYearKey]map[string]float64, keySet, error) {
+	allKeys := cols.Keys()
+
+	results := make(map[CompanyYearKey]map[string]float64, len(allKeys))
+	for _, key := range allKeys {
+		if row, ok := prev[key]; ok {
+			results[key] = row
+		} else {
+			results[key] = map[string]float64{}
+		}
+	}
+
+	// a full run computes every key, there is nothing to narrow down
+	var affected map[string]keySet
+	var recomputed keySet
+	if prev != nil {
+		keysByYear := make(map[int][]CompanyYearKey)
+		structural := make(keySet)
+		for _, key := range allKeys {
+			keysByYear[key.Year] = append(keysByYear[key.Year], key)
+			if _, ok := prev[key]; !ok {
+				structural[key] = true // new key
+			}
+		}
+		for key := range prev {
+			if _, ok := results[key]; !ok {
+				structural[key] = true // removed key
+			}
+		}
+		affected = affectedKeys(cfg, changed, structural, keysByYear)
+		recomputed = make(keySet)
+		for _, keys := range affected {
+			recomputed.addAll(keys)
+		}
+	}
+
+	if err := runStages(ctx, planStages(cfg), cols, results, affected, nil, numWorkers); err != nil {
+		return nil, nil, err
+	}
+	return results, recomputed, nil
+}
+
+// runStages computes stages into results: every key, or with affected != nil only the affected
+// keys of each stage. Cross-sectional metrics found in dists are ranked against that distribution
+// (gathered over more companies than cols has) instead of the keys of cols.
+func runStages(
+	ctx context.Context,
+	stages []stage,
+	cols *ColumnStore,
+	results map[CompanyYearKey]map[string]float64,
+	affected map[string]keySet,
+	dists map[string]yearDistribution,
+	numWorkers int,
+) error {
+	allKeys := cols.Keys()
+	// the keys of every stage are known up front, for progress
+	stageKeys := make([][]CompanyYearKey, len(stages))
+	progress := progressFrom(ctx)
+	for i, st := range stages {
+		stageKeys[i] = allKeys
+		if affected != nil {
+			stageKeys[i] = stageTargets(st, affected, results)
+		}
+		progress.addTotal(len(stageKeys[i]))
+	}
+
+	for i, st := range stages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		keys := stageKeys[i]
+		if len(keys) == 0 {
+			continue
+		}
+
+		// sources are resolved to columns (and per-key stages compiled) once per stage, not per value
+		var err error
+		switch {
+		case st.crossKey && dists[st.metrics[0].Name] != nil:
+			metric := cols.bindMetrics(st.metrics)[0]
+			err = crossKeySafely(metric, func() {
+				storeCrossKey(metric, keys, rankAgainst(dists[metric.Name], metric.params[0], keys, results, cols), results)
+			})
+		case st.crossKey:
+			metric := cols.bindMetrics(st.metrics)[0]
+			err = crossKeySafely(metric, func() {
+				computeCrossKeyStage(ctx, metric, keys, allKeys, results, cols)
+			})
+		default:
+			err = parallelComputeScores(ctx, keys, compileStage(st.metrics, cols), results, cols, numWorkers)
+		}
+		if err != nil {
+			return err
+		}
+		if st.crossKey {
+			progress.addDone(len(keys))
+		}
+	}
+	return nil
+}
+
+// crossKeySafely runs a cross-key stage, turning a panic in its operation into an error.
+func crossKeySafely(metric boundMetric, run func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic computing metric %s: %v\n%s", metric.Name, r, debug.Stack())
+			err = fmt.Errorf("metric %s failed: %v", metric.Name, r)
+		}
+	}()
+	run()
+	return nil
+}
+
+// stageTargets returns the keys, sorted, for which some metric of the stage has to be recomputed.
+func stageTargets(st stage, affected map[string]keySet, results map[CompanyYearKey]map[string]float64) []CompanyYearKey {
+	targets := make(keySet)
+	for _, metric := range st.metrics {
+		for key := range affected[metric.Name] {
+			if _, ok := results[key]; ok {
+				targets[key] = true
+			}
+		}
+	}
+	keys := make([]CompanyYearKey, 0, len(targets))
+	for key := range targets {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+	return keys
+}
+
+// computeCrossKeyStage evaluates a cross-key metric for keys and stores it in fresh row copies.
+func computeCrossKeyStage(
+	ctx context.Context,
+	metric boundMetric,
+	keys []CompanyYearKey,
+	allKeys []CompanyYearKey,
+	results map[CompanyYearKey]map[string]float64,
+	cols *ColumnStore,
+) {
+	values := crossKeyOperations[metric.Operation.Type](ctx, metric.Operation, metric.params, keys, allKeys, results, cols)
+	storeCrossKey(metric, keys, values, results)
+}
+
+// storeCrossKey stores the values of a cross-key metric in fresh row copies.
+func storeCrossKey(metric boundMetric, keys []CompanyYearKey, values map[CompanyYearKey]float64, results map[CompanyYearKey]map[string]float64) {
+	for _, key := range keys {
+		row := copyRow(results[key], metric.Name)
+		if val, ok := values[key]; ok {
+			row[metric.Name] = val
+		}
+		results[key] = row
+	}
+}
+
+// copyRow copies a result row without the given metrics, which are about to be recomputed.
+func copyRow(row map[string]float64, metrics ...string) map[string]float64 {
+	out := make(map[string]float64, len(row)+len(metrics))
+	for name, val := range row {
+		out[name] = val
+	}
+	for _, name := range metrics {
+		delete(out, name)
+	}
+	return out
+}
+
+func sortKeys(keys []CompanyYearKey) {
+	sort.Slice(keys, func(i, j int) bool { return lessKey(keys[i], keys[j]) })
+}
+
+// compareKeys orders keys like lessKey, for the slices package.
+func compareKeys(a, b CompanyYearKey) int {
+	if n := strings.Compare(a.CompanyID, b.CompanyID); n != 0 {
+		return n
+	}
+	return cmp.Compare(a.Year, b.Year)
+}
+
+// lessKey orders keys by company then year.
+func lessKey(a, b CompanyYearKey) bool {
+	if a.CompanyID == b.CompanyID {
+		return a.Year < b.Year
+	}
+	return a.CompanyID < b.CompanyID
+}
+
+// ScoreCache keeps the last result set of a score config and, when the store publishes a new
+// snapshot, recomputes only the company-years affected by what changed. The results are the same
+// as a full CalculateScore on the new snapshot. Concurrent callers asking for the same snapshot
+// version share one computation, which runs without holding the cache's lock.
+type ScoreCache struct {
+	config *c.Config
+	store  *DatasetStore
+
+	mu    sync.Mutex
+	state *scoreState
+	// flight is the computation running for the newest version asked for, nil when there is none
+	flight *scoreFlight
+}
+
+// scoreState is what the cache keeps of the scores of one snapshot version. results feed the next
+// incremental run and rows are what callers get; the columns and the field kinds the config was
+// validated against are carried forward and patched with what changed, not rebuilt.
+type scoreState struct {
+	version int64
+	results map[CompanyYearKey]map[string]float64
+	rows    ScoreRows
+	cols    *ColumnStore
+	// kinds are the value kinds of every field (dataset => field => kinds). Between full runs they
+	// only grow: a kind that is gone from the data is still seen until the next one
+	kinds map[string]map[string]map[ValueKind]bool
+}
+
+// scoreFlight is one computation of the scores of a snapshot version; done is closed once rows
+// or err are set.
+type scoreFlight struct {
+	version int64
+	done    chan struct{}
+	rows    ScoreRows
+	err     error
+}
+
+func NewScoreCache(scoreConfig *c.Config, store *DatasetStore) *ScoreCache {
+	return &ScoreCache{config: scoreConfig, store: store}
+}
+
+// Cached returns the scores of the current snapshot if they were already computed, without
+// computing anything. The rows are shared as with Scores.
+func (sc *ScoreCache) Cached() (*Snapshot, ScoreRows, bool) {
+	snapshot := sc.store.Snapshot()
+	if snapshot == nil {
+		return nil, nil, false
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.state == nil || sc.state.version != snapshot.Version {
+		return nil, nil, false
+	}
+	return snapshot, sc.state.rows, true
+}
+
+// Scores returns the scores of the current snapshot along with it. The returned rows are shared
+// with later calls and must not be modified (ScoreRows.Sorted makes a copy).
+func (sc *ScoreCache) Scores(ctx context.Context) (*Snapshot, ScoreRows, error) {
+	snapshot := sc.store.Snapshot()
+	if snapshot == nil {
+		return nil, nil, fmt.Errorf("datasets are not loaded yet")
+	}
+
+	for {
+		sc.mu.Lock()
+		if sc.state != nil && sc.state.version == snapshot.Version {
+			rows := sc.state.rows
+			sc.mu.Unlock()
+			return snapshot, rows, nil
+		}
+
+		// someone is computing this version already => wait for it
+		if f := sc.flight; f != nil && f.version == snapshot.Version {
+			sc.mu.Unlock()
+			select {
+			case <-f.done:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+			if f.err != nil && ctx.Err() == nil && (errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded)) {
+				continue // its caller gave up, this one did not
+			}
+			return snapshot, f.rows, f.err
+		}
+
+		f := &scoreFlight{version: snapshot.Version, done: make(chan struct{})}
+		sc.flight = f
+		prev := sc.state
+		sc.mu.Unlock()
+
+		state, err := sc.compute(ctx, snapshot, prev)
+
+		sc.mu.Lock()
+		// a slower run for an older snapshot must not replace newer results
+		if err == nil && (sc.state == nil || snapshot.Version > sc.state.version) {
+			sc.state = state
+		}
+		if sc.flight == f {
+			sc.flight = nil
+		}
+		sc.mu.Unlock()
+
+		if err == nil {
+			f.rows = state.rows
+		}
+		f.err = err
+		close(f.done)
+		return snapshot, f.rows, err
+	}
+}
+
+// compute scores snapshot, incrementally from prev when the store still knows what changed since.
+// An incremental run only reads the changed company-years: the field kinds and the columns of
+// prev are patched with them (the columns are built again if a new company or year needs a slot)
+// and the rows of prev are copied with the recomputed ones replaced.
+func (sc *ScoreCache) compute(ctx context.Context, snapshot *Snapshot, prev *scoreState) (*scoreState, error) {
+	datasets := scoreDatasets(snapshot)
+	var changes ChangeSet
+	known := false
+	if prev != nil {
+		changes, known = sc.store.Changes(prev.version, snapshot.Version)
+	}
+	if !known {
+		return sc.computeFull(ctx, snapshot, datasets)
+	}
+
+	// changes are by dataset name, the config uses the aliases
+	changed := make(map[string]keySet)
+	for alias, name := range datasetAliases {
+		if keys := changes[name]; len(keys) > 0 {
+			changed[alias] = keys
+		}
+	}
+
+	kinds := patchKinds(prev.kinds, datasets, changed)
+	if err := validateScoreConfigKinds(sc.config, kinds); err != nil {
+		return nil, fmt.Errorf("invalid score config %s: %w", sc.config.Name, err)
+	}
+	var cols *ColumnStore
+	if patched, ok := prev.cols.withChanges(datasets, changed); ok {
+		cols = snapshot.useColumns(patched)
+	} else {
+		cols = snapshot.Columns() // a company or year without a slot: the layout changes
+	}
+
+	results, recomputed, err := recomputeScores(ctx, sc.config, cols, prev.results, changed, workerCount(snapshot.workers))
+	if err != nil {
+		return nil, err
+	}
+	return &scoreState{
+		version: snapshot.Version,
+		results: results,
+		rows:    patchRows(prev.rows, cols, results, recomputed),
+		cols:    cols,
+		kinds:   kinds,
+	}, nil
+}
+
+// computeFull scores snapshot from scratch.
+func (sc *ScoreCache) computeFull(ctx context.Context, snapshot *Snapshot, datasets map[string]Dataset) (*scoreState, error) {
+	kinds := make(map[string]map[string]map[ValueKind]bool, len(datasets))
+	for name, ds := range datasets {
+		kinds[name] = ds.FieldKinds()
+	}
+	if err := validateScoreConfigKinds(sc.config, kinds); err != nil {
+		return nil, fmt.Errorf("invalid score config %s: %w", sc.config.Name, err)
+	}
+	cols := snapshot.Columns()
+	results, err := computeScores(ctx, sc.config, cols, nil, nil, workerCount(snapshot.workers))
+	if err != nil {
+		return nil, err
+	}
+	return &scoreState{version: snapshot.Version, results: results, rows: newScoreRows(results), cols: cols, kinds: kinds}, nil
+}
+
+// patchKinds adds the kinds of the values at the changed keys to kinds, which is not modified.
+func patchKinds(
+	kinds map[string]map[string]map[ValueKind]bool,
+	datasets map[string]Dataset,
+	changed map[string]keySet,
+) map[string]map[string]map[ValueKind]bool {
+	out := maps.Clone(kinds)
+	for name, keys := range changed {
+		fields := make(map[string]map[ValueKind]bool, len(kinds[name]))
+		for field, seen := range kinds[name] {
+			fields[field] = maps.Clone(seen)
+		}
+		for key := range keys {
+			for field, v := range datasets[name][key] {
+				if v.IsNull() {
+					continue
+				}
+				if fields[field] == nil {
+					fields[field] = make(map[ValueKind]bool)
+				}
+				fields[field][v.Kind] = true
+			}
+		}
+		out[name] = fields
+	}
+	return out
+}
+
+// patchRows returns rows (ordered by company and year, not modified) with the rows of the
+// recomputed keys replaced by their results. Only when keys appeared or disappeared are the rows
+// laid out again, in the order of cols' keys, which is already theirs.
+func patchRows(rows ScoreRows, cols *ColumnStore, results map[CompanyYearKey]map[string]float64, recomputed keySet) ScoreRows {
+	out := slices.Clone(rows)
+	for key := range recomputed {
+		i, found := slices.BinarySearchFunc(out, key, func(row ScoredRow, key CompanyYearKey) int {
+			return compareKeys(row.Key(), key)
+		})
+		values, ok := results[key]
+		if found != ok {
+			return rowsOf(cols, results) // key added or removed
+		}
+		if ok {
+			out[i].Values = values
+		}
+	}
+	return out
+}
+
+// rowsOf lays out results in the order of cols' keys, by company and year.
+func rowsOf(cols *ColumnStore, results map[CompanyYearKey]map[string]float64) ScoreRows {
+	keys := cols.Keys()
+	rows := make(ScoreRows, len(keys))
+	for i, key := range keys {
+		rows[i] = ScoredRow{CompanyID: key.CompanyID, Year: key.Year, Values: results[key]}
+	}
+	return rows
+}
@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+func TestScoreCacheIncremental(t *testing.T) {
+	dir := t.TempDir()
+	var waste, emissions strings.Builder
+	waste.WriteString("company_id,date,was_1,was_2\n")
+	emissions.WriteString("company_id,date,emi_1\n")
+	for company := 1; company <= 5; company++ {
+		for year := 2021; year <= 2024; year++ {
+			fmt.Fprintf(&waste, "%d,%d-06-30,%d,%d\n", company, year, company*10+year%10, company)
+			fmt.Fprintf(&emissions, "%d,%d-06-30,%d\n", company, year, (company*7+year)%13+1)
+		}
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "waste_data.csv"), []byte(waste.String()), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "emissions_data.csv"), []byte(emissions.String()), 0o644))
+
+	param := func(source string) c.Parameter { return c.Parameter{Source: source} }
+	cfg := &c.Config{Name: "incremental", Metrics: []c.Metric{
+		{Name: "total", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{param("waste.was_1"), param("waste.was_2")}}},
+		{Name: "prev_total", Operation: c.Operation{Type: "lag", Parameters: []c.Parameter{param("self.total")}}},
+		{Name: "growth", Operation: c.Operation{Type: "divide", Parameters: []c.Parameter{param("self.total"), param("self.prev_total")}}},
+		{Name: "growth_rank", Operation: c.Operation{Type: "pct_rank", Parameters: []c.Parameter{param("self.growth")}}},
+		{Name: "intensity", Operation: c.Operation{Type: "divide", Parameters: []c.Parameter{param("emissions.emi_1"), param("self.total")}}},
+		{Name: "ranked", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{param("self.growth_rank"), param("self.intensity")}}},
+	}}
+
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	cache := NewScoreCache(cfg, store)
+
+	_, before, err := cache.Scores(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, before, 20)
+	assert.InDelta(t, 0.1, before.Map()[CompanyYearKey{"5", 2022}]["growth_rank"], 1e-9)
+
+	ev := func(op ChangeOp, company string, date, field string, value Value) ChangeEvent {
+		d, err := ParseDateOrYear(date)
+		require.NoError(t, err)
+		return ChangeEvent{Op: op, Dataset: "waste_data", CompanyID: company, Date: d, Field: field, Value: value}
+	}
+	store.ApplyChanges([]ChangeEvent{
+		ev(ChangeUpdate, "2", "2022-06-30", "was_1", NumberValue(99)),
+		ev(ChangeDelete, "3", "2022-06-30", "", Value{}),
+		ev(ChangeInsert, "6", "2022-01-01", "was_1", NumberValue(5)),
+	})
+
+	snapshot, after, err := cache.Scores(context.Background())
+	require.NoError(t, err)
+	full, err := CalculateScore(context.Background(), cfg, snapshot)
+	require.NoError(t, err)
+	assert.Equal(t, full, after)
+	beforeByKey, afterByKey := before.Map(), after.Map()
+	assert.NotEqual(t, beforeByKey[CompanyYearKey{"2", 2023}], afterByKey[CompanyYearKey{"2", 2023}])
+
+	// 2024 does not depend on anything that changed: its rows are reused as they are
+	for company := 1; company <= 5; company++ {
+		key := CompanyYearKey{fmt.Sprint(company), 2024}
+		assert.Equal(t, reflect.ValueOf(beforeByKey[key]).Pointer(), reflect.ValueOf(afterByKey[key]).Pointer(), key)
+	}
+
+	// same snapshot => same results, nothing recomputed
+	_, again, err := cache.Scores(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, reflect.ValueOf(after).Pointer(), reflect.ValueOf(again).Pointer())
+
+	// a change within the existing companies and years patches the columns instead of rebuilding them
+	prev := cache.state
+	store.ApplyChanges([]ChangeEvent{ev(ChangeUpdate, "4", "2023-06-30", "was_2", NumberValue(7))})
+	snapshot, patched, err := cache.Scores(context.Background())
+	require.NoError(t, err)
+	full, err = CalculateScore(context.Background(), cfg, snapshot)
+	require.NoError(t, err)
+	assert.Equal(t, full, patched)
+	assert.Same(t, cache.state.cols, snapshot.Columns(), "the snapshot runs on the patched columns")
+	assert.Same(t, prev.cols.Dataset("emissions"), cache.state.cols.Dataset("emissions"))
+	assert.Same(t, prev.cols.Dataset("waste").Column("was_1"), cache.state.cols.Dataset("waste").Column("was_1"))
+	assert.NotSame(t, prev.cols.Dataset("waste").Column("was_2"), cache.state.cols.Dataset("waste").Column("was_2"))
+	assert.Equal(t, 47.0, prev.results[CompanyYearKey{"4", 2023}]["total"], "prev is not modified")
+}
+
+func TestScoreCacheSharesComputation(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "waste_data.csv"), []byte("company_id,date,was_1\n1,2023,4\n2,2023,6\n"), 0o644))
+	cfg := &c.Config{Name: "shared", Metrics: []c.Metric{
+		{Name: "total", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{{Source: "waste.was_1"}}}},
+	}}
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	cache := NewScoreCache(cfg, store)
+
+	// a computation of the current version is running: callers wait for it instead of starting
+	// their own, and the cache is not locked meanwhile
+	flight := &scoreFlight{version: store.Snapshot().Version, done: make(chan struct{})}
+	cache.flight = flight
+	type result struct {
+		rows ScoreRows
+		err  error
+	}
+	waiters := make(chan result, 4)
+	for i := 0; i < cap(waiters); i++ {
+		go func() {
+			_, rows, err := cache.Scores(context.Background())
+			waiters <- result{rows, err}
+		}()
+	}
+	_, _, ok := cache.Cached()
+	assert.False(t, ok)
+
+	shared := ScoreRows{{CompanyID: "1", Year: 2023, Values: map[string]float64{"total": 4}}}
+	flight.rows = shared
+	close(flight.done)
+	for i := 0; i < cap(waiters); i++ {
+		r := <-waiters
+		require.NoError(t, r.err)
+		assert.Equal(t, reflect.ValueOf(shared).Pointer(), reflect.ValueOf(r.rows).Pointer())
+	}
+
+	// a computation given up by its caller is redone by a caller still waiting
+	flight = &scoreFlight{version: store.Snapshot().Version, done: make(chan struct{})}
+	cache.mu.Lock()
+	cache.state, cache.flight = nil, flight
+	cache.mu.Unlock()
+	go func() {
+		_, rows, err := cache.Scores(context.Background())
+		waiters <- result{rows, err}
+	}()
+	cache.mu.Lock()
+	cache.flight = nil
+	cache.mu.Unlock()
+	flight.err = context.Canceled
+	close(flight.done)
+	r := <-waiters
+	require.NoError(t, r.err)
+	rows := r.rows
+	assert.Equal(t, map[CompanyYearKey]map[string]float64{{"1", 2023}: {"total": 4}, {"2", 2023}: {"total": 6}}, rows.Map())
+	_, cached, ok := cache.Cached()
+	require.True(t, ok)
+	assert.Equal(t, reflect.ValueOf(rows).Pointer(), reflect.ValueOf(cached).Pointer())
+	assert.Nil(t, cache.flight)
+}
+
+func TestPlanStages(t *testing.T) {
+	cfg := &c.Config{Metrics: []c.Metric{
+		{Name: "a", Operation: c.Operation{Type: "sum"}},
+		{Name: "b", Operation: c.Operation{Type: "divide"}},
+		{Name: "c", Operation: c.Operation{Type: "pct_rank"}},
+		{Name: "d", Operation: c.Operation{Type: "lag"}},
+		{Name: "e", Operation: c.Operation{Type: "or"}},
+	}}
+	var got [][]string
+	for _, st := range planStages(cfg) {
+		var names []string
+		for _, m := range st.metrics {
+			names = append(names, m.Name)
+		}
+		got = append(got, names)
+	}
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}, {"d"}, {"e"}}, got)
+}
+
+func TestComputeScoresRecoversPanics(t *testing.T) {
+	cols := buildColumnStore(syntheticDatasets(50, 3, 1))
+	operations["test_panic"] = func(ctx context.Context, m *planMetric, slot int, f *frame) (float64, bool) {
+		panic("boom")
+	}
+	crossKeyOperations["test_cross_panic"] = func(ctx context.Context, op c.Operation, params []sourceRef, targets, allKeys []CompanyYearKey, results map[CompanyYearKey]map[string]float64, cols *ColumnStore) map[CompanyYearKey]float64 {
+		var m map[CompanyYearKey]float64
+		m[targets[0]] = 1 // nil map
+		return m
+	}
+	defer delete(operations, "test_panic")
+	defer delete(crossKeyOperations, "test_cross_panic")
+
+	for opType, want := range map[string]string{"test_panic": "metric bad failed for company", "test_cross_panic": "metric bad failed: assignment to entry in nil map"} {
+		cfg := syntheticConfig(1)
+		cfg.Metrics = append(cfg.Metrics, c.Metric{Name: "bad", Operation: c.Operation{Type: opType, Parameters: []c.Parameter{{Source: "self.total_0"}}}})
+		results, err := computeScores(context.Background(), cfg, cols, nil, nil, 4)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), want)
+		assert.Nil(t, results)
+	}
+
+	// the server answers with an error status and keeps running
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "waste_data.csv"), []byte("company_id,date,was_0\n1,2023,5\n"), 0o644))
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	cfg := &c.Config{Name: "panics", Metrics: []c.Metric{{Name: "bad", Operation: c.Operation{Type: "test_panic", Parameters: []c.Parameter{{Source: "waste.was_0"}}}}}}
+	handler := CalculateScoreHandler(context.Background(), cfg, store, nil)
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/run-scores", nil))
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.Contains(t, rec.Body.String(), "metric bad failed for company 1, year 2023: boom")
+	}
+}
+
+func TestComputeScoresCancel(t *testing.T) {
+	cols := buildColumnStore(syntheticDatasets(2000, 5, 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the first key cancels the run: the other workers stop after the key they are on
+	var calls atomic.Int64
+	operations["test_cancel"] = func(ctx context.Context, m *planMetric, slot int, f *frame) (float64, bool) {
+		calls.Add(1)
+		cancel()
+		return 1, false
+	}
+	defer delete(operations, "test_cancel")
+	cfg := &c.Config{Name: "cancel", Metrics: []c.Metric{{Name: "m", Operation: c.Operation{Type: "test_cancel"}}}}
+
+	prev := map[CompanyYearKey]map[string]float64{cols.Keys()[0]: {"m": 7}}
+	results, err := computeScores(ctx, cfg, cols, nil, nil, 4)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, results)
+	assert.Less(t, calls.Load(), int64(100), "of %d keys", len(cols.Keys()))
+
+	// an incremental run leaves the previous results alone
+	_, err = computeScores(ctx, cfg, cols, prev, map[string]keySet{}, 4)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, map[CompanyYearKey]map[string]float64{cols.Keys()[0]: {"m": 7}}, prev)
+
+	// a deadline answers 504
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), 0)
+	defer cancelTimeout()
+	_, err = computeScores(ctx, cfg, cols, nil, nil, 4)
+	assert.Equal(t, http.StatusGatewayTimeout, scoreErrorStatus(err))
+}
+
+func TestScoreWorkers(t *testing.T) {
+	assert.Equal(t, runtime.GOMAXPROCS(0), workerCount(0))
+	assert.Equal(t, 3, workerCount(3))
+	assert.Equal(t, runtime.GOMAXPROCS(0), workerCount(-1))
+
+	// the store's snapshots carry the service's count
+	service := NewDataLoaderService(NewLoaderRegistry(), nil)
+	service.ScoreWorkers = 3
+	store := NewDatasetStore(service, FileStorage{Root: "../data"}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, store.Snapshot().workers)
+}
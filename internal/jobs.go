@@ -0,0 +1,517 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+const (
+	defaultJobRetention   = time.Hour
+	defaultJobConcurrency = 1
+	// jobPurgeInterval is how often expired jobs are dropped (more often with a shorter retention)
+	jobPurgeInterval = time.Minute
+)
+
+// scoreProgress counts the keys a score run has computed, over every stage.
+type scoreProgress struct {
+	done, total atomic.Int64
+}
+
+type progressKey struct{}
+
+// withProgress makes the runs under ctx count their keys into p.
+func withProgress(ctx context.Context, p *scoreProgress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// progressFrom is the progress of ctx, nil when nobody follows it (adding to nil does nothing).
+func progressFrom(ctx context.Context) *scoreProgress {
+	p, _ := ctx.Value(progressKey{}).(*scoreProgress)
+	return p
+}
+
+func (p *scoreProgress) addDone(n int) {
+	if p != nil {
+		p.done.Add(int64(n))
+	}
+}
+
+func (p *scoreProgress) addTotal(n int) {
+	if p != nil {
+		p.total.Add(int64(n))
+	}
+}
+
+// JobState is where a job is in its life.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+func (s JobState) finished() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobCancelled
+}
+
+// JobRequest is the body of POST /jobs: the product (score config) to run, which rows and metrics
+// to keep, and metrics replacing the product's ones with the same name (or added after them).
+type JobRequest struct {
+	Product   string     `json:"product"`
+	Filters   JobFilters `json:"filters"`
+	Overrides []c.Metric `json:"overrides"`
+}
+
+// JobFilters are the filters of /run-scores (company=, year=, ...) as JSON.
+type JobFilters struct {
+	Company  []string `json:"company"`
+	Year     []int    `json:"year"`
+	FromYear int      `json:"from_year"`
+	ToYear   int      `json:"to_year"`
+	Metrics  []string `json:"metrics"`
+}
+
+// query is the filters as /run-scores reads them.
+func (f JobFilters) query() url.Values {
+	query := url.Values{}
+	for _, id := range f.Company {
+		query.Add("company", id)
+	}
+	for _, y := range f.Year {
+		query.Add("year", strconv.Itoa(y))
+	}
+	if f.FromYear != 0 {
+		query.Set("from_year", strconv.Itoa(f.FromYear))
+	}
+	if f.ToYear != 0 {
+		query.Set("to_year", strconv.Itoa(f.ToYear))
+	}
+	for _, name := range f.Metrics {
+		query.Add("metrics", name)
+	}
+	return query
+}
+
+// JobProgress is how many keys a job has computed, over every stage of the run.
+type JobProgress struct {
+	Done  int64 `json:"done"`
+	Total int64 `json:"total"`
+}
+
+// JobStatus is what GET /jobs/{id} returns.
+type JobStatus struct {
+	ID         string      `json:"id"`
+	Product    string      `json:"product"`
+	State      JobState    `json:"state"`
+	Progress   JobProgress `json:"progress"`
+	Error      string      `json:"error,omitempty"`
+	Rows       int         `json:"rows,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  *time.Time  `json:"started_at,omitempty"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	ExpiresAt  *time.Time  `json:"expires_at,omitempty"`
+}
+
+// job is the status of a job; its rows are in the run store.
+type job struct {
+	id       string
+	cfg      *c.Config
+	filter   ScoreFilter
+	query    string
+	progress scoreProgress
+	cancel   context.CancelFunc
+
+	// guarded by JobManager.mu
+	state                      JobState
+	cancelled                  bool
+	err                        string
+	created, started, finished time.Time
+	rows                       int
+}
+
+// JobOptions configures a JobManager.
+type JobOptions struct {
+	// Retention is how long finished jobs are kept (0 => 1h)
+	Retention time.Duration
+	// Concurrency is how many jobs run at once, the others wait in the queue (0 => 1). Each run
+	// uses the score workers (SCORE_CONCURRENCY)
+	Concurrency int
+	// Runs stores the runs of the jobs that succeed, and the results are served from it. nil =>
+	// jobs only keep their status and have no result to serve
+	Runs RunStore
+}
+
+// JobManager runs score jobs in the background against the store's snapshot at the time they start,
+// and keeps their status until they expire; the rows of a succeeded job are its stored run.
+type JobManager struct {
+	ctx       context.Context
+	store     *DatasetStore
+	configs   map[string]*c.Config
+	retention time.Duration
+	runs      RunStore
+	slots     chan struct{}
+	now       func() time.Time
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// NewJobManager returns a manager running the products of configs (by config name). Jobs are
+// cancelled when ctx is done.
+func NewJobManager(ctx context.Context, store *DatasetStore, opts JobOptions, configs ...*c.Config) *JobManager {
+	if opts.Retention <= 0 {
+		opts.Retention = defaultJobRetention
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultJobConcurrency
+	}
+	m := &JobManager{
+		ctx:       ctx,
+		store:     store,
+		configs:   make(map[string]*c.Config, len(configs)),
+		retention: opts.Retention,
+		runs:      opts.Runs,
+		slots:     make(chan struct{}, opts.Concurrency),
+		now:       time.Now,
+		jobs:      make(map[string]*job),
+	}
+	for _, cfg := range configs {
+		m.configs[cfg.Name] = cfg
+	}
+	go m.expire(min(opts.Retention, jobPurgeInterval))
+	return m
+}
+
+// expire purges the expired jobs every interval until the manager's context is done, so they go
+// away even when nobody calls the API.
+func (m *JobManager) expire(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			m.mu.Lock()
+			m.purge()
+			m.mu.Unlock()
+		}
+	}
+}
+
+var (
+	errJobNotFound       = errors.New("job not found")
+	errDatasetsNotLoaded = errors.New("datasets are not loaded yet")
+	errJobResultNotKept  = errors.New("the result is not stored")
+)
+
+// Submit queues a job and returns its status. The product can be left out when there is only one.
+func (m *JobManager) Submit(req JobRequest) (JobStatus, error) {
+	cfg, err := m.product(req.Product)
+	if err != nil {
+		return JobStatus{}, err
+	}
+	cfg = overrideMetrics(cfg, req.Overrides)
+	snapshot := m.store.Snapshot()
+	if snapshot == nil {
+		return JobStatus{}, errDatasetsNotLoaded
+	}
+	// a job that can't run fails now rather than when it is polled; it runs on the snapshot of
+	// when it starts, so a queued job doesn't hold on to this one
+	if err := ValidateScoreConfig(cfg, scoreDatasets(snapshot)); err != nil {
+		return JobStatus{}, fmt.Errorf("invalid score config %s: %w", cfg.Name, err)
+	}
+	query := req.Filters.query()
+	filter, err := ParseScoreFilter(query, cfg)
+	if err != nil {
+		return JobStatus{}, err
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	j := &job{id: uuid.NewString(), cfg: cfg, filter: filter, query: query.Encode(), cancel: cancel, state: JobQueued}
+	m.mu.Lock()
+	m.purge()
+	j.created = m.now()
+	m.jobs[j.id] = j
+	status := m.status(j)
+	m.mu.Unlock()
+
+	go m.run(ctx, j)
+	return status, nil
+}
+
+func (m *JobManager) product(name string) (*c.Config, error) {
+	if name == "" && len(m.configs) == 1 {
+		for _, cfg := range m.configs {
+			return cfg, nil
+		}
+	}
+	cfg, ok := m.configs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown product %q", name)
+	}
+	return cfg, nil
+}
+
+// overrideMetrics returns the config with each override replacing the metric of the same name, or
+// added after the others. The config itself is not changed.
+func overrideMetrics(scoreConfig *c.Config, overrides []c.Metric) *c.Config {
+	if len(overrides) == 0 {
+		return scoreConfig
+	}
+	out := &c.Config{Name: scoreConfig.Name, Metrics: append([]c.Metric(nil), scoreConfig.Metrics...)}
+	for _, override := range overrides {
+		replaced := false
+		for i := range out.Metrics {
+			if out.Metrics[i].Name == override.Name {
+				out.Metrics[i], replaced = override, true
+				break
+			}
+		}
+		if !replaced {
+			out.Metrics = append(out.Metrics, override)
+		}
+	}
+	return out
+}
+
+func (m *JobManager) run(ctx context.Context, j *job) {
+	defer j.cancel()
+	select {
+	case m.slots <- struct{}{}:
+		defer func() { <-m.slots }()
+	case <-ctx.Done():
+		m.finish(j, 0, ctx.Err())
+		return
+	}
+
+	m.mu.Lock()
+	j.state, j.started = JobRunning, m.now()
+	m.mu.Unlock()
+
+	// a succeeded job is a run too, stored under the job's ID: the rows go straight to the store
+	snapshot := m.store.Snapshot()
+	rec := newRunRecorder(m.runs, j.id, "job", j.query, j.cfg, j.filter)
+	rec.setSnapshot(snapshot)
+	rows := 0
+	err := EmitScoresFiltered(withProgress(ctx, &j.progress), j.cfg, snapshot, j.filter, func(key CompanyYearKey, values map[string]float64) error {
+		rec.add(ScoredRow{CompanyID: key.CompanyID, Year: key.Year, Values: values})
+		rows++
+		return ctx.Err()
+	})
+	rec.finish(errors.Join(err, ctx.Err()))
+	if err == nil && m.runs != nil && !rec.stored() {
+		err = fmt.Errorf("failed to store the result of job %s", j.id)
+	}
+	m.finish(j, rows, err)
+}
+
+func (m *JobManager) finish(j *job, rows int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j.finished = m.now()
+	switch {
+	case j.cancelled:
+		j.state = JobCancelled
+	case err != nil:
+		j.state, j.err = JobFailed, err.Error()
+		log.Printf("[WARN] job %s failed: %v", j.id, err)
+	default:
+		j.state, j.rows = JobSucceeded, rows
+	}
+}
+
+// Status returns the status of a job that has not expired.
+func (m *JobManager) Status(id string) (JobStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.purge()
+	j, ok := m.jobs[id]
+	if !ok {
+		return JobStatus{}, errJobNotFound
+	}
+	return m.status(j), nil
+}
+
+// result returns the job and the record of its stored run once it has succeeded.
+func (m *JobManager) result(id string) (*job, RunRecord, JobStatus, error) {
+	m.mu.Lock()
+	m.purge()
+	j, ok := m.jobs[id]
+	var status JobStatus
+	if ok {
+		status = m.status(j)
+	}
+	m.mu.Unlock()
+	if !ok {
+		return nil, RunRecord{}, JobStatus{}, errJobNotFound
+	}
+	if status.State != JobSucceeded {
+		return j, RunRecord{}, status, nil
+	}
+	if m.runs == nil {
+		return j, RunRecord{}, status, errJobResultNotKept
+	}
+	record, err := m.runs.Get(id)
+	if errors.Is(err, errRunNotFound) {
+		err = fmt.Errorf("%w anymore (see RUNS_RETENTION and RUNS_MAX)", errJobResultNotKept)
+	}
+	return j, record, status, err
+}
+
+// Cancel stops a queued or running job, which stays around as cancelled. A finished job is removed
+// (with its results); removed reports which happened.
+func (m *JobManager) Cancel(id string) (status JobStatus, removed bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.purge()
+	j, ok := m.jobs[id]
+	if !ok {
+		return JobStatus{}, false, errJobNotFound
+	}
+	if j.state.finished() {
+		delete(m.jobs, id)
+		return m.status(j), true, nil
+	}
+	j.cancelled = true
+	j.cancel()
+	return m.status(j), false, nil
+}
+
+// purge drops the jobs that finished more than the retention ago. Callers hold mu.
+func (m *JobManager) purge() {
+	now := m.now()
+	for id, j := range m.jobs {
+		if j.state.finished() && now.Sub(j.finished) > m.retention {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// status is the status of j. Callers hold mu.
+func (m *JobManager) status(j *job) JobStatus {
+	s := JobStatus{
+		ID:        j.id,
+		Product:   j.cfg.Name,
+		State:     j.state,
+		Progress:  JobProgress{Done: j.progress.done.Load(), Total: j.progress.total.Load()},
+		Error:     j.err,
+		Rows:      j.rows,
+		CreatedAt: j.created,
+	}
+	if !j.started.IsZero() {
+		s.StartedAt = &j.started
+	}
+	if !j.finished.IsZero() {
+		expires := j.finished.Add(m.retention)
+		s.FinishedAt, s.ExpiresAt = &j.finished, &expires
+	}
+	return s
+}
+
+// JobsHandler serves the jobs API:
+//   - POST /jobs queues a job (JobRequest) and answers 202 with its status
+//   - GET /jobs/{id} is the status of a job
+//   - GET /jobs/{id}/result is the rows of a succeeded job, with the output options of /run-scores
+//     (format, sort, precision, and filters narrowing the job's further)
+//   - DELETE /jobs/{id} cancels a job, or removes a finished one
+func JobsHandler(jobs *JobManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodPost:
+			var req JobRequest
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid job request: %v", err), http.StatusBadRequest)
+				return
+			}
+			status, err := jobs.Submit(req)
+			if errors.Is(err, errDatasetsNotLoaded) {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Location", "/jobs/"+status.ID)
+			writeJobStatus(w, http.StatusAccepted, status)
+		case id == "":
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		case sub == "" && r.Method == http.MethodGet:
+			status, err := jobs.Status(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			writeJobStatus(w, http.StatusOK, status)
+		case sub == "" && r.Method == http.MethodDelete:
+			status, removed, err := jobs.Cancel(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if removed {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			writeJobStatus(w, http.StatusOK, status)
+		case sub == "result" && r.Method == http.MethodGet:
+			serveJobResult(w, r, jobs, id)
+		case sub == "" || sub == "result":
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+func serveJobResult(w http.ResponseWriter, r *http.Request, jobs *JobManager, id string) {
+	j, record, status, err := jobs.result(id)
+	switch {
+	case errors.Is(err, errJobNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errJobResultNotKept):
+		http.Error(w, fmt.Sprintf("job %s: %v", id, err), http.StatusGone)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+		return
+	case status.State != JobSucceeded:
+		http.Error(w, fmt.Sprintf("job %s is %s, it has no result", id, status.State), http.StatusConflict)
+		return
+	}
+	out, ok := parseScoreRequest(w, r, j.filter.Output(j.cfg))
+	if !ok {
+		return
+	}
+	out.meta.RunID, out.meta.GeneratedAt = status.ID, status.FinishedAt.UTC()
+	writeRunRows(w, jobs.runs, record.ID, out)
+}
+
+func writeJobStatus(w http.ResponseWriter, code int, status JobStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Failed to write job status: %v", err)
+	}
+}
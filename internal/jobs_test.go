@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+func newJobsFixture(t *testing.T, opts JobOptions) (*JobManager, *DatasetStore, http.HandlerFunc) {
+	dir := t.TempDir()
+	writePartitionFixture(t, dir)
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	if opts.Runs == nil {
+		if opts.Runs, err = NewFileRunStore(t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	jobs := NewJobManager(ctx, store, opts, crossSectionalConfig())
+	return jobs, store, JobsHandler(jobs)
+}
+
+func serveJobs(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(method, target, bytes.NewBufferString(body)))
+	return rec
+}
+
+// waitJob polls a job until it is in one of states.
+func waitJob(t *testing.T, jobs *JobManager, id string, states ...JobState) JobStatus {
+	var status JobStatus
+	require.Eventually(t, func() bool {
+		var err error
+		status, err = jobs.Status(id)
+		require.NoError(t, err)
+		for _, s := range states {
+			if status.State == s {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 5*time.Millisecond)
+	return status
+}
+
+func TestJobsHandler(t *testing.T) {
+	jobs, store, handler := newJobsFixture(t, JobOptions{})
+
+	rec := serveJobs(handler, http.MethodPost, "/jobs", `{"product": "cross_sectional", "filters": {"company": ["5001", "5002"], "from_year": 2022, "metrics": ["total", "gri"]}}`)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var submitted JobStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &submitted))
+	assert.Equal(t, "/jobs/"+submitted.ID, rec.Header().Get("Location"))
+	assert.Equal(t, "cross_sectional", submitted.Product)
+
+	status := waitJob(t, jobs, submitted.ID, JobSucceeded)
+	assert.Equal(t, 4, status.Rows)
+	assert.Equal(t, status.Progress.Total, status.Progress.Done)
+	assert.Positive(t, status.Progress.Total)
+	require.NotNil(t, status.ExpiresAt)
+	assert.Equal(t, status.FinishedAt.Add(time.Hour), *status.ExpiresAt)
+
+	rec = serveJobs(handler, http.MethodGet, "/jobs/"+submitted.ID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"state":"succeeded"`)
+
+	// the rows of /run-scores with the same filter, in any format
+	scores := httptest.NewRecorder()
+	CalculateScoreHandler(context.Background(), crossSectionalConfig(), store, nil)(scores,
+		httptest.NewRequest(http.MethodGet, "/run-scores?company=5001,5002&from_year=2022&metrics=total,gri&sort=-total", nil))
+	rec = serveJobs(handler, http.MethodGet, "/jobs/"+submitted.ID+"/result?sort=-total", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, scores.Body.String(), rec.Body.String())
+	assert.Equal(t, submitted.ID, rec.Header().Get("X-Run-ID"))
+
+	rec = serveJobs(handler, http.MethodGet, "/jobs/"+submitted.ID+"/result?format=json&company=5002", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var result struct {
+		RunID string      `json:"run_id"`
+		Rows  []ScoredRow `json:"rows"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, submitted.ID, result.RunID)
+	assert.Len(t, result.Rows, 2)
+	assert.Equal(t, http.StatusBadRequest, serveJobs(handler, http.MethodGet, "/jobs/"+submitted.ID+"/result?metrics=weighted", "").Code,
+		"not a metric of the job")
+
+	// a finished job is removed
+	assert.Equal(t, http.StatusNoContent, serveJobs(handler, http.MethodDelete, "/jobs/"+submitted.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, serveJobs(handler, http.MethodGet, "/jobs/"+submitted.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, serveJobs(handler, http.MethodGet, "/jobs/"+submitted.ID+"/result", "").Code)
+
+	for body, want := range map[string]int{
+		`{"product": "nope"}`:                            http.StatusBadRequest,
+		`{"filters": {"metrics": ["nope"]}}`:             http.StatusBadRequest,
+		`{"filters": {"from_year": 2024, "to_year": 1}}`: http.StatusBadRequest,
+		`{"overrides": [{"name": "total", "operation": {"type": "sum", "parameters": [{"source": "self.nope"}]}}]}`: http.StatusBadRequest,
+		`{"colour": "blue"}`: http.StatusBadRequest,
+		`not json`:           http.StatusBadRequest,
+	} {
+		assert.Equal(t, want, serveJobs(handler, http.MethodPost, "/jobs", body).Code, body)
+	}
+	assert.Equal(t, http.StatusMethodNotAllowed, serveJobs(handler, http.MethodPut, "/jobs", "").Code)
+	assert.Equal(t, http.StatusNotFound, serveJobs(handler, http.MethodGet, "/jobs/x/y", "").Code)
+}
+
+func TestJobOverrides(t *testing.T) {
+	jobs, _, _ := newJobsFixture(t, JobOptions{})
+	doubled := c.Metric{Name: "total", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{{Source: "waste.wst_1"}, {Source: "waste.wst_1"}}}}
+	extra := c.Metric{Name: "ratio", Operation: c.Operation{Type: "divide", Parameters: []c.Parameter{{Source: "self.total"}, {Source: "waste.wst_1"}}}}
+	status, err := jobs.Submit(JobRequest{Overrides: []c.Metric{doubled, extra}, Filters: JobFilters{Company: []string{"5001"}, Year: []int{2022}}})
+	require.NoError(t, err)
+	waitJob(t, jobs, status.ID, JobSucceeded)
+
+	_, record, _, err := jobs.result(status.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, record.Rows)
+	var rows ScoreRows
+	require.NoError(t, jobs.runs.Rows(status.ID, func(row ScoredRow) error {
+		rows = append(rows, row)
+		return nil
+	}))
+	require.Len(t, rows, 1)
+	// 5001/2022: wst_1 = (7 + 6066) % 40 % 7 = 5
+	assert.Equal(t, float64(10), rows[0].Values["total"])
+	assert.Equal(t, float64(2), rows[0].Values["ratio"])
+	assert.Len(t, crossSectionalConfig().Metrics, len(jobs.configs["cross_sectional"].Metrics), "the product is not changed")
+}
+
+func TestJobCancelAndRetention(t *testing.T) {
+	release := make(chan struct{})
+	operations["test_block"] = func(ctx context.Context, m *planMetric, slot int, f *frame) (float64, bool) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return 1, false
+	}
+	defer delete(operations, "test_block")
+
+	jobs, _, handler := newJobsFixture(t, JobOptions{Concurrency: 1, Retention: time.Minute})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	jobs.mu.Lock()
+	jobs.now = func() time.Time { return now }
+	jobs.mu.Unlock()
+	blocked := JobRequest{Overrides: []c.Metric{{Name: "blocked", Operation: c.Operation{Type: "test_block", Parameters: []c.Parameter{{Source: "waste.wst_1"}}}}}}
+
+	first, err := jobs.Submit(blocked)
+	require.NoError(t, err)
+	waitJob(t, jobs, first.ID, JobRunning)
+	second, err := jobs.Submit(blocked)
+	require.NoError(t, err)
+	assert.Equal(t, JobQueued, second.State, "one job at a time")
+	assert.Equal(t, http.StatusConflict, serveJobs(handler, http.MethodGet, "/jobs/"+second.ID+"/result", "").Code)
+
+	// a queued job is cancelled without running, a running one stops
+	rec := serveJobs(handler, http.MethodDelete, "/jobs/"+second.ID, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	waitJob(t, jobs, second.ID, JobCancelled)
+	_, _, err = jobs.Cancel(first.ID)
+	require.NoError(t, err)
+	status := waitJob(t, jobs, first.ID, JobCancelled)
+	assert.Zero(t, status.Rows)
+
+	// the next job gets the slot back
+	close(release)
+	third, err := jobs.Submit(blocked)
+	require.NoError(t, err)
+	waitJob(t, jobs, third.ID, JobSucceeded)
+
+	jobs.mu.Lock()
+	now = now.Add(time.Minute + time.Second)
+	jobs.mu.Unlock()
+	for _, id := range []string{first.ID, second.ID, third.ID} {
+		_, err := jobs.Status(id)
+		assert.ErrorIs(t, err, errJobNotFound, id)
+	}
+}
+
+func TestJobResultFromRunStore(t *testing.T) {
+	rs, err := NewFileRunStore(t.TempDir())
+	require.NoError(t, err)
+	jobs, _, handler := newJobsFixture(t, JobOptions{Runs: rs, Retention: 50 * time.Millisecond})
+	status, err := jobs.Submit(JobRequest{Filters: JobFilters{Company: []string{"5001"}}})
+	require.NoError(t, err)
+	waitJob(t, jobs, status.ID, JobSucceeded)
+	rec := serveJobs(handler, http.MethodGet, "/jobs/"+status.ID+"/result?format=ndjson", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"company_id":"5001"`)
+
+	// the result is the stored run: once the run store drops it, the job has none
+	rs.MaxRuns = 1
+	status2, err := jobs.Submit(JobRequest{Filters: JobFilters{Company: []string{"5002"}}})
+	require.NoError(t, err)
+	waitJob(t, jobs, status2.ID, JobSucceeded)
+	assert.Equal(t, http.StatusGone, serveJobs(handler, http.MethodGet, "/jobs/"+status.ID+"/result", "").Code)
+
+	// expired jobs are purged without anyone calling the API
+	require.Eventually(t, func() bool {
+		jobs.mu.Lock()
+		defer jobs.mu.Unlock()
+		return len(jobs.jobs) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// without a run store a job keeps its status only
+	noRuns := NewJobManager(context.Background(), jobs.store, JobOptions{}, crossSectionalConfig())
+	status, err = noRuns.Submit(JobRequest{})
+	require.NoError(t, err)
+	assert.Positive(t, waitJob(t, noRuns, status.ID, JobSucceeded).Rows)
+	assert.Equal(t, http.StatusGone, serveJobs(JobsHandler(noRuns), http.MethodGet, "/jobs/"+status.ID+"/result", "").Code)
+}
@@ -9,196 +9,322 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"time"
 )
 
-// DataLoader interface: for reading data from a specific file/path.
+// DataLoader interface: decodes the raw rows of a dataset from a stream (a local file,
+// an S3 object, ...). name is the object's file name, e.g. "waste_data.csv".
+// Rows are returned as-is (including the ones that failed to parse) so data-quality rules
+// can run before the rows are reduced to one per (company, year).
 type DataLoader interface {
-	LoadData(ctx context.Context, path string) (map[CompanyYearKey]map[string]float64, error)
+	LoadRecords(ctx context.Context, name string, r io.Reader) ([]Record, error)
+}
+
+// RecordStreamer is implemented by loaders that can hand out the rows of a source one at a time
+// instead of returning them all, so partitioned scoring never holds a whole source in memory.
+// fn is called in source order; an error from it stops the stream and is returned.
+type RecordStreamer interface {
+	StreamRecords(ctx context.Context, name string, r io.Reader, fn func(Record) error) error
+}
+
+// Fingerprinter is implemented by loaders whose data lives outside the object they are registered
+// for (e.g. a database). The store asks them for a fingerprint of that data on every refresh, on
+// top of the object's own hash/ETag; an empty fingerprint means "only the object matters".
+type Fingerprinter interface {
+	Fingerprint(ctx context.Context, name string, r io.Reader) (string, error)
+}
+
+// Record is one raw row of a dataset.
+type Record struct {
+	CompanyID string
+	RawDate   string
+	Date      time.Time
+	Values    map[string]Value
+	// Row is the 1-based position of the row in its source (line number for CSV, element for JSON)
+	Row int
+	// Invalid is set when the row could not be parsed (bad date, wrong number of fields, ...)
+	Invalid error
+	// KnownAt is when the values became known (optional "known_at" column). Sources can keep several
+	// observations of the same (company, date) with different KnownAt; the latest known one is current.
+	// Rows without it are known from the time their source was loaded.
+	KnownAt time.Time
+	// Removed marks a row that disappeared from its source at KnownAt (kept for as-of history)
+	Removed bool
 }
 
 // CSVLoader A simple CSV loader example.
 type CSVLoader struct{}
 
-func (CSVLoader) LoadData(ctx context.Context, path string) (map[CompanyYearKey]map[string]float64, error) {
-	return loadDatasetCSV(path) // reuse your existing CSV parsing function
+func (CSVLoader) LoadRecords(ctx context.Context, name string, r io.Reader) ([]Record, error) {
+	return readCSVRecords(ctx, r)
+}
+
+func (CSVLoader) StreamRecords(ctx context.Context, name string, r io.Reader, fn func(Record) error) error {
+	return scanCSVRecords(ctx, r, fn)
+}
+
+func (CSVLoader) LoadData(ctx context.Context, path string) (Dataset, error) {
+	records, err := withFile(ctx, path, readCSVRecords)
+	if err != nil {
+		return nil, err
+	}
+	return latestPerYear(records), nil
 }
 
 // JSONLoader Temporary files to test the JSON Import only
 type JSONLoader struct{}
 
-func (JSONLoader) LoadData(ctx context.Context, path string) (map[CompanyYearKey]map[string]float64, error) {
-	return loadJSONDataset(path)
+func (JSONLoader) LoadRecords(ctx context.Context, name string, r io.Reader) ([]Record, error) {
+	return readJSONRecords(ctx, r)
+}
+
+func (JSONLoader) StreamRecords(ctx context.Context, name string, r io.Reader, fn func(Record) error) error {
+	return scanJSONRecords(ctx, r, fn)
 }
 
-func loadDatasetCSV(filename string) (map[CompanyYearKey]map[string]float64, error) {
+func (JSONLoader) LoadData(ctx context.Context, path string) (Dataset, error) {
+	records, err := withFile(ctx, path, readJSONRecords)
+	if err != nil {
+		return nil, err
+	}
+	return latestPerYear(records), nil
+}
+
+// knownAtField is the optional column holding a row's knowledge timestamp.
+const knownAtField = "known_at"
+
+// ctxCheckEvery is how many rows a reader parses between two checks for cancellation.
+const ctxCheckEvery = 1024
+
+func withFile(
+	ctx context.Context,
+	filename string,
+	read func(context.Context, io.Reader) ([]Record, error),
+) ([]Record, error) {
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	reader := csv.NewReader(f)
+	records, err := read(ctx, f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", filename, err)
+	}
+	return records, nil
+}
+
+func loadDatasetCSV(filename string) (Dataset, error) {
+	records, err := withFile(context.Background(), filename, readCSVRecords)
+	if err != nil {
+		return nil, err
+	}
+	return latestPerYear(records), nil
+}
+
+func readCSVRecords(ctx context.Context, r io.Reader) ([]Record, error) {
+	var records []Record
+	err := scanCSVRecords(ctx, r, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// scanCSVRecords parses a CSV source row by row.
+func scanCSVRecords(ctx context.Context, r io.Reader, fn func(Record) error) error {
+	reader := csv.NewReader(r)
+	// short/long rows are reported per row instead of failing the whole file
+	reader.FieldsPerRecord = -1
 
 	headers, err := reader.Read()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read headers: %v", err)
+		return fmt.Errorf("failed to read headers: %v", err)
 	}
 
 	idxCompany := indexOf(headers, "company_id")
 	idxDate := indexOf(headers, "date")
 	if idxCompany == -1 || idxDate == -1 {
-		return nil, fmt.Errorf("missing required columns (company_id, date)")
+		return fmt.Errorf("missing required columns (company_id, date)")
 	}
+	idxKnownAt := indexOf(headers, knownAtField) // optional
 
-	// Use rowData to store the 'latest' row (by full date) for each (company, year)
-	data := make(map[CompanyYearKey]rowData)
+	for line := 2; ; line++ {
+		if line%ctxCheckEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
 
-	for {
 		row, err := reader.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		companyID := row[idxCompany]
-
-		// 1) Parse the date into a time.Time
-		parsedTime, err := ParseDateOrYear(row[idxDate])
-		if err != nil {
-			// Could skip or handle the error
-			log.Printf("Skipping row for %s due to date parse error: %v", companyID, err)
+		rec := Record{Row: line}
+		if len(row) != len(headers) {
+			rec.Invalid = fmt.Errorf("row has %d fields, header has %d", len(row), len(headers))
+			if err := fn(rec); err != nil {
+				return err
+			}
 			continue
 		}
 
-		// 2) The year is just parsedTime.Year()
-		yearInt := parsedTime.Year()
+		rec.CompanyID = row[idxCompany]
+		rec.RawDate = row[idxDate]
 
-		// The key for our "final" data
-		key := CompanyYearKey{
-			CompanyID: companyID,
-			Year:      yearInt,
+		// 1) Parse the date into a time.Time; the year is just Date.Year()
+		rec.Date, rec.Invalid = ParseDateOrYear(rec.RawDate)
+		if idxKnownAt != -1 && row[idxKnownAt] != "" && rec.Invalid == nil {
+			rec.KnownAt, rec.Invalid = ParseKnownAt(row[idxKnownAt])
 		}
 
-		// Gather numeric columns from the row
-		numericVals := map[string]float64{}
+		// 2) Gather typed values from the row; empty cells are null and left out
+		rec.Values = map[string]Value{}
 		for i, colName := range headers {
-			if i == idxCompany || i == idxDate {
+			if i == idxCompany || i == idxDate || i == idxKnownAt {
 				continue
 			}
-			valStr := row[i]
-			if valStr == "" {
-				continue
-			}
-			if v, err := strconv.ParseFloat(valStr, 64); err == nil {
-				numericVals[colName] = v
+			if v := ParseValue(row[i]); !v.IsNull() {
+				rec.Values[colName] = v
 			}
 		}
-
-		// 3) Check if we have an existing entry for (company, year). If not, store it.
-		if existing, ok := data[key]; !ok {
-			data[key] = rowData{
-				date:    parsedTime,
-				numeric: numericVals,
-			}
-		} else {
-			// 4) If we do have an existing entry, only overwrite if the new date is "later"
-			//    (based on your chosen definition of "latest").
-			if parsedTime.After(existing.date) {
-				data[key] = rowData{
-					date:    parsedTime,
-					numeric: numericVals,
-				}
-			}
+		if err := fn(rec); err != nil {
+			return err
 		}
 	}
 
-	// 5) Flatten rowData => final map for each (CompanyYearKey)
-	result := make(map[CompanyYearKey]map[string]float64)
-	for key, rd := range data {
-		result[key] = rd.numeric
-	}
-
-	return result, nil
+	return nil
 }
 
-func loadJSONDataset(filename string) (map[CompanyYearKey]map[string]float64, error) {
-	f, err := os.Open(filename)
+func readJSONRecords(ctx context.Context, r io.Reader) ([]Record, error) {
+	var records []Record
+	err := scanJSONRecords(ctx, r, func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	bytes, err := io.ReadAll(f)
-	if err != nil {
-		return nil, fmt.Errorf("error reading %s: %w", filename, err)
-	}
+	return records, nil
+}
 
-	// Unmarshal into a slice of rawJSONRow
-	var rows []rawJSONRow
-	if err := json.Unmarshal(bytes, &rows); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal JSON from %s: %w", filename, err)
+// scanJSONRecords decodes a JSON array of objects element by element: every key other than
+// company_id/date is a field, typed by its JSON value.
+func scanJSONRecords(ctx context.Context, r io.Reader, fn func(Record) error) error {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return fmt.Errorf("failed to unmarshal JSON: expected an array of objects")
 	}
 
-	// We'll store rowData with date/time for each (company, year)
-	data := make(map[CompanyYearKey]rowData)
+	for i := 0; dec.More(); i++ {
+		if i%ctxCheckEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		var r map[string]interface{}
+		if err := dec.Decode(&r); err != nil {
+			return fmt.Errorf("failed to unmarshal JSON: %w", err)
+		}
 
-	for _, r := range rows {
-		// Parse the date -> time.Time
-		parsedTime, err := ParseDateOrYear(r.DateStr)
-		if err != nil {
-			log.Printf("Skipping row for company=%s due to invalid date %q: %v", r.CompanyID, r.DateStr, err)
+		rec := Record{
+			Row:       i + 1,
+			CompanyID: jsonKeyString(r["company_id"]),
+			RawDate:   jsonKeyString(r["date"]),
+			Values:    make(map[string]Value),
+		}
+		if rec.CompanyID == "" || rec.RawDate == "" {
+			rec.Invalid = fmt.Errorf("missing company_id or date")
+			if err := fn(rec); err != nil {
+				return err
+			}
 			continue
 		}
 
-		// Convert to year
-		yearInt := parsedTime.Year()
-
-		key := CompanyYearKey{
-			CompanyID: r.CompanyID,
-			Year:      yearInt,
+		// Parse the date -> time.Time
+		rec.Date, rec.Invalid = ParseDateOrYear(rec.RawDate)
+		if knownAt := jsonKeyString(r[knownAtField]); knownAt != "" && rec.Invalid == nil {
+			rec.KnownAt, rec.Invalid = ParseKnownAt(knownAt)
 		}
 
-		// Gather numeric columns
-		numericVals := make(map[string]float64)
-		if r.Dis1 != nil {
-			numericVals["dis_1"] = *r.Dis1
+		// Gather typed values
+		for field, raw := range r {
+			if field == "company_id" || field == "date" || field == knownAtField {
+				continue
+			}
+			v, err := valueFromJSON(raw)
+			if err != nil {
+				rec.Invalid = fmt.Errorf("field %s: %w", field, err)
+				break
+			}
+			if !v.IsNull() {
+				rec.Values[field] = v
+			}
 		}
-		if r.Dis2 != nil {
-			numericVals["dis_2"] = *r.Dis2
+		if err := fn(rec); err != nil {
+			return err
 		}
-		if r.Dis3 != nil {
-			numericVals["dis_3"] = *r.Dis3
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("failed to unmarshal JSON: %w", err)
+	}
+	return nil
+}
+
+// latestPerYear keeps, for each (company, year), the row with the latest date and, among the
+// observations of that date, the latest known one. Rows that failed to parse are skipped.
+func latestPerYear(records []Record) Dataset {
+	// Use rowData to store the 'latest' row (by full date) for each (company, year)
+	data := make(map[CompanyYearKey]rowData)
+
+	for _, rec := range records {
+		if rec.Invalid != nil {
+			log.Printf("Skipping row %d for %s: %v", rec.Row, rec.CompanyID, rec.Invalid)
+			continue
 		}
-		if r.Dis4 != nil {
-			numericVals["dis_4"] = *r.Dis4
+
+		key := CompanyYearKey{
+			CompanyID: rec.CompanyID,
+			Year:      rec.Date.Year(),
 		}
-		// If you had more columns (dis_5, etc.), add them likewise.
 
-		// Check if we have an existing row for this (company, year).
-		if existing, ok := data[key]; !ok {
-			// If not, store it
+		// Check if we have an existing entry for (company, year). If not, store it.
+		// If we do, only overwrite if the new date is "later" (or the same date, known later).
+		existing, ok := data[key]
+		if !ok || rec.Date.After(existing.date) || (rec.Date.Equal(existing.date) && rec.KnownAt.After(existing.knownAt)) {
 			data[key] = rowData{
-				date:    parsedTime,
-				numeric: numericVals,
-			}
-		} else {
-			// If we do have an entry, only overwrite if parsedTime is "later"
-			if parsedTime.After(existing.date) {
-				data[key] = rowData{
-					date:    parsedTime,
-					numeric: numericVals,
-				}
+				date:    rec.Date,
+				knownAt: rec.KnownAt,
+				values:  rec.Values,
 			}
 		}
 	}
 
 	// Flatten rowData => final map for each (CompanyYearKey)
-	result := make(map[CompanyYearKey]map[string]float64, len(data))
-	for k, rd := range data {
-		result[k] = rd.numeric
+	result := make(Dataset, len(data))
+	for key, rd := range data {
+		result[key] = rd.values
 	}
+	return result
+}
 
-	return result, nil
+// jsonKeyString accepts company ids and dates written either as strings
+// ("1001", "2024-03-01", "2024") or as bare integers (1001, 2024).
+func jsonKeyString(raw interface{}) string {
+	switch v := raw.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return ""
+	}
 }
@@ -2,102 +2,161 @@ package internal
 
 import (
 	"context"
-	"fmt"
-	"log"
+	"math"
+	"sort"
 
 	c "esgbook-software-engineer-technical-test-2024/config"
 )
 
-func evalSum(
-	ctx context.Context,
-	params []c.Parameter,
-	key CompanyYearKey,
-	results map[string]float64,
-	datasets map[string]map[CompanyYearKey]map[string]float64,
-) (float64, bool, error) {
-
-	var total float64
-	var anyNonNull bool
-
-	for _, p := range params {
-		val, isNull := getValue(p.Source, key, results, datasets)
-		if !isNull {
-			total += val
-			anyNonNull = true
-		}
-	}
-
-	if !anyNonNull {
-		log.Printf("[evalSum] All parameters are null => null")
-		return 0, true, nil
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
 	}
+	return 0
+}
 
-	return total, false, nil
+// numericOperations only read number cells; a source of another kind is a type mismatch.
+var numericOperations = map[string]bool{
+	"sum":      true,
+	"or":       true,
+	"divide":   true,
+	"lag":      true,
+	"pct_rank": true,
 }
 
-func evalOr(
+// CrossKeyFn evaluates an operation whose value at one key depends on other keys (other years of
+// the same company, other companies of the same year). It computes the metric for every target
+// at once, reading the results of the earlier metrics for all keys.
+type CrossKeyFn func(
 	ctx context.Context,
-	params []c.Parameter,
+	op c.Operation,
+	params []sourceRef,
+	targets []CompanyYearKey,
+	allKeys []CompanyYearKey,
+	results map[CompanyYearKey]map[string]float64,
+	cols *ColumnStore,
+) map[CompanyYearKey]float64
+
+// crossKeyOperations are evaluated in their own stage, after every key has the earlier metrics.
+var crossKeyOperations = map[string]CrossKeyFn{
+	"lag":      evalLag,
+	"pct_rank": evalPctRank,
+}
+
+// crossCompanyOperations read other companies (lag only reads the same company). Scoring that
+// splits the companies into partitions or shards has to gather their source across all of them.
+var crossCompanyOperations = map[string]bool{
+	"pct_rank": true,
+}
+
+// valueAt reads a source at any key; self.<metric> comes from that key's results.
+func valueAt(
+	ref sourceRef,
 	key CompanyYearKey,
-	results map[string]float64,
-	datasets map[string]map[CompanyYearKey]map[string]float64,
-) (float64, bool, error) {
+	results map[CompanyYearKey]map[string]float64,
+	cols *ColumnStore,
+) (float64, bool) {
+	return getValue(ref, cols.Slot(key), results[key])
+}
 
-	if len(params) < 2 {
-		return 0, true, fmt.Errorf("[evalOr] not enough parameters")
+// lagPeriods is the number of years "lag" looks back; Periods 0 is the default, 1.
+func lagPeriods(op c.Operation) int {
+	if op.Periods <= 0 {
+		return 1
 	}
+	return op.Periods
+}
 
-	xVal, xNull := getValue(params[0].Source, key, results, datasets)
-	yVal, yNull := getValue(params[1].Source, key, results, datasets)
+// evalLag returns the value of its source `periods` years earlier for the same company.
+func evalLag(
+	ctx context.Context,
+	op c.Operation,
+	params []sourceRef,
+	targets []CompanyYearKey,
+	allKeys []CompanyYearKey,
+	results map[CompanyYearKey]map[string]float64,
+	cols *ColumnStore,
+) map[CompanyYearKey]float64 {
+	out := make(map[CompanyYearKey]float64, len(targets))
+	periods := lagPeriods(op)
+	for _, key := range targets {
+		prev := CompanyYearKey{CompanyID: key.CompanyID, Year: key.Year - periods}
+		if val, isNull := valueAt(params[0], prev, results, cols); !isNull {
+			out[key] = val
+		}
+	}
+	return out
+}
 
-	if !xNull {
-		return xVal, false, nil
+// evalPctRank returns the percentile rank (0..1) of its source among the companies of the same
+// year: (lower + 0.5 * equal) / n over the n non-null values, the value itself counting as equal.
+func evalPctRank(
+	ctx context.Context,
+	op c.Operation,
+	params []sourceRef,
+	targets []CompanyYearKey,
+	allKeys []CompanyYearKey,
+	results map[CompanyYearKey]map[string]float64,
+	cols *ColumnStore,
+) map[CompanyYearKey]float64 {
+	years := make(map[int]bool)
+	for _, key := range targets {
+		years[key.Year] = true
 	}
-	if !yNull {
-		return yVal, false, nil
+	dist := make(yearDistribution)
+	for _, key := range allKeys {
+		if years[key.Year] {
+			dist.addAt(params[0], key, results, cols)
+		}
 	}
-
-	// both are null
-	return 0, true, nil
+	dist.sort()
+	return rankAgainst(dist, params[0], targets, results, cols)
 }
 
-func evalDivide(
-	ctx context.Context,
-	params []c.Parameter,
-	key CompanyYearKey,
-	results map[string]float64,
-	//results map[CompanyYearKey]map[string]float64,
+// rankAgainst ranks the source of every target among the values of its year in dist.
+func rankAgainst(
+	dist yearDistribution,
+	source sourceRef,
+	targets []CompanyYearKey,
+	results map[CompanyYearKey]map[string]float64,
+	cols *ColumnStore,
+) map[CompanyYearKey]float64 {
+	out := make(map[CompanyYearKey]float64, len(targets))
+	for _, key := range targets {
+		if val, isNull := valueAt(source, key, results, cols); !isNull {
+			out[key] = dist.rank(key.Year, val)
+		}
+	}
+	return out
+}
 
-	datasets map[string]map[CompanyYearKey]map[string]float64,
-) (float64, bool, error) {
+// yearDistribution holds the values of a source by year, for cross-sectional operations. Partial
+// distributions (of some companies each) can be merged before they are sorted.
+type yearDistribution map[int][]float64
 
-	if len(params) < 2 {
-		return 0, true, fmt.Errorf("[evalDivide] not enough parameters")
+// addAt adds the source's value at key, if it has one.
+func (d yearDistribution) addAt(source sourceRef, key CompanyYearKey, results map[CompanyYearKey]map[string]float64, cols *ColumnStore) {
+	if val, isNull := valueAt(source, key, results, cols); !isNull {
+		d[key.Year] = append(d[key.Year], val)
 	}
-	xVal, xNull := getValue(params[0].Source, key, results, datasets)
-	yVal, yNull := getValue(params[1].Source, key, results, datasets)
+}
 
-	if xNull || yNull {
-		return 0, true, nil
-	}
-	if yVal == 0 {
-		return 0, true, fmt.Errorf("[evalDivide] division by zero")
+func (d yearDistribution) merge(other yearDistribution) {
+	for year, vals := range other {
+		d[year] = append(d[year], vals...)
 	}
+}
 
-	return xVal / yVal, false, nil
+func (d yearDistribution) sort() {
+	for _, vals := range d {
+		sort.Float64s(vals)
+	}
 }
 
-// OperationFn file operations store
-type OperationFn func(
-	ctx context.Context,
-	params []c.Parameter,
-	key CompanyYearKey,
-	results map[string]float64,
-	datasets map[string]map[CompanyYearKey]map[string]float64,
-) (float64, bool, error)
-
-var operations = map[string]OperationFn{
-	"sum":    evalSum,
-	"or":     evalOr,
-	"divide": evalDivide,
+// rank is the percentile rank of val in its (sorted) year: (lower + 0.5 * equal) / n.
+func (d yearDistribution) rank(year int, val float64) float64 {
+	vals := d[year]
+	lower := sort.SearchFloat64s(vals, val)
+	equal := sort.SearchFloat64s(vals, math.Nextafter(val, math.Inf(1))) - lower
+	return (float64(lower) + 0.5*float64(equal)) / float64(len(vals))
 }
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+func typedDatasets() map[string]Dataset {
+	return map[string]Dataset{
+		"disclosure": {
+			{CompanyID: "1000", Year: 2023}: {
+				"dis_1":               NumberValue(10),
+				"has_net_zero_target": BoolValue(true),
+				"reporting_standard":  StringValue("GRI"),
+			},
+			{CompanyID: "1001", Year: 2023}: {
+				"dis_1":               NumberValue(20),
+				"has_net_zero_target": BoolValue(false),
+				"reporting_standard":  StringValue("TCFD"),
+			},
+		},
+	}
+}
+
+// scoreKey computes the per-key metrics of cfg at one key of datasets.
+func scoreKey(cfg *c.Config, datasets map[string]Dataset, key CompanyYearKey) map[string]float64 {
+	cols := buildColumnStore(datasets)
+	plan := compileStage(cfg.Metrics, cols)
+	row := make(map[string]float64)
+	plan.evalKey(context.Background(), cols.Slot(key), plan.newFrame(), row)
+	return row
+}
+
+func TestCategoricalOperations(t *testing.T) {
+	half := 0.5
+	cfg := &c.Config{
+		Name: "typed",
+		Metrics: []c.Metric{
+			{Name: "net_zero", Operation: c.Operation{Type: "eq", Parameters: []c.Parameter{
+				{Source: "disclosure.has_net_zero_target"}, {Value: "yes"},
+			}}},
+			{Name: "major_standard", Operation: c.Operation{Type: "in",
+				Parameters: []c.Parameter{{Source: "disclosure.reporting_standard"}},
+				Values:     []string{"gri", "SASB"},
+			}},
+			{Name: "standard_score", Operation: c.Operation{Type: "lookup",
+				Parameters: []c.Parameter{{Source: "disclosure.reporting_standard"}},
+				Table:      map[string]float64{"gri": 1, "sasb": 0.8},
+				Default:    &half,
+			}},
+		},
+	}
+	datasets := typedDatasets()
+	require.NoError(t, ValidateScoreConfig(cfg, datasets))
+
+	got := scoreKey(cfg, datasets, CompanyYearKey{CompanyID: "1000", Year: 2023})
+	assert.Equal(t, map[string]float64{"net_zero": 1, "major_standard": 1, "standard_score": 1}, got)
+
+	got = scoreKey(cfg, datasets, CompanyYearKey{CompanyID: "1001", Year: 2023})
+	assert.Equal(t, map[string]float64{"net_zero": 0, "major_standard": 0, "standard_score": 0.5}, got)
+}
+
+func TestValidateScoreConfigTypeMismatch(t *testing.T) {
+	cfg := &c.Config{
+		Name: "bad",
+		Metrics: []c.Metric{
+			{Name: "m1", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{
+				{Source: "disclosure.dis_1"}, {Source: "disclosure.reporting_standard"},
+			}}},
+			{Name: "m2", Operation: c.Operation{Type: "eq", Parameters: []c.Parameter{
+				{Source: "disclosure.has_net_zero_target"}, {Value: "GRI"},
+			}}},
+			{Name: "m3", Operation: c.Operation{Type: "divide", Parameters: []c.Parameter{
+				{Source: "self.m4"}, {Source: "self.m1"},
+			}}},
+		},
+	}
+
+	err := ValidateScoreConfig(cfg, typedDatasets())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "disclosure.reporting_standard holds string values")
+	assert.Contains(t, err.Error(), "compares bool with string")
+	assert.Contains(t, err.Error(), "self.m4 is not defined")
+}
+
+func TestValidateScoreConfigDatasets(t *testing.T) {
+	sum := func(name, source string) c.Metric {
+		return c.Metric{Name: name, Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{{Source: source}}}}
+	}
+	cfg := &c.Config{Name: "datasets", Metrics: []c.Metric{sum("known", "waste.wst_1"), sum("typo", "wastes.wst_1")}}
+
+	// an unknown alias is an error, loaded or not
+	for _, datasets := range []map[string]Dataset{nil, typedDatasets()} {
+		err := ValidateScoreConfig(cfg, datasets)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "metric typo (sum): unknown dataset wastes in source wastes.wst_1")
+		assert.NotContains(t, err.Error(), "metric known")
+	}
+
+	// a known one that is not loaded only warns
+	cfg.Metrics = cfg.Metrics[:1]
+	warnings, err := CheckScoreConfig(cfg, map[string]Dataset{"disclosure": typedDatasets()["disclosure"], "waste": nil})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"metric known (sum): dataset waste is not loaded, waste.wst_1 reads as null"}, warnings)
+}
+
+func TestValidateScoreConfigLagPeriods(t *testing.T) {
+	lag := func(name string, periods int) c.Metric {
+		return c.Metric{Name: name, Operation: c.Operation{Type: "lag", Periods: periods, Parameters: []c.Parameter{
+			{Source: "disclosure.dis_1"},
+		}}}
+	}
+
+	// 0 is the default (1 year)
+	cfg := &c.Config{Name: "lags", Metrics: []c.Metric{lag("prev", 0), lag("prev_2", 2)}}
+	require.NoError(t, ValidateScoreConfig(cfg, typedDatasets()))
+
+	cfg.Metrics = append(cfg.Metrics, lag("next", -1))
+	err := ValidateScoreConfig(cfg, typedDatasets())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "next")
+	assert.Contains(t, err.Error(), "periods cannot be negative")
+}
@@ -24,3 +24,29 @@ func ParseDateOrYear(raw string) (time.Time, error) {
 	//dateString := fmt.Sprintf("%04d-12-31", yearInt)
 	return time.Date(yearInt, time.January, 1, 0, 0, 0, 0, time.UTC), nil
 }
+
+// ParseKnownAt reads a knowledge timestamp: RFC 3339 ("2024-03-01T09:30:00Z") or a plain
+// date ("2024-03-01", midnight UTC).
+func ParseKnownAt(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid known_at %q, expected RFC 3339 or YYYY-MM-DD", raw)
+	}
+	return t, nil
+}
+
+// ParseAsOf reads the instant of an as-of query: an RFC 3339 timestamp is taken as is, a plain
+// date ("2024-03-01") means the end of that day (UTC).
+func ParseAsOf(raw string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid as_of %q, expected RFC 3339 or YYYY-MM-DD", raw)
+	}
+	return t.Add(24*time.Hour - time.Nanosecond), nil
+}
@@ -43,14 +43,43 @@ func TestLoadDatasetCSV(t *testing.T) {
 	key1000_2023 := CompanyYearKey{CompanyID: "1000", Year: 2023}
 	row, ok := results[key1000_2023]
 	require.True(t, ok)
-	assert.Equal(t, 12.34, row["dis_1"])
-	assert.Equal(t, 56.78, row["dis_2"])
+	assert.Equal(t, NumberValue(12.34), row["dis_1"])
+	assert.Equal(t, NumberValue(56.78), row["dis_2"])
 
 	key1001_2024 := CompanyYearKey{CompanyID: "1001", Year: 2024}
 	row2, ok2 := results[key1001_2024]
 	require.True(t, ok2)
-	assert.Equal(t, 44.44, row2["dis_1"])
-	assert.Equal(t, 88.88, row2["dis_2"])
+	assert.Equal(t, NumberValue(44.44), row2["dis_1"])
+	assert.Equal(t, NumberValue(88.88), row2["dis_2"])
+}
+
+func TestLoadDatasetCSVTypedValues(t *testing.T) {
+	csvContent := `company_id,date,emi_1,has_net_zero_target,reporting_standard
+1000,2023,12.5,yes,GRI
+1001,2023,,No,SASB`
+
+	tmpfile, err := os.CreateTemp("", "typed-*.csv")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+
+	_, err = tmpfile.WriteString(csvContent)
+	require.NoError(t, err)
+	require.NoError(t, tmpfile.Close())
+
+	results, err := loadDatasetCSV(tmpfile.Name())
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	row := results[CompanyYearKey{CompanyID: "1000", Year: 2023}]
+	assert.Equal(t, NumberValue(12.5), row["emi_1"])
+	assert.Equal(t, BoolValue(true), row["has_net_zero_target"])
+	assert.Equal(t, StringValue("GRI"), row["reporting_standard"])
+
+	// empty cells are null => not stored
+	row2 := results[CompanyYearKey{CompanyID: "1001", Year: 2023}]
+	_, ok := row2["emi_1"]
+	assert.False(t, ok)
+	assert.Equal(t, BoolValue(false), row2["has_net_zero_target"])
 }
 
 func TestLoadDatasetJSON(t *testing.T) {
@@ -83,8 +112,8 @@ func TestLoadDatasetJSON(t *testing.T) {
 	key1000_2023 := CompanyYearKey{CompanyID: "1000", Year: 2023}
 	row, ok := results[key1000_2023]
 	require.True(t, ok, "Expected an entry for (1000,2023)")
-	assert.Equal(t, 12.34, row["dis_1"])
-	assert.Equal(t, 56.78, row["dis_2"])
+	assert.Equal(t, NumberValue(12.34), row["dis_1"])
+	assert.Equal(t, NumberValue(56.78), row["dis_2"])
 
 	// Check (1001, 2024)
 	key1001_2024 := CompanyYearKey{CompanyID: "1001", Year: 2024}
@@ -94,8 +123,32 @@ func TestLoadDatasetJSON(t *testing.T) {
 	// The second row in JSON is older, the third row is "later" => if you have logic to compare
 	// date "2024-06-30" vs "2024-01-15", we expect the 3rd to overwrite.
 	// In a simple scenario, just expect the final row's values:
-	assert.Equal(t, 44.44, row2["dis_1"])
-	assert.Equal(t, 88.88, row2["dis_2"])
+	assert.Equal(t, NumberValue(44.44), row2["dis_1"])
+	assert.Equal(t, NumberValue(88.88), row2["dis_2"])
+}
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Value
+	}{
+		{"", Value{}},
+		{" 12.5 ", NumberValue(12.5)},
+		{"-3", NumberValue(-3)},
+		{"yes", BoolValue(true)},
+		{"GRI", StringValue("GRI")},
+		{"NaN", StringValue("NaN")},
+		{"nan", StringValue("nan")},
+		{"Inf", StringValue("Inf")},
+		{"-inf", StringValue("-inf")},
+		{"+Infinity", StringValue("+Infinity")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			assert.Equal(t, tt.want, ParseValue(tt.input))
+		})
+	}
 }
 
 func TestParseDateOrYear(t *testing.T) {
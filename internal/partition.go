@@ -0,0 +1,628 @@
+package internal
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// PartitionOptions configure partitioned (out-of-core) scoring.
+type PartitionOptions struct {
+	// MemoryBudget is roughly how many bytes the datasets of one partition may take in memory; the
+	// number of partitions is derived from it and the size of the inputs. 0 = one partition.
+	MemoryBudget int64
+	// Partitions, if set, is used instead of the budget
+	Partitions int
+	// MemoryPerInputByte is how many bytes of memory the parsed rows of one input byte take, to
+	// size partitions from the budget; default defaultMemoryPerInputByte. Inputs that expand more
+	// (narrow CSV columns, many small numbers) need a higher one.
+	MemoryPerInputByte float64
+	// SpillDir is where the spill files go (in a temporary directory removed at the end);
+	// default os.TempDir()
+	SpillDir string
+}
+
+// defaultMemoryPerInputByte estimates how many bytes of memory the parsed rows of one input byte
+// take (measured on CSV inputs: the nested maps of a dataset are ~15x its file).
+const defaultMemoryPerInputByte = 16
+
+// partitionCount derives the number of partitions from the inputs and the options.
+func partitionCount(objects []ObjectInfo, opts PartitionOptions) int {
+	if opts.Partitions > 0 {
+		return opts.Partitions
+	}
+	if opts.MemoryBudget <= 0 {
+		return 1
+	}
+	var total int64
+	for _, o := range objects {
+		total += o.Size
+	}
+	perByte := opts.MemoryPerInputByte
+	if perByte <= 0 {
+		perByte = defaultMemoryPerInputByte
+	}
+	return max(1, int(math.Ceil(float64(total)*perByte/float64(opts.MemoryBudget))))
+}
+
+// partitionOf assigns a company to one of n partitions.
+func partitionOf(companyID string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(companyID))
+	return int(h.Sum32() % uint32(n))
+}
+
+// spillRecord is a Record as written to a spill file (errors don't survive gob).
+type spillRecord struct {
+	CompanyID string
+	RawDate   string
+	Date      time.Time
+	KnownAt   time.Time
+	Values    map[string]Value
+	Row       int
+	Invalid   string
+}
+
+// ScorePartitioned scores the datasets under prefix without ever loading them whole: the rows are
+// first split by company-ID hash into spill files, then the partitions are scored one at a time.
+// Cross-sectional metrics (pct_rank) need every company of a year, so the stages are run in phases:
+// each phase ends by gathering the source of the next cross-sectional metric over all partitions.
+// emit receives the rows by company and year, merged from the partitions; the results are the
+// same as CalculateScore on a snapshot of the same files. Change events are not applied.
+func (s *DataLoaderService) ScorePartitioned(
+	ctx context.Context,
+	scoreConfig *c.Config,
+	storage Storage,
+	prefix string,
+	opts PartitionOptions,
+	emit func(CompanyYearKey, map[string]float64) error,
+) error {
+	tracer := otel.Tracer("score-app")
+	ctx, span := tracer.Start(ctx, "ScorePartitioned")
+	defer span.End()
+
+	// the config itself is checked up front, the kinds of its sources once every partition was seen
+	if err := validateScoreConfigKinds(scoreConfig, nil); err != nil {
+		return fmt.Errorf("invalid score config %s: %w", scoreConfig.Name, err)
+	}
+
+	objects, err := s.scoredObjects(ctx, storage, prefix)
+	if err != nil {
+		return err
+	}
+	n := partitionCount(objects, opts)
+
+	dir, err := os.MkdirTemp(opts.SpillDir, "score-spill-")
+	if err != nil {
+		return fmt.Errorf("failed to create spill directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &partitionRun{service: s, dir: dir, n: n, sources: make(map[string]string)}
+	for _, o := range objects {
+		if err := p.spill(ctx, storage, o); err != nil {
+			return err
+		}
+	}
+	log.Printf("Spilled %d datasets into %d partitions in %s", len(objects), n, dir)
+
+	phases := splitPhases(planStages(scoreConfig))
+	var dist yearDistribution
+	for i := range phases {
+		kinds := make(map[string]map[string]map[ValueKind]bool)
+		var next yearDistribution
+		if i+1 < len(phases) {
+			next = make(yearDistribution)
+		}
+		for part := 0; part < n; part++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := p.scorePartition(ctx, i, part, phases, dist, next, kinds); err != nil {
+				return err
+			}
+		}
+		if i == 0 {
+			if err := validateScoreConfigKinds(scoreConfig, kinds); err != nil {
+				return fmt.Errorf("invalid score config %s: %w", scoreConfig.Name, err)
+			}
+		}
+		if next != nil {
+			next.sort()
+		}
+		dist = next
+	}
+
+	// every partition's final results, merged by company and year
+	return p.mergeResults(emit)
+}
+
+// WritePartitionedScores scores the datasets under prefix out of core (see ScorePartitioned) and
+// writes the rows to w in the named format, with the config's precision. Nothing is kept in memory
+// but the partition being scored, which is what the score command runs on.
+func (s *DataLoaderService) WritePartitionedScores(
+	ctx context.Context,
+	scoreConfig *c.Config,
+	storage Storage,
+	prefix string,
+	opts PartitionOptions,
+	format string,
+	w io.Writer,
+) error {
+	rw, err := defaultFormats.Writer(format, FormatOptions{Delimiter: ','})
+	if err != nil {
+		return err
+	}
+	meta := ResultMeta{
+		Product:     scoreConfig.Name,
+		RunID:       uuid.NewString(),
+		GeneratedAt: time.Now().UTC(),
+		Metrics:     metricFormats(scoreConfig, false),
+	}
+	if err := rw.Begin(w, meta); err != nil {
+		return err
+	}
+	err = s.ScorePartitioned(ctx, scoreConfig, storage, prefix, opts, func(key CompanyYearKey, row map[string]float64) error {
+		return rw.WriteRow(ScoredRow{CompanyID: key.CompanyID, Year: key.Year, Values: row})
+	})
+	if endErr := rw.End(); err == nil {
+		err = endErr
+	}
+	return err
+}
+
+// scoredObjects lists the objects of the datasets score configs read; on a dataset name clash the
+// later object wins, as in a snapshot.
+func (s *DataLoaderService) scoredObjects(ctx context.Context, storage Storage, prefix string) ([]ObjectInfo, error) {
+	objects, err := s.supportedObjects(ctx, storage, prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	scored := make(map[string]bool, len(datasetAliases))
+	for _, name := range datasetAliases {
+		scored[name] = true
+	}
+	byName := make(map[string]int)
+	var out []ObjectInfo
+	for _, o := range objects {
+		name := datasetNameOf(o.Name())
+		if !scored[name] {
+			continue
+		}
+		if i, ok := byName[name]; ok {
+			out[i] = o
+			continue
+		}
+		byName[name] = len(out)
+		out = append(out, o)
+	}
+	return out, nil
+}
+
+// splitPhases cuts the stages before every cross-sectional metric, so every phase but the first
+// starts with one (the first may be empty: its distribution has to be gathered too).
+func splitPhases(stages []stage) [][]stage {
+	phases := [][]stage{nil}
+	for _, st := range stages {
+		if st.crossKey && crossCompanyOperations[st.metrics[0].Operation.Type] {
+			phases = append(phases, nil)
+		}
+		phases[len(phases)-1] = append(phases[len(phases)-1], st)
+	}
+	return phases
+}
+
+type partitionRun struct {
+	service *DataLoaderService
+	dir     string
+	n       int
+	// sources maps dataset name => the object it was read from, for the quality report
+	sources map[string]string
+}
+
+func (p *partitionRun) spillPath(dataset string, part int) string {
+	return filepath.Join(p.dir, fmt.Sprintf("%s.%04d.gob", dataset, part))
+}
+
+func (p *partitionRun) resultsPath(part int) string {
+	return filepath.Join(p.dir, fmt.Sprintf("results.%04d.gob", part))
+}
+
+func (p *partitionRun) rowsPath(part int) string {
+	return filepath.Join(p.dir, fmt.Sprintf("rows.%04d.gob", part))
+}
+
+// spill streams the rows of one object into its dataset's partition files.
+func (p *partitionRun) spill(ctx context.Context, storage Storage, o ObjectInfo) error {
+	name := o.Name()
+	dataset := datasetNameOf(name)
+	p.sources[dataset] = name
+
+	loader, ok := p.service.registry.GetLoader(filepath.Ext(name))
+	if !ok {
+		return fmt.Errorf("no loader for extension %q: %s", filepath.Ext(name), name)
+	}
+	r, err := storage.Open(ctx, o.Key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	files := make([]*os.File, p.n)
+	writers := make([]*bufio.Writer, p.n)
+	encoders := make([]*gob.Encoder, p.n)
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	write := func(rec Record) error {
+		part := partitionOf(rec.CompanyID, p.n)
+		if encoders[part] == nil {
+			f, err := os.Create(p.spillPath(dataset, part))
+			if err != nil {
+				return err
+			}
+			files[part], writers[part] = f, bufio.NewWriter(f)
+			encoders[part] = gob.NewEncoder(writers[part])
+		}
+		sr := spillRecord{CompanyID: rec.CompanyID, RawDate: rec.RawDate, Date: rec.Date, KnownAt: rec.KnownAt, Values: rec.Values, Row: rec.Row}
+		if rec.Invalid != nil {
+			sr.Invalid = rec.Invalid.Error()
+		}
+		return encoders[part].Encode(sr)
+	}
+
+	if err := streamRecords(ctx, loader, name, r, write); err != nil {
+		return fmt.Errorf("failed to spill %s: %w", o.Key, err)
+	}
+
+	for part, w := range writers {
+		if w == nil {
+			continue
+		}
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("failed to spill %s: %w", o.Key, err)
+		}
+		if err := files[part].Close(); err != nil {
+			return fmt.Errorf("failed to spill %s: %w", o.Key, err)
+		}
+		files[part] = nil
+	}
+	return nil
+}
+
+// streamRecords calls fn with every record of a source, as they are read if the loader streams.
+func streamRecords(ctx context.Context, loader DataLoader, name string, r io.Reader, fn func(Record) error) error {
+	if streamer, ok := loader.(RecordStreamer); ok {
+		return streamer.StreamRecords(ctx, name, r, fn)
+	}
+	// the loader can only return the whole source: it has to fit in memory once
+	records, err := loader.LoadRecords(ctx, name, r)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPartition reads one partition of every scored dataset back and reduces it like LoadDataset:
+// quality rules (they only compare rows of the same company) and latest row per year.
+func (p *partitionRun) loadPartition(part int) (map[string]Dataset, error) {
+	datasets := make(map[string]Dataset, len(datasetAliases))
+	for alias, name := range datasetAliases {
+		source, ok := p.sources[name]
+		if !ok {
+			datasets[alias] = nil
+			continue
+		}
+		records, err := readSpill(p.spillPath(name, part))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read partition %d of %s: %w", part, name, err)
+		}
+		accepted, _, _ := applyQualityRules(name, source, records, p.service.quality.Rules(name))
+		datasets[alias] = latestPerYear(accepted)
+	}
+	return datasets, nil
+}
+
+func readSpill(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil // no company of the dataset hashed to this partition
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	for {
+		var sr spillRecord
+		if err := dec.Decode(&sr); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		rec := Record{CompanyID: sr.CompanyID, RawDate: sr.RawDate, Date: sr.Date, KnownAt: sr.KnownAt, Values: sr.Values, Row: sr.Row}
+		if sr.Invalid != "" {
+			rec.Invalid = errors.New(sr.Invalid)
+		}
+		if rec.Values == nil && rec.Invalid == nil {
+			rec.Values = map[string]Value{} // gob drops empty maps
+		}
+		records = append(records, rec)
+	}
+}
+
+// scorePartition scores one partition through phase i. dist is the distribution gathered for the
+// phase's leading cross-sectional metric; next, if not nil, gathers the source of the next phase's.
+// The first phase also collects the field kinds for validation.
+func (p *partitionRun) scorePartition(
+	ctx context.Context,
+	i, part int,
+	phases [][]stage,
+	dist, next yearDistribution,
+	kinds map[string]map[string]map[ValueKind]bool,
+) error {
+	datasets, err := p.loadPartition(part)
+	if err != nil {
+		return err
+	}
+	if i == 0 {
+		for name, ds := range datasets {
+			mergeKinds(kinds, name, ds.FieldKinds())
+		}
+	}
+	cols := buildColumnStore(datasets)
+
+	results := make(map[CompanyYearKey]map[string]float64, len(cols.Keys()))
+	if i == 0 {
+		for _, key := range cols.Keys() {
+			results[key] = map[string]float64{}
+		}
+	} else if results, err = p.readResults(part); err != nil {
+		return err
+	}
+
+	gathered, err := runPhase(ctx, phases, i, cols, results, dist, workerCount(p.service.ScoreWorkers))
+	if err != nil {
+		return err
+	}
+	if next != nil {
+		next.merge(gathered)
+	}
+	return p.writeResults(part, results)
+}
+
+// runPhase runs phase i on the companies of cols into results; dist is what the phase's leading
+// cross-sectional metric ranks against (nil for the first phase). If a phase follows, it returns the
+// values of that phase's cross-sectional source, to be merged with the other companies' and sorted.
+func runPhase(
+	ctx context.Context,
+	phases [][]stage,
+	i int,
+	cols *ColumnStore,
+	results map[CompanyYearKey]map[string]float64,
+	dist yearDistribution,
+	workers int,
+) (yearDistribution, error) {
+	var dists map[string]yearDistribution
+	if dist != nil {
+		dists = map[string]yearDistribution{phases[i][0].metrics[0].Name: dist}
+	}
+	if err := runStages(ctx, phases[i], cols, results, nil, dists, workers); err != nil {
+		return nil, err
+	}
+
+	if i+1 == len(phases) {
+		return nil, nil
+	}
+	gathered := make(yearDistribution)
+	source := cols.bindMetrics(phases[i+1][0].metrics)[0].params[0]
+	for _, key := range cols.Keys() {
+		gathered.addAt(source, key, results, cols)
+	}
+	return gathered, nil
+}
+
+func mergeKinds(kinds map[string]map[string]map[ValueKind]bool, dataset string, fields map[string]map[ValueKind]bool) {
+	if kinds[dataset] == nil {
+		kinds[dataset] = make(map[string]map[ValueKind]bool)
+	}
+	for field, ks := range fields {
+		if kinds[dataset][field] == nil {
+			kinds[dataset][field] = make(map[ValueKind]bool)
+		}
+		for k := range ks {
+			kinds[dataset][field][k] = true
+		}
+	}
+}
+
+func (p *partitionRun) writeResults(part int, results map[CompanyYearKey]map[string]float64) error {
+	f, err := os.Create(p.resultsPath(part))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := gob.NewEncoder(w).Encode(results); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to spill results of partition %d: %w", part, err)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (p *partitionRun) readResults(part int) (map[CompanyYearKey]map[string]float64, error) {
+	f, err := os.Open(p.resultsPath(part))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var results map[CompanyYearKey]map[string]float64
+	if err := gob.NewDecoder(bufio.NewReader(f)).Decode(&results); err != nil {
+		return nil, fmt.Errorf("failed to read results of partition %d: %w", part, err)
+	}
+	for key, row := range results {
+		if row == nil {
+			results[key] = map[string]float64{} // gob drops empty maps
+		}
+	}
+	return results, nil
+}
+
+// mergeResults emits the final results of every partition by company and year: each partition's
+// results are written out as a sorted stream of rows, then the streams are merged, so only one row
+// per partition is held at a time.
+func (p *partitionRun) mergeResults(emit func(CompanyYearKey, map[string]float64) error) error {
+	cursors := make(rowCursors, 0, p.n)
+	defer func() {
+		for _, cur := range cursors {
+			cur.f.Close()
+		}
+	}()
+	for part := 0; part < p.n; part++ {
+		if err := p.writeRows(part); err != nil {
+			return err
+		}
+		f, err := os.Open(p.rowsPath(part))
+		if err != nil {
+			return err
+		}
+		cur := &rowCursor{f: f, dec: gob.NewDecoder(bufio.NewReader(f)), part: part}
+		cursors = append(cursors, cur)
+	}
+
+	var live rowCursors
+	for _, cur := range cursors {
+		ok, err := cur.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			live = append(live, cur)
+		}
+	}
+	heap.Init(&live)
+	for live.Len() > 0 {
+		cur := live[0]
+		values := cur.row.Values
+		if values == nil {
+			values = map[string]float64{} // gob drops empty maps
+		}
+		if err := emit(cur.row.Key(), values); err != nil {
+			return err
+		}
+		ok, err := cur.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&live, 0)
+		} else {
+			heap.Pop(&live)
+		}
+	}
+	return nil
+}
+
+// writeRows writes the results of a partition as a stream of rows sorted by company and year.
+func (p *partitionRun) writeRows(part int) error {
+	results, err := p.readResults(part)
+	if err != nil {
+		return err
+	}
+	rows := newScoreRows(results)
+
+	f, err := os.Create(p.rowsPath(part))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	for i := range rows {
+		if err := enc.Encode(&rows[i]); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to spill rows of partition %d: %w", part, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rowCursor reads the sorted rows of one partition.
+type rowCursor struct {
+	f    *os.File
+	dec  *gob.Decoder
+	part int
+	row  ScoredRow
+}
+
+// next reads the next row; it returns false at the end of the partition.
+func (cur *rowCursor) next() (bool, error) {
+	cur.row = ScoredRow{}
+	if err := cur.dec.Decode(&cur.row); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read rows of partition %d: %w", cur.part, err)
+	}
+	return true, nil
+}
+
+// rowCursors is a heap of cursors by their current row.
+type rowCursors []*rowCursor
+
+func (h rowCursors) Len() int           { return len(h) }
+func (h rowCursors) Less(i, j int) bool { return lessKey(h[i].row.Key(), h[j].row.Key()) }
+func (h rowCursors) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *rowCursors) Push(x any)        { *h = append(*h, x.(*rowCursor)) }
+func (h *rowCursors) Pop() any {
+	old := *h
+	cur := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return cur
+}
+
+// ScorePartitioned scores the store's objects with DataLoaderService.ScorePartitioned, reading
+// them again from storage rather than from the in-memory snapshot.
+func (s *DatasetStore) ScorePartitioned(
+	ctx context.Context,
+	scoreConfig *c.Config,
+	opts PartitionOptions,
+	emit func(CompanyYearKey, map[string]float64) error,
+) error {
+	return s.service.ScorePartitioned(ctx, scoreConfig, s.storage, s.prefix, opts, emit)
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// writePartitionFixture writes datasets with the cases that must survive the spill: restatements
+// (known_at), rows the quality rules reject, unparsable cells, nulls and strings, in CSV and JSON.
+func writePartitionFixture(t *testing.T, dir string) {
+	var emissions, disclosure strings.Builder
+	emissions.WriteString("company_id,date,known_at,emi_1\n")
+	disclosure.WriteString("company_id,date,dis_1,standard\n")
+	var waste []string
+	for company := 0; company < 150; company++ {
+		for year := 2020; year < 2024; year++ {
+			id, date := fmt.Sprint(5000+company), fmt.Sprintf("%d-12-31", year)
+			v := (company*7 + year*3) % 40
+
+			fmt.Fprintf(&emissions, "%s,%s,2024-01-01,%d\n", id, date, v-2) // negative ones are quarantined
+			if company%9 == 0 {
+				fmt.Fprintf(&emissions, "%s,%s,2024-06-01,%d\n", id, date, v+100) // restated
+			}
+			switch {
+			case company%13 == 0:
+				fmt.Fprintf(&disclosure, "%s,%s,oops,gri\n", id, date)
+			case company%5 == 0:
+				fmt.Fprintf(&disclosure, "%s,%s,,sasb\n", id, date)
+			default:
+				fmt.Fprintf(&disclosure, "%s,%s,%d,gri\n", id, date, v%10)
+			}
+			if (company+year)%6 != 0 { // missing company-years
+				waste = append(waste, fmt.Sprintf(`{"company_id": %q, "date": %q, "wst_1": %d}`, id, date, v%7))
+			}
+		}
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "emissions_data.csv"), []byte(emissions.String()), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "disclosure_data.csv"), []byte(disclosure.String()), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "waste_data.json"), []byte("["+strings.Join(waste, ",\n")+"]"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "unrelated.csv"), []byte("company_id,date,x\n1,2020,1\n"), 0o644))
+}
+
+// crossSectionalConfig has metrics in every position relative to the cross-sectional ones:
+// pct_rank first, lag, and a pct_rank of a computed value that later metrics read.
+func crossSectionalConfig() *c.Config {
+	src := func(s string) c.Parameter { return c.Parameter{Source: s} }
+	return &c.Config{Name: "cross_sectional", Metrics: []c.Metric{
+		{Name: "waste_rank", Operation: c.Operation{Type: "pct_rank", Parameters: []c.Parameter{src("waste.wst_1")}}},
+		{Name: "total", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{src("waste.wst_1"), src("emissions.emi_1")}}},
+		{Name: "prev_total", Operation: c.Operation{Type: "lag", Parameters: []c.Parameter{src("self.total")}}},
+		{Name: "growth", Operation: c.Operation{Type: "divide", Parameters: []c.Parameter{src("self.total"), src("self.prev_total")}}},
+		{Name: "gri", Operation: c.Operation{Type: "eq", Parameters: []c.Parameter{src("disclosure.standard"), {Value: "gri"}}}},
+		{Name: "total_rank", Operation: c.Operation{Type: "pct_rank", Parameters: []c.Parameter{src("self.total")}}},
+		{Name: "weighted", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{src("self.total_rank"), src("disclosure.dis_1")}}},
+	}}
+}
+
+func TestScorePartitionedMatchesInMemory(t *testing.T) {
+	dir := t.TempDir()
+	writePartitionFixture(t, dir)
+
+	quality := &c.QualityConfig{Datasets: []c.DatasetRules{{Name: "emissions_data", NonNegative: []string{"emi_1"}, MaxPerYear: 1}}}
+	service := NewDataLoaderService(NewLoaderRegistry(), quality)
+	store := NewDatasetStore(service, FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+
+	cfg := crossSectionalConfig()
+
+	want, err := CalculateScore(context.Background(), cfg, store.Snapshot())
+	require.NoError(t, err)
+
+	for _, opts := range []PartitionOptions{{}, {Partitions: 1}, {Partitions: 3}, {Partitions: 16}, {MemoryBudget: 64 << 10}} {
+		var got ScoreRows
+		opts.SpillDir = t.TempDir()
+		err := store.ScorePartitioned(context.Background(), cfg, opts,
+			func(key CompanyYearKey, row map[string]float64) error {
+				got = append(got, ScoredRow{CompanyID: key.CompanyID, Year: key.Year, Values: row})
+				return nil
+			})
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "%+v", opts) // same rows, by company and year
+	}
+
+	// the spill directory is cleaned up
+	spill := t.TempDir()
+	require.NoError(t, store.ScorePartitioned(context.Background(), cfg, PartitionOptions{Partitions: 4, SpillDir: spill},
+		func(CompanyYearKey, map[string]float64) error { return nil }))
+	entries, err := os.ReadDir(spill)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestWritePartitionedScores(t *testing.T) {
+	dir := t.TempDir()
+	writePartitionFixture(t, dir)
+	service := NewDataLoaderService(NewLoaderRegistry(), nil)
+	cfg := crossSectionalConfig()
+
+	// the same CSV as the in-memory rows written by the server
+	store := NewDatasetStore(service, FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	rows, err := CalculateScore(context.Background(), cfg, store.Snapshot())
+	require.NoError(t, err)
+	var want strings.Builder
+	rw, err := defaultFormats.Writer("csv", FormatOptions{Delimiter: ','})
+	require.NoError(t, err)
+	require.NoError(t, rw.Begin(&want, ResultMeta{Metrics: metricFormats(cfg, false)}))
+	for _, row := range rows {
+		require.NoError(t, rw.WriteRow(row))
+	}
+	require.NoError(t, rw.End())
+
+	var got strings.Builder
+	require.NoError(t, service.WritePartitionedScores(context.Background(), cfg, FileStorage{Root: dir}, "",
+		PartitionOptions{Partitions: 3, SpillDir: t.TempDir()}, "CSV", &got))
+	assert.Equal(t, want.String(), got.String())
+
+	err = service.WritePartitionedScores(context.Background(), cfg, FileStorage{Root: dir}, "",
+		PartitionOptions{}, "parquet", &got)
+	assert.ErrorContains(t, err, `unknown format "parquet"`)
+}
+
+func TestScorePartitionedValidates(t *testing.T) {
+	dir := t.TempDir()
+	writePartitionFixture(t, dir)
+	service := NewDataLoaderService(NewLoaderRegistry(), nil)
+
+	// strings only show up once the partitions were read: nothing is emitted
+	cfg := &c.Config{Name: "bad", Metrics: []c.Metric{
+		{Name: "total", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{{Source: "disclosure.standard"}}}},
+	}}
+	emitted := 0
+	err := service.ScorePartitioned(context.Background(), cfg, FileStorage{Root: dir}, "", PartitionOptions{Partitions: 4},
+		func(CompanyYearKey, map[string]float64) error { emitted++; return nil })
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "operation needs numbers")
+	assert.Zero(t, emitted)
+}
+
+func TestPartitionCount(t *testing.T) {
+	objects := []ObjectInfo{{Size: 1 << 20}, {Size: 3 << 20}}
+	assert.Equal(t, 1, partitionCount(objects, PartitionOptions{}))
+	assert.Equal(t, 7, partitionCount(objects, PartitionOptions{Partitions: 7}))
+	assert.Equal(t, 64, partitionCount(objects, PartitionOptions{MemoryBudget: 1 << 20}))
+	assert.Equal(t, 1, partitionCount(objects, PartitionOptions{MemoryBudget: 1 << 40}))
+	assert.Equal(t, 16, partitionCount(objects, PartitionOptions{MemoryBudget: 1 << 20, MemoryPerInputByte: 4}))
+	assert.Equal(t, 2, partitionCount(objects, PartitionOptions{MemoryBudget: 16 << 20, MemoryPerInputByte: 4.5}))
+}
@@ -0,0 +1,362 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// operandKind says where a compiled operand reads from.
+type operandKind uint8
+
+const (
+	operandNull    operandKind = iota // unknown dataset or field, malformed source
+	operandSelf                       // a metric of the key, in a frame slot
+	operandColumn                     // a dataset column
+	operandLiteral                    // a `value:` parameter, parsed once
+)
+
+// operandRef is a parameter compiled against a ColumnStore and a stage's frame layout.
+type operandRef struct {
+	kind operandKind
+	slot int // operandSelf
+	col  *Column
+	lit  Value
+}
+
+// float reads the operand in numeric context: only sources are read, non-numeric cells (and
+// literal values) read as null.
+func (o *operandRef) float(slot int, f *frame) (float64, bool) {
+	switch o.kind {
+	case operandSelf:
+		if !f.set[o.slot] {
+			return 0, true
+		}
+		return f.vals[o.slot], false
+	case operandColumn:
+		num, ok := o.col.Float(slot)
+		return num, !ok
+	}
+	return 0, true
+}
+
+// value reads the operand as a typed value; unknown sources and metrics without a value are null.
+func (o *operandRef) value(slot int, f *frame) Value {
+	switch o.kind {
+	case operandSelf:
+		if !f.set[o.slot] {
+			return Value{}
+		}
+		return NumberValue(f.vals[o.slot])
+	case operandColumn:
+		return o.col.Value(slot)
+	case operandLiteral:
+		return o.lit
+	}
+	return Value{}
+}
+
+// frame holds the metrics of one key while a stage is evaluated: one slot per metric of the stage
+// and per metric of an earlier stage it reads. A worker reuses its frame for every key.
+type frame struct {
+	vals []float64
+	set  []bool
+	// current is the metric being evaluated, for errors
+	current int
+}
+
+// OperationFn evaluates a per-key operation at the key at slot, reading the metric's compiled
+// operands (see compileStage) on the key's frame; it returns the value and whether it is null.
+type OperationFn func(ctx context.Context, m *planMetric, slot int, f *frame) (float64, bool)
+
+// planMetric is a metric compiled for a stage.
+type planMetric struct {
+	c.Metric
+	// eval is nil for unknown operations (which validation rejects): the metric is null
+	eval   OperationFn
+	params []operandRef
+	// values are the parsed `values` of "in"
+	values []Value
+	// byCode holds the result of "in" / "lookup" for every string of the dictionary of a column
+	// operand (index = code - 1), so categories are matched once per run instead of once per key
+	byCode []codeResult
+}
+
+type codeResult struct {
+	val    float64
+	isNull bool
+}
+
+// stagePlan is a per-key stage compiled against a ColumnStore: operations resolved to functions,
+// sources to columns or frame slots, metrics in dependency order. Evaluating a key doesn't allocate.
+type stagePlan struct {
+	// metrics are in evaluation order; metrics[i] writes frame slot i
+	metrics []planMetric
+	// inputs are the metrics of earlier stages the stage reads, in the slots after metrics
+	inputs []string
+	// names are the names of metrics, for copyRow
+	names []string
+}
+
+// operations are the per-key operations, by type.
+var operations = map[string]OperationFn{
+	"sum":    planSum,
+	"or":     planOr,
+	"divide": planDivide,
+	"eq":     planEq,
+	"in":     planIn,
+	"lookup": planLookup,
+	"map":    planLookup,
+}
+
+// compileStage compiles the metrics of a per-key stage.
+func compileStage(metrics []c.Metric, cols *ColumnStore) *stagePlan {
+	metrics = dependencyOrder(metrics)
+	p := &stagePlan{metrics: make([]planMetric, len(metrics))}
+	slots := make(map[string]int, len(metrics))
+	for i, metric := range metrics {
+		slots[metric.Name] = i
+		p.names = append(p.names, metric.Name)
+	}
+	slotOf := func(name string) int {
+		if i, ok := slots[name]; ok {
+			return i
+		}
+		slots[name] = len(metrics) + len(p.inputs)
+		p.inputs = append(p.inputs, name)
+		return slots[name]
+	}
+
+	bound := cols.bindMetrics(metrics)
+	for i, metric := range metrics {
+		pm := &p.metrics[i]
+		pm.Metric = metric
+		pm.params = make([]operandRef, len(metric.Operation.Parameters))
+		for j, param := range metric.Operation.Parameters {
+			ref := bound[i].params[j]
+			switch {
+			case param.Source == "":
+				pm.params[j] = operandRef{kind: operandLiteral, lit: ParseValue(param.Value)}
+			case ref.self:
+				pm.params[j] = operandRef{kind: operandSelf, slot: slotOf(ref.metric)}
+			case ref.col != nil:
+				pm.params[j] = operandRef{kind: operandColumn, col: ref.col}
+			}
+		}
+
+		if pm.eval = operations[metric.Operation.Type]; pm.eval == nil {
+			log.Printf("Unknown operation: %s", metric.Operation.Type)
+		}
+		if metric.Operation.Type == "in" {
+			for _, raw := range metric.Operation.Values {
+				pm.values = append(pm.values, ParseValue(raw))
+			}
+		}
+		if len(pm.params) > 0 && pm.params[0].kind == operandColumn && pm.params[0].col.dict != nil {
+			switch metric.Operation.Type {
+			case "in":
+				pm.byCode = make([]codeResult, len(pm.params[0].col.dict))
+				for k, s := range pm.params[0].col.dict {
+					pm.byCode[k] = codeResult{val: boolToFloat(matchAny(StringValue(s), pm.values))}
+				}
+			case "lookup", "map":
+				pm.byCode = make([]codeResult, len(pm.params[0].col.dict))
+				for k, s := range pm.params[0].col.dict {
+					pm.byCode[k].val, pm.byCode[k].isNull = lookupCategory(metric.Operation, s)
+				}
+			}
+		}
+	}
+	return p
+}
+
+// dependencyOrder sorts metrics so that every metric comes after the metrics of the stage it reads,
+// keeping config order otherwise (validation already requires definitions before use, so a valid
+// config keeps its order). Cycles, which validation rejects, are left in config order.
+func dependencyOrder(metrics []c.Metric) []c.Metric {
+	index := make(map[string]int, len(metrics))
+	for i, metric := range metrics {
+		index[metric.Name] = i
+	}
+	done := make([]bool, len(metrics))
+	visiting := make([]bool, len(metrics))
+	ordered := make([]c.Metric, 0, len(metrics))
+	var visit func(i int)
+	visit = func(i int) {
+		if done[i] || visiting[i] {
+			return
+		}
+		visiting[i] = true
+		for _, p := range metrics[i].Operation.Parameters {
+			if !strings.HasPrefix(p.Source, "self.") {
+				continue
+			}
+			if dep, ok := index[strings.TrimPrefix(p.Source, "self.")]; ok {
+				visit(dep)
+			}
+		}
+		visiting[i], done[i] = false, true
+		ordered = append(ordered, metrics[i])
+	}
+	for i := range metrics {
+		visit(i)
+	}
+	return ordered
+}
+
+func (p *stagePlan) newFrame() *frame {
+	n := len(p.metrics) + len(p.inputs)
+	return &frame{vals: make([]float64, n), set: make([]bool, n)}
+}
+
+// evalKey computes the stage at slot into row: the inputs are read from row, the stage's metrics
+// are computed on f and written back (null metrics are left out).
+func (p *stagePlan) evalKey(ctx context.Context, slot int, f *frame, row map[string]float64) {
+	clear(f.set)
+	for i, name := range p.inputs {
+		s := len(p.metrics) + i
+		f.vals[s], f.set[s] = row[name]
+	}
+	for i := range p.metrics {
+		m := &p.metrics[i]
+		f.current = i
+		if m.eval == nil {
+			continue // null
+		}
+		val, isNull := m.eval(ctx, m, slot, f)
+		f.vals[i], f.set[i] = val, !isNull
+	}
+	for i := range p.metrics {
+		if f.set[i] {
+			row[p.metrics[i].Name] = f.vals[i]
+		}
+	}
+}
+
+func planSum(_ context.Context, m *planMetric, slot int, f *frame) (float64, bool) {
+	var total float64
+	var anyNonNull bool
+	for i := range m.params {
+		if val, isNull := m.params[i].float(slot, f); !isNull {
+			total += val
+			anyNonNull = true
+		}
+	}
+	return total, !anyNonNull
+}
+
+func planOr(_ context.Context, m *planMetric, slot int, f *frame) (float64, bool) {
+	if len(m.params) < 2 {
+		return 0, true
+	}
+	if val, isNull := m.params[0].float(slot, f); !isNull {
+		return val, false
+	}
+	return m.params[1].float(slot, f)
+}
+
+func planDivide(_ context.Context, m *planMetric, slot int, f *frame) (float64, bool) {
+	if len(m.params) < 2 {
+		return 0, true
+	}
+	x, xNull := m.params[0].float(slot, f)
+	y, yNull := m.params[1].float(slot, f)
+	if xNull || yNull {
+		return 0, true
+	}
+	if y == 0 {
+		log.Printf("[WARN] metric %s: division by zero", m.Name)
+		return 0, true
+	}
+	return x / y, false
+}
+
+func planEq(_ context.Context, m *planMetric, slot int, f *frame) (float64, bool) {
+	if len(m.params) < 2 {
+		return 0, true
+	}
+	x, y := m.params[0].value(slot, f), m.params[1].value(slot, f)
+	if x.IsNull() || y.IsNull() {
+		return 0, true
+	}
+	return boolToFloat(x.Equal(y)), false
+}
+
+func planIn(_ context.Context, m *planMetric, slot int, f *frame) (float64, bool) {
+	if len(m.params) < 1 {
+		return 0, true
+	}
+	if m.byCode != nil {
+		if code := m.params[0].col.code(slot); code != 0 {
+			r := m.byCode[code-1]
+			return r.val, r.isNull
+		}
+	}
+	x := m.params[0].value(slot, f)
+	if x.IsNull() {
+		return 0, true
+	}
+	return boolToFloat(matchAny(x, m.values)), false
+}
+
+func planLookup(_ context.Context, m *planMetric, slot int, f *frame) (float64, bool) {
+	if len(m.params) < 1 {
+		return 0, true
+	}
+	if m.byCode != nil {
+		if code := m.params[0].col.code(slot); code != 0 {
+			r := m.byCode[code-1]
+			return r.val, r.isNull
+		}
+	}
+	x := m.params[0].value(slot, f)
+	if x.IsNull() {
+		return 0, true
+	}
+	if x.Kind == KindNumber {
+		return lookupNumber(m.Operation, x.Num)
+	}
+	return lookupCategory(m.Operation, x.String())
+}
+
+// lookupNumber is lookupCategory of a number's text, formatted without allocating.
+func lookupNumber(op c.Operation, num float64) (float64, bool) {
+	var buf [32]byte
+	b := strconv.AppendFloat(buf[:0], num, 'f', -1, 64)
+	for i, ch := range b {
+		if 'A' <= ch && ch <= 'Z' { // NaN, Inf
+			b[i] = ch + 'a' - 'A'
+		}
+	}
+	if val, ok := op.Table[string(b)]; ok {
+		return val, false
+	}
+	if op.Default != nil {
+		return *op.Default, false
+	}
+	return 0, true
+}
+
+func matchAny(x Value, values []Value) bool {
+	for _, v := range values {
+		if x.Equal(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupCategory maps a category through the operation's table (lowercase keys); unknown
+// categories fall back to the default, or null without one.
+func lookupCategory(op c.Operation, category string) (float64, bool) {
+	if val, ok := op.Table[strings.ToLower(category)]; ok {
+		return val, false
+	}
+	if op.Default != nil {
+		return *op.Default, false
+	}
+	return 0, true
+}
@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// planTestConfig uses every per-key operation, on numbers, bools, categories, literals and metrics.
+func planTestConfig() *c.Config {
+	half := 0.5
+	src := func(s string) c.Parameter { return c.Parameter{Source: s} }
+	return &c.Config{Name: "plan", Metrics: []c.Metric{
+		{Name: "total", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{src("disclosure.dis_1"), src("waste.was_1"), {Value: "5"}}}},
+		{Name: "either", Operation: c.Operation{Type: "or", Parameters: []c.Parameter{src("waste.was_1"), src("self.total")}}},
+		{Name: "ratio", Operation: c.Operation{Type: "divide", Parameters: []c.Parameter{src("self.either"), src("disclosure.dis_1")}}},
+		{Name: "zero", Operation: c.Operation{Type: "divide", Parameters: []c.Parameter{src("self.total"), src("waste.was_2")}}},
+		{Name: "net_zero", Operation: c.Operation{Type: "eq", Parameters: []c.Parameter{src("disclosure.has_net_zero_target"), {Value: "yes"}}}},
+		{Name: "same", Operation: c.Operation{Type: "eq", Parameters: []c.Parameter{src("self.total"), src("self.either")}}},
+		{Name: "major", Operation: c.Operation{Type: "in", Parameters: []c.Parameter{src("disclosure.reporting_standard")}, Values: []string{"gri", "SASB"}}},
+		{Name: "small", Operation: c.Operation{Type: "in", Parameters: []c.Parameter{src("disclosure.dis_1")}, Values: []string{"10", "12"}}},
+		{Name: "score", Operation: c.Operation{Type: "lookup", Parameters: []c.Parameter{src("disclosure.reporting_standard")},
+			Table: map[string]float64{"gri": 1, "sasb": 0.8}, Default: &half}},
+		{Name: "no_default", Operation: c.Operation{Type: "map", Parameters: []c.Parameter{src("disclosure.reporting_standard")},
+			Table: map[string]float64{"tcfd": 0.3}}},
+		{Name: "by_number", Operation: c.Operation{Type: "lookup", Parameters: []c.Parameter{src("disclosure.dis_1")},
+			Table: map[string]float64{"10": 7}}},
+		{Name: "missing", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{src("nope.x"), src("disclosure.dis_1.extra")}}},
+	}}
+}
+
+func planTestDatasets() map[string]Dataset {
+	datasets := typedDatasets()
+	datasets["disclosure"][CompanyYearKey{"1002", 2023}] = map[string]Value{"reporting_standard": StringValue("sasb"), "dis_1": NumberValue(12)}
+	datasets["waste"] = Dataset{
+		{CompanyID: "1000", Year: 2023}: {"was_1": NumberValue(1.5), "was_2": NumberValue(0)},
+		{CompanyID: "1001", Year: 2023}: {"was_2": NumberValue(4)},
+		{CompanyID: "1003", Year: 2023}: {"was_1": NumberValue(-1)},
+	}
+	return datasets
+}
+
+// interpret evaluates metrics at key one at a time, by name: the operation looked up by type,
+// sources read through the ColumnStore, metrics read from and written to the row. It is the
+// reference the compiled plan is checked against.
+func interpret(cols *ColumnStore, metrics []c.Metric, key CompanyYearKey, row map[string]float64) map[string]float64 {
+	slot := cols.Slot(key)
+	for _, metric := range cols.bindMetrics(metrics) {
+		if val, isNull := interpretMetric(metric, slot, row); !isNull {
+			row[metric.Name] = val
+		}
+	}
+	return row
+}
+
+func interpretMetric(m boundMetric, slot int, row map[string]float64) (float64, bool) {
+	op := m.Operation
+	num := func(i int) (float64, bool) { return getValue(m.params[i], slot, row) }
+	value := func(i int) Value {
+		ref := m.params[i]
+		switch {
+		case op.Parameters[i].Source == "":
+			return ParseValue(op.Parameters[i].Value)
+		case ref.self:
+			if val, ok := row[ref.metric]; ok {
+				return NumberValue(val)
+			}
+			return Value{}
+		}
+		return ref.col.Value(slot)
+	}
+
+	switch op.Type {
+	case "sum":
+		var total float64
+		anyNonNull := false
+		for i := range m.params {
+			if val, isNull := num(i); !isNull {
+				total += val
+				anyNonNull = true
+			}
+		}
+		return total, !anyNonNull
+	case "or":
+		if val, isNull := num(0); !isNull {
+			return val, false
+		}
+		return num(1)
+	case "divide":
+		x, xNull := num(0)
+		y, yNull := num(1)
+		if xNull || yNull || y == 0 {
+			return 0, true
+		}
+		return x / y, false
+	case "eq":
+		x, y := value(0), value(1)
+		if x.IsNull() || y.IsNull() {
+			return 0, true
+		}
+		return boolToFloat(x.Equal(y)), false
+	case "in":
+		x := value(0)
+		if x.IsNull() {
+			return 0, true
+		}
+		for _, raw := range op.Values {
+			if x.Equal(ParseValue(raw)) {
+				return 1, false
+			}
+		}
+		return 0, false
+	case "lookup", "map":
+		x := value(0)
+		if x.IsNull() {
+			return 0, true
+		}
+		return lookupCategory(op, x.String())
+	}
+	return 0, true
+}
+
+func TestCompiledPlanMatchesInterpreter(t *testing.T) {
+	cfg := planTestConfig()
+	cfg.Metrics = append(cfg.Metrics,
+		c.Metric{Name: "after", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{{Source: "self.total"}, {Source: "self.earlier"}}}},
+	)
+	cols := buildColumnStore(planTestDatasets())
+
+	plan := compileStage(cfg.Metrics, cols)
+	assert.Equal(t, []string{"earlier"}, plan.inputs)
+	f := plan.newFrame()
+	for _, key := range cols.Keys() {
+		// the row already has a metric of an earlier stage
+		want := interpret(cols, cfg.Metrics, key, map[string]float64{"earlier": 100})
+		got := map[string]float64{"earlier": 100}
+		plan.evalKey(context.Background(), cols.Slot(key), f, got)
+		assert.Equal(t, want, got, key)
+	}
+}
+
+func TestRegisteredOperation(t *testing.T) {
+	operations["test_max"] = func(ctx context.Context, m *planMetric, slot int, f *frame) (float64, bool) {
+		x, xNull := m.params[0].float(slot, f)
+		y, yNull := m.params[1].float(slot, f)
+		if xNull || yNull {
+			return 0, true
+		}
+		return max(x, y), false
+	}
+	defer delete(operations, "test_max")
+	cfg := planTestConfig()
+	cfg.Metrics = append(cfg.Metrics,
+		c.Metric{Name: "biggest", Operation: c.Operation{Type: "test_max", Parameters: []c.Parameter{{Source: "self.total"}, {Source: "self.ratio"}}}},
+		c.Metric{Name: "after", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{{Source: "self.biggest"}}}},
+		c.Metric{Name: "unknown", Operation: c.Operation{Type: "nope"}},
+	)
+
+	got := scoreKey(cfg, planTestDatasets(), CompanyYearKey{"1002", 2023})
+	assert.Equal(t, map[string]float64{"total": 12, "either": 12, "ratio": 1, "same": 1, "major": 1, "small": 1, "score": 0.8, "biggest": 12, "after": 12}, got)
+}
+
+func TestDependencyOrder(t *testing.T) {
+	metric := func(name string, sources ...string) c.Metric {
+		m := c.Metric{Name: name, Operation: c.Operation{Type: "sum"}}
+		for _, s := range sources {
+			m.Operation.Parameters = append(m.Operation.Parameters, c.Parameter{Source: s})
+		}
+		return m
+	}
+	names := func(metrics []c.Metric) []string {
+		var out []string
+		for _, m := range metrics {
+			out = append(out, m.Name)
+		}
+		return out
+	}
+
+	inOrder := []c.Metric{metric("a", "waste.x"), metric("b", "self.a"), metric("c", "self.earlier")}
+	assert.Equal(t, []string{"a", "b", "c"}, names(dependencyOrder(inOrder)))
+
+	outOfOrder := []c.Metric{metric("c", "self.b", "self.a"), metric("b", "self.a"), metric("d"), metric("a")}
+	assert.Equal(t, []string{"a", "b", "c", "d"}, names(dependencyOrder(outOfOrder)))
+
+	cycle := []c.Metric{metric("a", "self.b"), metric("b", "self.a")}
+	assert.ElementsMatch(t, []string{"a", "b"}, names(dependencyOrder(cycle)))
+}
+
+func TestCompiledPlanDoesNotAllocate(t *testing.T) {
+	cfg := planTestConfig()
+	cfg.Metrics = append(cfg.Metrics[:3], cfg.Metrics[4:]...) // without the division by zero, which logs
+	cols := buildColumnStore(planTestDatasets())
+	plan := compileStage(cfg.Metrics, cols)
+	f := plan.newFrame()
+	rows := make([]map[string]float64, len(cols.Keys()))
+	for i, key := range cols.Keys() {
+		rows[i] = make(map[string]float64)
+		plan.evalKey(context.Background(), cols.Slot(key), f, rows[i])
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		for i, key := range cols.Keys() {
+			plan.evalKey(context.Background(), cols.Slot(key), f, rows[i])
+		}
+	})
+	require.Zero(t, allocs)
+}
+
+// BenchmarkEvaluateKeys evaluates the per-key metrics of every key of a large synthetic snapshot,
+// with the reference interpreter (operation looked up by name, metrics read and written by name)
+// and the compiled plan (resolved functions, frame slots).
+func BenchmarkEvaluateKeys(b *testing.B) {
+	cols := buildColumnStore(syntheticDatasets(benchCompanies, benchYears, benchFields))
+	cfg := syntheticConfig(benchFields)
+	cfg.Metrics = append(cfg.Metrics, c.Metric{Name: "any", Operation: c.Operation{Type: "or", Parameters: []c.Parameter{
+		{Source: fmt.Sprintf("self.ratio_%d", 0)}, {Source: "self.total_1"},
+	}}})
+	keys := cols.Keys()
+	rows := make([]map[string]float64, len(keys))
+	for i := range rows {
+		rows[i] = make(map[string]float64, len(cfg.Metrics))
+	}
+
+	b.Run("interpreter", func(b *testing.B) {
+		metrics := cols.bindMetrics(cfg.Metrics)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for k, key := range keys {
+				clear(rows[k])
+				slot := cols.Slot(key)
+				for _, metric := range metrics {
+					if val, isNull := interpretMetric(metric, slot, rows[k]); !isNull {
+						rows[k][metric.Name] = val
+					}
+				}
+			}
+		}
+		b.ReportMetric(float64(len(keys)*b.N)/b.Elapsed().Seconds(), "keys/s")
+	})
+	b.Run("compiled", func(b *testing.B) {
+		plan := compileStage(cfg.Metrics, cols)
+		f := plan.newFrame()
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for k, key := range keys {
+				clear(rows[k])
+				plan.evalKey(context.Background(), cols.Slot(key), f, rows[k])
+			}
+		}
+		b.ReportMetric(float64(len(keys)*b.N)/b.Elapsed().Seconds(), "keys/s")
+	})
+}
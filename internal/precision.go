@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// RoundingMode is how metric values are rounded to their precision.
+type RoundingMode string
+
+const (
+	// RoundHalfUp rounds halves away from zero (2.345 => 2.35, -2.345 => -2.35)
+	RoundHalfUp RoundingMode = "half-up"
+	// RoundHalfEven rounds halves to the even digit (2.345 => 2.34, 2.355 => 2.36)
+	RoundHalfEven RoundingMode = "half-even"
+	// RoundTruncate drops the extra digits (2.349 => 2.34, -2.349 => -2.34)
+	RoundTruncate RoundingMode = "truncate"
+)
+
+const (
+	defaultPrecision = 2
+	maxPrecision     = 15
+)
+
+// parseRoundingMode reads a rounding mode of the config; "half_up" is read as "half-up", and
+// empty is the default, half-up.
+func parseRoundingMode(raw string) (RoundingMode, error) {
+	switch mode := RoundingMode(strings.ReplaceAll(strings.ToLower(raw), "_", "-")); mode {
+	case "":
+		return RoundHalfUp, nil
+	case RoundHalfUp, RoundHalfEven, RoundTruncate:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown rounding %q, expected half-up, half-even or truncate", raw)
+}
+
+// MetricFormat is how a metric's values are written: multiplied by Scale, then rounded to
+// Precision decimals. A nil Precision writes values in full.
+type MetricFormat struct {
+	Name      string       `json:"name"`
+	Unit      string       `json:"unit,omitempty"`
+	Precision *int         `json:"precision"`
+	Rounding  RoundingMode `json:"rounding,omitempty"`
+	Scale     float64      `json:"scale"`
+}
+
+// metricFormats returns the formats of the config's metrics, in config order. With full the values
+// are scaled but not rounded.
+func metricFormats(scoreConfig *c.Config, full bool) []MetricFormat {
+	formats := make([]MetricFormat, len(scoreConfig.Metrics))
+	for i, metric := range scoreConfig.Metrics {
+		f := MetricFormat{Name: metric.Name, Unit: metric.Unit, Scale: metric.Scale}
+		if f.Scale == 0 {
+			f.Scale = 1
+		}
+		if !full {
+			precision := defaultPrecision
+			if metric.Precision != nil {
+				precision = *metric.Precision
+			}
+			f.Precision = &precision
+			f.Rounding, _ = parseRoundingMode(metric.Rounding) // validated with the config
+		}
+		formats[i] = f
+	}
+	return formats
+}
+
+// validateMetricFormat checks the output settings of a metric.
+func validateMetricFormat(metric c.Metric) []error {
+	var errs []error
+	if p := metric.Precision; p != nil && (*p < 0 || *p > maxPrecision) {
+		errs = append(errs, fmt.Errorf("precision must be between 0 and %d, got %d", maxPrecision, *p))
+	}
+	if _, err := parseRoundingMode(metric.Rounding); err != nil {
+		errs = append(errs, err)
+	}
+	if math.IsNaN(metric.Scale) || math.IsInf(metric.Scale, 0) {
+		errs = append(errs, fmt.Errorf("invalid scale %v", metric.Scale))
+	}
+	return errs
+}
+
+// Value is val scaled and rounded, as it is written.
+func (f MetricFormat) Value(val float64) float64 {
+	val *= f.Scale
+	if f.Precision == nil {
+		return val
+	}
+	return roundDecimal(val, *f.Precision, f.Rounding)
+}
+
+// Text is val scaled and rounded, with exactly Precision decimals (or in full).
+func (f MetricFormat) Text(val float64) string {
+	val = f.Value(val)
+	if f.Precision == nil {
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(val, 'f', *f.Precision, 64)
+}
+
+// Label is the name of the metric with its unit, e.g. "emissions (tCO2e)".
+func (f MetricFormat) Label() string {
+	if f.Unit == "" {
+		return f.Name
+	}
+	return f.Name + " (" + f.Unit + ")"
+}
+
+// roundDecimal rounds val to places decimals. It rounds the shortest decimal form of val (what
+// gets printed, e.g. 2.675) rather than its binary value (2.67499999...), so halves round the way
+// they read.
+func roundDecimal(val float64, places int, mode RoundingMode) float64 {
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return val
+	}
+	if val == 0 {
+		return 0 // -0 too
+	}
+	digits := strconv.FormatFloat(math.Abs(val), 'f', -1, 64)
+	intPart, frac, _ := strings.Cut(digits, ".")
+	if len(frac) <= places {
+		return val
+	}
+	kept, rest := []byte(intPart+frac[:places]), frac[places:]
+
+	var up bool
+	switch mode {
+	case RoundHalfEven:
+		last := kept[len(kept)-1] - '0'
+		up = rest[0] > '5' || rest[0] == '5' && (strings.TrimRight(rest[1:], "0") != "" || last%2 == 1)
+	case RoundTruncate:
+	default:
+		up = rest[0] >= '5'
+	}
+	if up {
+		i := len(kept) - 1
+		for ; i >= 0 && kept[i] == '9'; i-- {
+			kept[i] = '0'
+		}
+		if i < 0 {
+			kept = append([]byte{'1'}, kept...)
+		} else {
+			kept[i]++
+		}
+	}
+
+	text := string(kept[:len(kept)-places]) + "." + string(kept[len(kept)-places:])
+	rounded, _ := strconv.ParseFloat(text, 64)
+	if val < 0 && rounded != 0 { // no "-0.00"
+		rounded = -rounded
+	}
+	return rounded
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+func TestRoundDecimal(t *testing.T) {
+	for _, tc := range []struct {
+		val    float64
+		places int
+		mode   RoundingMode
+		want   float64
+	}{
+		{2.345, 2, RoundHalfUp, 2.35},
+		{2.675, 2, RoundHalfUp, 2.68}, // 2.67499999... in binary
+		{1.005, 2, RoundHalfUp, 1.01},
+		{-2.345, 2, RoundHalfUp, -2.35},
+		{2.344, 2, RoundHalfUp, 2.34},
+		{2.345, 2, RoundHalfEven, 2.34},
+		{2.355, 2, RoundHalfEven, 2.36},
+		{2.3451, 2, RoundHalfEven, 2.35},
+		{-2.345, 2, RoundHalfEven, -2.34},
+		{2.5, 0, RoundHalfEven, 2},
+		{3.5, 0, RoundHalfEven, 4},
+		{2.349, 2, RoundTruncate, 2.34},
+		{-2.349, 2, RoundTruncate, -2.34},
+		{9.995, 2, RoundHalfUp, 10},
+		{99.5, 0, RoundHalfUp, 100},
+		{1234.5678, 0, RoundHalfUp, 1235},
+		{0.1, 4, RoundHalfUp, 0.1},
+		{1e-7, 2, RoundHalfUp, 0},
+		{-0.001, 2, RoundHalfUp, 0},
+	} {
+		got := roundDecimal(tc.val, tc.places, tc.mode)
+		assert.Equal(t, tc.want, got, "%v to %d (%s)", tc.val, tc.places, tc.mode)
+		assert.False(t, math.Signbit(got) && got == 0, "%v to %d (%s) is -0", tc.val, tc.places, tc.mode)
+	}
+	assert.True(t, math.IsNaN(roundDecimal(math.NaN(), 2, RoundHalfUp)))
+	assert.True(t, math.IsInf(roundDecimal(math.Inf(-1), 2, RoundHalfUp), -1))
+}
+
+func TestMetricFormat(t *testing.T) {
+	zero, four := 0, 4
+	cfg := &c.Config{Metrics: []c.Metric{
+		{Name: "default"},
+		{Name: "tonnes", Precision: &zero, Unit: "t", Scale: 0.001},
+		{Name: "ratio", Precision: &four, Rounding: "half_even"},
+		{Name: "cut", Rounding: "TRUNCATE"},
+	}}
+	formats := metricFormats(cfg, false)
+	var texts []string
+	for _, f := range formats {
+		texts = append(texts, f.Text(1234.56785))
+	}
+	assert.Equal(t, []string{"1234.57", "1", "1234.5678", "1234.56"}, texts)
+	assert.Equal(t, "tonnes (t)", formats[1].Label())
+	assert.Equal(t, "ratio", formats[2].Label())
+	assert.Equal(t, RoundHalfEven, formats[2].Rounding)
+
+	// full precision: scaled, not rounded
+	full := metricFormats(cfg, true)
+	assert.Nil(t, full[0].Precision)
+	assert.Equal(t, "1234.56785", full[0].Text(1234.56785))
+	assert.Equal(t, 1.23456785, full[1].Value(1234.56785))
+}
+
+func TestValidateMetricFormat(t *testing.T) {
+	sixteen, negative := 16, -1
+	metric := func(m c.Metric) c.Metric {
+		m.Name = "m"
+		m.Operation = c.Operation{Type: "sum", Parameters: []c.Parameter{{Source: "waste.was_1"}}}
+		return m
+	}
+	cfg := &c.Config{Name: "bad", Metrics: []c.Metric{
+		metric(c.Metric{Precision: &sixteen, Rounding: "ceil", Scale: math.Inf(1)}),
+	}}
+	err := ValidateScoreConfig(cfg, nil)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "precision must be between 0 and 15, got 16")
+	assert.ErrorContains(t, err, `unknown rounding "ceil"`)
+	assert.ErrorContains(t, err, "invalid scale +Inf")
+
+	cfg.Metrics = []c.Metric{metric(c.Metric{Precision: &negative})}
+	assert.ErrorContains(t, ValidateScoreConfig(cfg, nil), "precision must be between 0 and 15, got -1")
+	cfg.Metrics = []c.Metric{metric(c.Metric{Rounding: "half-even", Scale: -1})}
+	assert.NoError(t, ValidateScoreConfig(cfg, nil))
+}
+
+func TestCalculateScoreHandlerPrecision(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "waste_data.csv"), []byte("company_id,date,was_1\n1,2023,1234.5678\n"), 0o644))
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	one := 1
+	sum := c.Operation{Type: "sum", Parameters: []c.Parameter{{Source: "waste.was_1"}}}
+	cfg := &c.Config{Name: "precision", Metrics: []c.Metric{
+		{Name: "kg", Operation: sum},
+		{Name: "t", Operation: sum, Precision: &one, Unit: "t", Scale: 0.001},
+	}}
+	handler := CalculateScoreHandler(context.Background(), cfg, store, nil)
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	assert.Equal(t, "company,year,kg,t\n1,2023,1234.57,1.2\n", get("/run-scores").Body.String())
+	assert.Equal(t, "company,year,kg,t\n1,2023,1234.5678,1.2345678\n", get("/run-scores?precision=full").Body.String())
+	assert.Equal(t, `{"company_id":"1","year":2023,"values":{"kg":1234.57,"t":1.2}}`+"\n", get("/run-scores?format=ndjson").Body.String())
+	assert.Equal(t, http.StatusBadRequest, get("/run-scores?precision=3").Code)
+}
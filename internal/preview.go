@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// maxPreviewConfigSize bounds the config body of a preview.
+const maxPreviewConfigSize = 1 << 20
+
+// defaultPreviewSample is the number of companies a preview without ?sample= keeps.
+const defaultPreviewSample = 100
+
+// Preview is what POST /preview returns: the scores of a config that is not deployed, with what
+// validation found. Values are written with the config's precision.
+type Preview struct {
+	Product    string         `json:"product"`
+	ConfigHash string         `json:"config_hash"`
+	Warnings   []string       `json:"warnings"`
+	Errors     []string       `json:"errors,omitempty"`
+	Companies  int            `json:"companies"`
+	Metrics    []MetricFormat `json:"metrics"`
+	Rows       []PreviewRow   `json:"rows"`
+}
+
+// PreviewRow is a row of a preview; nulls are null.
+type PreviewRow struct {
+	CompanyID string              `json:"company_id"`
+	Year      int                 `json:"year"`
+	Values    map[string]*float64 `json:"values"`
+}
+
+// sampleCompanies keeps n of the companies of keys, spread evenly over their IDs; n <= 0 keeps all.
+func sampleCompanies(keys []CompanyYearKey, n int) map[string]bool {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, key := range keys {
+		if !seen[key.CompanyID] {
+			seen[key.CompanyID] = true
+			ids = append(ids, key.CompanyID)
+		}
+	}
+	if n <= 0 || n >= len(ids) {
+		return seen
+	}
+	sort.Strings(ids)
+	sample := make(map[string]bool, n)
+	for i := 0; i < n; i++ {
+		sample[ids[i*len(ids)/n]] = true
+	}
+	return sample
+}
+
+// checkConfigReport validates a config against the snapshot's datasets: the warnings (including the
+// datasets that failed to load, never nil) and every validation error.
+func checkConfigReport(scoreConfig *c.Config, snapshot *Snapshot) (warnings, errs []string) {
+	warnings, checkErr := CheckScoreConfig(scoreConfig, scoreDatasets(snapshot))
+	if warnings == nil {
+		warnings = []string{}
+	}
+	for name, loadErr := range snapshot.Unavailable {
+		warnings = append(warnings, fmt.Sprintf("dataset %s is unavailable, its sources read as null: %s", name, loadErr))
+	}
+	if checkErr != nil {
+		var joined interface{ Unwrap() []error }
+		if errors.As(checkErr, &joined) {
+			for _, err := range joined.Unwrap() {
+				errs = append(errs, err.Error())
+			}
+		} else {
+			errs = []string{checkErr.Error()}
+		}
+	}
+	return warnings, errs
+}
+
+// PreviewHandler scores a score config sent in the body (YAML or JSON) against the store's current
+// snapshot, without deploying or storing anything. The filters of /run-scores narrow the rows and
+// metrics, and ?sample=N keeps N of the companies left (defaultPreviewSample without it). The rows
+// are streamed as they are written. A config that doesn't validate answers 422 with the errors and
+// warnings.
+func PreviewHandler(store *DatasetStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPreviewConfigSize))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read config: %v", err), http.StatusBadRequest)
+			return
+		}
+		format := "yaml"
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			format = "json"
+		}
+		scoreConfig, err := c.ParseScoreConfig(data, format)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(scoreConfig.Metrics) == 0 {
+			http.Error(w, "config has no metrics", http.StatusBadRequest)
+			return
+		}
+		if scoreConfig.Name == "" {
+			scoreConfig.Name = "preview"
+		}
+		sample := defaultPreviewSample
+		if raw := r.URL.Query().Get("sample"); raw != "" {
+			if sample, err = strconv.Atoi(raw); err != nil || sample <= 0 {
+				http.Error(w, fmt.Sprintf("invalid sample %q, expected a number of companies", raw), http.StatusBadRequest)
+				return
+			}
+		}
+		snapshot := store.Snapshot()
+		if snapshot == nil {
+			http.Error(w, "datasets are not loaded yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		preview := Preview{Product: scoreConfig.Name, ConfigHash: configHash(scoreConfig), Rows: []PreviewRow{}}
+		preview.Warnings, preview.Errors = checkConfigReport(scoreConfig, snapshot)
+		if len(preview.Errors) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeJSON(w, preview)
+			return
+		}
+
+		filter, err := ParseScoreFilter(r.URL.Query(), scoreConfig)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var kept []CompanyYearKey
+		for _, key := range snapshot.Columns().Keys() {
+			if filter.Match(key) {
+				kept = append(kept, key)
+			}
+		}
+		// every company sampled has a company-year kept, so a row
+		filter.Companies = sampleCompanies(kept, sample)
+		preview.Companies = len(filter.Companies)
+		preview.Metrics = metricFormats(filter.Output(scoreConfig), false)
+
+		var out *bufio.Writer
+		begin := func() error {
+			head, err := json.Marshal(preview)
+			if err != nil {
+				return err
+			}
+			w.Header().Set("Content-Type", "application/json")
+			out = bufio.NewWriter(w)
+			// the preview ends with its empty rows, "rows":[]}: left open for them
+			_, err = out.Write(head[:len(head)-2])
+			return err
+		}
+		rows := 0
+		err = EmitScoresFiltered(r.Context(), scoreConfig, snapshot, filter, func(key CompanyYearKey, values map[string]float64) error {
+			if out == nil {
+				if err := begin(); err != nil {
+					return err
+				}
+			}
+			row := previewRow(ScoredRow{CompanyID: key.CompanyID, Year: key.Year, Values: values}, preview.Metrics)
+			data, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			if rows > 0 {
+				out.WriteByte(',')
+			}
+			rows++
+			out.WriteByte('\n')
+			_, err = out.Write(data)
+			return err
+		})
+		if err == nil && out == nil {
+			err = begin()
+		}
+		if err != nil {
+			if out == nil {
+				http.Error(w, fmt.Sprintf("Error: %v", err), scoreErrorStatus(err))
+			} else {
+				log.Printf("[WARN] Preview of %s cut short: %v", preview.Product, err)
+			}
+			return
+		}
+		out.WriteString("]}\n")
+		if err := out.Flush(); err != nil {
+			log.Printf("Failed to write response: %v", err)
+		}
+	}
+}
+
+// previewRow is the row of a preview with the metrics' precision.
+func previewRow(row ScoredRow, metrics []MetricFormat) PreviewRow {
+	out := PreviewRow{CompanyID: row.CompanyID, Year: row.Year, Values: make(map[string]*float64, len(metrics))}
+	for _, metric := range metrics {
+		if val, ok := cellValue(row, metric.Name); ok {
+			val = metric.Value(val)
+			out.Values[metric.Name] = &val
+		} else {
+			out.Values[metric.Name] = nil
+		}
+	}
+	return out
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const previewConfig = `
+name: draft
+metrics:
+  - name: total
+    operation:
+      type: sum
+      parameters:
+        - source: waste.wst_1
+        - source: emissions.emi_1
+  - name: total_rank
+    operation:
+      type: pct_rank
+      parameters:
+        - source: self.total
+  - name: weighted
+    operation:
+      type: sum
+      parameters:
+        - source: self.total_rank
+        - source: disclosure.dis_1
+    precision: 0
+`
+
+func TestPreviewHandler(t *testing.T) {
+	_, store, _ := newJobsFixture(t, JobOptions{})
+	handler := PreviewHandler(store)
+	post := func(target, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) Preview {
+		var p Preview
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p), rec.Body.String())
+		return p
+	}
+
+	rec := post("/preview?sample=3&from_year=2023", "application/yaml", previewConfig)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	p := decode(rec)
+	assert.Equal(t, "draft", p.Product)
+	assert.Equal(t, 3, p.Companies)
+	require.Len(t, p.Rows, 3)
+	assert.Equal(t, []string{"5000", "5050", "5100"}, []string{p.Rows[0].CompanyID, p.Rows[1].CompanyID, p.Rows[2].CompanyID}, "spread over the companies")
+	assert.Equal(t, []string{"metric weighted (sum): disclosure.dis_1 mixes number/string values, non-numeric cells will read as null"}, p.Warnings)
+
+	// the sampled rows are the rows of a full run
+	full := decode(post("/preview?company=5050&year=2023", "application/yaml", previewConfig))
+	require.Len(t, full.Rows, 1)
+	assert.Equal(t, full.Rows[0], p.Rows[1])
+	require.NotNil(t, full.Rows[0].Values["weighted"])
+	weighted := *full.Rows[0].Values["weighted"]
+	assert.Equal(t, float64(int(weighted)), weighted, "written with the config's precision")
+
+	// JSON, with a source that has no data
+	rec = post("/preview?metrics=missing", "application/json", `{"metrics": [{"name": "missing", "operation": {"type": "sum", "parameters": [
+		{"source": "waste.nope"}]}}]}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	p = decode(rec)
+	assert.Equal(t, "preview", p.Product)
+	assert.Equal(t, []string{"metric missing (sum): waste.nope has no values in dataset waste, it reads as null"}, p.Warnings)
+	assert.Equal(t, defaultPreviewSample, p.Companies, "sampled by default")
+	assert.Len(t, p.Rows, 4*defaultPreviewSample)
+	assert.Nil(t, p.Rows[0].Values["missing"])
+	p = decode(post("/preview?sample=1000", "application/yaml", previewConfig))
+	assert.Equal(t, 150, p.Companies)
+	assert.Len(t, p.Rows, 600)
+
+	rec = post("/preview", "application/yaml", `
+metrics:
+  - name: a
+    operation: {type: nope}
+  - name: b
+    operation: {type: sum, parameters: [{source: self.c}]}
+`)
+	require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	p = decode(rec)
+	assert.Equal(t, []string{"metric a (nope): unknown operation", "metric b (sum): self.c is not defined before this metric"}, p.Errors)
+	assert.Empty(t, p.Rows)
+
+	assert.Equal(t, http.StatusBadRequest, post("/preview", "application/yaml", "metrics: [").Code)
+	assert.Equal(t, http.StatusBadRequest, post("/preview", "application/yaml", "name: empty").Code)
+	assert.Equal(t, http.StatusBadRequest, post("/preview?sample=0", "application/yaml", previewConfig).Code)
+	assert.Equal(t, http.StatusBadRequest, post("/preview?metrics=nope", "application/yaml", previewConfig).Code)
+}
@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// Rule names as they appear in the quarantine output and the quality summary.
+const (
+	ruleParse             = "parse"
+	ruleRequired          = "required"
+	ruleRange             = "range"
+	ruleNonNegative       = "non_negative"
+	ruleAllowed           = "allowed"
+	ruleUniqueCompanyDate = "unique_company_date"
+	ruleMaxPerYear        = "max_per_year"
+)
+
+// QuarantinedRow is a row rejected by a data-quality rule, with the rule that failed.
+type QuarantinedRow struct {
+	Dataset   string `json:"dataset"`
+	Source    string `json:"source"`
+	Row       int    `json:"row"`
+	CompanyID string `json:"company_id"`
+	Date      string `json:"date"`
+	Rule      string `json:"rule"`
+	Field     string `json:"field,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// DatasetQuality summarises the quality checks of one dataset.
+type DatasetQuality struct {
+	Dataset         string         `json:"dataset"`
+	Source          string         `json:"source"`
+	RowsRead        int            `json:"rows_read"`
+	RowsAccepted    int            `json:"rows_accepted"`
+	RowsQuarantined int            `json:"rows_quarantined"`
+	ByRule          map[string]int `json:"by_rule,omitempty"`
+}
+
+// QualityReport is the data-quality outcome of one load of all datasets.
+type QualityReport struct {
+	GeneratedAt time.Time        `json:"generated_at"`
+	Datasets    []DatasetQuality `json:"datasets"`
+	Quarantine  []QuarantinedRow `json:"-"`
+}
+
+// applyQualityRules splits the records of a dataset into accepted rows and quarantined ones.
+// Row-level rules run first; uniqueness and per-year limits are then checked on the rows that passed.
+func applyQualityRules(
+	dataset, source string,
+	records []Record,
+	rules *c.DatasetRules,
+) ([]Record, []QuarantinedRow, DatasetQuality) {
+	summary := DatasetQuality{
+		Dataset:  dataset,
+		Source:   source,
+		RowsRead: len(records),
+		ByRule:   make(map[string]int),
+	}
+	var quarantined []QuarantinedRow
+	reject := func(rec Record, rule, field, reason string) {
+		quarantined = append(quarantined, QuarantinedRow{
+			Dataset:   dataset,
+			Source:    source,
+			Row:       rec.Row,
+			CompanyID: rec.CompanyID,
+			Date:      rec.RawDate,
+			Rule:      rule,
+			Field:     field,
+			Reason:    reason,
+		})
+		summary.ByRule[rule]++
+	}
+
+	passed := make([]Record, 0, len(records))
+	for _, rec := range records {
+		if rec.Invalid != nil {
+			reject(rec, ruleParse, "", rec.Invalid.Error())
+			continue
+		}
+		if rules != nil {
+			if rule, field, reason := checkRow(rec, rules); rule != "" {
+				reject(rec, rule, field, reason)
+				continue
+			}
+		}
+		passed = append(passed, rec)
+	}
+
+	if rules != nil && rules.UniqueCompanyDate {
+		// the first row for a (company, date) wins, later ones are duplicates; observations
+		// known at different times are history, not duplicates
+		seen := make(map[string]bool, len(passed))
+		unique := passed[:0]
+		for _, rec := range passed {
+			k := rec.CompanyID + "|" + rec.Date.Format("2006-01-02")
+			if !rec.KnownAt.IsZero() {
+				k += "|" + rec.KnownAt.Format(time.RFC3339Nano)
+			}
+			if seen[k] {
+				reject(rec, ruleUniqueCompanyDate, "", fmt.Sprintf("duplicate row for company %s on %s", rec.CompanyID, rec.RawDate))
+				continue
+			}
+			seen[k] = true
+			unique = append(unique, rec)
+		}
+		passed = unique
+	}
+
+	if rules != nil && rules.MaxPerYear > 0 {
+		// too many rows in a year means we can't tell which one is right => the whole year is quarantined
+		counts := make(map[CompanyYearKey]int)
+		observed := make(map[string]bool)
+		for _, rec := range passed {
+			if !rec.KnownAt.IsZero() {
+				// the observations of one date count as one row
+				k := rec.CompanyID + "|" + rec.Date.Format("2006-01-02")
+				if observed[k] {
+					continue
+				}
+				observed[k] = true
+			}
+			counts[CompanyYearKey{CompanyID: rec.CompanyID, Year: rec.Date.Year()}]++
+		}
+		kept := passed[:0]
+		for _, rec := range passed {
+			key := CompanyYearKey{CompanyID: rec.CompanyID, Year: rec.Date.Year()}
+			if n := counts[key]; n > rules.MaxPerYear {
+				reject(rec, ruleMaxPerYear, "", fmt.Sprintf("%d rows for company %s in %d, max is %d", n, key.CompanyID, key.Year, rules.MaxPerYear))
+				continue
+			}
+			kept = append(kept, rec)
+		}
+		passed = kept
+	}
+
+	summary.RowsAccepted = len(passed)
+	summary.RowsQuarantined = len(quarantined)
+	return passed, quarantined, summary
+}
+
+// checkRow runs the row-level rules and returns the first one that fails, or an empty rule name.
+func checkRow(rec Record, rules *c.DatasetRules) (rule, field, reason string) {
+	for _, f := range rules.Required {
+		if rec.Values[f].IsNull() {
+			return ruleRequired, f, "missing value"
+		}
+	}
+
+	for _, f := range rules.NonNegative {
+		v, ok := rec.Values[f]
+		if !ok {
+			continue
+		}
+		num, isNum := v.Float()
+		if !isNum {
+			return ruleNonNegative, f, fmt.Sprintf("%q is not a number", v.String())
+		}
+		if num < 0 {
+			return ruleNonNegative, f, fmt.Sprintf("%v is negative", num)
+		}
+	}
+
+	for _, r := range rules.Ranges {
+		v, ok := rec.Values[r.Field]
+		if !ok {
+			continue
+		}
+		num, isNum := v.Float()
+		if !isNum {
+			return ruleRange, r.Field, fmt.Sprintf("%q is not a number", v.String())
+		}
+		if r.Min != nil && num < *r.Min {
+			return ruleRange, r.Field, fmt.Sprintf("%v is below %v", num, *r.Min)
+		}
+		if r.Max != nil && num > *r.Max {
+			return ruleRange, r.Field, fmt.Sprintf("%v is above %v", num, *r.Max)
+		}
+	}
+
+	for _, a := range rules.Allowed {
+		v, ok := rec.Values[a.Field]
+		if !ok {
+			continue
+		}
+		allowed := false
+		for _, raw := range a.Values {
+			if v.Equal(ParseValue(raw)) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ruleAllowed, a.Field, fmt.Sprintf("%q is not one of %s", v.String(), strings.Join(a.Values, ", "))
+		}
+	}
+
+	return "", "", ""
+}
+
+// quarantineSuffix ends the name of the quarantine file of each dataset.
+const quarantineSuffix = ".quarantine.csv"
+
+// WriteQuarantine writes the quarantined rows as one CSV file per dataset into dir, and removes the
+// files of the datasets that have none left.
+func (r *QualityReport) WriteQuarantine(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create quarantine dir %s: %w", dir, err)
+	}
+
+	byDataset := make(map[string][]QuarantinedRow)
+	for _, q := range r.Quarantine {
+		byDataset[q.Dataset] = append(byDataset[q.Dataset], q)
+	}
+
+	stale, err := filepath.Glob(filepath.Join(dir, "*"+quarantineSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		if _, ok := byDataset[strings.TrimSuffix(filepath.Base(path), quarantineSuffix)]; ok {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+
+	for dataset, rows := range byDataset {
+		path := filepath.Join(dir, dataset+quarantineSuffix)
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", path, err)
+		}
+		err = writeQuarantineCSV(f, rows)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func writeQuarantineCSV(w io.Writer, rows []QuarantinedRow) error {
+	// reports are shared between requests, sort a copy
+	rows = append([]QuarantinedRow(nil), rows...)
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Dataset != rows[j].Dataset {
+			return rows[i].Dataset < rows[j].Dataset
+		}
+		return rows[i].Row < rows[j].Row
+	})
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"dataset", "source", "row", "company_id", "date", "rule", "field", "reason"}); err != nil {
+		return err
+	}
+	for _, q := range rows {
+		err := cw.Write([]string{q.Dataset, q.Source, strconv.Itoa(q.Row), q.CompanyID, q.Date, q.Rule, q.Field, q.Reason})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+func TestApplyQualityRules(t *testing.T) {
+	csvContent := `company_id,date,emi_1,reporting_standard
+1000,2023-01-01,10,GRI
+1000,2023-01-01,11,GRI
+1001,2023-02-01,-5,GRI
+1002,2023-03-01,5000,GRI
+1003,2023-04-01,7,CDP
+1004,2023-05-01,,GRI
+1005,not-a-date,1,GRI
+1006,2023-01-01,1,GRI
+1006,2023-06-01,2,GRI
+1006,2023-12-01,3,GRI
+1007,2024-01-01,4,sasb`
+
+	records, err := readCSVRecords(context.Background(), strings.NewReader(csvContent))
+	require.NoError(t, err)
+
+	maxEmi := 1000.0
+	rules := &c.DatasetRules{
+		Name:              "emissions_data",
+		Required:          []string{"emi_1"},
+		NonNegative:       []string{"emi_1"},
+		Ranges:            []c.RangeRule{{Field: "emi_1", Max: &maxEmi}},
+		Allowed:           []c.AllowedRule{{Field: "reporting_standard", Values: []string{"GRI", "SASB"}}},
+		UniqueCompanyDate: true,
+		MaxPerYear:        2,
+	}
+
+	accepted, quarantined, summary := applyQualityRules("emissions_data", "emissions_data.csv", records, rules)
+
+	rulesByRow := make(map[int]string)
+	for _, q := range quarantined {
+		rulesByRow[q.Row] = q.Rule
+	}
+	assert.Equal(t, map[int]string{
+		3:  ruleUniqueCompanyDate,
+		4:  ruleNonNegative,
+		5:  ruleRange,
+		6:  ruleAllowed,
+		7:  ruleRequired,
+		8:  ruleParse,
+		9:  ruleMaxPerYear,
+		10: ruleMaxPerYear,
+		11: ruleMaxPerYear,
+	}, rulesByRow)
+
+	require.Len(t, accepted, 2)
+	assert.Equal(t, "1000", accepted[0].CompanyID)
+	assert.Equal(t, NumberValue(10), accepted[0].Values["emi_1"])
+	assert.Equal(t, "1007", accepted[1].CompanyID)
+
+	assert.Equal(t, 11, summary.RowsRead)
+	assert.Equal(t, 2, summary.RowsAccepted)
+	assert.Equal(t, 9, summary.RowsQuarantined)
+	assert.Equal(t, 3, summary.ByRule[ruleMaxPerYear])
+}
+
+func TestStoreWritesQuarantine(t *testing.T) {
+	dataDir, quarantineDir := t.TempDir(), t.TempDir()
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dataDir, "waste_data.csv"), []byte("company_id,date,wst_1\n"+content), 0o644))
+	}
+	quality := &c.QualityConfig{Datasets: []c.DatasetRules{{Name: "waste_data", NonNegative: []string{"wst_1"}}}}
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), quality), FileStorage{Root: dataDir}, "", StoreOptions{QuarantineDir: quarantineDir})
+	path := filepath.Join(quarantineDir, "waste_data.quarantine.csv")
+
+	write("1,2023-01-01,-1\n2,2023-01-01,5\n")
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "non_negative")
+
+	// once the rows are fixed, the file of the last load is not left behind
+	write("1,2023-01-01,1\n2,2023-01-01,5\n")
+	_, err = store.Refresh(context.Background())
+	require.NoError(t, err)
+	assert.NoFileExists(t, path)
+}
@@ -1,5 +1,9 @@
 package internal
 
+import (
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
 // LoaderRegistry holds a map of extension => DataLoader
 type LoaderRegistry struct {
 	registry map[string]DataLoader
@@ -16,16 +20,19 @@ func (lr *LoaderRegistry) RegisterLoader(ext string, loader DataLoader) {
 	lr.registry[ext] = loader
 }
 
-// NewLoaderRegistry initializes a default registry with a CSV loader.
-// You could easily extend this with JSONLoader, RepoLoader, etc.
+// NewLoaderRegistry initializes a default registry with the CSV, JSON, SQL and URL loaders.
+// You could easily extend this with more loaders.
 func NewLoaderRegistry() *LoaderRegistry {
-	return &LoaderRegistry{
+	lr := &LoaderRegistry{
 		registry: map[string]DataLoader{
 			".csv":  CSVLoader{},
 			".json": JSONLoader{},
-			// ".sql": RepoLoader{ DB: ... },
+			".sql":  NewSQLLoader(),
 		},
 	}
+	// URL datasets are decoded by the other loaders of the same registry
+	lr.registry[".url"] = NewURLLoader(lr)
+	return lr
 }
 
 // Load all files in directory
@@ -34,9 +41,15 @@ func NewLoaderRegistry() *LoaderRegistry {
 // using the loaders from the LoaderRegistry.
 type DataLoaderService struct {
 	registry *LoaderRegistry
+	quality  *c.QualityConfig
+
+	// ScoreWorkers is the number of workers computing each per-key stage of a run on the
+	// service's data, 0 => GOMAXPROCS
+	ScoreWorkers int
 }
 
-// NewDataLoaderService constructs the service with a LoaderRegistry
-func NewDataLoaderService(lr *LoaderRegistry) *DataLoaderService {
-	return &DataLoaderService{registry: lr}
+// NewDataLoaderService constructs the service with a LoaderRegistry and the
+// data-quality rules applied to every dataset it loads (nil => no rules).
+func NewDataLoaderService(lr *LoaderRegistry, quality *c.QualityConfig) *DataLoaderService {
+	return &DataLoaderService{registry: lr, quality: quality}
 }
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ScoredRow is the scores of one company-year.
+type ScoredRow struct {
+	CompanyID string             `json:"company_id"`
+	Year      int                `json:"year"`
+	Values    map[string]float64 `json:"values"`
+}
+
+func (r ScoredRow) Key() CompanyYearKey {
+	return CompanyYearKey{CompanyID: r.CompanyID, Year: r.Year}
+}
+
+// ScoreRows are the results of a score run in a fixed order: by company then year, unless sorted
+// otherwise. Runs compute into a map by key; everything downstream (caches, handlers, writers)
+// gets rows, so the same data always comes out in the same order.
+type ScoreRows []ScoredRow
+
+// newScoreRows orders the results of a run by company then year. The rows share their values
+// with results.
+func newScoreRows(results map[CompanyYearKey]map[string]float64) ScoreRows {
+	keys := make([]CompanyYearKey, 0, len(results))
+	for key := range results {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+	rows := make(ScoreRows, len(keys))
+	for i, key := range keys {
+		rows[i] = ScoredRow{CompanyID: key.CompanyID, Year: key.Year, Values: results[key]}
+	}
+	return rows
+}
+
+// Map returns the rows by key (sharing their values).
+func (rows ScoreRows) Map() map[CompanyYearKey]map[string]float64 {
+	out := make(map[CompanyYearKey]map[string]float64, len(rows))
+	for _, row := range rows {
+		out[row.Key()] = row.Values
+	}
+	return out
+}
+
+// emitTo hands the rows to emit in order, as a run for streamScores.
+func (rows ScoreRows) emitTo(emit func(CompanyYearKey, map[string]float64) error) error {
+	for _, row := range rows {
+		if err := emit(row.Key(), row.Values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SortKey is one field of a sort order: "company", "year" or a metric name.
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// ParseSortKeys parses a sort order such as "-total,company": comma-separated fields, each
+// optionally prefixed with "-" (descending) or "+" (ascending), or suffixed with ":desc" / ":asc".
+// Fields are "company", "year" or one of metrics.
+func ParseSortKeys(raw string, metrics []string) ([]SortKey, error) {
+	var keys []SortKey
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var key SortKey
+		switch {
+		case strings.HasPrefix(part, "-"):
+			key = SortKey{Field: part[1:], Desc: true}
+		case strings.HasPrefix(part, "+"):
+			key = SortKey{Field: part[1:]}
+		default:
+			field, dir, _ := strings.Cut(part, ":")
+			key.Field = field
+			switch strings.ToLower(dir) {
+			case "", "asc":
+			case "desc":
+				key.Desc = true
+			default:
+				return nil, fmt.Errorf("invalid sort direction %q for %s, expected asc or desc", dir, field)
+			}
+		}
+		if key.Field != "company" && key.Field != "year" && !slices.Contains(metrics, key.Field) {
+			return nil, fmt.Errorf("cannot sort by %q: not company, year or a metric of the config", key.Field)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// isDefaultOrder reports whether keys sort rows the way they come out of a run: by company, then
+// year, ascending.
+func isDefaultOrder(keys []SortKey) bool {
+	natural := []SortKey{{Field: "company"}, {Field: "year"}}
+	return len(keys) <= len(natural) && slices.Equal(keys, natural[:len(keys)])
+}
+
+// Sorted returns a copy of the rows sorted by keys, then by company and year. Null metrics sort
+// last in either direction. Without keys the rows are returned as they are.
+func (rows ScoreRows) Sorted(keys []SortKey) ScoreRows {
+	if len(keys) == 0 {
+		return rows
+	}
+	out := slices.Clone(rows)
+	slices.SortStableFunc(out, func(a, b ScoredRow) int {
+		for _, key := range keys {
+			if cmp := compareField(a, b, key); cmp != 0 {
+				return cmp
+			}
+		}
+		return 0 // rows are by company and year already
+	})
+	return out
+}
+
+func compareField(a, b ScoredRow, key SortKey) int {
+	var cmp int
+	switch key.Field {
+	case "company":
+		cmp = strings.Compare(a.CompanyID, b.CompanyID)
+	case "year":
+		cmp = a.Year - b.Year
+	default:
+		x, xok := a.Values[key.Field]
+		y, yok := b.Values[key.Field]
+		switch {
+		case !xok && !yok:
+			return 0
+		case !xok:
+			return 1 // nulls last, whatever the direction
+		case !yok:
+			return -1
+		case x < y:
+			cmp = -1
+		case x > y:
+			cmp = 1
+		}
+	}
+	if key.Desc {
+		return -cmp
+	}
+	return cmp
+}
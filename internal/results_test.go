@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+func TestParseSortKeys(t *testing.T) {
+	metrics := []string{"total", "ratio"}
+
+	keys, err := ParseSortKeys("", metrics)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	keys, err = ParseSortKeys("-total, year:asc,company:DESC,+ratio", metrics)
+	require.NoError(t, err)
+	assert.Equal(t, []SortKey{{Field: "total", Desc: true}, {Field: "year"}, {Field: "company", Desc: true}, {Field: "ratio"}}, keys)
+
+	_, err = ParseSortKeys("nope", metrics)
+	assert.ErrorContains(t, err, `cannot sort by "nope"`)
+	_, err = ParseSortKeys("total:up", metrics)
+	assert.ErrorContains(t, err, "invalid sort direction")
+
+	assert.True(t, isDefaultOrder(nil))
+	assert.True(t, isDefaultOrder([]SortKey{{Field: "company"}, {Field: "year"}}))
+	assert.False(t, isDefaultOrder([]SortKey{{Field: "year"}}))
+	assert.False(t, isDefaultOrder([]SortKey{{Field: "company", Desc: true}}))
+}
+
+func TestScoreRowsSorted(t *testing.T) {
+	rows := newScoreRows(map[CompanyYearKey]map[string]float64{
+		{"b", 2023}: {"total": 1},
+		{"a", 2024}: {},
+		{"a", 2023}: {"total": 3},
+		{"c", 2022}: {"total": 1},
+	})
+	keys := func(rows ScoreRows) []string {
+		var out []string
+		for _, row := range rows {
+			out = append(out, fmt.Sprintf("%s/%d", row.CompanyID, row.Year%10))
+		}
+		return out
+	}
+	assert.Equal(t, []string{"a/3", "a/4", "b/3", "c/2"}, keys(rows))
+
+	// nulls last both ways, ties stay by company and year
+	assert.Equal(t, []string{"b/3", "c/2", "a/3", "a/4"}, keys(rows.Sorted([]SortKey{{Field: "total"}})))
+	assert.Equal(t, []string{"a/3", "b/3", "c/2", "a/4"}, keys(rows.Sorted([]SortKey{{Field: "total", Desc: true}})))
+	assert.Equal(t, []string{"c/2", "b/3", "a/3", "a/4"}, keys(rows.Sorted([]SortKey{{Field: "year"}, {Field: "company", Desc: true}})))
+
+	// the run's order is left alone
+	assert.Equal(t, []string{"a/3", "a/4", "b/3", "c/2"}, keys(rows))
+}
+
+func TestCalculateScoreHandlerOrder(t *testing.T) {
+	dir := t.TempDir()
+	data := "company_id,date,was_1\n3,2023,5\n1,2024,7\n2,2023,\n1,2023,9\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "waste_data.csv"), []byte(data), 0o644))
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	cfg := &c.Config{Name: "order", Metrics: []c.Metric{
+		{Name: "total", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{{Source: "waste.was_1"}}}},
+	}}
+	handler := CalculateScoreHandler(context.Background(), cfg, store, nil)
+	get := func(target string) (int, string) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	code, body := get("/run-scores")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "company,year,total\n1,2023,9.00\n1,2024,7.00\n2,2023,\n3,2023,5.00\n", body)
+	for i := 0; i < 5; i++ {
+		_, again := get("/run-scores")
+		assert.Equal(t, body, again)
+	}
+
+	_, body = get("/run-scores?sort=-total")
+	assert.Equal(t, "company,year,total\n1,2023,9.00\n1,2024,7.00\n3,2023,5.00\n2,2023,\n", body)
+	_, body = get("/run-scores?sort=year:desc,company")
+	assert.Equal(t, []string{"company,year,total", "1,2024,7.00", "1,2023,9.00", "2,2023,", "3,2023,5.00", ""}, strings.Split(body, "\n"))
+
+	code, body = get("/run-scores?sort=unknown")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, `cannot sort by "unknown"`)
+}
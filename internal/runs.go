@@ -0,0 +1,535 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// RunRecord describes a stored score run: what was scored, on which data, and what came out.
+type RunRecord struct {
+	ID      string `json:"id"`
+	Product string `json:"product"`
+	// Source is the endpoint that ran it: run-scores, partitioned, distributed or job
+	Source string `json:"source"`
+	// Query is the request's query (filters, sort, as_of, ...), or the job's filters as one
+	Query string `json:"query,omitempty"`
+	// ConfigHash is the sha256 of the score config, overrides included
+	ConfigHash string `json:"config_hash"`
+	// Datasets maps the snapshot's source objects to the sha256 of their content
+	Datasets map[string]string `json:"datasets,omitempty"`
+	// DataFingerprint identifies the data as a whole (the one distributed workers agree on)
+	DataFingerprint string      `json:"data_fingerprint,omitempty"`
+	StartedAt       time.Time   `json:"started_at"`
+	FinishedAt      time.Time   `json:"finished_at"`
+	Rows            int         `json:"rows"`
+	Metrics         []RunMetric `json:"metrics"`
+}
+
+// RunMetric is a metric of a run: how it is written and how many of its values are set.
+type RunMetric struct {
+	MetricFormat
+	Values int `json:"values"`
+	Nulls  int `json:"nulls"`
+}
+
+// RunStore keeps score runs and their rows.
+type RunStore interface {
+	// Create starts storing the rows of a run; nothing is visible until the writer commits
+	Create(id string) (RunWriter, error)
+	// Get returns the record of a run
+	Get(id string) (RunRecord, error)
+	// List returns the records of every run, newest first
+	List() ([]RunRecord, error)
+	// Rows reads the rows of a run, in the order they were written
+	Rows(id string, emit func(ScoredRow) error) error
+}
+
+// RunWriter stores the rows of a run, then its record with Commit (or nothing with Abort).
+type RunWriter interface {
+	WriteRow(row ScoredRow) error
+	Commit(record RunRecord) error
+	Abort()
+}
+
+var errRunNotFound = errors.New("run not found")
+
+// configHash is the sha256 of the config's JSON form.
+func configHash(scoreConfig *c.Config) string {
+	data, err := json.Marshal(scoreConfig)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// runRecorder stores a run as its rows are written. It opens the run on the first row, so a run
+// that fails before any leaves nothing behind. Storage errors are logged, they never fail the run.
+// A nil recorder records nothing.
+type runRecorder struct {
+	store     RunStore
+	w         RunWriter
+	failed    bool
+	committed bool
+	record    RunRecord
+	counts    []RunMetric
+}
+
+// newRunRecorder starts recording a run of scoreConfig in rs, whose output has the metrics of
+// filter. It returns nil when runs are not stored (rs == nil).
+func newRunRecorder(rs RunStore, id, source, query string, scoreConfig *c.Config, filter ScoreFilter) *runRecorder {
+	if rs == nil {
+		return nil
+	}
+	rec := &runRecorder{store: rs, record: RunRecord{
+		ID:         id,
+		Product:    scoreConfig.Name,
+		Source:     source,
+		Query:      query,
+		ConfigHash: configHash(scoreConfig),
+		StartedAt:  time.Now().UTC(),
+	}}
+	for _, f := range metricFormats(filter.Output(scoreConfig), false) {
+		rec.counts = append(rec.counts, RunMetric{MetricFormat: f})
+	}
+	return rec
+}
+
+// setSnapshot records the data the run scored.
+func (rec *runRecorder) setSnapshot(snapshot *Snapshot) {
+	if rec == nil || snapshot == nil {
+		return
+	}
+	rec.record.Datasets = snapshot.Fingerprints
+	rec.record.DataFingerprint = dataFingerprint(snapshot)
+}
+
+func (rec *runRecorder) open() bool {
+	if rec.w == nil && !rec.failed {
+		w, err := rec.store.Create(rec.record.ID)
+		if err != nil {
+			log.Printf("[WARN] failed to store run %s: %v", rec.record.ID, err)
+			rec.failed = true
+			return false
+		}
+		rec.w = w
+	}
+	return !rec.failed
+}
+
+func (rec *runRecorder) add(row ScoredRow) {
+	if rec == nil || !rec.open() {
+		return
+	}
+	if err := rec.w.WriteRow(row); err != nil {
+		log.Printf("[WARN] failed to store run %s: %v", rec.record.ID, err)
+		rec.w.Abort()
+		rec.failed = true
+		return
+	}
+	rec.record.Rows++
+	for i := range rec.counts {
+		if val, ok := row.Values[rec.counts[i].Name]; ok && !math.IsNaN(val) && !math.IsInf(val, 0) {
+			rec.counts[i].Values++
+		} else {
+			rec.counts[i].Nulls++
+		}
+	}
+}
+
+// finish commits the run, or drops it when the run failed (err != nil).
+func (rec *runRecorder) finish(err error) {
+	if rec == nil {
+		return
+	}
+	if err != nil {
+		if rec.w != nil && !rec.failed {
+			rec.w.Abort()
+		}
+		return
+	}
+	if !rec.open() {
+		return
+	}
+	rec.record.FinishedAt = time.Now().UTC()
+	rec.record.Metrics = rec.counts
+	if err := rec.w.Commit(rec.record); err != nil {
+		log.Printf("[WARN] failed to store run %s: %v", rec.record.ID, err)
+		return
+	}
+	rec.committed = true
+}
+
+// stored reports whether finish committed the run.
+func (rec *runRecorder) stored() bool {
+	return rec != nil && rec.committed
+}
+
+// FileRunStore keeps runs in a local directory: <id>.json for the record and <id>.rows for the
+// rows (gob, values as computed). The records are read once, when the store is opened, and kept
+// in an index: one process writes a directory. Runs past Retention, and the oldest ones beyond
+// MaxRuns, are deleted as new runs are committed (and by Prune).
+type FileRunStore struct {
+	Dir string
+	// Retention is how long runs are kept after they started, 0 => forever
+	Retention time.Duration
+	// MaxRuns is how many runs are kept at most, 0 => no limit
+	MaxRuns int
+
+	mu sync.Mutex
+	// records are the committed runs by ID, order their IDs newest first
+	records map[string]RunRecord
+	order   []string
+	now     func() time.Time
+}
+
+// NewFileRunStore returns a store in dir, creating it if needed, with the runs already in it.
+func NewFileRunStore(dir string) (*FileRunStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create runs directory %s: %w", dir, err)
+	}
+	s := &FileRunStore{Dir: dir, records: make(map[string]RunRecord), now: time.Now}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		record, err := s.read(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			log.Printf("[WARN] skipping run %s: %v", path, err)
+			continue
+		}
+		s.add(record)
+	}
+	return s, nil
+}
+
+// add indexes a committed run; s.mu must be held, or the store not shared yet.
+func (s *FileRunStore) add(record RunRecord) {
+	if _, ok := s.records[record.ID]; ok {
+		s.order = slices.DeleteFunc(s.order, func(id string) bool { return id == record.ID })
+	}
+	s.records[record.ID] = record
+	// newest first; runs started at the same time stay in the order they were added
+	i := sort.Search(len(s.order), func(i int) bool { return s.records[s.order[i]].StartedAt.Before(record.StartedAt) })
+	s.order = slices.Insert(s.order, i, record.ID)
+}
+
+// Prune deletes the runs past Retention and the oldest ones beyond MaxRuns.
+func (s *FileRunStore) Prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+}
+
+func (s *FileRunStore) prune() {
+	keep := len(s.order)
+	if s.MaxRuns > 0 {
+		keep = min(keep, s.MaxRuns)
+	}
+	if s.Retention > 0 {
+		horizon := s.now().Add(-s.Retention)
+		keep = sort.Search(keep, func(i int) bool { return s.records[s.order[i]].StartedAt.Before(horizon) })
+	}
+	for _, id := range s.order[keep:] {
+		delete(s.records, id)
+		// the record first: a run without one is not listed
+		for _, ext := range []string{".json", ".rows"} {
+			if path, _ := s.path(id, ext); path != "" {
+				if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+					log.Printf("[WARN] failed to delete run %s: %v", id, err)
+				}
+			}
+		}
+	}
+	s.order = s.order[:keep]
+}
+
+// path returns the file of a run; IDs are UUIDs, anything else is not a run.
+func (s *FileRunStore) path(id, ext string) (string, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return "", errRunNotFound
+	}
+	return filepath.Join(s.Dir, id+ext), nil
+}
+
+func (s *FileRunStore) Create(id string) (RunWriter, error) {
+	path, err := s.path(id, ".rows")
+	if err != nil {
+		return nil, fmt.Errorf("invalid run ID %q", id)
+	}
+	f, err := os.CreateTemp(s.Dir, id+".rows.*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(f)
+	return &fileRunWriter{store: s, id: id, path: path, f: f, bw: bw, enc: gob.NewEncoder(bw)}, nil
+}
+
+type fileRunWriter struct {
+	store *FileRunStore
+	id    string
+	path  string
+	f     *os.File
+	bw    *bufio.Writer
+	enc   *gob.Encoder
+}
+
+func (fw *fileRunWriter) WriteRow(row ScoredRow) error {
+	return fw.enc.Encode(&row)
+}
+
+// Commit moves the rows in place, then writes the record: a run is listed once it is complete.
+func (fw *fileRunWriter) Commit(record RunRecord) error {
+	if err := fw.bw.Flush(); err != nil {
+		fw.Abort()
+		return err
+	}
+	if err := fw.f.Close(); err != nil {
+		os.Remove(fw.f.Name())
+		return err
+	}
+	if err := os.Rename(fw.f.Name(), fw.path); err != nil {
+		os.Remove(fw.f.Name())
+		return err
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	recordPath, _ := fw.store.path(fw.id, ".json")
+	tmp := recordPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, recordPath); err != nil {
+		return err
+	}
+	fw.store.mu.Lock()
+	defer fw.store.mu.Unlock()
+	fw.store.add(record)
+	fw.store.prune()
+	return nil
+}
+
+func (fw *fileRunWriter) Abort() {
+	fw.f.Close()
+	os.Remove(fw.f.Name())
+}
+
+func (s *FileRunStore) Get(id string) (RunRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[id]
+	if !ok {
+		return RunRecord{}, errRunNotFound
+	}
+	return record, nil
+}
+
+// read reads the record of a run from its file.
+func (s *FileRunStore) read(id string) (RunRecord, error) {
+	var record RunRecord
+	path, err := s.path(id, ".json")
+	if err != nil {
+		return record, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return record, errRunNotFound
+	} else if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, fmt.Errorf("invalid record of run %s: %w", id, err)
+	}
+	return record, nil
+}
+
+func (s *FileRunStore) List() ([]RunRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]RunRecord, len(s.order))
+	for i, id := range s.order {
+		records[i] = s.records[id]
+	}
+	return records, nil
+}
+
+func (s *FileRunStore) Rows(id string, emit func(ScoredRow) error) error {
+	path, err := s.path(id, ".rows")
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return errRunNotFound
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	for {
+		var row ScoredRow
+		if err := dec.Decode(&row); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read rows of run %s: %w", id, err)
+		}
+		if row.Values == nil {
+			row.Values = map[string]float64{}
+		}
+		if err := emit(row); err != nil {
+			return err
+		}
+	}
+}
+
+// outputConfig is a config with the metrics (and formats) of a run, to write its rows again.
+func (record RunRecord) outputConfig() *c.Config {
+	out := &c.Config{Name: record.Product}
+	for _, m := range record.Metrics {
+		out.Metrics = append(out.Metrics, c.Metric{
+			Name:      m.Name,
+			Precision: m.Precision,
+			Rounding:  string(m.Rounding),
+			Unit:      m.Unit,
+			Scale:     m.Scale,
+		})
+	}
+	return out
+}
+
+// RunsHandler serves the stored runs:
+//   - GET /runs lists them, newest first (?product= and ?limit= narrow the list)
+//   - GET /runs/{id} is the record of a run
+//   - GET /runs/{id}/result is its rows, with the output options of /run-scores (format, sort,
+//     precision, filters)
+func RunsHandler(rs RunStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/runs"), "/"), "/")
+		switch {
+		case id == "":
+			listRuns(w, r, rs)
+		case sub == "":
+			record, err := rs.Get(id)
+			if err != nil {
+				http.Error(w, err.Error(), runErrorStatus(err))
+				return
+			}
+			writeJSON(w, record)
+		case sub == "result":
+			serveRunResult(w, r, rs, id)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+func runErrorStatus(err error) int {
+	if errors.Is(err, errRunNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func listRuns(w http.ResponseWriter, r *http.Request, rs RunStore) {
+	limit := 0
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", raw), http.StatusBadRequest)
+			return
+		}
+	}
+	records, err := rs.List()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if product := r.URL.Query().Get("product"); product != "" {
+		kept := records[:0]
+		for _, record := range records {
+			if record.Product == product {
+				kept = append(kept, record)
+			}
+		}
+		records = kept
+	}
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	writeJSON(w, map[string][]RunRecord{"runs": records})
+}
+
+func serveRunResult(w http.ResponseWriter, r *http.Request, rs RunStore, id string) {
+	record, err := rs.Get(id)
+	if err != nil {
+		http.Error(w, err.Error(), runErrorStatus(err))
+		return
+	}
+	out, ok := parseScoreRequest(w, r, record.outputConfig())
+	if !ok {
+		return
+	}
+	out.meta.RunID, out.meta.GeneratedAt = record.ID, record.FinishedAt
+	writeRunRows(w, rs, id, out)
+}
+
+// writeRunRows writes the stored rows of a run with the output options of out. Without a sort
+// order they are streamed in the order they were stored; with one they are read into memory.
+func writeRunRows(w http.ResponseWriter, rs RunStore, id string, out scoreOutput) {
+	if len(out.order) == 0 {
+		streamScores(w, out.rw, out.meta, nil, func(emit func(CompanyYearKey, map[string]float64) error) error {
+			return rs.Rows(id, func(row ScoredRow) error {
+				if !out.filter.Match(row.Key()) {
+					return nil
+				}
+				return emit(row.Key(), out.filter.project(row.Values))
+			})
+		})
+		return
+	}
+	var rows ScoreRows
+	if err := rs.Rows(id, func(row ScoredRow) error {
+		rows = append(rows, row)
+		return nil
+	}); err != nil {
+		http.Error(w, err.Error(), runErrorStatus(err))
+		return
+	}
+	sorted := out.filter.Apply(rows).Sorted(out.order)
+	streamScores(w, out.rw, out.meta, nil, sorted.emitTo)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRunStore(t *testing.T) {
+	rs, err := NewFileRunStore(t.TempDir())
+	require.NoError(t, err)
+
+	write := func(id string, started time.Time, rows ...ScoredRow) {
+		w, err := rs.Create(id)
+		require.NoError(t, err)
+		for _, row := range rows {
+			require.NoError(t, w.WriteRow(row))
+		}
+		require.NoError(t, w.Commit(RunRecord{ID: id, Product: "p", StartedAt: started, Rows: len(rows)}))
+	}
+	older, newer := uuid.NewString(), uuid.NewString()
+	rows := ScoreRows{
+		{CompanyID: "2", Year: 2023, Values: map[string]float64{"m": 1.23456789}},
+		{CompanyID: "1", Year: 2022, Values: map[string]float64{}},
+	}
+	write(older, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), rows...)
+	write(newer, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC))
+
+	// an aborted run leaves nothing behind
+	w, err := rs.Create(uuid.NewString())
+	require.NoError(t, err)
+	require.NoError(t, w.WriteRow(rows[0]))
+	w.Abort()
+	entries, err := os.ReadDir(rs.Dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 4)
+
+	records, err := rs.List()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, []string{newer, older}, []string{records[0].ID, records[1].ID}, "newest first")
+
+	var got ScoreRows
+	require.NoError(t, rs.Rows(older, func(row ScoredRow) error {
+		got = append(got, row)
+		return nil
+	}))
+	assert.Equal(t, rows, got, "in the order written, values in full")
+
+	for _, id := range []string{uuid.NewString(), "../etc/passwd", ""} {
+		_, err := rs.Get(id)
+		assert.ErrorIs(t, err, errRunNotFound, id)
+	}
+	_, err = rs.Create("../x")
+	assert.Error(t, err)
+}
+
+func TestFileRunStoreRetention(t *testing.T) {
+	dir := t.TempDir()
+	rs, err := NewFileRunStore(dir)
+	require.NoError(t, err)
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	rs.now = func() time.Time { return now }
+
+	ids := make([]string, 4)
+	for i := range ids {
+		ids[i] = uuid.NewString()
+		w, err := rs.Create(ids[i])
+		require.NoError(t, err)
+		require.NoError(t, w.Commit(RunRecord{ID: ids[i], StartedAt: now.Add(-time.Duration(i) * 24 * time.Hour)}))
+	}
+
+	// the index is rebuilt from the directory
+	reopened, err := NewFileRunStore(dir)
+	require.NoError(t, err)
+	records, err := reopened.List()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	assert.Equal(t, ids, []string{records[0].ID, records[1].ID, records[2].ID, records[3].ID}, "newest first")
+
+	// runs started 2 days ago or earlier are past the retention, then only the newest 1 is kept
+	rs.Retention = 36 * time.Hour
+	rs.Prune()
+	records, err = rs.List()
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+	rs.MaxRuns = 1
+	rs.Prune()
+	records, err = rs.List()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, ids[0], records[0].ID)
+
+	_, err = rs.Get(ids[1])
+	assert.ErrorIs(t, err, errRunNotFound)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "the record and rows of the kept run")
+}
+
+// failingResponseWriter is a client that went away: every write of the body fails.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w *failingResponseWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestRunsHandler(t *testing.T) {
+	rs, err := NewFileRunStore(t.TempDir())
+	require.NoError(t, err)
+
+	jobs, store, _ := newJobsFixture(t, JobOptions{Runs: rs})
+	scores := CalculateScoreHandler(context.Background(), crossSectionalConfig(), store, rs)
+	runs := RunsHandler(rs)
+	get := func(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	published := get(scores, "/run-scores?company=5001,5002&metrics=total,growth&sort=-total")
+	require.Equal(t, http.StatusOK, published.Code)
+	id := published.Header().Get("X-Run-ID")
+	assert.Equal(t, http.StatusBadRequest, get(scores, "/run-scores?as_of=yesterday").Code)
+
+	rec := get(runs, "/runs/"+id)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var record RunRecord
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &record))
+	assert.Equal(t, "cross_sectional", record.Product)
+	assert.Equal(t, "run-scores", record.Source)
+	assert.Equal(t, "company=5001,5002&metrics=total,growth&sort=-total", record.Query)
+	assert.Equal(t, configHash(crossSectionalConfig()), record.ConfigHash)
+	assert.Equal(t, store.Snapshot().Fingerprints, record.Datasets)
+	assert.Equal(t, dataFingerprint(store.Snapshot()), record.DataFingerprint)
+	assert.False(t, record.FinishedAt.Before(record.StartedAt))
+	assert.Equal(t, 8, record.Rows)
+	require.Len(t, record.Metrics, 2)
+	assert.Equal(t, "growth", record.Metrics[1].Name)
+	assert.Equal(t, 8, record.Metrics[1].Values+record.Metrics[1].Nulls)
+	assert.Equal(t, 2, record.Metrics[1].Nulls, "no growth in the first year")
+
+	// the stored rows are the published ones, and can be written in any format
+	rec = get(runs, "/runs/"+id+"/result")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, published.Body.String(), rec.Body.String())
+	assert.Equal(t, id, rec.Header().Get("X-Run-ID"))
+	rec = get(runs, "/runs/"+id+"/result?format=ndjson&company=5002&precision=full")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"company_id":"5002"`)
+	assert.NotContains(t, rec.Body.String(), `"company_id":"5001"`)
+	rec = get(runs, "/runs/"+id+"/result?format=ndjson&sort=company,-year")
+	require.Equal(t, http.StatusOK, rec.Code)
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	require.Len(t, lines, 8)
+	assert.Contains(t, lines[0], `"company_id":"5001"`)
+	assert.Contains(t, lines[7], `"company_id":"5002"`)
+
+	// a client that goes away aborts the run: it is not stored
+	broken := &failingResponseWriter{ResponseRecorder: httptest.NewRecorder()}
+	scores(broken, httptest.NewRequest(http.MethodGet, "/run-scores", nil))
+	assert.Equal(t, http.StatusNotFound, get(runs, "/runs/"+broken.Header().Get("X-Run-ID")).Code)
+
+	// jobs are stored under their ID
+	status, err := jobs.Submit(JobRequest{Filters: JobFilters{Company: []string{"5003"}}})
+	require.NoError(t, err)
+	waitJob(t, jobs, status.ID, JobSucceeded)
+	rec = get(runs, "/runs?product=cross_sectional")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list struct {
+		Runs []RunRecord `json:"runs"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	require.Len(t, list.Runs, 2, "failed requests are not runs")
+	assert.Equal(t, status.ID, list.Runs[0].ID)
+	assert.Equal(t, "job", list.Runs[0].Source)
+	assert.Equal(t, "company=5003", list.Runs[0].Query)
+	assert.Equal(t, 4, list.Runs[0].Rows)
+
+	rec = get(runs, "/runs?limit=1&product=nope")
+	assert.JSONEq(t, `{"runs": []}`, rec.Body.String())
+	assert.Equal(t, http.StatusBadRequest, get(runs, "/runs?limit=x").Code)
+	assert.Equal(t, http.StatusNotFound, get(runs, "/runs/"+uuid.NewString()).Code)
+	assert.Equal(t, http.StatusNotFound, get(runs, "/runs/"+uuid.NewString()+"/result").Code)
+}
@@ -3,10 +3,11 @@ package internal
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
-	"os"
 	"path/filepath"
-	"sort"
+	"runtime"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -23,22 +24,31 @@ type CompanyYearKey struct {
 
 type rowData struct {
 	date    time.Time
-	numeric map[string]float64
+	knownAt time.Time
+	values  map[string]Value
 }
 
-// just to test the json file
-type rawJSONRow struct {
-	CompanyID string   `json:"company_id"`
-	DateStr   string   `json:"date"`
-	Dis1      *float64 `json:"dis_1,omitempty"` // use pointer so we can detect "null" vs. 0
-	Dis2      *float64 `json:"dis_2,omitempty"`
-	Dis3      *float64 `json:"dis_3,omitempty"`
-	Dis4      *float64 `json:"dis_4,omitempty"`
-	// Add more fields if needed
+// Dataset holds the latest row of typed values for each (company, year).
+type Dataset map[CompanyYearKey]map[string]Value
+
+// FieldKinds reports, for every field of the dataset, the set of value kinds seen in it.
+// A cleanly typed column has exactly one kind.
+func (d Dataset) FieldKinds() map[string]map[ValueKind]bool {
+	kinds := make(map[string]map[ValueKind]bool)
+	for _, row := range d {
+		for field, v := range row {
+			if v.IsNull() {
+				continue
+			}
+			if kinds[field] == nil {
+				kinds[field] = make(map[ValueKind]bool)
+			}
+			kinds[field][v.Kind] = true
+		}
+	}
+	return kinds
 }
 
-type DisclosureData map[CompanyYearKey]map[string]float64
-
 func indexOf(slice []string, target string) int {
 	for i, s := range slice {
 		if s == target {
@@ -48,110 +58,45 @@ func indexOf(slice []string, target string) int {
 	return -1
 }
 
-func getAllDataCompanyKeys(datasets map[string]map[CompanyYearKey]map[string]float64) []CompanyYearKey {
-	unique := make(map[CompanyYearKey]bool)
-	for _, ds := range datasets {
-		for key := range ds {
-			unique[key] = true
-		}
-	}
-	out := make([]CompanyYearKey, 0, len(unique))
-	for k := range unique {
-		out = append(out, k)
-	}
-	return out
-}
-
-func evaluateMetric(
-	ctx context.Context,
-	metric c.Metric,
-	key CompanyYearKey,
-//results map[CompanyYearKey]map[string]float64,
-	results map[string]float64,
-	datasets map[string]map[CompanyYearKey]map[string]float64,
-) (float64, bool) {
-	// if we've already computed metric, return it
-	if val, ok := results[metric.Name]; ok {
-		return val, false
-	}
-
-	opFn, ok := operations[metric.Operation.Type]
-	if !ok {
-		log.Printf("Unknown operation: %s", metric.Operation.Type)
-		return 0, true
-	}
-
-	val, isNull, err := opFn(ctx, metric.Operation.Parameters, key, results, datasets)
-	if err != nil {
-		// You might decide an error means “null,” or handle differently
-		log.Printf("Error in operation %s: %v", metric.Operation.Type, err)
-		return 0, true
-	}
-
-	if !isNull {
-		results[metric.Name] = val
-	}
-
-	return val, isNull
-}
-
+// getValue reads a resolved source at a slot of the ColumnStore (-1 = no row) as a number.
 func getValue(
-	source string,
-	key CompanyYearKey,
+	ref sourceRef,
+	slot int,
 //results map[CompanyYearKey]map[string]float64,
 	results map[string]float64,
-	datasets map[string]map[CompanyYearKey]map[string]float64,
 ) (float64, bool) {
-	// Check for self-reference
-	if strings.HasPrefix(source, "self.") {
-		metricName := strings.TrimPrefix(source, "self.")
-		val, ok := results[metricName]
-		if !ok {
-			// We haven't computed it yet -> we need to do so dynamically if possible
-			// Or consider your approach to ordering the metrics in the config (topological).
-			// A simple approach is to do a second pass or a recursion here.
-			// For now, let's treat it as "null" if not precomputed:
-			return 0, true
-		}
-		return val, false
-	}
-
-	// Otherwise "datasetName.metricName"
-	parts := strings.Split(source, ".")
-	if len(parts) != 2 {
-		return 0, true // invalid format => null
+	if ref.self {
+		val, ok := results[ref.metric]
+		return val, !ok
 	}
-	datasetName := parts[0]
-	metricKey := parts[1]
-
-	ds, ok := datasets[datasetName]
-	if !ok {
-		// unknown dataset => null
-		return 0, true
-	}
-	row, ok := ds[key]
-	if !ok {
-		// no row => null
-		return 0, true
-	}
-	val, ok := row[metricKey]
-	if !ok {
-		return 0, true
-	}
-	return val, false
+	// non-numeric cells (categories, flags) read as null in numeric context
+	num, ok := ref.col.Float(slot)
+	return num, !ok
 }
 
-// We'll call this function in computeScores or a separate step.
+// scoreQueuePerWorker bounds the keys queued for, and the rows waiting behind, each worker of a stage.
+const scoreQueuePerWorker = 64
+
+// parallelComputeScores evaluates a compiled per-key stage for keys with numWorkers workers, each
+// with its own frame. Each key gets a fresh copy of its row (rows may be shared with a previous
+// result set), which replaces it in results once every key is done. It stops early when ctx is
+// done, and a panic in an operation stops the stage with an error instead of crashing the process;
+// results is left as it was in both cases.
 func parallelComputeScores(
 	ctx context.Context,
-	allKeys []CompanyYearKey,
-	scoreConfig *c.Config,
-	datasets map[string]map[CompanyYearKey]map[string]float64,
+	keys []CompanyYearKey,
+	plan *stagePlan,
+	results map[CompanyYearKey]map[string]float64,
+	cols *ColumnStore,
 	numWorkers int,
-) map[CompanyYearKey]map[string]float64 {
-	// 1) Create job + result channels
-	jobs := make(chan CompanyYearKey, len(allKeys))
-	results := make(chan keyResult, len(allKeys))
+) error {
+	numWorkers = max(1, min(numWorkers, len(keys)))
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// 1) Create bounded job + result channels
+	jobs := make(chan keyResult, numWorkers*scoreQueuePerWorker)
+	done := make(chan keyResult, numWorkers*scoreQueuePerWorker)
 
 	// 2) Spawn worker goroutines
 	var wg sync.WaitGroup
@@ -160,145 +105,213 @@ func parallelComputeScores(
 	for i := 0; i < numWorkers; i++ {
 		go func() {
 			defer wg.Done()
-			for key := range jobs {
-				// Compute the metrics for this (company, year)
-				metricsMap := computeScoresForKey(ctx, key, scoreConfig, datasets)
-				results <- keyResult{
-					Key:    key,
-					Result: metricsMap,
+			f := plan.newFrame()
+			for job := range jobs {
+				if ctx.Err() != nil {
+					continue // drain, the producer stops too
+				}
+				// Compute the stage's metrics for this (company, year)
+				if err := evalKeySafely(ctx, plan, cols.Slot(job.Key), f, job); err != nil {
+					cancel(err)
+					continue
+				}
+				select {
+				case done <- job:
+				case <-ctx.Done():
 				}
 			}
 		}()
 	}
 
-	// 3) Send all jobs to the workers
-	for _, key := range allKeys {
-		jobs <- key
-	}
-	close(jobs)
+	// 3) Send the jobs as the workers take them; rows are copied before results is written
+	go func() {
+		defer close(jobs)
+		for i, key := range keys {
+			select {
+			case jobs <- keyResult{Index: i, Key: key, Result: copyRow(results[key], plan.names...)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
 	// 4) Wait for all workers to finish, then close results
 	go func() {
 		wg.Wait()
-		close(results)
+		close(done)
 	}()
 
 	// 5) Collect results
-	finalResults := make(map[CompanyYearKey]map[string]float64, len(allKeys))
-	for kr := range results {
-		finalResults[kr.Key] = kr.Result
+	progress := progressFrom(ctx)
+	rows := make([]map[string]float64, len(keys))
+	for kr := range done {
+		rows[kr.Index] = kr.Result
+		progress.addDone(1)
 	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	for i, key := range keys {
+		results[key] = rows[i]
+	}
+	return nil
+}
 
-	return finalResults
+// evalKeySafely evaluates a key, turning a panic in an operation into an error.
+func evalKeySafely(ctx context.Context, plan *stagePlan, slot int, f *frame, job keyResult) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			metric := plan.metrics[f.current].Name
+			log.Printf("panic computing metric %s for %s %d: %v\n%s", metric, job.Key.CompanyID, job.Key.Year, r, debug.Stack())
+			err = fmt.Errorf("metric %s failed for company %s, year %d: %v", metric, job.Key.CompanyID, job.Key.Year, r)
+		}
+	}()
+	plan.evalKey(ctx, slot, f, job.Result)
+	return nil
 }
 
 // A simple struct to hold each worker's output
 type keyResult struct {
+	Index  int
 	Key    CompanyYearKey
 	Result map[string]float64
 }
 
-func computeScoresForKey(
-	ctx context.Context,
-	key CompanyYearKey,
-	scoreConfig *c.Config,
-	datasets map[string]map[CompanyYearKey]map[string]float64,
-) map[string]float64 {
-	metricResults := make(map[string]float64)
-
-	// Evaluate each metric in the config
-	for _, metric := range scoreConfig.Metrics {
-		val, isNull := evaluateMetric(ctx, metric, key, metricResults, datasets)
-		if !isNull {
-			// store this metric's final value under its name
-			metricResults[metric.Name] = val
+// LoadedDataset is one dataset file after loading and data-quality checks.
+type LoadedDataset struct {
+	Name       string
+	Source     string
+	Data       Dataset
+	Quality    DatasetQuality
+	Quarantine []QuarantinedRow
+	// rows are the accepted rows by company-year, kept so change events can be applied on top
+	rows map[CompanyYearKey][]Record
+}
+
+// datasetNameOf derives the dataset name from a file name, e.g. "waste_data.csv" => "waste_data"
+func datasetNameOf(fileName string) string {
+	return strings.TrimSuffix(fileName, filepath.Ext(fileName))
+}
+
+// supportedObjects lists the objects under prefix that have a loader registered for their extension.
+func (s *DataLoaderService) supportedObjects(ctx context.Context, storage Storage, prefix string) ([]ObjectInfo, error) {
+	objects, err := storage.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var supported []ObjectInfo
+	for _, o := range objects {
+		ext := filepath.Ext(o.Name()) // e.g. ".csv"
+		if _, ok := s.registry.GetLoader(ext); !ok {
+			log.Printf("[WARN] Skipping file with unsupported extension %q: %s", ext, o.Key)
+			continue
 		}
+		supported = append(supported, o)
 	}
-	return metricResults
+	return supported, nil
 }
 
-func (s *DataLoaderService) LoadAllData(
-	ctx context.Context,
-	dataDir string,
-) (map[string]map[CompanyYearKey]map[string]float64, error) {
+// LoadDataset decodes one object with the loader registered for its extension and runs the
+// data-quality rules of its dataset on it. fileName is the object's name, e.g. "waste_data.csv".
+func (s *DataLoaderService) LoadDataset(ctx context.Context, fileName string, r io.Reader) (*LoadedDataset, error) {
+	ext := filepath.Ext(fileName)
 
-	files, err := os.ReadDir(dataDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read data directory %s: %w", dataDir, err)
+	loader, ok := s.registry.GetLoader(ext)
+	if !ok {
+		return nil, fmt.Errorf("no loader for extension %q: %s", ext, fileName)
 	}
 
-	combined := make(map[string]map[CompanyYearKey]map[string]float64)
+	records, err := loader.LoadRecords(ctx, fileName, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load data from %s: %w", fileName, err)
+	}
 
-	for _, f := range files {
-		if f.IsDir() {
-			continue // skip subdirectories
-		}
+	datasetName := datasetNameOf(fileName)
 
-		fullPath := filepath.Join(dataDir, f.Name())
-		ext := filepath.Ext(f.Name()) // e.g. ".csv"
+	// Run the data-quality rules; failing rows go to quarantine instead of being scored
+	accepted, quarantined, summary := applyQualityRules(datasetName, fileName, records, s.quality.Rules(datasetName))
+	if len(quarantined) > 0 {
+		log.Printf("[WARN] %s: %d of %d rows quarantined %v", fileName, len(quarantined), len(records), summary.ByRule)
+	}
 
-		loader, ok := s.registry.GetLoader(ext)
-		if !ok {
-			log.Printf("[WARN] Skipping file with unsupported extension %q: %s", ext, f.Name())
-			continue
-		}
+	return &LoadedDataset{
+		Name:       datasetName,
+		Source:     fileName,
+		Data:       latestPerYear(accepted),
+		Quality:    summary,
+		Quarantine: quarantined,
+		rows:       rowsByCompanyYear(accepted),
+	}, nil
+}
 
-		ds, err := loader.LoadData(ctx, fullPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load data from %s: %w", f.Name(), err)
-		}
+// LoadAllData does a one-off load of every supported file in dataDir into a fresh snapshot.
+// Long-running callers should use a DatasetStore, which only reloads what changed.
+func (s *DataLoaderService) LoadAllData(
+	ctx context.Context,
+	dataDir string,
+) (*Snapshot, error) {
+	store := NewDatasetStore(s, FileStorage{Root: dataDir}, "", StoreOptions{})
+	if _, err := store.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return store.Snapshot(), nil
+}
 
-		// e.g. "waste_data.csv" => datasetName = "waste_data"
-		datasetName := strings.TrimSuffix(f.Name(), ext)
-		combined[datasetName] = ds
+// workerCount is the number of workers computing a per-key stage, n <= 0 => GOMAXPROCS.
+func workerCount(n int) int {
+	if n > 0 {
+		return n
 	}
+	return runtime.GOMAXPROCS(0)
+}
 
-	return combined, nil
+// datasetAliases maps the dataset names used in score configs to the loaded datasets,
+// e.g. "disclosure" => "disclosure_data" (from "disclosure_data.csv").
+var datasetAliases = map[string]string{
+	"disclosure": "disclosure_data",
+	"waste":      "waste_data",
+	"emissions":  "emissions_data",
+}
+
+// scoreDatasets returns the snapshot's datasets under their score config names.
+func scoreDatasets(snapshot *Snapshot) map[string]Dataset {
+	datasets := make(map[string]Dataset, len(datasetAliases))
+	for alias, name := range datasetAliases {
+		datasets[alias] = snapshot.Datasets[name]
+	}
+	return datasets
 }
 
 func CalculateScore(
 	ctx context.Context,
-	configFileName string,
-	dataService *DataLoaderService,
-) (*c.Config, map[CompanyYearKey]map[string]float64, error) {
+	scoreConfig *c.Config,
+	snapshot *Snapshot,
+) (ScoreRows, error) {
 
 	// Start a tracing span
 	tracer := otel.Tracer("score-app")
 	ctx, span := tracer.Start(ctx, "CalculateScoreApp")
 	defer span.End()
 
-	// 1) Load the scoring config (score_1.yaml)
-	scoreConfig, err := c.InitScoreConfig(configFileName)
-	if err != nil {
-		return nil, nil, fmt.Errorf("error initializing score config: %w", err)
-	}
-	log.Printf("Loaded config: %s\n", scoreConfig.Name)
+	// 1) Map the datasets of the snapshot to the names used in score configs
+	datasets := scoreDatasets(snapshot)
 
-	// 2) Load all CSVs (or other files) from "data/" using the injected service
-	combined, err := dataService.LoadAllData(ctx, dir)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to load data from folder: %w", err)
+	for name, loadErr := range snapshot.Unavailable {
+		log.Printf("[WARN] dataset %s is unavailable, its sources read as null: %s", name, loadErr)
 	}
 
-	// 3) Map them to expected dataset names. For example, if you expect "disclosureData",
-	//    "wasteData", "emissionsData" as file names:
-	datasets := map[string]map[CompanyYearKey]map[string]float64{
-		"disclosure": combined["disclosure_data"], // "disclosure_data.csv" => "disclosure_data"
-		"waste":      combined["waste_data"],
-		"emissions":  combined["emissions_data"],
+	// 2) Validate the config against what was loaded (types, references) before computing anything
+	if err := ValidateScoreConfig(scoreConfig, datasets); err != nil {
+		return nil, fmt.Errorf("invalid score config %s: %w", scoreConfig.Name, err)
 	}
 
-	// 4) Parallel compute scores
-	allKeys := getAllDataCompanyKeys(datasets)
-
-	sort.Slice(allKeys, func(i, j int) bool {
-		if allKeys[i].CompanyID == allKeys[j].CompanyID {
-			return allKeys[i].Year < allKeys[j].Year
-		}
-		return allKeys[i].CompanyID < allKeys[j].CompanyID
-	})
-
-	scoredResults := parallelComputeScores(ctx, allKeys, scoreConfig, datasets, 4)
+	// 3) Compute the scores, stage by stage
+	scoredResults, err := computeScores(ctx, scoreConfig, snapshot.Columns(), nil, nil, workerCount(snapshot.workers))
+	if err != nil {
+		return nil, err
+	}
 
-	return scoreConfig, scoredResults, nil
+	// 4) Order the rows by company and year
+	return newScoreRows(scoredResults), nil
 }
@@ -0,0 +1,9 @@
+package internal
+
+// database/sql drivers available to ".sql" datasets (see SQLLoader): "postgres" for warehouses and
+// "sqlite3" for local database files. sqlite3 needs a cgo build (the Dockerfile links it
+// statically); without cgo it is still registered but opening it fails with an error saying so.
+import (
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
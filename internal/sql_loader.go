@@ -0,0 +1,368 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// SQLLoader reads a dataset from a SQL database through database/sql. It is registered for
+// ".sql" files: each file in the data directory declares one dataset with a header of
+// "-- key: value" comments followed by the query template, e.g.
+//
+//	-- driver: postgres
+//	-- dsn: ${EMISSIONS_DB_DSN}
+//	-- company_id: company
+//	-- date: reported_on
+//	-- columns: emi_1=scope_1, emi_2=scope_2
+//	-- version_query: SELECT max(updated_at) FROM emissions
+//	SELECT company, reported_on, scope_1, scope_2
+//	FROM {{ env "EMISSIONS_SCHEMA" "public" }}.emissions
+//
+// dsn is expanded from the environment so credentials stay out of the file. company_id and date
+// name the key columns (defaults "company_id" and "date"); columns maps field names to result
+// columns (default: every other column, under its own name). An optional "-- known_at: column"
+// names a column with the time each row became known (see Record.KnownAt). The drivers linked into
+// the binary are listed in sql_drivers.go.
+type SQLLoader struct {
+	mu  sync.Mutex
+	dbs map[string]*sql.DB // connection pools by driver + dsn
+}
+
+func NewSQLLoader() *SQLLoader {
+	return &SQLLoader{dbs: make(map[string]*sql.DB)}
+}
+
+// sqlSpec is a parsed ".sql" dataset file.
+type sqlSpec struct {
+	Dataset       string
+	Driver        string
+	DSN           string
+	CompanyColumn string
+	DateColumn    string
+	// KnownAtColumn optionally holds the row's knowledge time
+	KnownAtColumn string
+	// Fields maps field name => result column; empty means every non-key column
+	Fields       map[string]string
+	VersionQuery string
+	Query        string
+}
+
+func (l *SQLLoader) LoadRecords(ctx context.Context, name string, r io.Reader) ([]Record, error) {
+	spec, err := readSQLSpec(name, r)
+	if err != nil {
+		return nil, err
+	}
+	db, err := l.db(spec.Driver, spec.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, spec.Query)
+	if err != nil {
+		return nil, fmt.Errorf("query for %s failed: %w", spec.Dataset, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	idxCompany := indexOf(columns, spec.CompanyColumn)
+	idxDate := indexOf(columns, spec.DateColumn)
+	if idxCompany == -1 || idxDate == -1 {
+		return nil, fmt.Errorf("query for %s is missing the key columns (%s, %s)", spec.Dataset, spec.CompanyColumn, spec.DateColumn)
+	}
+	idxKnownAt := -1
+	if spec.KnownAtColumn != "" {
+		if idxKnownAt = indexOf(columns, spec.KnownAtColumn); idxKnownAt == -1 {
+			return nil, fmt.Errorf("query for %s has no known_at column %s", spec.Dataset, spec.KnownAtColumn)
+		}
+	}
+
+	// field name => column index
+	fieldIdx := make(map[string]int)
+	if len(spec.Fields) == 0 {
+		for i, col := range columns {
+			if i != idxCompany && i != idxDate && i != idxKnownAt {
+				fieldIdx[col] = i
+			}
+		}
+	} else {
+		for field, col := range spec.Fields {
+			i := indexOf(columns, col)
+			if i == -1 {
+				return nil, fmt.Errorf("query for %s has no column %s (field %s)", spec.Dataset, col, field)
+			}
+			fieldIdx[field] = i
+		}
+	}
+
+	raw := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+
+	var records []Record
+	for n := 1; rows.Next(); n++ {
+		if n%ctxCheckEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to scan row %d of %s: %w", n, spec.Dataset, err)
+		}
+
+		rec := Record{
+			Row:       n,
+			CompanyID: sqlString(raw[idxCompany]),
+			Values:    make(map[string]Value, len(fieldIdx)),
+		}
+		rec.Date, rec.RawDate, rec.Invalid = sqlDate(raw[idxDate])
+		if rec.CompanyID == "" && rec.Invalid == nil {
+			rec.Invalid = fmt.Errorf("empty company id")
+		}
+		if idxKnownAt != -1 && raw[idxKnownAt] != nil && rec.Invalid == nil {
+			rec.KnownAt, rec.Invalid = sqlKnownAt(raw[idxKnownAt])
+		}
+		for field, i := range fieldIdx {
+			if v := sqlValue(raw[i]); !v.IsNull() {
+				rec.Values[field] = v
+			}
+		}
+		records = append(records, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading rows of %s: %w", spec.Dataset, err)
+	}
+	return records, nil
+}
+
+// Fingerprint runs the dataset's version_query, so the store notices data that changed in the
+// database while the ".sql" file stayed the same. Without a version_query it returns "" and the
+// dataset is only reloaded when the file changes.
+func (l *SQLLoader) Fingerprint(ctx context.Context, name string, r io.Reader) (string, error) {
+	spec, err := readSQLSpec(name, r)
+	if err != nil {
+		return "", err
+	}
+	if spec.VersionQuery == "" {
+		return "", nil
+	}
+	db, err := l.db(spec.Driver, spec.DSN)
+	if err != nil {
+		return "", err
+	}
+
+	var version interface{}
+	if err := db.QueryRowContext(ctx, spec.VersionQuery).Scan(&version); err != nil {
+		return "", fmt.Errorf("version query for %s failed: %w", spec.Dataset, err)
+	}
+	return sqlString(version), nil
+}
+
+// Close closes every connection pool the loader opened.
+func (l *SQLLoader) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var firstErr error
+	for key, db := range l.dbs {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(l.dbs, key)
+	}
+	return firstErr
+}
+
+func (l *SQLLoader) db(driver, dsn string) (*sql.DB, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := driver + "|" + dsn
+	if db, ok := l.dbs[key]; ok {
+		return db, nil
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database: %w", driver, err)
+	}
+	l.dbs[key] = db
+	return db, nil
+}
+
+// readSQLSpec parses the header comments of a ".sql" file and renders its query template.
+func readSQLSpec(fileName string, r io.Reader) (*sqlSpec, error) {
+	spec := &sqlSpec{
+		Dataset:       datasetNameOf(fileName),
+		CompanyColumn: "company_id",
+		DateColumn:    "date",
+	}
+
+	var query strings.Builder
+	inHeader := true
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if inHeader && strings.HasPrefix(trimmed, "--") {
+			key, val, ok := strings.Cut(strings.TrimSpace(strings.TrimPrefix(trimmed, "--")), ":")
+			if !ok {
+				continue // plain comment
+			}
+			if err := spec.set(strings.TrimSpace(key), strings.TrimSpace(val)); err != nil {
+				return nil, fmt.Errorf("%s: %w", fileName, err)
+			}
+			continue
+		}
+		if trimmed != "" {
+			inHeader = false
+		}
+		query.WriteString(line)
+		query.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", fileName, err)
+	}
+
+	var err error
+	if spec.Driver == "" {
+		return nil, fmt.Errorf("%s: missing '-- driver:' header", fileName)
+	}
+	if strings.TrimSpace(query.String()) == "" {
+		return nil, fmt.Errorf("%s: no query", fileName)
+	}
+	if spec.Query, err = renderQuery(fileName, query.String(), spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+func (s *sqlSpec) set(key, val string) error {
+	switch key {
+	case "driver":
+		s.Driver = val
+	case "dsn":
+		s.DSN = os.ExpandEnv(val)
+	case "company_id":
+		s.CompanyColumn = val
+	case "date":
+		s.DateColumn = val
+	case "known_at":
+		s.KnownAtColumn = val
+	case "version_query":
+		s.VersionQuery = val
+	case "columns":
+		s.Fields = make(map[string]string)
+		for _, pair := range strings.Split(val, ",") {
+			field, col, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				field, col = strings.TrimSpace(pair), strings.TrimSpace(pair)
+			}
+			field, col = strings.TrimSpace(field), strings.TrimSpace(col)
+			if field == "" || col == "" {
+				return fmt.Errorf("invalid column mapping %q", pair)
+			}
+			s.Fields[field] = col
+		}
+	default:
+		// other "-- key: value" lines are ordinary comments
+	}
+	return nil
+}
+
+// renderQuery expands the query template. Templates see the dataset name as {{ .Dataset }} and can
+// read the environment with {{ env "NAME" "default" }}.
+func renderQuery(fileName, text string, spec *sqlSpec) (string, error) {
+	tmpl, err := template.New(fileName).Funcs(template.FuncMap{
+		"env": func(name string, def ...string) string {
+			if v, ok := os.LookupEnv(name); ok {
+				return v
+			}
+			if len(def) > 0 {
+				return def[0]
+			}
+			return ""
+		},
+	}).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("%s: invalid query template: %w", fileName, err)
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, spec); err != nil {
+		return "", fmt.Errorf("%s: failed to render query: %w", fileName, err)
+	}
+	return out.String(), nil
+}
+
+// sqlValue converts a scanned column into a typed Value.
+func sqlValue(raw interface{}) Value {
+	switch v := raw.(type) {
+	case nil:
+		return Value{}
+	case int64:
+		return NumberValue(float64(v))
+	case float64:
+		return NumberValue(v)
+	case bool:
+		return BoolValue(v)
+	case []byte:
+		return ParseValue(string(v))
+	case string:
+		return ParseValue(v)
+	case time.Time:
+		return StringValue(v.Format("2006-01-02"))
+	default:
+		return ParseValue(fmt.Sprint(v))
+	}
+}
+
+func sqlString(raw interface{}) string {
+	switch v := raw.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// sqlDate accepts DATE/TIMESTAMP columns as well as text ("2024-03-01", "2024") and integer years.
+func sqlDate(raw interface{}) (time.Time, string, error) {
+	if t, ok := raw.(time.Time); ok {
+		return t.UTC(), t.Format("2006-01-02"), nil
+	}
+	s := sqlString(raw)
+	t, err := ParseDateOrYear(s)
+	return t, s, err
+}
+
+// sqlKnownAt accepts TIMESTAMP columns and text timestamps (see ParseKnownAt).
+func sqlKnownAt(raw interface{}) (time.Time, error) {
+	if t, ok := raw.(time.Time); ok {
+		return t.UTC(), nil
+	}
+	return ParseKnownAt(sqlString(raw))
+}
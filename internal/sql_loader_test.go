@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSQLiteDB creates a sqlite database file holding an emissions table and returns its path.
+// The test is skipped when the sqlite3 driver is unusable (a build without cgo).
+func newSQLiteDB(t *testing.T, dir string) (string, *sql.DB) {
+	t.Helper()
+	path := filepath.Join(dir, "emissions.db")
+	db, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		t.Skipf("sqlite3 driver unavailable: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE emissions (
+		company INTEGER,
+		reported_on TEXT,
+		scope_1 REAL,
+		standard TEXT,
+		ignored TEXT,
+		updated_at INTEGER
+	)`)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO emissions VALUES
+		(1000, '2023-03-01', 12.5, 'GRI', 'x', 1),
+		(1000, '2023-09-01', 14.0, NULL, 'x', 1),
+		('1001', '2024', 7, 'SASB', 'x', 1),
+		('1002', 'not a date', 1.0, 'GRI', 'x', 1)`)
+	require.NoError(t, err)
+	return path, db
+}
+
+func TestSQLLoader(t *testing.T) {
+	dir := t.TempDir()
+	dbPath, db := newSQLiteDB(t, t.TempDir())
+	t.Setenv("SCORETEST_DSN", dbPath)
+	t.Setenv("SCORETEST_SCHEMA", "main")
+
+	spec := `-- Emissions straight from the warehouse
+-- driver: sqlite3
+-- dsn: ${SCORETEST_DSN}
+-- company_id: company
+-- date: reported_on
+-- columns: emi_1=scope_1, reporting_standard=standard
+-- version_query: SELECT max(updated_at) FROM emissions
+SELECT company, reported_on, scope_1, standard, ignored
+FROM {{ env "SCORETEST_SCHEMA" "public" }}.emissions -- {{ .Dataset }}
+ORDER BY rowid
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "emissions_data.sql"), []byte(spec), 0o644))
+
+	loader := NewSQLLoader()
+	defer loader.Close()
+	registry := NewLoaderRegistry()
+	registry.RegisterLoader(".sql", loader)
+	store := NewDatasetStore(NewDataLoaderService(registry, nil), FileStorage{Root: dir}, "", StoreOptions{})
+
+	changed, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	snapshot := store.Snapshot()
+	ds := snapshot.Datasets["emissions_data"]
+	require.Len(t, ds, 2)
+	// latest row of 2023 wins, with its null standard left out
+	assert.Equal(t, map[string]Value{"emi_1": NumberValue(14)}, ds[CompanyYearKey{"1000", 2023}])
+	assert.Equal(t, map[string]Value{
+		"emi_1":              NumberValue(7),
+		"reporting_standard": StringValue("SASB"),
+	}, ds[CompanyYearKey{"1001", 2024}])
+	// the row with a bad date is quarantined
+	require.Len(t, snapshot.Quality.Quarantine, 1)
+	assert.Equal(t, ruleParse, snapshot.Quality.Quarantine[0].Rule)
+	assert.Equal(t, "1002", snapshot.Quality.Quarantine[0].CompanyID)
+
+	// same version => no reload
+	changed, err = store.Refresh(context.Background())
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// data changed in the database, the file did not => picked up through the version query
+	_, err = db.Exec(`DELETE FROM emissions WHERE company <> 1000 OR reported_on <> '2023-03-01'`)
+	require.NoError(t, err)
+	_, err = db.Exec(`UPDATE emissions SET updated_at = 2`)
+	require.NoError(t, err)
+	changed, err = store.Refresh(context.Background())
+	require.NoError(t, err)
+	require.True(t, changed)
+	ds = store.Snapshot().Datasets["emissions_data"]
+	require.Len(t, ds, 1)
+	assert.Equal(t, map[string]Value{
+		"emi_1":              NumberValue(12.5),
+		"reporting_standard": StringValue("GRI"),
+	}, ds[CompanyYearKey{"1000", 2023}])
+}
+
+func TestSQLLoaderQueryError(t *testing.T) {
+	dbPath, _ := newSQLiteDB(t, t.TempDir())
+	spec := "-- driver: sqlite3\n-- dsn: " + dbPath + "\nSELECT company FROM emissions\n"
+
+	loader := NewSQLLoader()
+	defer loader.Close()
+	_, err := loader.LoadRecords(context.Background(), "emissions_data.sql", strings.NewReader(spec))
+	assert.ErrorContains(t, err, "missing the key columns")
+
+	spec = "-- driver: sqlite3\n-- dsn: " + dbPath + "\nSELECT * FROM nope\n"
+	_, err = loader.LoadRecords(context.Background(), "emissions_data.sql", strings.NewReader(spec))
+	assert.ErrorContains(t, err, "query for emissions_data failed")
+}
+
+func TestReadSQLSpecErrors(t *testing.T) {
+	_, err := readSQLSpec("no_driver.sql", strings.NewReader("SELECT 1"))
+	assert.ErrorContains(t, err, "missing '-- driver:' header")
+
+	_, err = readSQLSpec("no_query.sql", strings.NewReader("-- driver: sqlite3\n"))
+	assert.ErrorContains(t, err, "no query")
+
+	_, err = readSQLSpec("bad_template.sql", strings.NewReader("-- driver: sqlite3\nSELECT {{ .Nope"))
+	assert.ErrorContains(t, err, "invalid query template")
+}
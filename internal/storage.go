@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage is where dataset objects live: a local directory, an S3 bucket, ...
+// Keys are slash-separated paths relative to the storage root.
+type Storage interface {
+	// List returns the objects directly under prefix (no recursion into sub-prefixes), sorted by key.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Open streams the content of an object.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// ObjectInfo describes one stored object.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// ETag identifies the content when the backend provides one (S3); empty for local files,
+	// which are hashed instead.
+	ETag string
+}
+
+// Name is the last element of the key, e.g. "waste_data.csv".
+func (o ObjectInfo) Name() string {
+	return path.Base(o.Key)
+}
+
+// OpenStorage resolves a data location into a Storage and the prefix to list:
+//
+//	data, ./data, file://data, file:///srv/data => local directory
+//	s3://bucket/some/prefix                     => S3 bucket (see NewS3StorageFromEnv)
+func OpenStorage(location string) (Storage, string, error) {
+	switch {
+	case strings.HasPrefix(location, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		if bucket == "" {
+			return nil, "", fmt.Errorf("missing bucket in %q", location)
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		storage, err := NewS3StorageFromEnv(bucket)
+		if err != nil {
+			return nil, "", err
+		}
+		return storage, prefix, nil
+	case strings.HasPrefix(location, "file://"):
+		return FileStorage{Root: strings.TrimPrefix(location, "file://")}, "", nil
+	case strings.Contains(location, "://"):
+		return nil, "", fmt.Errorf("unsupported data location %q, expected a path, file:// or s3://", location)
+	default:
+		return FileStorage{Root: location}, "", nil
+	}
+}
+
+// FileStorage serves objects from a local directory.
+type FileStorage struct {
+	Root string
+}
+
+func (fs FileStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	dir := filepath.Join(fs.Root, filepath.FromSlash(prefix))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory %s: %w", dir, err)
+	}
+
+	objects := make([]ObjectInfo, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue // skip subdirectories
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", e.Name(), err)
+		}
+		objects = append(objects, ObjectInfo{
+			Key:     path.Join(prefix, e.Name()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (fs FileStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(fs.Root, filepath.FromSlash(key)))
+}
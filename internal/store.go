@@ -0,0 +1,805 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot is an immutable view of every loaded dataset. Runs take the current snapshot once
+// and compute against it while the store swaps in newer ones; nothing in a snapshot is ever
+// modified after it has been published.
+type Snapshot struct {
+	// Version increases every time the store publishes a snapshot with different data
+	Version  int64
+	LoadedAt time.Time
+	// Datasets by dataset name, e.g. "waste_data"
+	Datasets map[string]Dataset
+	// Fingerprints maps each source object to the sha256 of the content it was loaded from
+	Fingerprints map[string]string
+	// Unavailable lists the datasets that failed to load (SkipFailed policy), with the error
+	Unavailable map[string]string
+	Quality     *QualityReport
+	// AsOf is set on snapshots rebuilt from history (SnapshotAsOf): only data known then is in them
+	AsOf time.Time
+
+	columns *lazyColumns
+	// workers computing each per-key stage of a run on the snapshot (DataLoaderService.ScoreWorkers)
+	workers int
+	// sources are the loaded objects the datasets were built from, by dataset name, and patched the
+	// company-years with change events applied; both nil in snapshots rebuilt from history
+	sources map[string]snapshotSource
+	patched ChangeSet
+}
+
+// snapshotSource is the object a dataset of a snapshot was loaded from.
+type snapshotSource struct {
+	object string
+	loaded *LoadedDataset
+}
+
+// LoadPolicy decides what a refresh does when some datasets fail to load.
+type LoadPolicy int
+
+const (
+	// FailOnError fails the whole refresh; the previous snapshot stays current
+	FailOnError LoadPolicy = iota
+	// SkipFailed publishes the datasets that loaded and marks the failed ones unavailable
+	SkipFailed
+)
+
+// ParseLoadPolicy reads a policy name: "fail" or "continue".
+func ParseLoadPolicy(name string) (LoadPolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "fail":
+		return FailOnError, nil
+	case "continue", "skip":
+		return SkipFailed, nil
+	default:
+		return FailOnError, fmt.Errorf("unknown load policy %q, expected fail or continue", name)
+	}
+}
+
+// StoreOptions configure a DatasetStore; the zero value loads with FailOnError and
+// defaultLoadConcurrency files at a time.
+type StoreOptions struct {
+	Policy LoadPolicy
+	// Concurrency is the maximum number of objects hashed/loaded at the same time
+	Concurrency int
+	// QuarantineDir, if set, receives the quarantined rows whenever data changes
+	QuarantineDir string
+	// HistoryRetention is how far back the observed row history is kept (see SnapshotAsOf); older
+	// observations are folded into the one current at the horizon when an object is reloaded.
+	// 0 keeps all of it.
+	HistoryRetention time.Duration
+}
+
+const defaultLoadConcurrency = 4
+
+// DatasetError is the load failure of one source object.
+type DatasetError struct {
+	Source string
+	Err    error
+}
+
+func (e *DatasetError) Error() string { return fmt.Sprintf("%s: %v", e.Source, e.Err) }
+func (e *DatasetError) Unwrap() error { return e.Err }
+
+// fileState is what change detection compares between two refreshes of the same object.
+type fileState struct {
+	size    int64
+	modTime time.Time
+	etag    string
+	hash    string
+}
+
+// unchanged reports whether the listing says the object is the same as when it was loaded:
+// same ETag when the backend has them, same size and mtime otherwise.
+func (st fileState) unchanged(o ObjectInfo) bool {
+	if o.ETag != "" {
+		return st.etag == o.ETag
+	}
+	return st.size == o.Size && st.modTime.Equal(o.ModTime)
+}
+
+type storeEntry struct {
+	state  fileState
+	loaded *LoadedDataset
+	// err is set when the object failed to load under SkipFailed; it is retried once the object changes
+	err error
+	// observed is the history of the object's rows without a known_at of their own: each version of
+	// a row stamped with when it was first seen, and a Removed row when it disappeared
+	observed   map[CompanyYearKey][]Record
+	observedAt time.Time
+	// historyFrom is the retention horizon observed was last pruned at: it is incomplete before that
+	historyFrom time.Time
+}
+
+// DatasetStore keeps the datasets under a storage prefix in memory. It loads every object once and
+// on each Refresh only reloads the objects whose ETag (or size/mtime) changed and whose content
+// hash differs, then atomically publishes a new Snapshot.
+type DatasetStore struct {
+	service *DataLoaderService
+	storage Storage
+	prefix  string
+	opts    StoreOptions
+
+	// refreshMu serialises refreshes; mu guards the published state and is only held around
+	// reading and publishing it, not while objects are fetched. entries is written under both, so
+	// either one is enough to read it.
+	refreshMu sync.Mutex
+	mu        sync.Mutex
+	entries   map[string]*storeEntry
+	current   atomic.Pointer[Snapshot]
+	// overlay holds the change events applied on top of the loaded files (see ChangeFeed), and
+	// overlayFrom the retention horizon it was last pruned at
+	overlay     changeOverlay
+	overlayFrom time.Time
+	// changeLog has the company-years changed by the last published versions, oldest first
+	changeLog []versionChanges
+	// shards are the shards read for shard jobs (see ScoreShard)
+	shards shardCache
+	// startedAt is when the first refresh began: the row history of this process starts then
+	startedAt time.Time
+}
+
+// ChangeSet lists changed company-years by dataset name.
+type ChangeSet map[string]map[CompanyYearKey]bool
+
+func (cs ChangeSet) add(dataset string, key CompanyYearKey) {
+	if cs[dataset] == nil {
+		cs[dataset] = make(map[CompanyYearKey]bool)
+	}
+	cs[dataset][key] = true
+}
+
+// errHistoryNotKept is returned for as-of instants older than the row history kept.
+var errHistoryNotKept = errors.New("the row history is not kept that far back")
+
+// maxChangeLog is how many published versions the store remembers the changes of.
+const maxChangeLog = 256
+
+type versionChanges struct {
+	version int64
+	changes ChangeSet
+}
+
+// NewDatasetStore creates an empty store for the objects under prefix in storage (see OpenStorage);
+// call Refresh to do the first load.
+func NewDatasetStore(service *DataLoaderService, storage Storage, prefix string, opts StoreOptions) *DatasetStore {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultLoadConcurrency
+	}
+	return &DatasetStore{
+		service: service,
+		storage: storage,
+		prefix:  prefix,
+		opts:    opts,
+		entries: make(map[string]*storeEntry),
+		overlay: make(changeOverlay),
+	}
+}
+
+// Snapshot returns the current snapshot, nil until the first successful Refresh.
+func (s *DatasetStore) Snapshot() *Snapshot {
+	return s.current.Load()
+}
+
+// Refresh re-lists the storage prefix and reloads what changed, up to opts.Concurrency objects
+// at a time. It returns true if a new snapshot was published. Failures of individual objects are
+// returned together (as *DatasetError); with FailOnError the previous snapshot then stays current,
+// with SkipFailed the failed datasets are published as unavailable.
+func (s *DatasetStore) Refresh(ctx context.Context) (bool, error) {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	if s.startedAt.IsZero() {
+		s.startedAt = time.Now().UTC()
+	}
+
+	objects, err := s.service.supportedObjects(ctx, s.storage, s.prefix)
+	if err != nil {
+		return false, err
+	}
+
+	entries := s.entries // only refreshes replace it, and this is the only one running
+	next := make(map[string]*storeEntry, len(objects))
+	changed := len(objects) != len(entries)
+
+	// 1) compare the listing; unchanged ETag or size and mtime => keep the entry as is
+	var candidates []ObjectInfo
+	for _, o := range objects {
+		prev, known := entries[o.Key]
+		if known && prev.state.unchanged(o) && !s.isExternal(o.Name()) {
+			next[o.Key] = prev
+			continue
+		}
+		candidates = append(candidates, o)
+	}
+
+	// 2) hash and (re)load the candidates in parallel
+	results := make([]*storeEntry, len(candidates))
+	reloaded := make([]bool, len(candidates))
+	runBounded(ctx, len(candidates), s.opts.Concurrency, func(i int) {
+		o := candidates[i]
+		results[i], reloaded[i] = s.loadEntry(ctx, o, entries[o.Key])
+	})
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	var errs []error
+	for i, o := range candidates {
+		e := results[i]
+		next[o.Key] = e
+		changed = changed || reloaded[i]
+		if e.err != nil {
+			errs = append(errs, &DatasetError{Source: o.Key, Err: e.err})
+		}
+	}
+	loadErr := errors.Join(errs...)
+
+	if loadErr != nil && s.opts.Policy == FailOnError {
+		return false, loadErr
+	}
+
+	// 3) publish; change events may have been applied while the objects were fetched
+	s.mu.Lock()
+	if !changed && s.current.Load() != nil {
+		s.entries = next
+		s.mu.Unlock()
+		return false, loadErr
+	}
+
+	var version int64 = 1
+	if prev := s.current.Load(); prev != nil {
+		version = prev.Version + 1
+	}
+	// a reload with newer rows than the change events of a company-year supersedes them
+	for _, o := range candidates {
+		prev, e := entries[o.Key], next[o.Key]
+		if prev != nil && e.loaded != nil && e.loaded != prev.loaded {
+			s.overlay.supersede(e.loaded.Name, e)
+		}
+	}
+	if s.opts.HistoryRetention > 0 {
+		horizon := time.Now().UTC().Add(-s.opts.HistoryRetention)
+		if s.overlay.prune(horizon) {
+			s.overlayFrom = horizon
+		}
+	}
+	snapshot := newSnapshot(version, next)
+	snapshot.workers = s.service.ScoreWorkers
+	s.applyOverlay(snapshot, next)
+	s.recordChanges(version, s.reloadedChanges(s.current.Load(), snapshot, next))
+
+	s.entries = next
+	s.current.Store(snapshot)
+	s.mu.Unlock()
+
+	if s.opts.QuarantineDir != "" {
+		if err := snapshot.Quality.WriteQuarantine(s.opts.QuarantineDir); err != nil {
+			log.Printf("[WARN] %v", err)
+		}
+	}
+	return true, loadErr
+}
+
+// loadEntry reads an object whose listing changed and reloads it if its content did too. The
+// object is streamed into its loader and hashed on the way, so it is fetched once and never held
+// in memory as a whole; when the hash turns out unchanged the previous load is kept and the new
+// one dropped. The bool reports whether the dataset (or its availability) changed.
+func (s *DatasetStore) loadEntry(ctx context.Context, o ObjectInfo, prev *storeEntry) (*storeEntry, bool) {
+	name := o.Name()
+
+	r, err := s.storage.Open(ctx, o.Key)
+	if err != nil {
+		return keepHistory(prev, &storeEntry{err: err}), true
+	}
+	defer r.Close()
+
+	// data living outside the object (database, ...) is part of the fingerprint
+	if fp, ok := s.loaderFor(name).(Fingerprinter); ok {
+		return s.loadExternal(ctx, o, prev, fp, r)
+	}
+
+	h := sha256.New()
+	tee := io.TeeReader(r, h)
+	loaded, err := s.service.LoadDataset(ctx, name, tee)
+	if err == nil {
+		// loaders may stop before the end (trailing newlines, ...); the hash covers every byte
+		if _, err = io.Copy(io.Discard, tee); err != nil {
+			err = fmt.Errorf("failed to read %s: %w", o.Key, err)
+		}
+	}
+	if err != nil {
+		// no hash: the content is read again once the object changes
+		return keepHistory(prev, &storeEntry{state: fileState{size: o.Size, modTime: o.ModTime, etag: o.ETag}, err: err}), true
+	}
+	state := fileState{size: o.Size, modTime: o.ModTime, etag: o.ETag, hash: hex.EncodeToString(h.Sum(nil))}
+
+	// touched but same content => keep what was loaded
+	if prev != nil && prev.state.hash == state.hash {
+		return keepHistory(prev, &storeEntry{state: state, loaded: prev.loaded, err: prev.err}), false
+	}
+	return s.loaded(o, prev, state, loaded), true
+}
+
+// loadExternal handles objects that only describe where the data lives (".sql", ".url", ...). They
+// are small, so they are read into memory: both the fingerprint and the load need them.
+func (s *DatasetStore) loadExternal(ctx context.Context, o ObjectInfo, prev *storeEntry, fp Fingerprinter, r io.Reader) (*storeEntry, bool) {
+	name := o.Name()
+
+	spec, err := readSpec(o, r)
+	if err != nil {
+		return keepHistory(prev, &storeEntry{err: err}), true
+	}
+	hash, err := externalHash(ctx, fp, name, spec)
+	if err != nil {
+		return keepHistory(prev, &storeEntry{err: err}), true
+	}
+	state := fileState{size: o.Size, modTime: o.ModTime, etag: o.ETag, hash: hash}
+
+	// same description, same data => nothing to reload
+	if prev != nil && prev.state.hash == hash {
+		return keepHistory(prev, &storeEntry{state: state, loaded: prev.loaded, err: prev.err}), false
+	}
+
+	loaded, err := s.service.LoadDataset(ctx, name, bytes.NewReader(spec))
+	if err != nil {
+		return keepHistory(prev, &storeEntry{state: state, err: err}), true
+	}
+	return s.loaded(o, prev, state, loaded), true
+}
+
+// keepHistory carries the row history of prev over to e: the history outlives failed loads.
+func keepHistory(prev, e *storeEntry) *storeEntry {
+	if prev != nil {
+		e.observed, e.observedAt, e.historyFrom = prev.observed, prev.observedAt, prev.historyFrom
+	}
+	return e
+}
+
+// maxSpecSize bounds the objects read by loadExternal.
+const maxSpecSize = 1 << 20
+
+// readSpec reads the object of an external source whole, up to maxSpecSize.
+func readSpec(o ObjectInfo, r io.Reader) ([]byte, error) {
+	spec, err := io.ReadAll(io.LimitReader(r, maxSpecSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", o.Key, err)
+	}
+	if len(spec) > maxSpecSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", o.Key, maxSpecSize)
+	}
+	return spec, nil
+}
+
+// externalHash fingerprints an external source: its description and the data it points to.
+func externalHash(ctx context.Context, fp Fingerprinter, name string, spec []byte) (string, error) {
+	sum := sha256.Sum256(spec)
+	hash := hex.EncodeToString(sum[:])
+	external, err := fp.Fingerprint(ctx, name, bytes.NewReader(spec))
+	if err != nil {
+		return "", err
+	}
+	if external != "" {
+		sum := sha256.Sum256([]byte(hash + "|" + external))
+		hash = hex.EncodeToString(sum[:])
+	}
+	return hash, nil
+}
+
+// loaded makes the entry of a freshly loaded dataset and adds it to the row history.
+func (s *DatasetStore) loaded(o ObjectInfo, prev *storeEntry, state fileState, loaded *LoadedDataset) *storeEntry {
+	log.Printf("Loaded dataset %s from %s (%d company-years)", loaded.Name, o.Key, len(loaded.Data))
+
+	e := &storeEntry{state: state, loaded: loaded, observedAt: observationTime(o, prev, s.isExternal(o.Name()))}
+	var history map[CompanyYearKey][]Record
+	if prev != nil {
+		history, e.historyFrom = prev.observed, prev.historyFrom
+	}
+	e.observed = observeRows(history, loaded.rows, e.observedAt)
+	if history == nil && len(e.observed) > 0 {
+		// the history is not persisted: versions older than the first one this process saw, or
+		// than the process when the object appeared later, are unknown
+		e.historyFrom = s.startedAt
+		if e.observedAt.Before(e.historyFrom) {
+			e.historyFrom = e.observedAt
+		}
+	}
+	if s.opts.HistoryRetention > 0 {
+		horizon := time.Now().UTC().Add(-s.opts.HistoryRetention)
+		var pruned bool
+		if e.observed, pruned = pruneObserved(e.observed, horizon); pruned {
+			e.historyFrom = horizon
+		}
+	}
+	return e
+}
+
+// observationTime is when the content of a reloaded object became known: its modification time,
+// or now for data living elsewhere, objects without one and mtimes that did not move forward.
+func observationTime(o ObjectInfo, prev *storeEntry, external bool) time.Time {
+	at := o.ModTime.UTC()
+	if external || at.IsZero() || (prev != nil && !at.After(prev.observedAt)) {
+		at = time.Now().UTC()
+	}
+	return at
+}
+
+// observeRows adds a reload to the row history: rows (without their own known_at) that are new or
+// changed are stamped with at, rows that disappeared get a Removed row at at. Unchanged rows keep
+// when they were first seen. history is not modified.
+func observeRows(history, rows map[CompanyYearKey][]Record, at time.Time) map[CompanyYearKey][]Record {
+	out := make(map[CompanyYearKey][]Record, len(rows))
+	for key, observed := range history {
+		out[key] = observed
+	}
+	for key := range rows {
+		out[key] = history[key]
+	}
+
+	for key, observed := range out {
+		// the current version of every date: the last one observed
+		current := make(map[string]Record)
+		for _, rec := range observed {
+			current[rec.Date.Format(dateLayout)] = rec
+		}
+
+		next := observed[:len(observed):len(observed)] // appends copy, history stays as it is
+		seen := make(map[string]bool)
+		for _, rec := range rows[key] {
+			d := rec.Date.Format(dateLayout)
+			if !rec.KnownAt.IsZero() || seen[d] {
+				continue // the row has its own history / first row of a date wins
+			}
+			seen[d] = true
+			if cur, ok := current[d]; ok && !cur.Removed && sameValues(cur.Values, rec.Values) {
+				continue
+			}
+			rec.KnownAt = at
+			next = append(next, rec)
+		}
+		for d, cur := range current {
+			if !cur.Removed && !seen[d] {
+				next = append(next, Record{Row: cur.Row, CompanyID: cur.CompanyID, RawDate: cur.RawDate, Date: cur.Date, KnownAt: at, Removed: true})
+			}
+		}
+
+		if len(next) == 0 {
+			delete(out, key)
+		} else {
+			out[key] = next
+		}
+	}
+	return out
+}
+
+// pruneObserved folds the observations known at horizon into the one current then: per row date
+// only the last of them is kept, or none when the row was removed by then. Later observations are
+// kept as they are; observed is not modified. pruned reports whether anything was dropped.
+func pruneObserved(observed map[CompanyYearKey][]Record, horizon time.Time) (map[CompanyYearKey][]Record, bool) {
+	out := make(map[CompanyYearKey][]Record, len(observed))
+	pruned := false
+	for key, recs := range observed {
+		// the last observation of every date at the horizon (observations are in time order)
+		last := make(map[string]int)
+		for i, rec := range recs {
+			if !rec.KnownAt.After(horizon) {
+				last[rec.Date.Format(dateLayout)] = i
+			}
+		}
+		keep := func(i int) bool {
+			rec := recs[i]
+			return rec.KnownAt.After(horizon) || (last[rec.Date.Format(dateLayout)] == i && !rec.Removed)
+		}
+
+		kept := recs
+		for i := range recs {
+			if !keep(i) {
+				kept = make([]Record, 0, len(recs))
+				for j := range recs {
+					if keep(j) {
+						kept = append(kept, recs[j])
+					}
+				}
+				pruned = true
+				break
+			}
+		}
+		if len(kept) > 0 {
+			out[key] = kept
+		}
+	}
+	return out, pruned
+}
+
+func sameValues(a, b map[string]Value) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for field, v := range a {
+		if w, ok := b[field]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// SnapshotAsOf rebuilds the datasets from the row history and the change events as they were known
+// at asOf, i.e. what a run at that instant would have seen (as far as the store has history: rows
+// loaded from files are known from the file's mtime on, unless they carry a known_at). The result
+// is not published; Version is the current one. Instants before the retention horizon of a pruned
+// history (StoreOptions.HistoryRetention), or before the history of rows without a known_at that
+// this process has seen, fail with errHistoryNotKept.
+func (s *DatasetStore) SnapshotAsOf(asOf time.Time) (*Snapshot, error) {
+	// the history and the patches are copied under the lock and the datasets built without it:
+	// row and patch version slices are never modified, only replaced
+	s.mu.Lock()
+	current := s.current.Load()
+	if current == nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("datasets are not loaded yet")
+	}
+	historyFrom := s.overlayFrom
+	for _, e := range s.entries {
+		if e.historyFrom.After(historyFrom) {
+			historyFrom = e.historyFrom
+		}
+	}
+	if asOf.Before(historyFrom) {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: as of %s is before %s", errHistoryNotKept,
+			asOf.UTC().Format(time.RFC3339), historyFrom.Format(time.RFC3339))
+	}
+	history := s.history()
+	overlay := s.overlay.clone()
+	s.mu.Unlock()
+
+	for name := range overlay {
+		if _, ok := history[name]; !ok {
+			history[name] = nil
+		}
+	}
+
+	snapshot := &Snapshot{
+		Version:      current.Version,
+		LoadedAt:     current.LoadedAt,
+		AsOf:         asOf.UTC(),
+		Datasets:     make(map[string]Dataset, len(history)),
+		Fingerprints: current.Fingerprints,
+		Unavailable:  make(map[string]string),
+		Quality:      current.Quality,
+		columns:      &lazyColumns{},
+		workers:      current.workers,
+	}
+	for name, reason := range current.Unavailable {
+		if _, ok := history[name]; !ok {
+			snapshot.Unavailable[name] = reason
+		}
+	}
+	for name, byKey := range history {
+		patches := overlay[name]
+		rules := s.service.quality.Rules(name)
+		ds := make(Dataset, len(byKey))
+		for key, rows := range byKey {
+			if values, ok, _ := materialiseChecked(name, key, rows, patches[key], asOf, rules); ok {
+				ds[key] = values
+			}
+		}
+		for key, byDate := range patches {
+			if _, done := byKey[key]; done {
+				continue
+			}
+			if values, ok, _ := materialiseChecked(name, key, nil, byDate, asOf, rules); ok {
+				ds[key] = values
+			}
+		}
+		snapshot.Datasets[name] = ds
+	}
+	return snapshot, nil
+}
+
+// history returns every observation of every dataset by dataset name: the observed rows plus the
+// rows that carry their own known_at. Callers hold s.mu.
+func (s *DatasetStore) history() map[string]map[CompanyYearKey][]Record {
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // a later object wins on a dataset name clash, as in newSnapshot
+
+	byName := make(map[string]map[CompanyYearKey][]Record, len(keys))
+	for _, key := range keys {
+		e := s.entries[key]
+		if e.loaded == nil && e.observed == nil {
+			continue
+		}
+		rows := make(map[CompanyYearKey][]Record, len(e.observed))
+		for k, observed := range e.observed {
+			rows[k] = observed
+		}
+		if e.loaded != nil {
+			for k, recs := range e.loaded.rows {
+				for _, rec := range recs {
+					if !rec.KnownAt.IsZero() {
+						rows[k] = append(rows[k][:len(rows[k]):len(rows[k])], rec)
+					}
+				}
+			}
+		}
+		byName[datasetNameOf(path.Base(key))] = rows
+	}
+	return byName
+}
+
+// reloadedChanges lists the company-years of every dataset that was loaded, reloaded, removed or
+// became unavailable, as found in the previous and in the new snapshot.
+func (s *DatasetStore) reloadedChanges(prev, snapshot *Snapshot, next map[string]*storeEntry) ChangeSet {
+	names := make(map[string]bool)
+	mark := func(key string, e *storeEntry) {
+		if e != nil && e.loaded != nil {
+			names[e.loaded.Name] = true
+		} else {
+			names[datasetNameOf(path.Base(key))] = true
+		}
+	}
+	for key, e := range next {
+		if old := s.entries[key]; old == nil || old.loaded != e.loaded {
+			mark(key, old)
+			mark(key, e)
+		}
+	}
+	for key, old := range s.entries {
+		if _, ok := next[key]; !ok {
+			mark(key, old)
+		}
+	}
+
+	changes := make(ChangeSet)
+	for name := range names {
+		for key := range snapshot.Datasets[name] {
+			changes.add(name, key)
+		}
+		if prev != nil {
+			for key := range prev.Datasets[name] {
+				changes.add(name, key)
+			}
+		}
+	}
+	return changes
+}
+
+// recordChanges remembers what a newly published version changed; callers hold s.mu.
+func (s *DatasetStore) recordChanges(version int64, changes ChangeSet) {
+	s.changeLog = append(s.changeLog, versionChanges{version: version, changes: changes})
+	if len(s.changeLog) > maxChangeLog {
+		s.changeLog = s.changeLog[len(s.changeLog)-maxChangeLog:]
+	}
+}
+
+// Changes returns the company-years changed between two snapshot versions, by dataset name.
+// ok=false means the store no longer knows (from is too old, or 0) and everything must be
+// treated as changed.
+func (s *DatasetStore) Changes(from, to int64) (ChangeSet, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if from <= 0 || from > to || len(s.changeLog) == 0 || s.changeLog[0].version > from+1 {
+		return nil, from == to && from > 0
+	}
+	changes := make(ChangeSet)
+	for _, vc := range s.changeLog {
+		if vc.version <= from || vc.version > to {
+			continue
+		}
+		for name, keys := range vc.changes {
+			for key := range keys {
+				changes.add(name, key)
+			}
+		}
+	}
+	return changes, true
+}
+
+func (s *DatasetStore) loaderFor(name string) DataLoader {
+	loader, _ := s.service.registry.GetLoader(filepath.Ext(name))
+	return loader
+}
+
+// isExternal reports whether the object's data lives elsewhere and has to be re-checked on every refresh.
+func (s *DatasetStore) isExternal(name string) bool {
+	_, ok := s.loaderFor(name).(Fingerprinter)
+	return ok
+}
+
+// runBounded calls fn(0..n-1) with at most limit calls in flight, and stops starting
+// new ones once ctx is done.
+func runBounded(ctx context.Context, n, limit int, fn func(i int)) {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Watch refreshes the store every interval until ctx is done.
+func (s *DatasetStore) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := s.Refresh(ctx)
+			if err != nil {
+				log.Printf("[WARN] dataset refresh failed: %v", err)
+			}
+			if changed {
+				log.Printf("Published dataset snapshot %d", s.Snapshot().Version)
+			}
+		}
+	}
+}
+
+func newSnapshot(version int64, entries map[string]*storeEntry) *Snapshot {
+	// key order, so a later object wins on a dataset name clash (same as os.ReadDir)
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	snapshot := &Snapshot{
+		Version:      version,
+		LoadedAt:     time.Now().UTC(),
+		Datasets:     make(map[string]Dataset, len(entries)),
+		Fingerprints: make(map[string]string, len(entries)),
+		Unavailable:  make(map[string]string),
+		Quality:      &QualityReport{GeneratedAt: time.Now().UTC()},
+		columns:      &lazyColumns{},
+		sources:      make(map[string]snapshotSource, len(entries)),
+		patched:      make(ChangeSet),
+	}
+	for _, name := range names {
+		e := entries[name]
+		if e.err != nil {
+			snapshot.Unavailable[datasetNameOf(path.Base(name))] = e.err.Error()
+			continue
+		}
+		snapshot.Datasets[e.loaded.Name] = e.loaded.Data
+		snapshot.sources[e.loaded.Name] = snapshotSource{object: name, loaded: e.loaded}
+		snapshot.Fingerprints[name] = e.state.hash
+		snapshot.Quality.Datasets = append(snapshot.Quality.Datasets, e.loaded.Quality)
+		snapshot.Quality.Quarantine = append(snapshot.Quality.Quarantine, e.loaded.Quarantine...)
+	}
+	return snapshot
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatasetStoreReloadsOnlyChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string, mtime time.Time) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	t0 := time.Now().Add(-time.Hour)
+	writeFile("waste_data.csv", "company_id,date,was_1\n1000,2023,1\n", t0)
+	writeFile("emissions_data.csv", "company_id,date,emi_1\n1000,2023,2\n", t0)
+
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "", StoreOptions{})
+	ctx := context.Background()
+
+	changed, err := store.Refresh(ctx)
+	require.NoError(t, err)
+	require.True(t, changed)
+	first := store.Snapshot()
+	assert.Equal(t, int64(1), first.Version)
+	assert.Equal(t, NumberValue(1), first.Datasets["waste_data"][CompanyYearKey{"1000", 2023}]["was_1"])
+
+	// nothing changed
+	changed, err = store.Refresh(ctx)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// touched with the same content => hash matches, no reload
+	writeFile("waste_data.csv", "company_id,date,was_1\n1000,2023,1\n", t0.Add(time.Minute))
+	changed, err = store.Refresh(ctx)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Same(t, first, store.Snapshot())
+
+	// real change => new snapshot, the untouched dataset is shared, the old snapshot is left alone
+	writeFile("waste_data.csv", "company_id,date,was_1\n1000,2023,5\n", t0.Add(2*time.Minute))
+	changed, err = store.Refresh(ctx)
+	require.NoError(t, err)
+	require.True(t, changed)
+	second := store.Snapshot()
+	assert.Equal(t, int64(2), second.Version)
+	assert.Equal(t, NumberValue(5), second.Datasets["waste_data"][CompanyYearKey{"1000", 2023}]["was_1"])
+	assert.Equal(t, NumberValue(1), first.Datasets["waste_data"][CompanyYearKey{"1000", 2023}]["was_1"])
+	assert.Equal(t,
+		reflect.ValueOf(first.Datasets["emissions_data"]).Pointer(),
+		reflect.ValueOf(second.Datasets["emissions_data"]).Pointer())
+	assert.NotEqual(t, first.Fingerprints["waste_data.csv"], second.Fingerprints["waste_data.csv"])
+
+	// removed file => dataset disappears
+	require.NoError(t, os.Remove(filepath.Join(dir, "emissions_data.csv")))
+	changed, err = store.Refresh(ctx)
+	require.NoError(t, err)
+	require.True(t, changed)
+	_, ok := store.Snapshot().Datasets["emissions_data"]
+	assert.False(t, ok)
+}
+
+func TestDatasetStoreLoadPolicies(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "waste_data.csv"), []byte("company_id,date,was_1\n1000,2023,1\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.csv"), []byte("id,when\n1,2\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken_too.json"), []byte("{not json"), 0o644))
+	service := NewDataLoaderService(NewLoaderRegistry(), nil)
+
+	// fail: nothing is published, every failure is reported
+	store := NewDatasetStore(service, FileStorage{Root: dir}, "", StoreOptions{Policy: FailOnError, Concurrency: 2})
+	changed, err := store.Refresh(context.Background())
+	require.Error(t, err)
+	assert.False(t, changed)
+	assert.Nil(t, store.Snapshot())
+	var dsErr *DatasetError
+	require.ErrorAs(t, err, &dsErr)
+	assert.Contains(t, err.Error(), "broken.csv")
+	assert.Contains(t, err.Error(), "broken_too.json")
+
+	// continue: the good dataset is published, the failed ones are marked unavailable
+	store = NewDatasetStore(service, FileStorage{Root: dir}, "", StoreOptions{Policy: SkipFailed})
+	changed, err = store.Refresh(context.Background())
+	require.Error(t, err)
+	assert.True(t, changed)
+	snapshot := store.Snapshot()
+	require.NotNil(t, snapshot)
+	assert.Contains(t, snapshot.Datasets, "waste_data")
+	assert.Contains(t, snapshot.Unavailable, "broken")
+	assert.Contains(t, snapshot.Unavailable, "broken_too")
+
+	// a cancelled context aborts the refresh whatever the policy
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store = NewDatasetStore(service, FileStorage{Root: dir}, "", StoreOptions{Policy: SkipFailed})
+	_, err = store.Refresh(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, store.Snapshot())
+}
+
+// blockingStorage holds every Open until release is closed.
+type blockingStorage struct {
+	FileStorage
+	opened  chan string
+	release chan struct{}
+}
+
+func (b blockingStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	b.opened <- key
+	<-b.release
+	return b.FileStorage.Open(ctx, key)
+}
+
+func TestDatasetStoreRefreshDoesNotLockWhileFetching(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "waste_data.csv"), []byte("company_id,date,was_1\n1000,2023,1\n"), 0o644))
+
+	storage := blockingStorage{FileStorage: FileStorage{Root: dir}, opened: make(chan string, 1), release: make(chan struct{})}
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), storage, "", StoreOptions{})
+
+	refreshed := make(chan error, 1)
+	go func() {
+		_, err := store.Refresh(context.Background())
+		refreshed <- err
+	}()
+	assert.Equal(t, "waste_data.csv", <-storage.opened)
+
+	// the store stays usable while the object is being fetched
+	done := make(chan struct{})
+	go func() {
+		store.Changes(0, 0)
+		_, err := store.SnapshotAsOf(time.Now())
+		assert.Error(t, err) // nothing published yet
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("store locked during the fetch")
+	}
+
+	close(storage.release)
+	require.NoError(t, <-refreshed)
+	assert.Equal(t, NumberValue(1), store.Snapshot().Datasets["waste_data"][CompanyYearKey{"1000", 2023}]["was_1"])
+}
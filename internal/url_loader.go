@@ -0,0 +1,306 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+)
+
+// Defaults for URL datasets; a ".url" file can override them in its header.
+const (
+	defaultURLTimeout  = 30 * time.Second
+	defaultURLMaxBytes = 256 << 20
+	defaultURLRetries  = 3
+)
+
+// URLLoader fetches a dataset published over HTTP(S). It is registered for ".url" files: each
+// file declares one dataset with optional "-- key: value" header comments followed by the URL, e.g.
+//
+//	-- format: csv
+//	-- header: Authorization: Bearer ${PARTNER_TOKEN}
+//	-- timeout: 10s
+//	-- max_bytes: 10485760
+//	-- retries: 5
+//	https://partner.example.com/esg/waste.csv
+//
+// The body is decoded by the loader registered for format (default: the extension of the URL path).
+// URL and header values are expanded from the environment. The ETag and Last-Modified of the last
+// response are kept and later fetches are conditional, so an unchanged dataset costs a 304.
+// A refresh downloads the body once: Fingerprint fetches it and hands it to the LoadRecords call that
+// follows, which drops it after parsing. Network errors, 5xx and 429 answers are retried with
+// exponential backoff.
+type URLLoader struct {
+	registry *LoaderRegistry
+	Client   *http.Client
+	// InitialBackoff is the wait before the first retry; it grows exponentially from there
+	InitialBackoff time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*urlResponse // validators and hash of the last good response by URL, no body
+	// pending holds bodies fetched by Fingerprint until the LoadRecords of the same refresh takes them
+	pending map[string][]byte
+}
+
+func NewURLLoader(registry *LoaderRegistry) *URLLoader {
+	return &URLLoader{
+		registry:       registry,
+		Client:         http.DefaultClient,
+		InitialBackoff: 500 * time.Millisecond,
+		cache:          make(map[string]*urlResponse),
+		pending:        make(map[string][]byte),
+	}
+}
+
+// urlSpec is a parsed ".url" dataset file.
+type urlSpec struct {
+	URL      string
+	Format   string
+	Header   http.Header
+	Timeout  time.Duration
+	MaxBytes int64
+	Retries  uint64
+}
+
+type urlResponse struct {
+	etag         string
+	lastModified string
+	hash         string
+	// body is nil on a 304 answer
+	body []byte
+}
+
+func (l *URLLoader) LoadRecords(ctx context.Context, name string, r io.Reader) ([]Record, error) {
+	spec, err := readURLSpec(name, r)
+	if err != nil {
+		return nil, err
+	}
+
+	ext := "." + spec.Format
+	if spec.Format == "" {
+		u, _ := url.Parse(spec.URL) // validated by readURLSpec
+		ext = path.Ext(u.Path)
+	}
+	inner, ok := l.registry.GetLoader(ext)
+	if !ok || ext == ".url" {
+		return nil, fmt.Errorf("%s: no loader for format %q, set '-- format:'", name, ext)
+	}
+
+	l.mu.Lock()
+	body, ok := l.pending[spec.URL]
+	delete(l.pending, spec.URL)
+	l.mu.Unlock()
+
+	// no body from Fingerprint (first use, or only the ".url" file changed) => fetch it in full,
+	// since bodies are not cached
+	if !ok {
+		resp, err := l.fetch(ctx, spec, nil)
+		if err != nil {
+			return nil, err
+		}
+		body = resp.body
+	}
+	return inner.LoadRecords(ctx, datasetNameOf(name)+ext, bytes.NewReader(body))
+}
+
+// Fingerprint fetches the URL (conditionally, after a first response) and returns the hash of the
+// body, so the store reloads the dataset whenever the published content changes. A new body is
+// kept for the LoadRecords call of that reload.
+func (l *URLLoader) Fingerprint(ctx context.Context, name string, r io.Reader) (string, error) {
+	spec, err := readURLSpec(name, r)
+	if err != nil {
+		return "", err
+	}
+
+	l.mu.Lock()
+	prev := l.cache[spec.URL]
+	l.mu.Unlock()
+
+	resp, err := l.fetch(ctx, spec, prev)
+	if err != nil {
+		return "", err
+	}
+
+	l.mu.Lock()
+	delete(l.pending, spec.URL)
+	if resp.body != nil && (prev == nil || prev.hash != resp.hash) {
+		l.pending[spec.URL] = resp.body
+	}
+	l.mu.Unlock()
+	return resp.hash, nil
+}
+
+// fetch GETs the URL with retries, conditionally when cached is set (a 304 answer returns cached),
+// and remembers the validators and hash of the response.
+func (l *URLLoader) fetch(ctx context.Context, spec *urlSpec, cached *urlResponse) (*urlResponse, error) {
+	b := backoff.NewExponentialBackOff(
+		backoff.WithInitialInterval(l.InitialBackoff),
+		backoff.WithMaxElapsedTime(0), // bounded by the number of retries instead
+	)
+	retry := backoff.WithContext(backoff.WithMaxRetries(b, spec.Retries), ctx)
+
+	resp, err := backoff.RetryWithData(func() (*urlResponse, error) {
+		return l.get(ctx, spec, cached)
+	}, retry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", redactURL(spec.URL), err)
+	}
+
+	l.mu.Lock()
+	l.cache[spec.URL] = &urlResponse{etag: resp.etag, lastModified: resp.lastModified, hash: resp.hash}
+	l.mu.Unlock()
+	return resp, nil
+}
+
+// get does one attempt. Errors that retrying cannot fix are wrapped with backoff.Permanent.
+func (l *URLLoader) get(ctx context.Context, spec *urlSpec, cached *urlResponse) (*urlResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, spec.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, spec.URL, nil)
+	if err != nil {
+		return nil, backoff.Permanent(err)
+	}
+	for name, vals := range spec.Header {
+		req.Header[name] = vals
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return cached, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+		return nil, fmt.Errorf("%s", resp.Status)
+	case resp.StatusCode/100 != 2:
+		return nil, backoff.Permanent(fmt.Errorf("%s", resp.Status))
+	}
+
+	// read one byte past the limit to tell "exactly MaxBytes" from "too large"
+	body, err := io.ReadAll(io.LimitReader(resp.Body, spec.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > spec.MaxBytes {
+		return nil, backoff.Permanent(fmt.Errorf("response larger than %d bytes", spec.MaxBytes))
+	}
+
+	sum := sha256.Sum256(body)
+	return &urlResponse{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		hash:         hex.EncodeToString(sum[:]),
+		body:         body,
+	}, nil
+}
+
+// readURLSpec parses a ".url" file: header comments, then the URL on the first other non-empty line.
+func readURLSpec(fileName string, r io.Reader) (*urlSpec, error) {
+	spec := &urlSpec{
+		Header:   make(http.Header),
+		Timeout:  defaultURLTimeout,
+		MaxBytes: defaultURLMaxBytes,
+		Retries:  defaultURLRetries,
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "--") {
+			key, val, ok := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "--")), ":")
+			if !ok {
+				continue // plain comment
+			}
+			if err := spec.set(strings.TrimSpace(key), strings.TrimSpace(val)); err != nil {
+				return nil, fmt.Errorf("%s: %w", fileName, err)
+			}
+			continue
+		}
+		if spec.URL != "" {
+			return nil, fmt.Errorf("%s: more than one URL", fileName)
+		}
+		spec.URL = os.ExpandEnv(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", fileName, err)
+	}
+
+	if spec.URL == "" {
+		return nil, fmt.Errorf("%s: no URL", fileName)
+	}
+	u, err := url.Parse(spec.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%s: invalid URL %q, expected http(s)://host/...", fileName, redactURL(spec.URL))
+	}
+	return spec, nil
+}
+
+func (s *urlSpec) set(key, val string) error {
+	var err error
+	switch key {
+	case "format":
+		s.Format = strings.TrimPrefix(strings.ToLower(val), ".")
+	case "header":
+		name, hv, ok := strings.Cut(val, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("invalid header %q, expected 'Name: value'", val)
+		}
+		s.Header.Add(strings.TrimSpace(name), os.ExpandEnv(strings.TrimSpace(hv)))
+	case "timeout":
+		if s.Timeout, err = time.ParseDuration(val); err != nil || s.Timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q", val)
+		}
+	case "max_bytes":
+		if s.MaxBytes, err = strconv.ParseInt(val, 10, 64); err != nil || s.MaxBytes <= 0 {
+			return fmt.Errorf("invalid max_bytes %q", val)
+		}
+	case "retries":
+		if s.Retries, err = strconv.ParseUint(val, 10, 64); err != nil {
+			return fmt.Errorf("invalid retries %q", val)
+		}
+	default:
+		// other "-- key: value" lines are ordinary comments
+	}
+	return nil
+}
+
+// redactURL drops credentials and the query (which often carries tokens) from a URL before it is logged.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid url>"
+	}
+	u.User = nil
+	if u.RawQuery != "" {
+		u.RawQuery = "..."
+	}
+	return u.String()
+}
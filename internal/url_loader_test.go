@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestURLDatasetStore(t *testing.T) {
+	body := atomic.Value{}
+	body.Store("company_id,date,wst_1\n1,2023-01-01,10\n")
+	var requests, fullResponses, failures atomic.Int32
+	failures.Store(2) // the first two requests fail with a 503
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failures.Load() > 0 {
+			failures.Add(-1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		content := body.Load().(string)
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(content)))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fullResponses.Add(1)
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+
+	t.Setenv("PARTNER_TOKEN", "secret")
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "waste_data.url"), []byte(
+		"-- partner waste feed\n-- header: Authorization: Bearer ${PARTNER_TOKEN}\n"+server.URL+"/feeds/waste.csv?v=1\n"), 0o644))
+
+	registry := NewLoaderRegistry()
+	loader, _ := registry.GetLoader(".url")
+	loader.(*URLLoader).InitialBackoff = time.Millisecond
+
+	store := NewDatasetStore(NewDataLoaderService(registry, nil), FileStorage{Root: dir}, "", StoreOptions{})
+	changed, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, NumberValue(10), store.Snapshot().Datasets["waste_data"][CompanyYearKey{"1", 2023}]["wst_1"])
+	// two 503s, then one download shared by the fingerprint and the load
+	assert.Equal(t, int32(3), requests.Swap(0))
+
+	// unchanged feed => conditional requests answered with 304, no new snapshot
+	changed, err = store.Refresh(context.Background())
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, int32(1), fullResponses.Load())
+	assert.Equal(t, int32(1), requests.Swap(0))
+
+	body.Store("company_id,date,wst_1\n1,2023-01-01,42\n")
+	changed, err = store.Refresh(context.Background())
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, NumberValue(42), store.Snapshot().Datasets["waste_data"][CompanyYearKey{"1", 2023}]["wst_1"])
+	assert.Equal(t, int32(1), requests.Swap(0))
+	assert.Equal(t, int32(2), fullResponses.Load())
+
+	// the parsed body is not kept around
+	ul := loader.(*URLLoader)
+	ul.mu.Lock()
+	assert.Empty(t, ul.pending)
+	for _, cached := range ul.cache {
+		assert.Nil(t, cached.body)
+	}
+	ul.mu.Unlock()
+}
+
+func TestURLLoaderErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/down.csv":
+			w.WriteHeader(http.StatusBadGateway)
+		case "/big.csv":
+			fmt.Fprint(w, strings.Repeat("x", 100))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	loader := NewURLLoader(NewLoaderRegistry())
+	loader.InitialBackoff = time.Millisecond
+	load := func(spec string) error {
+		_, err := loader.LoadRecords(context.Background(), "feed.url", strings.NewReader(spec))
+		return err
+	}
+
+	// 5xx is retried, up to the limit
+	err := load("-- retries: 2\n" + server.URL + "/down.csv")
+	assert.ErrorContains(t, err, "502 Bad Gateway")
+	assert.Equal(t, int32(3), requests.Swap(0))
+
+	// 4xx is not
+	err = load(server.URL + "/missing.csv")
+	assert.ErrorContains(t, err, "404 Not Found")
+	assert.Equal(t, int32(1), requests.Swap(0))
+
+	err = load("-- max_bytes: 10\n" + server.URL + "/big.csv")
+	assert.ErrorContains(t, err, "larger than 10 bytes")
+	assert.Equal(t, int32(1), requests.Swap(0))
+
+	assert.ErrorContains(t, load(server.URL+"/data.xlsx"), `no loader for format ".xlsx"`)
+	assert.ErrorContains(t, load("ftp://example.com/data.csv"), "invalid URL")
+	assert.ErrorContains(t, load("-- timeout: soon\n"+server.URL+"/data.csv"), "invalid timeout")
+}
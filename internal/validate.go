@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// minParameters is the number of parameters each operation needs.
+var minParameters = map[string]int{
+	"sum":      1,
+	"or":       2,
+	"divide":   2,
+	"eq":       2,
+	"in":       1,
+	"lookup":   1,
+	"map":      1,
+	"lag":      1,
+	"pct_rank": 1,
+}
+
+// ValidateScoreConfig checks a score config against the loaded datasets before anything is computed:
+// unknown operations, malformed sources, sources of unknown datasets, self references to metrics that are not defined earlier,
+// type mismatches between an operation and the kind of values its sources hold, and invalid
+// precision / rounding / scale.
+// All problems are returned together.
+func ValidateScoreConfig(cfg *c.Config, datasets map[string]Dataset) error {
+	// field kinds are computed once per dataset
+	kinds := make(map[string]map[string]map[ValueKind]bool, len(datasets))
+	for name, ds := range datasets {
+		if ds != nil { // not loaded
+			kinds[name] = ds.FieldKinds()
+		}
+	}
+	return validateScoreConfigKinds(cfg, kinds)
+}
+
+// CheckScoreConfig is ValidateScoreConfig, also returning the warnings: problems that don't stop a
+// run but make some of its values null (mixed value kinds, sources with no data).
+func CheckScoreConfig(cfg *c.Config, datasets map[string]Dataset) ([]string, error) {
+	kinds := make(map[string]map[string]map[ValueKind]bool, len(datasets))
+	for name, ds := range datasets {
+		if ds != nil { // not loaded
+			kinds[name] = ds.FieldKinds()
+		}
+	}
+	return checkScoreConfigKinds(cfg, kinds)
+}
+
+// validateScoreConfigKinds validates against the field kinds of every dataset (dataset => field =>
+// kinds); with nil kinds only the config itself is checked, not the types of its sources. Warnings
+// are logged.
+func validateScoreConfigKinds(cfg *c.Config, kinds map[string]map[string]map[ValueKind]bool) error {
+	warnings, err := checkScoreConfigKinds(cfg, kinds)
+	for _, warning := range warnings {
+		log.Printf("[WARN] %s", warning)
+	}
+	return err
+}
+
+func checkScoreConfigKinds(cfg *c.Config, kinds map[string]map[string]map[ValueKind]bool) ([]string, error) {
+	var errs []error
+	var warnings []string
+	defined := make(map[string]bool)
+
+	for _, metric := range cfg.Metrics {
+		opType := metric.Operation.Type
+		prefix := fmt.Sprintf("metric %s (%s)", metric.Name, opType)
+
+		if metric.Name == "" {
+			errs = append(errs, fmt.Errorf("metric with operation %q has no name", opType))
+		} else if defined[metric.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate metric name", prefix))
+		}
+		for _, err := range validateMetricFormat(metric) {
+			errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+		}
+
+		if !isKnownOperation(opType) {
+			errs = append(errs, fmt.Errorf("%s: unknown operation", prefix))
+			defined[metric.Name] = true
+			continue
+		}
+		if n := len(metric.Operation.Parameters); n < minParameters[opType] {
+			errs = append(errs, fmt.Errorf("%s: needs at least %d parameters, got %d", prefix, minParameters[opType], n))
+		}
+		if opType == "in" && len(metric.Operation.Values) == 0 {
+			errs = append(errs, fmt.Errorf("%s: no values to match against", prefix))
+		}
+		if (opType == "lookup" || opType == "map") && len(metric.Operation.Table) == 0 {
+			errs = append(errs, fmt.Errorf("%s: empty lookup table", prefix))
+		}
+		if opType == "lag" && metric.Operation.Periods < 0 {
+			errs = append(errs, fmt.Errorf("%s: periods cannot be negative (omit it or use 0 for 1 year)", prefix))
+		}
+		if _, crossKey := crossKeyOperations[opType]; crossKey {
+			for _, p := range metric.Operation.Parameters {
+				if p.Source == "" {
+					errs = append(errs, fmt.Errorf("%s: needs a source, not a literal value", prefix))
+				}
+			}
+		}
+
+		operandKinds := make([]map[ValueKind]bool, 0, len(metric.Operation.Parameters))
+		for _, p := range metric.Operation.Parameters {
+			k, err := parameterKinds(p, defined, kinds)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+				continue
+			}
+			operandKinds = append(operandKinds, k)
+
+			// nil => unknown (dataset not loaded or field never filled), nothing to check
+			if k == nil && kinds != nil && p.Source != "" {
+				dataset, _, _ := strings.Cut(p.Source, ".")
+				if _, loaded := kinds[dataset]; !loaded {
+					warnings = append(warnings, fmt.Sprintf("%s: dataset %s is not loaded, %s reads as null", prefix, dataset, p.Source))
+				} else {
+					warnings = append(warnings, fmt.Sprintf("%s: %s has no values in dataset %s, it reads as null", prefix, p.Source, dataset))
+				}
+			}
+			if k == nil || !numericOperations[opType] {
+				continue
+			}
+			if !k[KindNumber] {
+				errs = append(errs, fmt.Errorf("%s: %s holds %s values, operation needs numbers", prefix, p.Source, kindList(k)))
+			} else if len(k) > 1 {
+				warnings = append(warnings, fmt.Sprintf("%s: %s mixes %s values, non-numeric cells will read as null", prefix, p.Source, kindList(k)))
+			}
+		}
+
+		if opType == "eq" && len(operandKinds) == 2 && operandKinds[0] != nil && operandKinds[1] != nil {
+			if !kindsOverlap(operandKinds[0], operandKinds[1]) {
+				errs = append(errs, fmt.Errorf("%s: compares %s with %s", prefix, kindList(operandKinds[0]), kindList(operandKinds[1])))
+			}
+		}
+
+		defined[metric.Name] = true
+	}
+
+	return warnings, errors.Join(errs...)
+}
+
+func isKnownOperation(opType string) bool {
+	_, perKey := operations[opType]
+	_, crossKey := crossKeyOperations[opType]
+	return perKey || crossKey
+}
+
+// parameterKinds returns the kinds a parameter can resolve to, or nil if that can't be known up front.
+func parameterKinds(
+	p c.Parameter,
+	defined map[string]bool,
+	kinds map[string]map[string]map[ValueKind]bool,
+) (map[ValueKind]bool, error) {
+	if p.Source == "" {
+		if p.Value == "" {
+			return nil, fmt.Errorf("parameter has neither source nor value")
+		}
+		return map[ValueKind]bool{ParseValue(p.Value).Kind: true}, nil
+	}
+
+	if strings.HasPrefix(p.Source, "self.") {
+		name := strings.TrimPrefix(p.Source, "self.")
+		if !defined[name] {
+			return nil, fmt.Errorf("%s is not defined before this metric", p.Source)
+		}
+		return map[ValueKind]bool{KindNumber: true}, nil
+	}
+
+	parts := strings.Split(p.Source, ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid source %q, expected <dataset>.<field> or self.<metric>", p.Source)
+	}
+	fields, ok := kinds[parts[0]]
+	if !ok {
+		if _, known := datasetAliases[parts[0]]; !known {
+			return nil, fmt.Errorf("unknown dataset %s in source %s", parts[0], p.Source)
+		}
+		return nil, nil
+	}
+	return fields[parts[1]], nil
+}
+
+func kindsOverlap(a, b map[ValueKind]bool) bool {
+	for k := range a {
+		if b[k] {
+			return true
+		}
+	}
+	return false
+}
+
+func kindList(kinds map[ValueKind]bool) string {
+	names := make([]string, 0, len(kinds))
+	for _, k := range []ValueKind{KindNumber, KindBool, KindString} {
+		if kinds[k] {
+			names = append(names, k.String())
+		}
+	}
+	return strings.Join(names, "/")
+}
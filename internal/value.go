@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ValueKind is the type of a single cell in a loaded dataset.
+type ValueKind int
+
+const (
+	KindNull ValueKind = iota
+	KindNumber
+	KindBool
+	KindString
+)
+
+func (k ValueKind) String() string {
+	switch k {
+	case KindNumber:
+		return "number"
+	case KindBool:
+		return "bool"
+	case KindString:
+		return "string"
+	default:
+		return "null"
+	}
+}
+
+// Value is a typed cell: a number, a boolean, a string (category / free text) or null.
+// The zero Value is null.
+type Value struct {
+	Kind ValueKind
+	Num  float64
+	Bool bool
+	Str  string
+}
+
+func NumberValue(f float64) Value { return Value{Kind: KindNumber, Num: f} }
+func BoolValue(b bool) Value      { return Value{Kind: KindBool, Bool: b} }
+func StringValue(s string) Value  { return Value{Kind: KindString, Str: s} }
+
+func (v Value) IsNull() bool { return v.Kind == KindNull }
+
+// Float returns the numeric value, ok=false for anything that is not a number.
+func (v Value) Float() (float64, bool) {
+	if v.Kind != KindNumber {
+		return 0, false
+	}
+	return v.Num, true
+}
+
+// Equal compares two values of the same kind. Strings are compared case-insensitively,
+// so "GRI" and "gri" are the same category.
+func (v Value) Equal(o Value) bool {
+	if v.Kind != o.Kind {
+		return false
+	}
+	switch v.Kind {
+	case KindNumber:
+		return v.Num == o.Num
+	case KindBool:
+		return v.Bool == o.Bool
+	case KindString:
+		return strings.EqualFold(v.Str, o.Str)
+	default:
+		return true
+	}
+}
+
+func (v Value) String() string {
+	switch v.Kind {
+	case KindNumber:
+		return strconv.FormatFloat(v.Num, 'f', -1, 64)
+	case KindBool:
+		return strconv.FormatBool(v.Bool)
+	case KindString:
+		return v.Str
+	default:
+		return ""
+	}
+}
+
+// ParseValue infers the type of a raw text cell: empty => null, finite numbers => number,
+// true/false/yes/no => bool, anything else => string. "NaN", "Inf" and "infinity" are
+// accepted by strconv.ParseFloat but are not measurements, so they stay strings.
+func ParseValue(raw string) Value {
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return Value{}
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return NumberValue(f)
+	}
+	switch strings.ToLower(s) {
+	case "true", "yes":
+		return BoolValue(true)
+	case "false", "no":
+		return BoolValue(false)
+	}
+	return StringValue(s)
+}
+
+// valueFromJSON converts a decoded JSON scalar into a Value.
+func valueFromJSON(raw interface{}) (Value, error) {
+	switch v := raw.(type) {
+	case nil:
+		return Value{}, nil
+	case float64:
+		return NumberValue(v), nil
+	case bool:
+		return BoolValue(v), nil
+	case string:
+		return ParseValue(v), nil
+	default:
+		return Value{}, fmt.Errorf("unsupported JSON value %v (%T)", raw, raw)
+	}
+}
+
+// MarshalJSON writes the value as the matching JSON scalar.
+func (v Value) MarshalJSON() ([]byte, error) {
+	switch v.Kind {
+	case KindNumber:
+		return json.Marshal(v.Num)
+	case KindBool:
+		return json.Marshal(v.Bool)
+	case KindString:
+		return json.Marshal(v.Str)
+	default:
+		return []byte("null"), nil
+	}
+}
+
+func (v *Value) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	parsed, err := valueFromJSON(raw)
+	if err != nil {
+		return err
+	}
+	*v = parsed
+	return nil
+}
@@ -0,0 +1,436 @@
+package internal
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/munnerz/goautoneg"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+// ResultMeta describes a score run to the writers.
+type ResultMeta struct {
+	// Product is the name of the score config
+	Product     string    `json:"product"`
+	RunID       string    `json:"run_id"`
+	GeneratedAt time.Time `json:"generated_at"`
+	// Metrics are the columns of the rows, in config order, with how their values are written
+	Metrics []MetricFormat `json:"metrics"`
+}
+
+// ResultWriter writes the rows of a score run in one output format. A writer is used for one
+// response: Begin once, WriteRow for every row in order, then End.
+type ResultWriter interface {
+	ContentType() string
+	// Extension is the file extension of the format, for Content-Disposition
+	Extension() string
+	Begin(w io.Writer, meta ResultMeta) error
+	WriteRow(row ScoredRow) error
+	End() error
+}
+
+// FormatOptions are the query parameters writers take: ?delimiter= and ?null= for CSV. Precision
+// (?precision=full) is applied to the metric formats of the run, not by the writers.
+type FormatOptions struct {
+	Delimiter rune
+	Null      string
+}
+
+// ResultFormat is an output format: its ?format= name, the media types that select it in Accept,
+// and how to make a writer for one response.
+type ResultFormat struct {
+	Name       string
+	MediaTypes []string
+	New        func(opts FormatOptions) ResultWriter
+}
+
+// FormatRegistry holds the output formats, by name. The first one registered is the default, used
+// when a request names none.
+type FormatRegistry struct {
+	formats []ResultFormat
+}
+
+// RegisterFormat adds an output format, or replaces the one of the same name.
+func (fr *FormatRegistry) RegisterFormat(format ResultFormat) {
+	for i := range fr.formats {
+		if fr.formats[i].Name == format.Name {
+			fr.formats[i] = format
+			return
+		}
+	}
+	fr.formats = append(fr.formats, format)
+}
+
+// NewFormatRegistry initializes a registry with CSV (the default), JSON, NDJSON and XLSX.
+func NewFormatRegistry() *FormatRegistry {
+	fr := &FormatRegistry{}
+	fr.RegisterFormat(ResultFormat{Name: "csv", MediaTypes: []string{"text/csv"},
+		New: func(opts FormatOptions) ResultWriter { return &csvResultWriter{opts: opts} }})
+	fr.RegisterFormat(ResultFormat{Name: "json", MediaTypes: []string{"application/json"},
+		New: func(FormatOptions) ResultWriter { return &jsonResultWriter{} }})
+	fr.RegisterFormat(ResultFormat{Name: "ndjson", MediaTypes: []string{"application/x-ndjson", "application/ndjson"},
+		New: func(FormatOptions) ResultWriter { return &ndjsonResultWriter{} }})
+	fr.RegisterFormat(ResultFormat{Name: "xlsx", MediaTypes: []string{xlsxContentType},
+		New: func(FormatOptions) ResultWriter { return &xlsxResultWriter{} }})
+	return fr
+}
+
+// defaultFormats are the formats of the score handlers.
+var defaultFormats = NewFormatRegistry()
+
+// errNotAcceptable is returned when the Accept header matches none of the formats.
+var errNotAcceptable = errors.New("not acceptable")
+
+// Negotiate picks the writer of a request: ?format= first, then the Accept header; a request that
+// names neither gets the default format.
+func (fr *FormatRegistry) Negotiate(r *http.Request) (ResultWriter, error) {
+	opts, err := parseFormatOptions(r)
+	if err != nil {
+		return nil, err
+	}
+	if name := r.URL.Query().Get("format"); name != "" {
+		return fr.Writer(name, opts)
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return fr.formats[0].New(opts), nil
+	}
+	var alternatives []string
+	for _, format := range fr.formats {
+		alternatives = append(alternatives, format.MediaTypes...)
+	}
+	if mediaType := goautoneg.Negotiate(accept, alternatives); mediaType != "" {
+		for _, format := range fr.formats {
+			for _, mt := range format.MediaTypes {
+				if mt == mediaType {
+					return format.New(opts), nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %q matches none of %s", errNotAcceptable, accept, strings.Join(alternatives, ", "))
+}
+
+// Writer makes a writer of the format called name (any case).
+func (fr *FormatRegistry) Writer(name string, opts FormatOptions) (ResultWriter, error) {
+	for _, format := range fr.formats {
+		if strings.EqualFold(format.Name, name) {
+			return format.New(opts), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown format %q, expected one of %s", name, strings.Join(fr.names(), ", "))
+}
+
+func (fr *FormatRegistry) names() []string {
+	names := make([]string, len(fr.formats))
+	for i, format := range fr.formats {
+		names[i] = format.Name
+	}
+	return names
+}
+
+func parseFormatOptions(r *http.Request) (FormatOptions, error) {
+	opts := FormatOptions{Delimiter: ',', Null: r.URL.Query().Get("null")}
+	switch raw := r.URL.Query().Get("delimiter"); raw {
+	case "":
+	case "tab", `\t`:
+		opts.Delimiter = '\t'
+	default:
+		d, size := utf8.DecodeRuneInString(raw)
+		if size != len(raw) || d == '"' || d == '\r' || d == '\n' || d == utf8.RuneError {
+			return opts, fmt.Errorf("invalid delimiter %q, expected a single character", raw)
+		}
+		opts.Delimiter = d
+	}
+	return opts, nil
+}
+
+// formatStatus is the status of a negotiation error.
+func formatStatus(err error) int {
+	if errors.Is(err, errNotAcceptable) {
+		return http.StatusNotAcceptable
+	}
+	return http.StatusBadRequest
+}
+
+// newResultMeta describes a new run of the config for a request: with ?precision=full the values
+// are written as computed (scaled, not rounded).
+func newResultMeta(scoreConfig *c.Config, r *http.Request) (ResultMeta, error) {
+	var full bool
+	switch raw := r.URL.Query().Get("precision"); raw {
+	case "":
+	case "full":
+		full = true
+	default:
+		return ResultMeta{}, fmt.Errorf("invalid precision %q, expected full", raw)
+	}
+	return ResultMeta{
+		Product:     scoreConfig.Name,
+		RunID:       uuid.NewString(),
+		GeneratedAt: time.Now().UTC(),
+		Metrics:     metricFormats(scoreConfig, full),
+	}, nil
+}
+
+// csvResultWriter writes a header row (metric names) then one row per company-year, values with the
+// decimals of their metric and nulls as the null token (empty by default).
+type csvResultWriter struct {
+	opts    FormatOptions
+	w       *csv.Writer
+	metrics []MetricFormat
+	record  []string
+}
+
+func (cw *csvResultWriter) ContentType() string { return "text/csv" }
+func (cw *csvResultWriter) Extension() string   { return "csv" }
+
+func (cw *csvResultWriter) Begin(w io.Writer, meta ResultMeta) error {
+	cw.w = csv.NewWriter(w)
+	cw.w.Comma = cw.opts.Delimiter
+	cw.metrics = meta.Metrics
+	header := []string{"company", "year"}
+	for _, metric := range meta.Metrics {
+		header = append(header, metric.Name)
+	}
+	return cw.w.Write(header)
+}
+
+func (cw *csvResultWriter) WriteRow(row ScoredRow) error {
+	cw.record = append(cw.record[:0], row.CompanyID, strconv.Itoa(row.Year))
+	for _, metric := range cw.metrics {
+		if val, ok := row.Values[metric.Name]; ok {
+			cw.record = append(cw.record, metric.Text(val))
+		} else {
+			cw.record = append(cw.record, cw.opts.Null)
+		}
+	}
+	return cw.w.Write(cw.record)
+}
+
+func (cw *csvResultWriter) End() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// appendRowJSON appends a row as a JSON object, {"company_id", "year", "values"}, with every metric
+// in values (scaled and rounded) and nulls as null. Non-finite values, which JSON can't hold, are
+// null too.
+func appendRowJSON(b []byte, row ScoredRow, metrics []MetricFormat) []byte {
+	b = append(b, `{"company_id":`...)
+	id, _ := json.Marshal(row.CompanyID)
+	b = append(b, id...)
+	b = append(b, `,"year":`...)
+	b = strconv.AppendInt(b, int64(row.Year), 10)
+	b = append(b, `,"values":{`...)
+	for i, metric := range metrics {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		name, _ := json.Marshal(metric.Name)
+		b = append(b, name...)
+		b = append(b, ':')
+		if val, ok := row.Values[metric.Name]; ok && !math.IsNaN(val) && !math.IsInf(val, 0) {
+			b = strconv.AppendFloat(b, metric.Value(val), 'g', -1, 64)
+		} else {
+			b = append(b, "null"...)
+		}
+	}
+	return append(b, "}}"...)
+}
+
+// jsonResultWriter writes one JSON document: the run's metadata and its rows,
+// {"product", "run_id", "generated_at", "metrics", "rows": [...]}. Rows are streamed.
+type jsonResultWriter struct {
+	w       *bufio.Writer
+	metrics []MetricFormat
+	rows    int
+	buf     []byte
+}
+
+func (jw *jsonResultWriter) ContentType() string { return "application/json" }
+func (jw *jsonResultWriter) Extension() string   { return "json" }
+
+func (jw *jsonResultWriter) Begin(w io.Writer, meta ResultMeta) error {
+	jw.w = bufio.NewWriter(w)
+	jw.metrics = meta.Metrics
+	if meta.Metrics == nil {
+		meta.Metrics = []MetricFormat{}
+	}
+	head, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// the metadata object, left open for the rows
+	jw.w.Write(head[:len(head)-1])
+	_, err = jw.w.WriteString(`,"rows":[`)
+	return err
+}
+
+func (jw *jsonResultWriter) WriteRow(row ScoredRow) error {
+	jw.buf = jw.buf[:0]
+	if jw.rows > 0 {
+		jw.buf = append(jw.buf, ',')
+	}
+	jw.buf = append(jw.buf, '\n')
+	jw.buf = appendRowJSON(jw.buf, row, jw.metrics)
+	jw.rows++
+	_, err := jw.w.Write(jw.buf)
+	return err
+}
+
+func (jw *jsonResultWriter) End() error {
+	if _, err := jw.w.WriteString("]}\n"); err != nil {
+		return err
+	}
+	return jw.w.Flush()
+}
+
+// ndjsonResultWriter writes one JSON object per row and line, as the rows come.
+type ndjsonResultWriter struct {
+	w       *bufio.Writer
+	metrics []MetricFormat
+	buf     []byte
+}
+
+func (nw *ndjsonResultWriter) ContentType() string { return "application/x-ndjson" }
+func (nw *ndjsonResultWriter) Extension() string   { return "ndjson" }
+
+func (nw *ndjsonResultWriter) Begin(w io.Writer, meta ResultMeta) error {
+	nw.w = bufio.NewWriter(w)
+	nw.metrics = meta.Metrics
+	return nil
+}
+
+func (nw *ndjsonResultWriter) WriteRow(row ScoredRow) error {
+	nw.buf = appendRowJSON(nw.buf[:0], row, nw.metrics)
+	nw.buf = append(nw.buf, '\n')
+	if _, err := nw.w.Write(nw.buf); err != nil {
+		return err
+	}
+	// a line is a record for the reader: don't hold it back
+	return nw.w.Flush()
+}
+
+func (nw *ndjsonResultWriter) End() error { return nw.w.Flush() }
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// xlsxResultWriter writes a workbook with one sheet, "scores": a header row (metric names with their
+// units) then one row per company-year, values rounded. Null metrics are empty cells. The sheet is the last part of the archive, so rows are
+// streamed into it.
+type xlsxResultWriter struct {
+	zw      *zip.Writer
+	sheet   *bufio.Writer
+	metrics []MetricFormat
+	row     int
+}
+
+func (xw *xlsxResultWriter) ContentType() string { return xlsxContentType }
+func (xw *xlsxResultWriter) Extension() string   { return "xlsx" }
+
+var xlsxParts = []struct{ name, body string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="scores" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+func (xw *xlsxResultWriter) Begin(w io.Writer, meta ResultMeta) error {
+	xw.zw = zip.NewWriter(w)
+	xw.metrics = meta.Metrics
+	for _, part := range xlsxParts {
+		f, err := xw.zw.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.body); err != nil {
+			return err
+		}
+	}
+	f, err := xw.zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	xw.sheet = bufio.NewWriter(f)
+	xw.sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	xw.startRow()
+	xw.stringCell(0, "company")
+	xw.stringCell(1, "year")
+	for i, metric := range meta.Metrics {
+		xw.stringCell(i+2, metric.Label())
+	}
+	_, err = xw.sheet.WriteString("</row>")
+	return err
+}
+
+func (xw *xlsxResultWriter) WriteRow(row ScoredRow) error {
+	xw.startRow()
+	xw.stringCell(0, row.CompanyID)
+	xw.numberCell(1, float64(row.Year))
+	for i, metric := range xw.metrics {
+		if val, ok := row.Values[metric.Name]; ok && !math.IsNaN(val) && !math.IsInf(val, 0) {
+			xw.numberCell(i+2, metric.Value(val))
+		}
+	}
+	_, err := xw.sheet.WriteString("</row>")
+	return err
+}
+
+func (xw *xlsxResultWriter) End() error {
+	xw.sheet.WriteString("</sheetData></worksheet>")
+	if err := xw.sheet.Flush(); err != nil {
+		return err
+	}
+	return xw.zw.Close()
+}
+
+func (xw *xlsxResultWriter) startRow() {
+	xw.row++
+	fmt.Fprintf(xw.sheet, `<row r="%d">`, xw.row)
+}
+
+func (xw *xlsxResultWriter) stringCell(col int, s string) {
+	fmt.Fprintf(xw.sheet, `<c r="%s%d" t="inlineStr"><is><t>`, xlsxColumn(col), xw.row)
+	xml.EscapeText(xw.sheet, []byte(s))
+	xw.sheet.WriteString("</t></is></c>")
+}
+
+func (xw *xlsxResultWriter) numberCell(col int, val float64) {
+	fmt.Fprintf(xw.sheet, `<c r="%s%d"><v>%s</v></c>`, xlsxColumn(col), xw.row, strconv.FormatFloat(val, 'g', -1, 64))
+}
+
+// xlsxColumn is the letters of a 0-based column: A, B, ..., Z, AA, ...
+func xlsxColumn(col int) string {
+	var b []byte
+	for col++; col > 0; col = (col - 1) / 26 {
+		b = append([]byte{byte('A' + (col-1)%26)}, b...)
+	}
+	return string(b)
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	c "esgbook-software-engineer-technical-test-2024/config"
+)
+
+func testRows() (ResultMeta, ScoreRows) {
+	three := 3
+	cfg := &c.Config{Name: "score_1", Metrics: []c.Metric{
+		{Name: "total"},
+		{Name: "ratio", Precision: &three, Unit: "%", Scale: 100},
+	}}
+	meta := ResultMeta{Product: "score_1", RunID: "run-1", GeneratedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Metrics: metricFormats(cfg, false)}
+	rows := ScoreRows{
+		{CompanyID: "1000", Year: 2023, Values: map[string]float64{"total": 12.345, "ratio": 0.5}},
+		{CompanyID: `a "b" & <c>`, Year: 2024, Values: map[string]float64{"total": -1}},
+	}
+	return meta, rows
+}
+
+func writeAll(t *testing.T, rw ResultWriter, meta ResultMeta, rows ScoreRows) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, rw.Begin(&buf, meta))
+	for _, row := range rows {
+		require.NoError(t, rw.WriteRow(row))
+	}
+	require.NoError(t, rw.End())
+	return buf.Bytes()
+}
+
+func TestNegotiate(t *testing.T) {
+	negotiate := func(target, accept string) (string, error) {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		rw, err := defaultFormats.Negotiate(r)
+		if err != nil {
+			return "", err
+		}
+		return rw.Extension(), nil
+	}
+	for _, tc := range []struct{ target, accept, want string }{
+		{"/run-scores", "", "csv"},
+		{"/run-scores", "*/*", "csv"},
+		{"/run-scores", "application/json", "json"},
+		{"/run-scores", "text/html,application/xhtml+xml,*/*;q=0.8", "csv"},
+		{"/run-scores", "text/csv;q=0.5, application/x-ndjson", "ndjson"},
+		{"/run-scores", "application/ndjson", "ndjson"},
+		{"/run-scores", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "xlsx"},
+		{"/run-scores?format=JSON", "text/csv", "json"},
+		{"/run-scores?format=xlsx", "", "xlsx"},
+	} {
+		got, err := negotiate(tc.target, tc.accept)
+		require.NoError(t, err, tc)
+		assert.Equal(t, tc.want, got, tc)
+	}
+
+	_, err := negotiate("/run-scores?format=parquet", "")
+	assert.ErrorContains(t, err, `unknown format "parquet"`)
+	assert.Equal(t, http.StatusBadRequest, formatStatus(err))
+	_, err = negotiate("/run-scores", "image/png")
+	assert.Equal(t, http.StatusNotAcceptable, formatStatus(err))
+	_, err = negotiate("/run-scores?delimiter=ab", "")
+	assert.ErrorContains(t, err, "invalid delimiter")
+}
+
+func TestCSVResultWriter(t *testing.T) {
+	meta, rows := testRows()
+	out := writeAll(t, &csvResultWriter{opts: FormatOptions{Delimiter: ','}}, meta, rows)
+	assert.Equal(t, "company,year,total,ratio\n1000,2023,12.35,50.000\n\"a \"\"b\"\" & <c>\",2024,-1.00,\n", string(out))
+
+	out = writeAll(t, &csvResultWriter{opts: FormatOptions{Delimiter: '\t', Null: "NA"}}, meta, rows)
+	assert.Equal(t, "company\tyear\ttotal\tratio\n1000\t2023\t12.35\t50.000\n\"a \"\"b\"\" & <c>\"\t2024\t-1.00\tNA\n", string(out))
+}
+
+func TestJSONResultWriters(t *testing.T) {
+	meta, rows := testRows()
+
+	var doc struct {
+		ResultMeta
+		Rows []struct {
+			CompanyID string              `json:"company_id"`
+			Year      int                 `json:"year"`
+			Values    map[string]*float64 `json:"values"`
+		} `json:"rows"`
+	}
+	require.NoError(t, json.Unmarshal(writeAll(t, &jsonResultWriter{}, meta, rows), &doc))
+	assert.Equal(t, meta, doc.ResultMeta)
+	require.Len(t, doc.Rows, 2)
+	assert.Equal(t, 12.35, *doc.Rows[0].Values["total"])
+	assert.Equal(t, 50.0, *doc.Rows[0].Values["ratio"])
+	assert.Equal(t, `a "b" & <c>`, doc.Rows[1].CompanyID)
+	ratio, present := doc.Rows[1].Values["ratio"]
+	assert.True(t, present)
+	assert.Nil(t, ratio, "null stays null")
+
+	// no rows: still a document
+	require.NoError(t, json.Unmarshal(writeAll(t, &jsonResultWriter{}, meta, nil), &doc))
+	assert.Empty(t, doc.Rows)
+
+	lines := strings.Split(strings.TrimSuffix(string(writeAll(t, &ndjsonResultWriter{}, meta, rows)), "\n"), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"company_id":"1000","year":2023,"values":{"total":12.35,"ratio":50}}`, lines[0])
+	assert.JSONEq(t, `{"company_id":"a \"b\" & <c>","year":2024,"values":{"total":-1,"ratio":null}}`, lines[1])
+}
+
+func TestXLSXResultWriter(t *testing.T) {
+	meta, rows := testRows()
+	out := writeAll(t, &xlsxResultWriter{}, meta, rows)
+
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	require.NoError(t, err)
+	parts := make(map[string][]byte)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		parts[f.Name], err = io.ReadAll(rc)
+		require.NoError(t, err)
+		rc.Close()
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels"} {
+		assert.Contains(t, parts, name)
+		assert.NoError(t, xml.Unmarshal(parts[name], new(struct{})), name)
+	}
+
+	var sheet struct {
+		Rows []struct {
+			Cells []struct {
+				Ref    string `xml:"r,attr"`
+				Type   string `xml:"t,attr"`
+				Value  string `xml:"v"`
+				Inline string `xml:"is>t"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	require.NoError(t, xml.Unmarshal(parts["xl/worksheets/sheet1.xml"], &sheet))
+	require.Len(t, sheet.Rows, 3)
+	cells := func(i int) []string {
+		var out []string
+		for _, cell := range sheet.Rows[i].Cells {
+			out = append(out, cell.Ref+"="+cell.Value+cell.Inline)
+		}
+		return out
+	}
+	assert.Equal(t, []string{"A1=company", "B1=year", "C1=total", "D1=ratio (%)"}, cells(0))
+	assert.Equal(t, []string{"A2=1000", "B2=2023", "C2=12.35", "D2=50"}, cells(1))
+	assert.Equal(t, []string{`A3=a "b" & <c>`, "B3=2024", "C3=-1"}, cells(2), "null is an empty cell")
+	assert.Equal(t, "inlineStr", sheet.Rows[1].Cells[0].Type)
+
+	assert.Equal(t, "A", xlsxColumn(0))
+	assert.Equal(t, "Z", xlsxColumn(25))
+	assert.Equal(t, "AA", xlsxColumn(26))
+	assert.Equal(t, "BA", xlsxColumn(52))
+}
+
+func TestCalculateScoreHandlerFormats(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "waste_data.csv"), []byte("company_id,date,was_1\n1,2023,5\n2,2023,\n"), 0o644))
+	store := NewDatasetStore(NewDataLoaderService(NewLoaderRegistry(), nil), FileStorage{Root: dir}, "", StoreOptions{})
+	_, err := store.Refresh(context.Background())
+	require.NoError(t, err)
+	cfg := &c.Config{Name: "formats", Metrics: []c.Metric{
+		{Name: "total", Operation: c.Operation{Type: "sum", Parameters: []c.Parameter{{Source: "waste.was_1"}}}},
+	}}
+	handler := CalculateScoreHandler(context.Background(), cfg, store, nil)
+	get := func(target, accept string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Accept", accept)
+		handler(rec, r)
+		return rec
+	}
+
+	rec := get("/run-scores", "application/json")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.NotEmpty(t, rec.Header().Get("X-Run-ID"))
+	var doc map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &doc))
+	assert.Equal(t, "formats", doc["product"])
+	assert.Equal(t, rec.Header().Get("X-Run-ID"), doc["run_id"])
+	assert.Equal(t, []any{
+		map[string]any{"company_id": "1", "year": float64(2023), "values": map[string]any{"total": float64(5)}},
+		map[string]any{"company_id": "2", "year": float64(2023), "values": map[string]any{"total": nil}},
+	}, doc["rows"])
+
+	rec = get("/run-scores?format=csv&null=null&delimiter=%3B", "application/json")
+	assert.Equal(t, "text/csv", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "company;year;total\n1;2023;5.00\n2;2023;null\n", rec.Body.String())
+
+	rec = get("/run-scores", "application/pdf")
+	assert.Equal(t, http.StatusNotAcceptable, rec.Code)
+}
@@ -3,20 +3,40 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"go.opentelemetry.io/otel"
 
+	"esgbook-software-engineer-technical-test-2024/config"
 	"esgbook-software-engineer-technical-test-2024/internal"
 	"esgbook-software-engineer-technical-test-2024/middleware"
 )
 
-const timeout = 10
-
 const file = "score_1.yaml"
 
+const qualityFile = "quality.yaml"
+
+const defaultRefreshInterval = 30 * time.Second
+
+const defaultChangePollInterval = time.Second
+
+const defaultHistoryRetention = 30 * 24 * time.Hour
+
+const defaultRegisterRetry = 5 * time.Second
+
+const defaultRegisterInterval = 30 * time.Second
+
+const defaultWorkerCheckInterval = 10 * time.Second
+
+const defaultRunsRetention = 30 * 24 * time.Hour
+
 func BoostrapServer(ctx context.Context) error {
 	server := http.NewServeMux()
 
@@ -39,7 +59,205 @@ func BoostrapServer(ctx context.Context) error {
 	}()
 	otel.SetTracerProvider(tp)
 
-	server.HandleFunc("/run-scores", internal.CalculateScoreHandler(ctx, file))
+	qualityRules, err := config.InitQualityConfig(qualityFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dataService := internal.NewDataLoaderService(internal.NewLoaderRegistry(), qualityRules)
+	// Workers computing each stage of a score run, default GOMAXPROCS
+	if val := os.Getenv("SCORE_CONCURRENCY"); val != "" {
+		if dataService.ScoreWorkers, err = strconv.Atoi(val); err != nil {
+			log.Fatalf("invalid SCORE_CONCURRENCY %q: %v", val, err)
+		}
+	}
+
+	// The score config is embedded, parse it once
+	scoreConfig, err := config.InitScoreConfig(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger.Info("Loaded score config", "name", scoreConfig.Name)
+
+	// Load the datasets once and keep them in memory, reloading only the files that change.
+	// DATA_DIR is a local directory or an s3://bucket/prefix location
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data"
+	}
+	storage, prefix, err := internal.OpenStorage(dataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	storeOpts := internal.StoreOptions{QuarantineDir: os.Getenv("QUARANTINE_DIR"), HistoryRetention: defaultHistoryRetention}
+	if storeOpts.Policy, err = internal.ParseLoadPolicy(os.Getenv("DATA_LOAD_POLICY")); err != nil {
+		log.Fatal(err)
+	}
+	if val := os.Getenv("DATA_LOAD_CONCURRENCY"); val != "" {
+		if storeOpts.Concurrency, err = strconv.Atoi(val); err != nil {
+			log.Fatalf("invalid DATA_LOAD_CONCURRENCY %q: %v", val, err)
+		}
+	}
+	if val := os.Getenv("HISTORY_RETENTION"); val != "" {
+		if storeOpts.HistoryRetention, err = time.ParseDuration(val); err != nil {
+			log.Fatalf("invalid HISTORY_RETENTION %q: %v", val, err)
+		}
+	}
+	store := internal.NewDatasetStore(dataService, storage, prefix, storeOpts)
+
+	// Change events (CDC) are applied on top of the loaded datasets; the state file and its journal
+	// keep the offsets and applied changes across restarts
+	var changeSources []internal.ChangeSource
+	if path := os.Getenv("CDC_LOG"); path != "" {
+		changeSources = append(changeSources, internal.LogTailSource{Path: path})
+	}
+	if dir := os.Getenv("CDC_BATCH_DIR"); dir != "" {
+		changeSources = append(changeSources, internal.BatchDirSource{Dir: dir})
+	}
+	var changeFeed *internal.ChangeFeed
+	if len(changeSources) > 0 {
+		statePath := os.Getenv("CDC_STATE_FILE")
+		if statePath == "" {
+			statePath = "cdc_state.json"
+		}
+		changeFeed = internal.NewChangeFeed(store, statePath, changeSources...)
+		if err := changeFeed.Restore(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if _, err := store.Refresh(ctx); err != nil {
+		logger.Error("Initial dataset load failed", "err", err)
+	}
+	refreshInterval := defaultRefreshInterval
+	if val := os.Getenv("DATA_REFRESH_INTERVAL"); val != "" {
+		if refreshInterval, err = time.ParseDuration(val); err != nil {
+			log.Fatalf("invalid DATA_REFRESH_INTERVAL %q: %v", val, err)
+		}
+	}
+	go store.Watch(ctx, refreshInterval)
+	if changeFeed != nil {
+		pollInterval := defaultChangePollInterval
+		if val := os.Getenv("CDC_POLL_INTERVAL"); val != "" {
+			if pollInterval, err = time.ParseDuration(val); err != nil {
+				log.Fatalf("invalid CDC_POLL_INTERVAL %q: %v", val, err)
+			}
+		}
+		go changeFeed.Run(ctx, pollInterval)
+	}
+
+	partitionOpts := partitionOptions()
+
+	// Distributed scoring: instances in worker mode (WORKER_MODE, or WORKER_URL) take shard jobs;
+	// the one clients call coordinates the workers listed in SCORE_WORKERS or registered on
+	// /workers (WORKER_URL + COORDINATOR_URL). WORKER_TOKEN is the shared secret of shard jobs and
+	// registrations, required in worker mode; workers that fail their health checks (every
+	// WORKER_CHECK_INTERVAL) are removed until they register again
+	workerToken := os.Getenv("WORKER_TOKEN")
+	workerMode := os.Getenv("WORKER_URL") != ""
+	if val := os.Getenv("WORKER_MODE"); val != "" {
+		if workerMode, err = strconv.ParseBool(val); err != nil {
+			log.Fatalf("invalid WORKER_MODE %q: %v", val, err)
+		}
+	}
+	if workerMode && workerToken == "" {
+		log.Fatal("WORKER_MODE needs WORKER_TOKEN: shard jobs are only taken with it")
+	}
+	var workers []string
+	if val := os.Getenv("SCORE_WORKERS"); val != "" {
+		workers = strings.Split(val, ",")
+	}
+	shards := 0
+	if val := os.Getenv("SCORE_SHARDS"); val != "" {
+		if shards, err = strconv.Atoi(val); err != nil {
+			log.Fatalf("invalid SCORE_SHARDS %q: %v", val, err)
+		}
+	}
+	coordinator := internal.NewCoordinator(shards, workers...)
+	coordinator.Token = workerToken
+	workerCheckInterval := defaultWorkerCheckInterval
+	if val := os.Getenv("WORKER_CHECK_INTERVAL"); val != "" {
+		if workerCheckInterval, err = time.ParseDuration(val); err != nil {
+			log.Fatalf("invalid WORKER_CHECK_INTERVAL %q: %v", val, err)
+		}
+	}
+	go coordinator.Watch(ctx, workerCheckInterval)
+	if coordinatorURL, workerURL := os.Getenv("COORDINATOR_URL"), os.Getenv("WORKER_URL"); coordinatorURL != "" && workerURL != "" {
+		if workerToken == "" {
+			log.Fatal("WORKER_URL and COORDINATOR_URL need WORKER_TOKEN to register")
+		}
+		go registerWorker(ctx, coordinatorURL, workerURL, workerToken)
+	}
+
+	// Every score run is stored with its rows in RUNS_DIR, listed on /runs; runs older than
+	// RUNS_RETENTION or beyond the newest RUNS_MAX are deleted
+	runsDir := os.Getenv("RUNS_DIR")
+	if runsDir == "" {
+		runsDir = "runs"
+	}
+	runs, err := internal.NewFileRunStore(runsDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	runs.Retention = defaultRunsRetention
+	if val := os.Getenv("RUNS_RETENTION"); val != "" {
+		if runs.Retention, err = time.ParseDuration(val); err != nil {
+			log.Fatalf("invalid RUNS_RETENTION %q: %v", val, err)
+		}
+	}
+	if val := os.Getenv("RUNS_MAX"); val != "" {
+		if runs.MaxRuns, err = strconv.Atoi(val); err != nil {
+			log.Fatalf("invalid RUNS_MAX %q: %v", val, err)
+		}
+	}
+	runs.Prune()
+
+	// Jobs run score requests in the background: JOB_CONCURRENCY of them at once, finished ones
+	// kept for JOB_RETENTION
+	var jobOpts internal.JobOptions
+	if val := os.Getenv("JOB_RETENTION"); val != "" {
+		if jobOpts.Retention, err = time.ParseDuration(val); err != nil {
+			log.Fatalf("invalid JOB_RETENTION %q: %v", val, err)
+		}
+	}
+	if val := os.Getenv("JOB_CONCURRENCY"); val != "" {
+		if jobOpts.Concurrency, err = strconv.Atoi(val); err != nil {
+			log.Fatalf("invalid JOB_CONCURRENCY %q: %v", val, err)
+		}
+	}
+	jobOpts.Runs = runs
+	jobs := internal.NewJobManager(ctx, store, jobOpts, scoreConfig)
+
+	// The gRPC service (scorepb.ScoreService, with health and reflection) on GRPC_PORT
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = "9000"
+	}
+	lis, err := net.Listen("tcp", ":"+grpcPort)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		logger.Info("Starting gRPC service on :" + grpcPort)
+		if err := internal.ServeGRPC(ctx, lis, internal.NewGRPCServer(store, runs, scoreConfig)); err != nil {
+			logger.Error("gRPC server stopped", "err", err)
+		}
+	}()
+
+	server.HandleFunc("/run-scores", internal.CalculateScoreHandler(ctx, scoreConfig, store, runs))
+	server.HandleFunc("/run-scores/partitioned", internal.PartitionedScoreHandler(scoreConfig, store, partitionOpts, runs))
+	server.HandleFunc("/run-scores/distributed", internal.DistributedScoreHandler(scoreConfig, coordinator, runs))
+	server.HandleFunc("/jobs", internal.JobsHandler(jobs))
+	server.HandleFunc("/jobs/", internal.JobsHandler(jobs))
+	server.HandleFunc("/runs", internal.RunsHandler(runs))
+	server.HandleFunc("/runs/", internal.RunsHandler(runs))
+	server.HandleFunc("/diff", internal.DiffHandler(scoreConfig, store, runs))
+	server.HandleFunc("/preview", internal.PreviewHandler(store))
+	server.HandleFunc("/explain", internal.ExplainHandler(scoreConfig, store))
+	server.HandleFunc("/workers", internal.WorkersHandler(coordinator))
+	if workerMode {
+		server.HandleFunc("/worker/shard", internal.WorkerShardHandler(store, workerToken))
+	}
+	server.HandleFunc("/quality", internal.QualityReportHandler(store))
 	server.HandleFunc("/health", internal.HealthCheckHandler)
 	wrapped := middleware.LoggingMiddleware(logger)(server)
 	logger.Info("Starting service on :8000")
@@ -50,9 +268,64 @@ func BoostrapServer(ctx context.Context) error {
 	return nil
 }
 
+// partitionOptions reads the settings of out-of-core scoring: SCORE_MEMORY_BUDGET (bytes) sets how
+// much of the datasets a partition may hold in memory, SCORE_MEMORY_PER_INPUT_BYTE how much memory
+// an input byte takes once parsed, SCORE_PARTITIONS fixes the number of partitions instead.
+func partitionOptions() internal.PartitionOptions {
+	opts := internal.PartitionOptions{SpillDir: os.Getenv("SCORE_SPILL_DIR")}
+	var err error
+	if val := os.Getenv("SCORE_MEMORY_BUDGET"); val != "" {
+		if opts.MemoryBudget, err = strconv.ParseInt(val, 10, 64); err != nil {
+			log.Fatalf("invalid SCORE_MEMORY_BUDGET %q: %v", val, err)
+		}
+	}
+	if val := os.Getenv("SCORE_MEMORY_PER_INPUT_BYTE"); val != "" {
+		if opts.MemoryPerInputByte, err = strconv.ParseFloat(val, 64); err != nil {
+			log.Fatalf("invalid SCORE_MEMORY_PER_INPUT_BYTE %q: %v", val, err)
+		}
+	}
+	if val := os.Getenv("SCORE_PARTITIONS"); val != "" {
+		if opts.Partitions, err = strconv.Atoi(val); err != nil {
+			log.Fatalf("invalid SCORE_PARTITIONS %q: %v", val, err)
+		}
+	}
+	return opts
+}
+
+// registerWorker registers this instance with the coordinator, and again every
+// defaultRegisterInterval so that it comes back if the coordinator removed it or restarted.
+func registerWorker(ctx context.Context, coordinatorURL, workerURL, token string) {
+	for {
+		wait := defaultRegisterInterval
+		if err := internal.RegisterWorker(ctx, coordinatorURL, workerURL, token); err != nil {
+			log.Printf("[WARN] failed to register with coordinator %s: %v", coordinatorURL, err)
+			wait = defaultRegisterRetry
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		if err := runDiff(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "score" {
+		if err := runScore(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	logger := middleware.InitLogger()
-	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Minute)
+	// runs until interrupted; long score runs go through /jobs rather than a deadline here
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 	errChan := make(chan error, 2)
 
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"esgbook-software-engineer-technical-test-2024/config"
+	"esgbook-software-engineer-technical-test-2024/internal"
+)
+
+// runScore is the score command: it scores the data in DATA_DIR out of core, one partition at a
+// time, and writes the rows to stdout or -out. Unlike the server it never loads the datasets
+// whole, so it works on data larger than memory. The SCORE_* variables of the server are the
+// defaults of its flags.
+//
+//	score-app score [-config new.yaml] [-format csv] [-out scores.csv] [-memory-budget 1073741824]
+func runScore(args []string) error {
+	opts := partitionOptions()
+	fs := flag.NewFlagSet("score", flag.ContinueOnError)
+	configPath := fs.String("config", "", "score config file (default: the embedded "+file+")")
+	format := fs.String("format", "csv", "output format: csv, json, ndjson or xlsx")
+	out := fs.String("out", "", "output file (default: stdout)")
+	fs.Int64Var(&opts.MemoryBudget, "memory-budget", opts.MemoryBudget, "bytes the datasets of one partition may take in memory (0: one partition)")
+	fs.Float64Var(&opts.MemoryPerInputByte, "memory-per-input-byte", opts.MemoryPerInputByte, "bytes of memory one input byte takes once parsed (default 16)")
+	fs.IntVar(&opts.Partitions, "partitions", opts.Partitions, "number of partitions, instead of the budget")
+	fs.StringVar(&opts.SpillDir, "spill-dir", opts.SpillDir, "where spill files go (default: the system temp dir)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	scoreConfig, err := config.InitScoreConfig(file)
+	if err != nil {
+		return err
+	}
+	if *configPath != "" {
+		if scoreConfig, err = readScoreConfig(*configPath); err != nil {
+			return err
+		}
+	}
+	qualityRules, err := config.InitQualityConfig(qualityFile)
+	if err != nil {
+		return err
+	}
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data"
+	}
+	storage, prefix, err := internal.OpenStorage(dataDir)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+	}
+	bw := bufio.NewWriter(w)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	service := internal.NewDataLoaderService(internal.NewLoaderRegistry(), qualityRules)
+	err = service.WritePartitionedScores(ctx, scoreConfig, storage, prefix, opts, *format, bw)
+	if flushErr := bw.Flush(); err == nil {
+		err = flushErr
+	}
+	if w != os.Stdout {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}